@@ -1,13 +1,19 @@
 package api
 
 import (
+	"bytes"
 	"crypto/md5"
 	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
 	"fmt"
 	"hash"
+	"hash/crc32"
 	"io"
+	"os"
 	"path/filepath"
 	"sync/atomic"
+	"time"
 
 	gio "github.com/Byron/godi/io"
 )
@@ -23,6 +29,22 @@ type FileHashMismatch struct {
 	Path string
 }
 
+// Thrown if the modification time of a file didn't match the one we expected
+type FileModTimeMismatch struct {
+	Path      string
+	Want, Got time.Time
+}
+
+// Thrown if the destination of a copy existed already, but with contents different from the source
+type FileExistsMismatch struct {
+	Path string
+}
+
+// Thrown if a file isn't a hard link to the file it was sealed as link to anymore
+type FileLinkMismatch struct {
+	Path, Target string
+}
+
 func (f *FileSizeMismatch) Error() string {
 	return fmt.Sprintf("Filesize of '%s' reported as %d, yet %d bytes were read", f.Path, f.Want, f.Got)
 }
@@ -31,6 +53,84 @@ func (f *FileHashMismatch) Error() string {
 	return f.Path
 }
 
+func (f *FileModTimeMismatch) Error() string {
+	return fmt.Sprintf("Modification time of '%s' reported as %s, yet it was %s", f.Path, f.Want, f.Got)
+}
+
+func (f *FileExistsMismatch) Error() string {
+	return fmt.Sprintf("File '%s' exists already, and its contents differ from the one to copy", f.Path)
+}
+
+func (f *FileLinkMismatch) Error() string {
+	return fmt.Sprintf("File '%s' is no hard link to '%s'", f.Path, f.Target)
+}
+
+// Returns nil if the file at the path of f is a hard link to the file it is said to link to, see FileInfo.Link
+func checkLink(f *FileInfo) error {
+	target := filepath.Join(f.Root(), f.Link)
+	stat, err := gio.Lstat(f.Path)
+	if err != nil {
+		return err
+	}
+	tstat, err := gio.Lstat(target)
+	if err != nil {
+		return err
+	}
+	if !os.SameFile(stat, tstat) {
+		return &FileLinkMismatch{f.Path, target}
+	}
+	return nil
+}
+
+// Returns nil if the existing file at the given path, which is to be used instead of writing f,
+// has the contents of f. Objects of stores are named by their sha1 digest alone, which is why the md5 digest
+// has to match as well
+func checkContents(path string, f *FileInfo) error {
+	fd, err := gio.Open(path)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+	sha1gen, md5gen := sha1.New(), md5.New()
+	if _, err = io.Copy(io.MultiWriter(sha1gen, md5gen), fd); err != nil {
+		return err
+	}
+	if !bytes.Equal(sha1gen.Sum(nil), f.Sha1) || (len(f.MD5) > 0 && !bytes.Equal(md5gen.Sum(nil), f.MD5)) {
+		return &FileExistsMismatch{path}
+	}
+	return nil
+}
+
+// Returns nil if the existing file at the path of f has the same contents as the file described by f
+func checkExisting(f *FileInfo) error {
+	stat, err := gio.Lstat(f.Path)
+	if err != nil {
+		return err
+	}
+	if stat.Mode()&os.ModeType != f.Mode&os.ModeType {
+		return &FileExistsMismatch{f.Path}
+	}
+
+	// Symlinks are hashed by their target, just like when they are read
+	if stat.Mode()&os.ModeSymlink == os.ModeSymlink {
+		target, err := gio.Readlink(f.Path)
+		if err != nil {
+			return err
+		}
+		sha1gen := sha1.New()
+		io.WriteString(sha1gen, target)
+		if !bytes.Equal(sha1gen.Sum(nil), f.Sha1) {
+			return &FileExistsMismatch{f.Path}
+		}
+		return nil
+	}
+
+	if stat.Size() != f.Size {
+		return &FileExistsMismatch{f.Path}
+	}
+	return checkContents(f.Path, f)
+}
+
 // Intercepts Write calls and updates the stats accordingly. Implements only what we need, forwrading the calls as needed
 type HashStatAdapter struct {
 	hash  hash.Hash
@@ -51,24 +151,61 @@ func (h *HashStatAdapter) Sum(b []byte) []byte {
 	return h.hash.Sum(b)
 }
 
+// Returns all digests computed for f, keyed by their name, see io.MetadataWriter
+func digestsOf(f *FileInfo) map[string][]byte {
+	digests := map[string][]byte{"sha1": f.Sha1, "md5": f.MD5}
+	if len(f.Sha256) > 0 {
+		digests["sha256"] = f.Sha256
+	}
+	if len(f.Sha512) > 0 {
+		digests["sha512"] = f.Sha512
+	}
+	if len(f.CRC32) > 0 {
+		digests["crc32"] = f.CRC32
+	}
+	return digests
+}
+
 // Drains FileInfos from files channel, reads them using ctrl and generates hashes.
 // Creates a Result using makeResult() and sends it down the results channel.
 // If wctrls is set, we will setup parallel writer which writes the bytes used for hashing
-// to all controllers at the same time, which will be as slow as the slowest device
+// to all controllers at the same time, which will be as slow as the slowest device.
+// The given digests are computed in addition to sha1 and md5.
 func Gather(files <-chan FileInfo, results chan<- Result, stats *Stats,
 	makeResult func(*FileInfo, *FileInfo, error) Result,
 	rctrl *gio.ReadChannelController,
-	wctrls gio.RootedWriteControllers) {
+	wctrls gio.RootedWriteControllers,
+	digests Digests) {
 	if rctrl == nil {
 		panic("ReadChannelController and WaitGroup must be set")
 	}
 
 	sha1gen := HashStatAdapter{sha1.New(), stats}
 	md5gen := HashStatAdapter{md5.New(), stats}
-	const nHashes = 2
+	sha256gen := HashStatAdapter{sha256.New(), stats}
+	sha512gen := HashStatAdapter{sha512.New(), stats}
+	crc32gen := HashStatAdapter{crc32.NewIEEE(), stats}
+	hashers := []io.Writer{&sha1gen, &md5gen}
+	if digests&DigestSha256 != 0 {
+		hashers = append(hashers, &sha256gen)
+	}
+	if digests&DigestSha512 != 0 {
+		hashers = append(hashers, &sha512gen)
+	}
+	if digests&DigestCRC32 != 0 {
+		hashers = append(hashers, &crc32gen)
+	}
+	nHashes := len(hashers)
 	atomic.AddUint32(&stats.NumHashers, uint32(nHashes))
 	isWriting := len(wctrls) > 0
 	numDestinations := wctrls.Trees()
+	// Hard links are recreated if all destinations can have them, and existing files make the copy fail
+	canLink := !isWriting || wctrls.CanLink()
+	for _, wctrl := range wctrls {
+		if wctrl.OnExist != gio.ExistFail {
+			canLink = false
+		}
+	}
 	// The hgher this number, the less syscall and communication overhead we will have.
 	// As we expect mostly larger files, we go for bigger buffers
 	var buf [512 * 1024]byte
@@ -89,8 +226,7 @@ func Gather(files <-chan FileInfo, results chan<- Result, stats *Stats,
 		// Writer with full checking enabled - it will never show anything for the hashes, but might
 		// report errrs for the real writers
 		// We place the hashes last, as the writers will be changed in each iteration
-		writers[len(writers)-1] = &sha1gen
-		writers[len(writers)-2] = &md5gen
+		copy(writers[numDestinations:], hashers)
 		multiWriter = gio.NewParallelMultiWriter(writers)
 
 		// Keeps all Writers we are going to prepare per source file
@@ -106,11 +242,16 @@ func Gather(files <-chan FileInfo, results chan<- Result, stats *Stats,
 			wctrl.Ctrl.InitChannelWriters(channelWriters[ofs:ofse])
 			for x := ofs; x < ofse; x++ {
 				channelWriters[x].SetWriter(&lazyWriters[x])
+				lazyWriters[x].OnExist = wctrl.OnExist
+				lazyWriters[x].NoDigestMetadata = wctrl.NoDigestMetadata
+				lazyWriters[x].Archive = wctrl.Archives[wctrl.Trees[x-ofs]]
+				lazyWriters[x].Store = wctrl.Stores[wctrl.Trees[x-ofs]]
+				lazyWriters[x].Replacements = wctrl.Replacements
 			}
 			ofs = ofse
 		}
 	} else {
-		multiWriter = gio.NewUncheckedParallelMultiWriter(&sha1gen, &md5gen)
+		multiWriter = gio.NewUncheckedParallelMultiWriter(hashers...)
 	}
 
 	// umf == unmodifiedFileInfo
@@ -138,9 +279,33 @@ func Gather(files <-chan FileInfo, results chan<- Result, stats *Stats,
 				}
 				// Could be a previously unset writer
 				if wc, ok := w.(gio.WriteCloser); ok {
-					wc.Close()
+					lw := wc.Writer().(*gio.LazyFileWriteCloser)
+					if e == nil {
+						lw.SetDigests(digestsOf(f))
+					}
+					// Existing files are replaced when closing, which may fail as well
+					if cerr := wc.Close(); e == nil {
+						e = cerr
+					}
 					// we may change the same instance, as it will be copied into the Result structure later on
-					f.Path = wc.Writer().(*gio.LazyFileWriteCloser).Path()
+					f.Path = lw.Path()
+					f.Action = lw.Action()
+					// Existing files we keep have a modification time of their own
+					f.ModTime = lw.ModTime()
+					if f.Action == gio.ActionSkipped {
+						f.ModTime = time.Time{}
+					}
+					if f.Action == gio.ActionRenamed {
+						f.RelaPath = filepath.Join(filepath.Dir(forig.RelaPath), filepath.Base(f.Path))
+					} else {
+						f.RelaPath = forig.RelaPath
+					}
+					// An existing file is only accepted if it is the one we would have written
+					if e == nil && f.Action == gio.ActionSkipped {
+						e = checkExisting(f)
+					} else if e == nil && f.Action == gio.ActionDeduplicated {
+						e = checkContents(lw.Object(), f)
+					}
 					// it doesn't matter here if there actually is an error, aggregator will handle it
 					results <- makeResult(f, &forig, e)
 				}
@@ -154,8 +319,47 @@ func Gather(files <-chan FileInfo, results chan<- Result, stats *Stats,
 		} // handle write mode
 	} // sendResults
 
+	// Hard links are neither read nor written, but checked to be one. Their digests are those of the file they
+	// link to, which are set by the aggregator, just like it creates them in all destinations
+	sendLinkResults := func(f *FileInfo) {
+		err := checkLink(f)
+		if !isWriting {
+			results <- makeResult(f, f, err)
+			return
+		}
+
+		forig := *f
+		awid := 0
+		for _, wctrl := range wctrls {
+			for _, tree := range wctrl.Trees {
+				if !isFailedDestination[awid] {
+					f.Path = filepath.Join(tree, forig.RelaPath)
+					f.Action = gio.ActionLinked
+					// Links share the modification time of the copy they link to
+					f.ModTime = time.Time{}
+					if wctrl.KeepModTimes {
+						f.ModTime = forig.ModTime
+					}
+					results <- makeResult(f, &forig, err)
+				}
+				awid += 1
+			}
+		}
+	} // sendLinkResults
+
 	// NOTE: This loop must not return ! It must be finished !!
 	for f := range files {
+		// Streams are read like any other file, as they can't be linked
+		if len(f.Link) > 0 && f.stream == nil && canLink {
+			sendLinkResults(&f)
+			continue
+		}
+		// Links which can't be recreated are copied like the file they link to
+		f.Link = ""
+		if !canLink {
+			f.linked = false
+		}
+
 		// In hash-only mode, there is only one result
 		var err error
 		if isWriting {
@@ -174,12 +378,18 @@ func Gather(files <-chan FileInfo, results chan<- Result, stats *Stats,
 				for x := 0; x < len(wctrl.Trees); x++ {
 					// reset previous errror by resetting the writer pointer
 					// If the destination is known to have an error, disable its writer
+					// Writers are only prepared if they are going to be closed
 					if isFailedDestination[awid] {
 						pmw.SetWriterAtIndex(awid, nil)
 					} else {
 						pmw.SetWriterAtIndex(awid, &channelWriters[awid])
+						lazyWriters[awid].SetPath(filepath.Join(wctrl.Trees[awid-fawid], f.RelaPath), f.Mode)
+						if wctrl.KeepModTimes {
+							lazyWriters[awid].SetModTime(f.ModTime)
+						}
+						lazyWriters[awid].SetSize(f.Size)
+						lazyWriters[awid].SetSparse(f.sparse)
 					}
-					lazyWriters[awid].SetPath(filepath.Join(wctrl.Trees[awid-fawid], f.RelaPath), f.Mode)
 					awid += 1
 				}
 			} // for each device's write controller
@@ -190,13 +400,23 @@ func Gather(files <-chan FileInfo, results chan<- Result, stats *Stats,
 
 		} // handle write mode preparations
 
-		// let the other end open the file and close it as well
-		reader := rctrl.NewChannelReaderFromPath(f.Path, f.Mode, buf[:])
+		// let the other end open the file and close it as well, unless it can only be streamed
+		var reader *gio.ChannelReader
+		if f.stream != nil {
+			reader = rctrl.NewChannelReaderFromReader(f.stream, buf[:])
+		} else {
+			reader = rctrl.NewChannelReaderFromPath(f.Path, f.Mode, buf[:])
+		}
 
-		sha1gen.Reset()
-		md5gen.Reset()
+		for _, h := range hashers {
+			h.(*HashStatAdapter).Reset()
+		}
 		var written int64
 		written, err = reader.WriteTo(multiWriter)
+		if f.stream != nil {
+			// Allow the generator to continue with the next stream
+			close(f.stream.done)
+		}
 
 		if err != nil {
 			// This should actually never fail, the way we are implemented.
@@ -210,6 +430,15 @@ func Gather(files <-chan FileInfo, results chan<- Result, stats *Stats,
 		umf := f
 		f.Sha1 = sha1gen.Sum(nil)
 		f.MD5 = md5gen.Sum(nil)
+		if digests&DigestSha256 != 0 {
+			f.Sha256 = sha256gen.Sum(nil)
+		}
+		if digests&DigestSha512 != 0 {
+			f.Sha512 = sha512gen.Sum(nil)
+		}
+		if digests&DigestCRC32 != 0 {
+			f.CRC32 = crc32gen.Sum(nil)
+		}
 
 		if written != f.Size {
 			err = &FileSizeMismatch{f.Path, f.Size, written}
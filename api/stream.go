@@ -0,0 +1,78 @@
+package api
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+
+	gio "github.com/Byron/godi/io"
+)
+
+// The contents of a file which can't be opened by its path. It must be closed once it was read, as its
+// generator waits for that before producing the next one
+type fileStream struct {
+	io.Reader
+	done chan bool
+}
+
+// SendStream sends the given file along with a stream of its contents, and waits until it was read.
+// This way, files can be read from anything, while their path and mode describe them for writing.
+// Returns false if done was closed before
+func SendStream(f FileInfo, r io.Reader, files chan<- FileInfo, done <-chan bool) bool {
+	f.stream = &fileStream{r, make(chan bool)}
+	select {
+	case <-done:
+		return false
+	case files <- f:
+	}
+	select {
+	case <-done:
+		return false
+	case <-f.stream.done:
+		return true
+	}
+}
+
+var errStreamCancelled = errors.New("Streaming was cancelled")
+
+// StreamArchive sends all files received on in, which are members of the given archive, in the order in which
+// they appear in it, and along with a stream of their contents. That way, the archive is read front to back,
+// which is the only way to read compressed archives.
+// Files which are not in the archive are sent last, and fail to be read.
+// Returns once all files were sent and read, or if done is closed.
+func StreamArchive(archive string, in <-chan FileInfo, files chan<- FileInfo, done <-chan bool) {
+	var names []string
+	pending := make(map[string]FileInfo)
+	for f := range in {
+		name := filepath.ToSlash(f.RelaPath)
+		names = append(names, name)
+		pending[name] = f
+	}
+
+	// Files we couldn't stream will report the issue when they are read
+	err := gio.WalkArchive(archive, func(name string, _ os.FileInfo, r io.Reader) error {
+		f, ok := pending[name]
+		if !ok {
+			return nil
+		}
+		delete(pending, name)
+		if !SendStream(f, r, files, done) {
+			return errStreamCancelled
+		}
+		return nil
+	})
+	if err == errStreamCancelled {
+		return
+	}
+
+	for _, name := range names {
+		if f, ok := pending[name]; ok {
+			select {
+			case <-done:
+				return
+			case files <- f:
+			}
+		}
+	}
+}
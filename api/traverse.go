@@ -0,0 +1,220 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+
+	gio "github.com/Byron/godi/io"
+)
+
+// Keeps all information required to traverse trees recursively
+type traverser struct {
+	files      chan<- FileInfo
+	results    chan<- Result
+	done       <-chan bool
+	filters    []FileFilter
+	stats      *Stats
+	makeResult func(root, msg string, err error) Result
+
+	// The RelaPath of the first path of each file with hard links in the current tree, if they are detected
+	links map[gio.FileID]string
+}
+
+// Traverse sends all files of the given trees to the files channel, recursively, skipping those matching one of
+// the filters. Trees may also be files, or archives whose members are sent along with a stream of their contents,
+// with a RelaPath relative to the archive.
+// Errors and information about skipped files are sent as results, created by makeResult with the affected tree's
+// root. A message is only set if there is no error.
+// Returns early if done is closed, or if the stats indicate that the engines should be stopped.
+func Traverse(trees []string, files chan<- FileInfo, results chan<- Result, done <-chan bool,
+	filters []FileFilter, stats *Stats, makeResult func(root, msg string, err error) Result) {
+	t := traverser{files, results, done, filters, stats, makeResult, nil}
+	t.traverse(trees, false)
+}
+
+// TraverseLinks is like Traverse, but detects hard links on the local file system. The first path of a file
+// within a tree is sent as usual, and all others have their Link set to it, see FileInfo.Link
+func TraverseLinks(trees []string, files chan<- FileInfo, results chan<- Result, done <-chan bool,
+	filters []FileFilter, stats *Stats, makeResult func(root, msg string, err error) Result) {
+	t := traverser{files, results, done, filters, stats, makeResult, nil}
+	t.traverse(trees, true)
+}
+
+func (t *traverser) traverse(trees []string, detectLinks bool) {
+	files, results, makeResult := t.files, t.results, t.makeResult
+	for _, tree := range trees {
+		// Links are only valid within their tree
+		if detectLinks {
+			t.links = make(map[gio.FileID]string)
+		}
+		// could also be a file
+		if tstat, err := gio.Stat(tree); err != nil {
+			results <- makeResult(tree, "", fmt.Errorf("Couldn't access tree or file '%s': %v", tree, err))
+			continue
+		} else if tstat.Mode().IsRegular() && gio.IsArchivePath(tree) {
+			if t.traverseArchive(tree) {
+				break
+			}
+			continue
+		} else if !tstat.IsDir() {
+			// Assume it's a file and send it of like that
+			files <- FileInfo{
+				Path:     tree,
+				RelaPath: filepath.Base(tree),
+				Mode:     tstat.Mode(),
+				Size:     tstat.Size(),
+				ModTime:  tstat.ModTime(),
+				sparse:   gio.IsSparse(tstat),
+			}
+			continue
+		}
+
+		cancelled, treeError := t.traverseFilesRecursively(tree, tree)
+		if cancelled {
+			// interrupted usually, or there was an error
+			break
+		} else if treeError {
+			// Just abort processing of this tree
+			continue
+		}
+	}
+}
+
+// Traverse recursively, return false if the caller should stop traversing due to an error
+func (t *traverser) traverseFilesRecursively(tree string, root string) (bool, bool) {
+	select {
+	case <-t.done:
+		return true, false
+	default:
+	} // select
+
+	// read dir and, build file info, and recurse into subdirectories
+	dirInfos, err := gio.ReadDir(tree)
+	if err != nil {
+		t.results <- t.makeResult(root, "", err)
+		return false, true
+	}
+
+	shouldExclude := func(tree string, fi os.FileInfo, dirOnly bool) (bool, string) {
+		if (fi.Mode()&os.ModeDir != os.ModeDir) == dirOnly {
+			return true, ""
+		}
+
+		path := filepath.Join(tree, fi.Name())
+		for _, excludeFilter := range t.filters {
+			if excludeFilter.Matches(fi.Name(), fi.Mode()) {
+				atomic.AddUint32(&t.stats.NumSkippedFiles, 1)
+				t.results <- t.makeResult(root, fmt.Sprintf("Ignoring '%s' at '%s'", excludeFilter, path), nil)
+				return true, ""
+			}
+		}
+		return false, path
+	} // func shouldExclude()
+
+	// first generate infos
+	const fileOnly = false
+toNextFile:
+	for _, fi := range dirInfos {
+
+		// Actually we wouldn't need atomic access here, but lets be sure the race-detector is happy with us
+		// If at least one gather had errors to all destinations, there is no meaning in delivering more paths
+		if atomic.LoadUint32(&t.stats.StopTheEngines) > 0 {
+			return false, true
+		}
+
+		exclude, path := shouldExclude(tree, fi, fileOnly)
+		if exclude {
+			continue toNextFile
+		}
+
+		f := FileInfo{
+			Path:     path,
+			RelaPath: path[len(root)+1:],
+			Mode:     fi.Mode(),
+			Size:     fi.Size(),
+			ModTime:  fi.ModTime(),
+			sparse:   gio.IsSparse(fi),
+		}
+		if id, ok := gio.FileIDOf(fi); ok && t.links != nil {
+			if first, seen := t.links[id]; seen {
+				f.Link = first
+			} else {
+				t.links[id] = f.RelaPath
+				f.linked = true
+			}
+		}
+		t.files <- f
+	}
+
+	// then recurse into directories, apply a filter though
+	const dirOnly = !fileOnly
+toNextDir:
+	for _, fi := range dirInfos {
+		exclude, path := shouldExclude(tree, fi, dirOnly)
+		if exclude {
+			continue toNextDir
+		}
+
+		cancelled, treeError := t.traverseFilesRecursively(path, root)
+		if cancelled || treeError {
+			return cancelled, treeError
+		}
+	}
+
+	return false, false
+}
+
+// Sends all files in the given archive, each one only after the previous one was read, as archives are read
+// front to back. Returns true if we were cancelled
+func (t *traverser) traverseArchive(archive string) bool {
+	errCancelled, errStopped := errors.New("cancelled"), errors.New("stopped")
+	err := gio.WalkArchive(archive, func(name string, fi os.FileInfo, r io.Reader) error {
+		if atomic.LoadUint32(&t.stats.StopTheEngines) > 0 {
+			return errStopped
+		}
+
+		// Filters apply to the directories containing the file as well
+		relaPath := filepath.FromSlash(name)
+		components := strings.Split(name, "/")
+		for i, c := range components {
+			mode := os.ModeDir
+			if i == len(components)-1 {
+				mode = fi.Mode()
+			}
+			for _, excludeFilter := range t.filters {
+				if excludeFilter.Matches(c, mode) {
+					atomic.AddUint32(&t.stats.NumSkippedFiles, 1)
+					t.results <- t.makeResult(archive, fmt.Sprintf("Ignoring '%s' at '%s'", excludeFilter, filepath.Join(archive, relaPath)), nil)
+					return nil
+				}
+			}
+		}
+
+		f := FileInfo{
+			Path:     filepath.Join(archive, relaPath),
+			RelaPath: relaPath,
+			Mode:     fi.Mode(),
+			Size:     fi.Size(),
+			ModTime:  fi.ModTime(),
+		}
+		if !SendStream(f, r, t.files, t.done) {
+			return errCancelled
+		}
+		return nil
+	})
+
+	switch err {
+	case nil, errStopped:
+		return false
+	case errCancelled:
+		return true
+	default:
+		t.results <- t.makeResult(archive, "", err)
+		return false
+	}
+}
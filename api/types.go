@@ -1,6 +1,7 @@
 package api
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
 	"os"
@@ -43,6 +44,23 @@ func IndexPath(tree string, extension string) string {
 		extension))
 }
 
+// ArchiveIndexPath returns a path to an index file describing the contents of the given archive.
+// It resides next to the archive, which isn't changed, and is named after it.
+func ArchiveIndexPath(archive string, extension string) string {
+	return filepath.Join(filepath.Dir(archive), filepath.Base(archive)+"_"+filepath.Base(IndexPath("", extension)))
+}
+
+// IndexedArchive returns the path to the archive described by the given index, see ArchiveIndexPath(), or an
+// empty string if the index doesn't describe an archive.
+func IndexedArchive(index string) string {
+	name := filepath.Base(index)
+	i := strings.LastIndex(name, "_"+IndexBaseName+"_")
+	if i < 1 || !reIsIndexPath.MatchString(name[i+1:]) || !io.IsArchivePath(name[:i]) {
+		return ""
+	}
+	return filepath.Join(filepath.Dir(index), name[:i])
+}
+
 // A utility to encapsulate a file-filter
 // These exist in special modes to filter entire classes of files, and as FNMatch compatible string
 type FileFilter struct {
@@ -124,6 +142,15 @@ var (
 	FilterVolatile = FileFilter{kind: filterModeVolatile}
 )
 
+// Digests is a set of hashes to compute in addition to sha1 and md5, which are always computed
+type Digests uint8
+
+const (
+	DigestSha256 Digests = 1 << iota
+	DigestCRC32
+	DigestSha512
+)
+
 // A struct holding information about a task, including
 type FileInfo struct {
 
@@ -139,9 +166,45 @@ type FileInfo struct {
 	// size of file
 	Size int64
 
+	// Time of the last modification of the file. May be unset if the seal didn't record it.
+	// It is informational only, and not protected by the seal's signature
+	ModTime time.Time
+
+	// RelaPath of the file this one is a hard link to, within the same tree. It is set by TraverseLinks() for all
+	// but the first path of a file, whose contents are neither read nor written again, but linked
+	Link string
+
 	// hashes of file
 	Sha1 []byte
 	MD5  []byte
+
+	// Additional hashes of the file, which are only computed on demand
+	Sha256 []byte
+	Sha512 []byte
+	CRC32  []byte
+
+	// Path to the seal this information was read from, if any. It is set when verifying only, and
+	// allows to tell apart files of multiple seals underneath the same root
+	Seal string
+
+	// What happened to the destination of a copy, which matters if it existed already. It is set when copying only
+	Action io.WriteAction
+
+	// The contents of the file if it can't be opened by its path, like a member of a compressed archive.
+	// It is set by generators only, see SendStream()
+	stream *fileStream
+
+	// True if the file has more than one hard link, see HasLinks()
+	linked bool
+
+	// True if the file has holes, which are kept when copying it
+	sparse bool
+}
+
+// HasLinks returns true if the file has hard links, which may be part of its tree and sent later with
+// their Link set to our RelaPath. It is set by TraverseLinks()
+func (f *FileInfo) HasLinks() bool {
+	return f.linked
 }
 
 // Compute the root of this file - it is the top-level directory used to specify all files to process
@@ -149,6 +212,22 @@ func (f *FileInfo) Root() string {
 	return f.Path[:len(f.Path)-len(f.RelaPath)-1]
 }
 
+// SameDigests returns true if all digests which both files have are equal, and if they have at least one in common.
+// Seals of different formats may keep different digests, which is why only the common ones can be compared
+func SameDigests(l, r *FileInfo) bool {
+	common := 0
+	for _, d := range [][2][]byte{{l.Sha512, r.Sha512}, {l.Sha256, r.Sha256}, {l.Sha1, r.Sha1}, {l.MD5, r.MD5}, {l.CRC32, r.CRC32}} {
+		if len(d[0]) == 0 || len(d[1]) == 0 {
+			continue
+		}
+		if !bytes.Equal(d[0], d[1]) {
+			return false
+		}
+		common += 1
+	}
+	return common > 0
+}
+
 type Importance uint8
 
 const (
@@ -242,6 +321,21 @@ func (s *BasicResult) FileInformation() *FileInfo {
 	return &s.Finfo
 }
 
+// MakeGeneratorResult returns a result as sent by generators, see Traverse(). It refers to the root of a tree,
+// and has no RelaPath. The result is a *BasicResult
+func MakeGeneratorResult(root, msg string, err error) Result {
+	prio := Info
+	if err != nil {
+		prio = Error
+	}
+	return &BasicResult{
+		Msg:   msg,
+		Err:   err,
+		Prio:  prio,
+		Finfo: FileInfo{Path: root},
+	}
+}
+
 // A partial implementation of a runner, which can be shared between the various commands
 type BasicRunner struct {
 	// Items we work on
@@ -5,7 +5,10 @@ import (
 	"os"
 	"path"
 	"path/filepath"
+	"sort"
 	"strings"
+
+	gio "github.com/Byron/godi/io"
 )
 
 // Append elm if it is not yet on dest
@@ -32,19 +35,82 @@ func IndexTrackingResultHandlerAdapter(indices *[]string, handler func(r Result)
 	}
 }
 
+// Sorts paths to seals by the time they were written, the oldest one first
+type byIndexTime []string
+
+func (a byIndexTime) Len() int      { return len(a) }
+func (a byIndexTime) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a byIndexTime) Less(i, j int) bool {
+	// The name of a seal starts with the time it was written, which makes it sortable
+	key := func(path string) string {
+		name := filepath.Base(path)
+		return name[strings.LastIndex(name, IndexBaseName+"_"):]
+	}
+	return key(a[i]) < key(a[j])
+}
+
+// FindSeals returns the paths to all seal files directly inside of the given directory, the oldest one first.
+// The directory may also be an archive, whose seals are members at the top-level, or reside next to it as
+// described in ArchiveIndexPath().
+func FindSeals(dir string) ([]string, error) {
+	var names, seals []string
+	if gio.IsArchive(dir) {
+		members, err := gio.ArchiveMembers(dir)
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range members {
+			if !strings.Contains(name, "/") {
+				names = append(names, name)
+			}
+		}
+
+		siblings, err := gio.ReadDir(filepath.Dir(dir))
+		if err != nil {
+			return nil, err
+		}
+		for _, fi := range siblings {
+			if path := filepath.Join(filepath.Dir(dir), fi.Name()); IndexedArchive(path) == filepath.Clean(dir) {
+				seals = append(seals, path)
+			}
+		}
+	} else {
+		infos, err := gio.ReadDir(dir)
+		if err != nil {
+			return nil, err
+		}
+		for _, fi := range infos {
+			names = append(names, fi.Name())
+		}
+	}
+
+	// Seals of archives next to the directory are not the directory's seals
+	for _, name := range names {
+		if strings.HasPrefix(name, IndexBaseName) && reIsIndexPath.MatchString(name) {
+			seals = append(seals, filepath.Join(dir, name))
+		}
+	}
+	sort.Sort(byIndexTime(seals))
+	return seals, nil
+}
+
 // Parse all valid source items from the given list.
 // May either be files or directories. The returned list may be shorter, as contained paths are
 // skipped automatically. Paths will be normalized.
+// Archives are like directories, see Traverse(). Files may also be members of archives, see io.Open().
 func ParseSources(items []string, allowFiles bool) (res []string, err error) {
 	var invalidTrees, noTrees, noRegularFiles []string
 	res = make([]string, len(items))
 	copy(res, items)
 
 	for i, tree := range res {
-		if stat, err := os.Stat(tree); err != nil {
+		if tree, err = gio.ResolveURL(tree); err != nil {
+			return nil, err
+		}
+		if stat, err := gio.Stat(tree); err != nil {
 			invalidTrees = append(invalidTrees, tree)
 			continue
-		} else if !stat.IsDir() {
+		} else if !stat.IsDir() && !gio.IsArchive(tree) {
 			if !allowFiles {
 				noTrees = append(noTrees, tree)
 				continue
@@ -93,3 +159,32 @@ func ParseSources(items []string, allowFiles bool) (res []string, err error) {
 
 	return res, nil
 }
+
+// MatchGlob returns true if the given slash separated path matches the glob pattern, which uses '/' as well.
+// Other than with filepath.Match, a '**' component matches any amount of directories
+func MatchGlob(pattern, path string) bool {
+	return matchGlobComponents(strings.Split(pattern, "/"), strings.Split(path, "/"))
+}
+
+// Like MatchGlob(), but with the components of pattern and path
+func matchGlobComponents(pattern, path []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := 0; i <= len(path); i++ {
+				if matchGlobComponents(pattern[1:], path[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+
+		if len(path) == 0 {
+			return false
+		}
+		if ok, _ := filepath.Match(pattern[0], path[0]); !ok {
+			return false
+		}
+		pattern, path = pattern[1:], path[1:]
+	}
+	return len(path) == 0
+}
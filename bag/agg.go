@@ -0,0 +1,301 @@
+package bag
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	gio "io"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/Byron/godi/api"
+	"github.com/Byron/godi/codec"
+	"github.com/Byron/godi/io"
+)
+
+// Keeps information about a manifest we write continuously
+type manifest struct {
+	path     string
+	finfos   chan<- api.FileInfo
+	result   <-chan error
+	err      error
+	stopped  bool // true if the finfos channel was closed
+	hasError bool // true if the manifest would be incomplete
+}
+
+// Keeps information about a bag we write
+type bagInfo struct {
+	manifests []*manifest
+
+	// Paths to payload files we have written so far, to be able to remove them on error
+	writtenFiles []string
+
+	numFiles, numBytes uint64
+
+	// if true, the bag is considered faulty, and it won't be finished
+	hasError bool
+}
+
+// Starts a go-routine which writes the given manifest continuously, as files come in.
+// Close the returned channel to finish it. The result is sent exactly once, which may be early in case of errors.
+func writeManifest(path string, c codec.Codec) (chan<- api.FileInfo, <-chan error) {
+	finfos := make(chan api.FileInfo)
+	result := make(chan error, 1)
+
+	go func() {
+		defer close(result)
+		fd, err := os.OpenFile(path, os.O_EXCL|os.O_CREATE|os.O_WRONLY, 0666)
+		if err == nil {
+			err = c.Serialize(finfos, fd)
+			fd.Close()
+		}
+		result <- err
+	}()
+
+	return finfos, result
+}
+
+// Send the given file to the manifest writer, unless it already stopped
+func (m *manifest) send(f api.FileInfo) {
+	if m.stopped {
+		return
+	}
+
+	select {
+	case err, ok := <-m.result:
+		// The writer only sends a result early if it failed
+		if ok {
+			m.err = err
+		}
+		m.stopped = true
+		m.hasError = true
+		close(m.finfos)
+	case m.finfos <- f:
+	}
+}
+
+// Finish writing the manifest, and return the error that occurred while writing it
+func (m *manifest) finish() error {
+	if !m.stopped {
+		close(m.finfos)
+		m.err = <-m.result
+		m.stopped = true
+	}
+	if m.err == nil && m.hasError {
+		return fmt.Errorf("Manifest '%s' is incomplete", m.path)
+	}
+	return m.err
+}
+
+// Writes the given tags as file at path
+func writeTags(path string, tags []Tag) error {
+	fd, err := os.OpenFile(path, os.O_EXCL|os.O_CREATE|os.O_WRONLY, 0666)
+	if err != nil {
+		return err
+	}
+	for _, t := range tags {
+		if _, err = fmt.Fprintf(fd, "%s: %s\n", t.Label, t.Value); err != nil {
+			break
+		}
+	}
+	if cerr := fd.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// Hashes the given tag files of the bag at root, and writes a tag manifest for each algorithm we use
+func writeTagManifests(root string, tagFiles []string) error {
+	finfos := make([]api.FileInfo, len(tagFiles))
+	for i, name := range tagFiles {
+		sha256gen, md5gen := sha256.New(), md5.New()
+		if err := hashFile(filepath.Join(root, name), sha256gen, md5gen); err != nil {
+			return err
+		}
+		finfos[i] = api.FileInfo{RelaPath: name, Sha256: sha256gen.Sum(nil), MD5: md5gen.Sum(nil)}
+	}
+
+	for _, alg := range algorithms {
+		in := make(chan api.FileInfo, len(finfos))
+		for _, f := range finfos {
+			in <- f
+		}
+		close(in)
+
+		fd, err := os.OpenFile(filepath.Join(root, tagManifestPrefix+alg+".txt"), os.O_EXCL|os.O_CREATE|os.O_WRONLY, 0666)
+		if err != nil {
+			return err
+		}
+		err = codec.NewBagItManifest(alg).Serialize(in, fd)
+		if cerr := fd.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func hashFile(path string, hashes ...hash.Hash) error {
+	fd, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+
+	writers := make([]gio.Writer, len(hashes))
+	for i, h := range hashes {
+		writers[i] = h
+	}
+	_, err = gio.Copy(gio.MultiWriter(writers...), fd)
+	return err
+}
+
+// Writes all tag files of the given bag, whose payload manifests are complete
+func (s *Command) finishBag(root string, bi *bagInfo) error {
+	if err := writeTags(filepath.Join(root, DeclarationName), []Tag{
+		{"BagIt-Version", Version},
+		{"Tag-File-Character-Encoding", "UTF-8"},
+	}); err != nil {
+		return err
+	}
+
+	info := []Tag{
+		{"Bag-Software-Agent", "godi"},
+		{"Bagging-Date", time.Now().Format("2006-01-02")},
+		{oxumLabel, oxum(bi.numBytes, bi.numFiles)},
+	}
+	if err := writeTags(filepath.Join(root, InfoName), append(info, s.Info...)); err != nil {
+		return err
+	}
+
+	tagFiles := []string{DeclarationName, InfoName}
+	for _, m := range bi.manifests {
+		tagFiles = append(tagFiles, filepath.Base(m.path))
+	}
+	return writeTagManifests(root, tagFiles)
+}
+
+// Removes everything we have written into the bag at root so far
+func removeBag(root string, bi *bagInfo) {
+	sort.Sort(sort.Reverse(sort.StringSlice(bi.writtenFiles)))
+	for _, path := range bi.writtenFiles {
+		os.Remove(path)
+		for dir := filepath.Dir(path); dir != root && os.Remove(dir) == nil; dir = filepath.Dir(dir) {
+		}
+	}
+	bi.writtenFiles = nil
+
+	for _, name := range []string{DeclarationName, InfoName} {
+		os.Remove(filepath.Join(root, name))
+	}
+	for _, alg := range algorithms {
+		os.Remove(filepath.Join(root, manifestPrefix+alg+".txt"))
+		os.Remove(filepath.Join(root, tagManifestPrefix+alg+".txt"))
+	}
+}
+
+func (s *Command) Aggregate(results <-chan api.Result) <-chan api.Result {
+	bags := make(map[string]*bagInfo)
+	for _, root := range s.bags {
+		bi := bagInfo{}
+		for _, alg := range algorithms {
+			m := manifest{path: filepath.Join(root, manifestPrefix+alg+".txt")}
+			m.finfos, m.result = writeManifest(m.path, codec.NewBagItManifest(alg))
+			bi.manifests = append(bi.manifests, &m)
+		}
+		bags[root] = &bi
+	}
+
+	resultHandler := func(r api.Result, accumResult chan<- api.Result) bool {
+		f := r.FileInformation()
+		// Results of our generator refer to the source tree
+		if len(f.RelaPath) == 0 {
+			accumResult <- r
+			return r.Error() == nil
+		}
+
+		root := filepath.Dir(f.Root())
+		bi := bags[root]
+		if !os.IsExist(r.Error()) {
+			bi.writtenFiles = append(bi.writtenFiles, f.Path)
+		}
+
+		if r.Error() != nil || bi.hasError {
+			accumResult <- r
+			if !bi.hasError {
+				bi.hasError = true
+				removeBag(root, bi)
+			}
+			return r.Error() == nil
+		}
+
+		bi.numFiles += 1
+		bi.numBytes += uint64(f.Size)
+		payload := *f
+		payload.RelaPath = filepath.Join(PayloadDir, f.RelaPath)
+		for _, m := range bi.manifests {
+			m.send(payload)
+		}
+
+		accumResult <- r
+		return true
+	}
+
+	finalizer := func(accumResult chan<- api.Result) {
+		for _, root := range s.bags {
+			bi := bags[root]
+			var err error
+			for _, m := range bi.manifests {
+				if merr := m.finish(); err == nil {
+					err = merr
+				}
+			}
+			if err == nil && !bi.hasError && !s.Stats.WasCancelled {
+				err = s.finishBag(root, bi)
+			}
+
+			if err == nil && !bi.hasError && !s.Stats.WasCancelled {
+				accumResult <- &api.BasicResult{
+					Msg: fmt.Sprintf("Wrote bag with %d file(s) of %s to '%s'",
+						bi.numFiles, io.BytesVolume(bi.numBytes), root),
+					// special marker, to allow others to easily retrieve the bags we wrote from the result
+					Finfo: api.FileInfo{Path: root, Size: -1},
+					Prio:  api.Valuable,
+				}
+				continue
+			}
+
+			removeBag(root, bi)
+			msg := ""
+			if err != nil {
+				s.Stats.ErrCount += 1
+				msg = fmt.Sprintln(err.Error())
+			}
+			accumResult <- &api.BasicResult{
+				Msg:  msg + fmt.Sprintf("Did not write bag to '%s' due to preceeding errors", root),
+				Err:  err,
+				Prio: api.Error,
+			}
+		}
+
+		prefix := fmt.Sprintf("BAG %s", SymbolSuccess)
+		if s.Stats.ErrCount > 0 {
+			prefix = fmt.Sprintf("BAG %s", SymbolFail)
+		}
+		accumResult <- &api.BasicResult{
+			Msg: fmt.Sprintf(
+				"%s: %s",
+				prefix,
+				s.Stats.DeltaString(&s.Stats, s.Stats.Elapsed(), io.StatsClientSep),
+			) + s.Stats.String(),
+			Prio: api.Valuable,
+		}
+	}
+
+	return api.Aggregate(results, s.Done, resultHandler, finalizer, &s.Stats)
+}
@@ -0,0 +1,132 @@
+package bag_test
+
+import (
+	"crypto/sha512"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Byron/godi/api"
+	"github.com/Byron/godi/bag"
+	"github.com/Byron/godi/seal"
+	"github.com/Byron/godi/testlib"
+	"github.com/Byron/godi/verify"
+)
+
+// Verifies the given bag, and returns the error as well as the amount of bag problems that were reported
+func verifyBag(t *testing.T, dir string, handler func(api.Result)) (err error, numProblems int) {
+	verifycmd, err := verify.NewCommand([]string{dir}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = api.StartEngine(verifycmd, func(r api.Result) {
+		if msg, _ := r.Info(); strings.HasPrefix(msg, "BAG") {
+			numProblems += 1
+		}
+		handler(r)
+	})
+	return
+}
+
+func TestBag(t *testing.T) {
+	datasetTree, file, _ := testlib.MakeDatasetOrPanic()
+	defer testlib.RmTree(datasetTree)
+	dst, _ := ioutil.TempDir("", "bag")
+	defer testlib.RmTree(dst)
+	resHandler := testlib.ResultHandler(t, false)
+
+	if _, err := bag.NewCommand([]string{datasetTree, seal.Sep, filepath.Join(datasetTree, "subdir")}, 1, 1); err == nil {
+		t.Error("Can't bag a tree into itself")
+	}
+
+	cmd, err := bag.NewCommand([]string{datasetTree, dst}, 1, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd.Info = []bag.Tag{{"Source-Organization", "godi"}}
+
+	var bags []string
+	if err = api.StartEngine(cmd, api.IndexTrackingResultHandlerAdapter(&bags, resHandler)); err != nil {
+		t.Fatal(err)
+	}
+	if len(bags) != 1 || bags[0] != dst || !bag.IsBag(dst) {
+		t.Fatalf("Expected a bag at '%s', got %v", dst, bags)
+	}
+	for _, name := range []string{"bag-info.txt", "manifest-sha256.txt", "manifest-md5.txt", "tagmanifest-sha256.txt", "tagmanifest-md5.txt"} {
+		if _, err = os.Stat(filepath.Join(dst, name)); err != nil {
+			t.Error(err)
+		}
+	}
+	info, _ := ioutil.ReadFile(filepath.Join(dst, "bag-info.txt"))
+	if !strings.Contains(string(info), "Payload-Oxum: ") || !strings.Contains(string(info), "Source-Organization: godi") {
+		t.Errorf("Unexpected bag info: %s", info)
+	}
+
+	if _, err = bag.NewCommand([]string{datasetTree, dst}, 1, 1); err == nil {
+		t.Error("Existing bags must not be written to")
+	}
+
+	if err, _ = verifyBag(t, dst, resHandler); err != nil {
+		t.Error(err)
+	}
+
+	// An additional payload file is unlisted, and changes the oxum
+	extra := testlib.MakeFileOrPanic(filepath.Join(dst, bag.PayloadDir, "extra.bin"), 16)
+	err, numProblems := verifyBag(t, dst, testlib.ResultHandler(t, true))
+	if err == nil || numProblems != 3 {
+		t.Errorf("Expected an unlisted file in both manifests and a oxum mismatch, got %d problem(s)", numProblems)
+	}
+	os.Remove(extra)
+
+	// Changes to the payload are detected through the manifests
+	rela, _ := filepath.Rel(datasetTree, file)
+	if err = ioutil.WriteFile(filepath.Join(dst, bag.PayloadDir, rela), []byte("changed"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if err, numProblems = verifyBag(t, dst, testlib.ResultHandler(t, true)); err == nil || numProblems != 1 {
+		t.Errorf("Changed payload must fail verification, and change the oxum, got %d problem(s)", numProblems)
+	}
+
+	// As well as changes to the tag files
+	os.Remove(filepath.Join(dst, bag.PayloadDir, rela))
+	if err = ioutil.WriteFile(filepath.Join(dst, "bag-info.txt"), []byte("Payload-Oxum: 0.0\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if err, _ = verifyBag(t, dst, testlib.ResultHandler(t, true)); err == nil {
+		t.Error("Changed tag files must fail verification")
+	}
+}
+
+func TestBagSha512(t *testing.T) {
+	dst, _ := ioutil.TempDir("", "bag")
+	defer testlib.RmTree(dst)
+
+	// A bag as written by other tools, which prefer sha512
+	payload := []byte("payload")
+	if err := os.MkdirAll(filepath.Join(dst, bag.PayloadDir), 0777); err != nil {
+		t.Fatal(err)
+	}
+	files := map[string][]byte{
+		bag.DeclarationName:                       []byte("BagIt-Version: 1.0\nTag-File-Character-Encoding: UTF-8\n"),
+		filepath.Join(bag.PayloadDir, "file.txt"): payload,
+		"manifest-sha512.txt":                     []byte(fmt.Sprintf("%x  data/file.txt\n", sha512.Sum512(payload))),
+	}
+	for name, data := range files {
+		if err := ioutil.WriteFile(filepath.Join(dst, name), data, 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err, _ := verifyBag(t, dst, testlib.ResultHandler(t, false)); err != nil {
+		t.Error(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dst, bag.PayloadDir, "file.txt"), []byte("changed"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if err, _ := verifyBag(t, dst, testlib.ResultHandler(t, true)); err == nil {
+		t.Error("Changed payload must fail verification of the sha512 manifest")
+	}
+}
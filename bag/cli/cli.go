@@ -0,0 +1,118 @@
+/*
+Package cli implements the command-line interface for the Command, for use by the cli.App
+*/
+package cli
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/Byron/godi/api"
+	"github.com/Byron/godi/bag"
+	"github.com/Byron/godi/cli"
+	"github.com/Byron/godi/verify"
+
+	gcli "github.com/codegangsta/cli"
+)
+
+const (
+	verifyFlagName         = "verify"
+	infoFlagName           = "info"
+	streamsPerOutputDevice = "streams-per-output-device"
+	bagDescription         = `
+	Copy one or more directories into BagIt bags, as defined in RFC 8493.
+
+	The data is copied into the 'data' directory of each bag, and hashed while it is copied.
+	Once all data is copied, 'bagit.txt', 'bag-info.txt', as well as payload manifests and tag manifests
+	using sha256 and md5 are written. Bags are created from scratch, and must not exist yet.
+
+	[arguments ...] specify the source file(s) or directories, as well as the bag(s), for example
+	godi bag s/ /Volumes/a/delivery
+	godi bag --info 'Source-Organization: Film Archive' s1/ s2/ -- /Volumes/a/delivery /Volumes/b/delivery
+
+	Use 'godi verify' on a bag to validate it.`
+)
+
+// return subcommands for our particular area of algorithms
+func SubCommands() []gcli.Command {
+	cmd := bag.Command{}
+
+	return []gcli.Command{
+		gcli.Command{
+			Name:      bag.Name,
+			ShortName: "",
+			Usage:     bagDescription,
+			Action:    func(c *gcli.Context) { startBag(&cmd, c) },
+			Before:    func(c *gcli.Context) error { return checkBag(&cmd, c) },
+			Flags: []gcli.Flag{
+				gcli.BoolFlag{
+					Name:  verifyFlagName,
+					Usage: "Run `godi verify` on all produced bags when they are written",
+				},
+				gcli.StringSliceFlag{
+					Name:  infoFlagName,
+					Value: &gcli.StringSlice{},
+					Usage: "A tag like 'Label: Value' to add to bag-info.txt. Can be given multiple times",
+				},
+				gcli.IntFlag{
+					Name:  streamsPerOutputDevice + ", spod",
+					Value: 1,
+					Usage: "Amount of parallel streams per output device",
+				},
+			},
+		},
+	}
+}
+
+func checkBag(cmd *bag.Command, c *gcli.Context) error {
+	nr, level, filters, err := cli.CheckCommonFlags(c)
+	if err != nil {
+		return err
+	}
+
+	nw := c.Int(streamsPerOutputDevice)
+	if nw < 1 {
+		return fmt.Errorf("--%v must not be smaller than 1", streamsPerOutputDevice)
+	}
+
+	cmd.Info = nil
+	for _, spec := range c.StringSlice(infoFlagName) {
+		tag, err := bag.ParseTag(spec)
+		if err != nil {
+			return err
+		}
+		cmd.Info = append(cmd.Info, tag)
+	}
+
+	return cmd.Init(nr, nw, c.Args(), level, filters)
+}
+
+func startBag(cmd *bag.Command, c *gcli.Context) {
+	if !c.Bool(verifyFlagName) {
+		cli.RunAction(cmd, c)
+		return
+	}
+
+	// Bags are reported like seals, which allows to verify them afterwards
+	var bags []string
+	handler := cli.MakeLogHandler(cmd.LogLevel())
+	err := api.StartEngine(cmd, api.IndexTrackingResultHandlerAdapter(&bags, handler))
+
+	select {
+	case <-cmd.Done:
+	default:
+		if len(bags) > 0 {
+			verifycmd, verr := verify.NewCommand(bags, c.GlobalInt(cli.StreamsPerInputDeviceFlagName))
+			if verr == nil {
+				verr = api.StartEngine(verifycmd, handler)
+			}
+			if err == nil {
+				err = verr
+			}
+		}
+	}
+
+	if err != nil {
+		os.Exit(1)
+	}
+}
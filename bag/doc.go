@@ -0,0 +1,6 @@
+/*
+Package bag implements the 'bag' functionality, which copies data into BagIt bags as defined in RFC 8493,
+as well as the validation of the structure of existing bags.
+
+*/
+package bag
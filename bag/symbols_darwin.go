@@ -0,0 +1,8 @@
+package bag
+
+const (
+	SymbolOK       = "✔︎️ "
+	SymbolSuccess  = "✅ "
+	SymbolFail     = "⛔️ "
+	SymbolMismatch = "🚫 "
+)
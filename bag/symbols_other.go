@@ -0,0 +1,10 @@
+// +build !darwin
+
+package bag
+
+const (
+	SymbolOK       = "OK"
+	SymbolSuccess  = "SUCCESS"
+	SymbolFail     = "FAIL"
+	SymbolMismatch = "MISMATCH"
+)
@@ -0,0 +1,162 @@
+package bag
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/Byron/godi/api"
+	"github.com/Byron/godi/codec"
+	"github.com/Byron/godi/io"
+	"github.com/Byron/godi/seal"
+)
+
+const (
+	Name = "bag"
+
+	Version = "1.0"
+
+	DeclarationName = "bagit.txt"
+	InfoName        = "bag-info.txt"
+	PayloadDir      = "data"
+
+	manifestPrefix    = "manifest-"
+	tagManifestPrefix = "tagmanifest-"
+	oxumLabel         = "Payload-Oxum"
+)
+
+// The manifest algorithms we write, the first one is the one verify prefers
+var algorithms = []string{"sha256", "md5"}
+
+// A Tag is a metadata element of a bag, as stored in bag-info.txt
+type Tag struct {
+	Label, Value string
+}
+
+// ParseTag parses a tag given like 'Label: Value'
+func ParseTag(tag string) (Tag, error) {
+	tokens := strings.SplitN(tag, ":", 2)
+	if len(tokens) != 2 || len(strings.TrimSpace(tokens[0])) == 0 || strings.ContainsAny(tag, "\r\n") {
+		return Tag{}, fmt.Errorf("Invalid tag '%s', expected 'Label: Value'", tag)
+	}
+	return Tag{strings.TrimSpace(tokens[0]), strings.TrimSpace(tokens[1])}, nil
+}
+
+// A type representing all arguments required to drive a bag operation
+type Command struct {
+	api.BasicRunner
+
+	// Tags to write into bag-info.txt of each bag, in addition to the ones we generate
+	Info []Tag
+
+	// The base directories of the bags we write
+	bags []string
+
+	// A map of writers to the payload directories of our bags
+	rootedWriters io.RootedWriteControllers
+}
+
+// NewCommand returns an initialized bag command, for arguments like 'source [...] -- bag [...]'
+func NewCommand(items []string, nReaders, nWriters int) (*Command, error) {
+	c := Command{}
+	return &c, c.Init(nReaders, nWriters, items, api.Info, nil)
+}
+
+func (s *Command) Generate() <-chan api.Result {
+	generate := func(trees []string, files chan<- api.FileInfo, results chan<- api.Result) {
+		api.Traverse(trees, files, results, s.Done, s.Filters, &s.Stats, api.MakeGeneratorResult)
+	}
+
+	return api.Generate(s.RootedReaders, s, generate)
+}
+
+func (s *Command) Gather(rctrl *io.ReadChannelController, files <-chan api.FileInfo, results chan<- api.Result) {
+	makeResult := func(f, source *api.FileInfo, err error) api.Result {
+		return &api.BasicResult{
+			Finfo: *f,
+			Msg:   fmt.Sprintf("CP %s -> %s", source.Path, f.Path),
+			Prio:  api.Info,
+			Err:   err,
+		}
+	}
+
+	api.Gather(files, results, &s.Stats, makeResult, rctrl, s.rootedWriters, api.DigestSha256)
+}
+
+func (s *Command) Init(numReaders, numWriters int, items []string, maxLogLevel api.Importance, filters []api.FileFilter) error {
+	sources, bags, err := seal.ParseCopyArguments(items)
+	if err != nil {
+		return err
+	}
+	if numWriters < 1 {
+		numWriters = 1
+	}
+
+	// Bags are created from scratch, to be sure their manifests are complete
+	payloads := make([]string, len(bags))
+	for i, bag := range bags {
+		if _, err := os.Stat(filepath.Join(bag, DeclarationName)); err == nil {
+			return fmt.Errorf("There already is a bag at '%s'", bag)
+		}
+		if _, err := os.Stat(filepath.Join(bag, PayloadDir)); err == nil {
+			return fmt.Errorf("The payload directory of bag '%s' must not exist yet", bag)
+		}
+		payloads[i] = filepath.Join(bag, PayloadDir)
+	}
+
+	ff := make([]api.FileFilter, len(filters), len(filters)+1)
+	copy(ff, filters)
+	ff = append(ff, api.FilterSeals)
+
+	s.InitBasicRunner(numReaders, sources, maxLogLevel, ff)
+	s.bags = bags
+
+	dm := io.DeviceMap(payloads)
+	s.rootedWriters = make(io.RootedWriteControllers, len(dm))
+	for did, trees := range dm {
+		s.rootedWriters[did] = io.RootedWriteController{
+			Trees: trees,
+			Ctrl:  io.NewWriteChannelController(numWriters, numWriters*len(trees), &s.Stats.Stats),
+		}
+	}
+	return nil
+}
+
+// IsBag returns true if the given directory contains a bag declaration
+func IsBag(dir string) bool {
+	stat, err := os.Stat(filepath.Join(dir, DeclarationName))
+	return err == nil && stat.Mode().IsRegular()
+}
+
+// IsPayloadManifest returns true if the given path points to the payload manifest of a bag
+func IsPayloadManifest(path string) bool {
+	return strings.HasPrefix(filepath.Base(path), manifestPrefix) && codec.NewByPath(path) != nil &&
+		IsBag(filepath.Dir(path))
+}
+
+// Manifests returns the payload manifest of the given bag using the strongest algorithm we support, followed
+// by the tag manifest using the strongest algorithm, if there is one.
+func Manifests(dir string) ([]string, error) {
+	var res []string
+	for _, prefix := range []string{manifestPrefix, tagManifestPrefix} {
+		for _, alg := range codec.BagItAlgorithms() {
+			path := filepath.Join(dir, prefix+alg+".txt")
+			if _, err := os.Stat(path); err == nil {
+				res = append(res, path)
+				break
+			}
+		}
+	}
+
+	if len(res) == 0 || !strings.HasPrefix(filepath.Base(res[0]), manifestPrefix) {
+		return nil, fmt.Errorf("Bag at '%s' doesn't have a payload manifest using one of %s", dir,
+			strings.Join(codec.BagItAlgorithms(), ", "))
+	}
+	return res, nil
+}
+
+// Returns the payload oxum, which is '<octets>.<streams>'
+func oxum(numBytes, numFiles uint64) string {
+	return fmt.Sprintf("%d.%d", numBytes, numFiles)
+}
@@ -0,0 +1,164 @@
+package bag
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/Byron/godi/api"
+	"github.com/Byron/godi/codec"
+)
+
+// Indicates the Payload-Oxum of a bag doesn't match its payload
+type OxumMismatch struct {
+	Bag       string
+	Want, Got string
+}
+
+func (o *OxumMismatch) Error() string {
+	return fmt.Sprintf("Payload-Oxum of bag at '%s' is %s, but its payload has %s", o.Bag, o.Want, o.Got)
+}
+
+// Indicates a payload file is not listed in a payload manifest
+type UnlistedFile struct {
+	Path, Manifest string
+}
+
+func (u *UnlistedFile) Error() string {
+	return fmt.Sprintf("Payload file '%s' is not listed in manifest '%s'", u.Path, u.Manifest)
+}
+
+// Reads all tags from the given tag file. Values may continue on lines starting with whitespace
+func readTags(path string) ([]Tag, error) {
+	fd, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+
+	var tags []Tag
+	scanner := bufio.NewScanner(fd)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSuffix(scanner.Text(), "\r")
+		if len(line) == 0 {
+			continue
+		}
+		if (line[0] == ' ' || line[0] == '\t') && len(tags) > 0 {
+			tags[len(tags)-1].Value += " " + strings.TrimSpace(line)
+			continue
+		}
+		tag, err := ParseTag(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s, line %d: %s", path, lineNum, err)
+		}
+		tags = append(tags, tag)
+	}
+	return tags, scanner.Err()
+}
+
+// Returns the value of the first tag with the given label, ignoring case
+func tagValue(tags []Tag, label string) (string, bool) {
+	for _, t := range tags {
+		if strings.EqualFold(t.Label, label) {
+			return t.Value, true
+		}
+	}
+	return "", false
+}
+
+// Validate checks the structure of the bag in the given directory, which includes its declaration, that
+// its payload matches the Payload-Oxum and that all payload files are listed in all supported payload manifests.
+// Whether the payload matches the manifests is not checked, which is what verify does.
+func Validate(dir string) (problems []error) {
+	tags, err := readTags(filepath.Join(dir, DeclarationName))
+	if err != nil {
+		return []error{err}
+	}
+	for _, label := range []string{"BagIt-Version", "Tag-File-Character-Encoding"} {
+		if _, ok := tagValue(tags, label); !ok {
+			problems = append(problems, fmt.Errorf("Bag declaration at '%s' lacks the '%s' tag", dir, label))
+		}
+	}
+
+	var payload []string
+	var numBytes uint64
+	err = filepath.Walk(filepath.Join(dir, PayloadDir), func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			rela, _ := filepath.Rel(dir, path)
+			payload = append(payload, rela)
+			numBytes += uint64(info.Size())
+		}
+		return nil
+	})
+	if err != nil {
+		return append(problems, err)
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, InfoName)); err == nil {
+		info, err := readTags(filepath.Join(dir, InfoName))
+		if err != nil {
+			return append(problems, err)
+		}
+		got := oxum(numBytes, uint64(len(payload)))
+		if want, ok := tagValue(info, oxumLabel); ok && want != got {
+			problems = append(problems, &OxumMismatch{Bag: dir, Want: want, Got: got})
+		}
+	}
+
+	for _, alg := range algorithmsIn(dir) {
+		manifest := filepath.Join(dir, manifestPrefix+alg+".txt")
+		listed, err := listedFiles(manifest)
+		if err != nil {
+			problems = append(problems, err)
+			continue
+		}
+		for _, rela := range payload {
+			if !listed[rela] {
+				problems = append(problems, &UnlistedFile{Path: filepath.Join(dir, rela), Manifest: manifest})
+			}
+		}
+	}
+	return
+}
+
+// Returns all supported algorithms for which the given bag has a payload manifest
+func algorithmsIn(dir string) (res []string) {
+	for _, alg := range codec.BagItAlgorithms() {
+		if _, err := os.Stat(filepath.Join(dir, manifestPrefix+alg+".txt")); err == nil {
+			res = append(res, alg)
+		}
+	}
+	return
+}
+
+// Returns the relative paths of all files listed in the given manifest
+func listedFiles(manifest string) (map[string]bool, error) {
+	fd, err := os.Open(manifest)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+
+	files := make(chan api.FileInfo)
+	listed := make(map[string]bool)
+	done := make(chan bool)
+	go func() {
+		for f := range files {
+			listed[f.RelaPath] = true
+		}
+		close(done)
+	}()
+
+	err = codec.NewByPath(manifest).Deserialize(fd, files, func(*api.FileInfo) bool { return true })
+	close(files)
+	<-done
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read manifest '%s': %s", manifest, err)
+	}
+	return listed, nil
+}
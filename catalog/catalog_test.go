@@ -0,0 +1,192 @@
+package catalog_test
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Byron/godi/api"
+	"github.com/Byron/godi/catalog"
+	"github.com/Byron/godi/codec"
+	"github.com/Byron/godi/seal"
+	"github.com/Byron/godi/testlib"
+	"github.com/Byron/godi/verify"
+)
+
+func TestCatalog(t *testing.T) {
+	datasetTree, file, _ := testlib.MakeDatasetOrPanic()
+	defer testlib.RmTree(datasetTree)
+	catalogDir, _ := ioutil.TempDir("", "catalog")
+	defer testlib.RmTree(catalogDir)
+	resHandler := testlib.ResultHandler(t, false)
+
+	sealcmd, _ := seal.NewCommand([]string{datasetTree}, 1, 0)
+	var indices []string
+	if err := api.StartEngine(sealcmd, api.IndexTrackingResultHandlerAdapter(&indices, resHandler)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Mistyped catalogs are not created by accident
+	if _, err := catalog.Open(filepath.Join(catalogDir, "typo")); err == nil {
+		t.Error("Opening a catalog which doesn't exist must fail")
+	}
+	cat, err := catalog.Create(catalogDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = cat.FindAll([]string{"anything"}, resHandler); err == nil {
+		t.Error("Empty catalogs can't be searched")
+	}
+	if err = cat.AddAll(indices, "DRIVE_001", resHandler); err != nil {
+		t.Fatal(err)
+	}
+
+	find := func(c *catalog.Catalog, query string) (files []*api.FileInfo, entries []*catalog.Entry) {
+		q, err := catalog.ParseQuery(query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = c.Find(q, func(e *catalog.Entry, f *api.FileInfo) {
+			fc := *f
+			files = append(files, &fc)
+			entries = append(entries, e)
+		}); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+
+	if files, entries := find(cat, "smallie.blah"); len(files) != 1 || entries[0].Volume != "DRIVE_001" ||
+		files[0].Path != filepath.Join(datasetTree, "subdir", "smallie.blah") {
+		t.Errorf("Expected to find a single file by name, got %v", files)
+	}
+	if files, _ := find(cat, "subdir/*"); len(files) != 3 {
+		t.Errorf("Expected to find all files in subdir, got %d", len(files))
+	}
+	files, _ := find(cat, filepath.Base(file))
+	if len(files) != 1 {
+		t.Fatalf("Didn't find '%s'", file)
+	}
+	if byDigest, _ := find(cat, hex.EncodeToString(files[0].Sha1)); len(byDigest) != 1 || byDigest[0].RelaPath != files[0].RelaPath {
+		t.Errorf("Expected to find '%s' by digest, got %v", file, byDigest)
+	}
+
+	// Files are found without reading the contents of the seals
+	reopened, err := catalog.Open(catalogDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	contents, _ := filepath.Glob(filepath.Join(catalogDir, "*.gobz"))
+	for _, path := range contents {
+		os.Rename(path, path+".moved")
+	}
+	if byMD5, _ := find(reopened, hex.EncodeToString(files[0].MD5)); len(byMD5) != 1 {
+		t.Errorf("Expected to find '%s' by md5 in the lookup, got %v", file, byMD5)
+	}
+	for _, path := range contents {
+		os.Rename(path+".moved", path)
+	}
+
+	// The outcome of verify runs is recorded
+	verifycmd := verify.Command{Catalog: cat}
+	if err = verifycmd.Init(1, 0, indices, api.Info, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err = api.StartEngine(&verifycmd, resHandler); err != nil {
+		t.Error(err)
+	}
+
+	// Everything was persisted
+	cat, err = catalog.Open(catalogDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e := cat.Lookup(indices[0]); e == nil || !e.IsVerified() {
+		t.Errorf("Seal should be verified, got %v", e)
+	}
+
+	summary := ""
+	if err = cat.FindAll([]string{"*.blah"}, func(r api.Result) {
+		if msg, prio := r.Info(); prio == api.Valuable {
+			summary = msg
+		}
+		resHandler(r)
+	}); err != nil {
+		t.Error(err)
+	}
+	if !strings.Contains(summary, "1 match(es)") || !strings.Contains(summary, "1 of which verified") {
+		t.Errorf("Unexpected summary: %s", summary)
+	}
+
+	// Failures are recorded as well
+	if err = os.Remove(file); err != nil {
+		t.Fatal(err)
+	}
+	verifycmd = verify.Command{Catalog: cat}
+	if err = verifycmd.Init(1, 0, indices, api.Info, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err = api.StartEngine(&verifycmd, testlib.ResultHandler(t, true)); err == nil {
+		t.Error("Verify should have failed")
+	}
+	if e := cat.Lookup(indices[0]); e == nil || e.IsVerified() || e.LastVerified.IsZero() {
+		t.Errorf("Failed verification should be recorded, got %v", e)
+	}
+}
+
+func TestCatalogDigestsAndGlobs(t *testing.T) {
+	datasetTree, file, _ := testlib.MakeDatasetOrPanic()
+	defer testlib.RmTree(datasetTree)
+	catalogDir, _ := ioutil.TempDir("", "catalog")
+	defer testlib.RmTree(catalogDir)
+	resHandler := testlib.ResultHandler(t, false)
+
+	// Seals of checksum lists only have the digest of their format
+	var indices []string
+	for _, format := range []string{codec.Sha256SumName, codec.SFVName} {
+		sealcmd, _ := seal.NewCommand([]string{datasetTree}, 1, 0)
+		sealcmd.Format = format
+		if err := api.StartEngine(sealcmd, api.IndexTrackingResultHandlerAdapter(&indices, resHandler)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cat, err := catalog.Create(catalogDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = cat.AddAll(indices, "DRIVE_001", resHandler); err != nil {
+		t.Fatal(err)
+	}
+
+	count := func(query string) (n int) {
+		q, err := catalog.ParseQuery(query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = cat.Find(q, func(*catalog.Entry, *api.FileInfo) { n += 1 }); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+
+	data, _ := ioutil.ReadFile(file)
+	sha := sha256.Sum256(data)
+	crc := make([]byte, 4)
+	binary.BigEndian.PutUint32(crc, crc32.ChecksumIEEE(data))
+	for _, digest := range [][]byte{sha[:], crc} {
+		if n := count(hex.EncodeToString(digest)); n != 1 {
+			t.Errorf("Expected to find '%s' by digest %x, got %d file(s)", file, digest, n)
+		}
+	}
+
+	// '**' matches any amount of directories, once per seal
+	if n := count("nothing/**"); n != 2 {
+		t.Errorf("Expected to find the nested file in both seals, got %d file(s)", n)
+	}
+}
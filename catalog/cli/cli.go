@@ -0,0 +1,121 @@
+/*
+Package cli implements the command-line interface for the Catalog, for use by the cli.App
+*/
+package cli
+
+import (
+	"errors"
+	"os"
+
+	"github.com/Byron/godi/api"
+	"github.com/Byron/godi/catalog"
+	"github.com/Byron/godi/cli"
+
+	gcli "github.com/codegangsta/cli"
+)
+
+const (
+	dirFlagName        = "dir"
+	volumeFlagName     = "volume"
+	catalogDescription = `
+	Keep track of all your seals, and find out where a file is stored.
+
+	The catalog stores the contents of seals locally, which allows to search them even if the devices
+	they are on are not connected. By default it is located at ~/.godi/catalog, or at $GODI_CATALOG if set.
+	It is created when adding the first seal.
+`
+	addDescription = `
+	Add the contents of one or more seals to the catalog.
+
+	[arguments ...] are one or more seal files, for example
+
+	godi catalog add --volume DRIVE_042 /Volumes/DRIVE_042/godi_2014-07-30_102259.gobz
+`
+	findDescription = `
+	Find cataloged files by name, path, glob or digest, and show which volumes and seals contain them.
+	In globs, '**' matches any amount of directories.
+
+	[arguments ...] are one or more queries, for example
+
+	godi catalog find A003C012_140730_R1AB.mov '*.r3d' 'A003/**' 3f786850e387550fdab836ed7e6dc881de23001b
+`
+)
+
+// return subcommands for our particular area of algorithms
+func SubCommands() []gcli.Command {
+	dir := gcli.StringFlag{
+		Name:  dirFlagName,
+		Value: "",
+		Usage: "The directory containing the catalog, if it is not the default one",
+	}
+
+	return []gcli.Command{
+		gcli.Command{
+			Name:      catalog.Name,
+			ShortName: "",
+			Usage:     catalogDescription,
+			Subcommands: []gcli.Command{
+				gcli.Command{
+					Name:   "add",
+					Usage:  addDescription,
+					Action: func(c *gcli.Context) { runCatalog(c, catalog.Create, addSeals) },
+					Flags: []gcli.Flag{
+						dir,
+						gcli.StringFlag{
+							Name:  volumeFlagName,
+							Value: "",
+							Usage: "The label of the volume containing the seals. Defaults to the name of the directory containing each seal",
+						},
+					},
+				},
+				gcli.Command{
+					Name:   "find",
+					Usage:  findDescription,
+					Action: func(c *gcli.Context) { runCatalog(c, catalog.Open, findFiles) },
+					Flags:  []gcli.Flag{dir},
+				},
+			},
+		},
+	}
+}
+
+func addSeals(cat *catalog.Catalog, c *gcli.Context, handler func(api.Result)) error {
+	if len(c.Args()) == 0 {
+		return errors.New("Please provide at least one seal file to add")
+	}
+	return cat.AddAll(c.Args(), c.String(volumeFlagName), handler)
+}
+
+func findFiles(cat *catalog.Catalog, c *gcli.Context, handler func(api.Result)) error {
+	if len(c.Args()) == 0 {
+		return errors.New("Please provide at least one name, glob or digest to find")
+	}
+	return cat.FindAll(c.Args(), handler)
+}
+
+// Opens the catalog with open and runs the given function with it, dealing with errors accordingly
+func runCatalog(c *gcli.Context, open func(string) (*catalog.Catalog, error),
+	run func(*catalog.Catalog, *gcli.Context, func(api.Result)) error) {
+	_, level, _, err := cli.CheckCommonFlags(c)
+	handler := cli.MakeLogHandler(level)
+
+	if err == nil {
+		dir := c.String(dirFlagName)
+		if len(dir) == 0 {
+			dir = catalog.DefaultDir()
+		}
+
+		var cat *catalog.Catalog
+		if cat, err = open(dir); err == nil {
+			err = run(cat, c, handler)
+		}
+	}
+	if err != nil {
+		handler(&api.BasicResult{Err: err, Prio: api.Error})
+	}
+
+	nerr := cli.CliFinishApp(c)
+	if err != nil || nerr != nil {
+		os.Exit(1)
+	}
+}
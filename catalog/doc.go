@@ -0,0 +1,9 @@
+/*
+Package catalog implements a local catalog of seals, which allows to find out where files are stored
+even if the devices containing them are not connected.
+
+The catalog is a directory containing an index of all cataloged seals, and a copy of each seal's contents
+in the gob format. It is embedded in godi and doesn't need any external database.
+
+*/
+package catalog
@@ -0,0 +1,108 @@
+package catalog
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/Byron/godi/api"
+)
+
+// A Query matches files by name, glob or digest
+type Query struct {
+	pattern string // name or glob
+	isGlob  bool
+	digest  []byte // any digest a seal may have, if set
+}
+
+// The lengths of the digests files may have in seals, in bytes: sha1, md5, sha256, sha512 and crc32
+var digestSizes = []int{20, 16, 32, 64, 4}
+
+// Returns all digests of the given file
+func digestsOf(f *api.FileInfo) [][]byte {
+	return [][]byte{f.Sha1, f.MD5, f.Sha256, f.Sha512, f.CRC32}
+}
+
+// ParseQuery parses the given query, which is a file name, a relative path, a glob like '*.mov' or 'A003/**',
+// or a hexadecimal sha1, md5, sha256, sha512 or crc32 digest. As names may look like digests, digest queries
+// find files with that name as well
+func ParseQuery(q string) (*Query, error) {
+	if len(q) == 0 {
+		return nil, fmt.Errorf("Empty queries are not allowed")
+	}
+
+	for _, size := range digestSizes {
+		if len(q) != 2*size {
+			continue
+		}
+		if digest, err := hex.DecodeString(q); err == nil {
+			return &Query{pattern: q, digest: digest}, nil
+		}
+	}
+
+	query := Query{pattern: filepath.ToSlash(q), isGlob: strings.ContainsAny(q, "*?[")}
+	if query.isGlob {
+		if _, err := filepath.Match(query.pattern, "empty"); err != nil {
+			return nil, fmt.Errorf("Invalid glob '%s': %s", q, err)
+		}
+	}
+	return &query, nil
+}
+
+// Matches returns true if the given file matches the query.
+// Patterns containing a slash are matched against the relative path, otherwise against the file name.
+func (q *Query) Matches(f *api.FileInfo) bool {
+	if q.digest != nil {
+		for _, digest := range digestsOf(f) {
+			if bytes.Equal(q.digest, digest) {
+				return true
+			}
+		}
+	}
+	return q.matchesPath(f.RelaPath)
+}
+
+// Returns true if our pattern is matched against file names instead of relative paths
+func (q *Query) matchesNameOnly() bool {
+	return !strings.Contains(q.pattern, "/")
+}
+
+// Returns true if the file at the given relative path matches our pattern
+func (q *Query) matchesPath(relaPath string) bool {
+	name := filepath.ToSlash(relaPath)
+	if q.matchesNameOnly() {
+		name = filepath.Base(name)
+	}
+	if q.isGlob {
+		return api.MatchGlob(q.pattern, name)
+	}
+	return q.pattern == name
+}
+
+// Find calls fn with all cataloged files matching the given query, along with the entry of the seal
+// they are listed in. Files are found using the lookup of the catalog, and only their path, size and digests
+// are known. The file is only valid during the call.
+func (c *Catalog) Find(q *Query, fn func(e *Entry, f *api.FileInfo)) error {
+	if err := c.checkNotEmpty(); err != nil {
+		return err
+	}
+	if err := c.loadLookup(); err != nil {
+		return fmt.Errorf("Failed to read catalog lookup at '%s': %s", c.lookupPath(), err)
+	}
+
+	// Matches are reported by seal, in the order of the entries
+	byEntry := make(map[string][]int)
+	for _, i := range c.files.find(q) {
+		id := c.files.files[i].Entry
+		byEntry[id] = append(byEntry[id], i)
+	}
+	for _, e := range c.Entries() {
+		for _, i := range byEntry[e.ID] {
+			f := c.files.files[i].info(e)
+			fn(e, &f)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,173 @@
+package catalog
+
+import (
+	"encoding/gob"
+	"os"
+	"path/filepath"
+
+	"github.com/Byron/godi/api"
+)
+
+const lookupName = "files.gob"
+
+// A cataloged file, as kept in the lookup
+type indexedFile struct {
+	Entry    string // The ID of the entry listing the file
+	RelaPath string
+	Size     int64
+	Sha1     []byte
+	MD5      []byte
+	Sha256   []byte
+	Sha512   []byte
+	CRC32    []byte
+}
+
+func newIndexedFile(id string, f *api.FileInfo) indexedFile {
+	return indexedFile{id, f.RelaPath, f.Size, f.Sha1, f.MD5, f.Sha256, f.Sha512, f.CRC32}
+}
+
+// Returns the file as listed in the seal of the given entry. Only its path, size and digests are known
+func (f *indexedFile) info(e *Entry) api.FileInfo {
+	return api.FileInfo{
+		Path:     filepath.Join(e.Root, f.RelaPath),
+		RelaPath: f.RelaPath,
+		Size:     f.Size,
+		Sha1:     f.Sha1,
+		MD5:      f.MD5,
+		Sha256:   f.Sha256,
+		Sha512:   f.Sha512,
+		CRC32:    f.CRC32,
+		Seal:     e.Seal,
+	}
+}
+
+// Allows to find the files of all cataloged seals by digest, name and relative path, without reading the
+// contents of each seal
+type lookup struct {
+	files []indexedFile
+
+	// Indices into files, by each of their digests, by file name, and by relative path with forward slashes
+	byDigest, byName, byPath map[string][]int
+}
+
+// Rebuilds all maps from our files
+func (l *lookup) index() {
+	l.byDigest = make(map[string][]int)
+	l.byName = make(map[string][]int)
+	l.byPath = make(map[string][]int)
+	for i := range l.files {
+		f := &l.files[i]
+		for _, digest := range [][]byte{f.Sha1, f.MD5, f.Sha256, f.Sha512, f.CRC32} {
+			if len(digest) > 0 {
+				l.byDigest[string(digest)] = append(l.byDigest[string(digest)], i)
+			}
+		}
+		path := filepath.ToSlash(f.RelaPath)
+		l.byName[filepath.Base(path)] = append(l.byName[filepath.Base(path)], i)
+		l.byPath[path] = append(l.byPath[path], i)
+	}
+}
+
+// Replaces all files of the entry with the given ID with the given ones
+func (l *lookup) replace(id string, files []indexedFile) {
+	kept := l.files[:0]
+	for _, f := range l.files {
+		if f.Entry != id {
+			kept = append(kept, f)
+		}
+	}
+	l.files = append(kept, files...)
+	l.index()
+}
+
+// Returns the indices of all files matching the given query, in ascending order
+func (l *lookup) find(q *Query) (res []int) {
+	switch {
+	case q.digest != nil:
+		return mergeIndices(l.byDigest[string(q.digest)], l.byName[q.pattern])
+	case q.isGlob:
+		for i := range l.files {
+			if q.matchesPath(l.files[i].RelaPath) {
+				res = append(res, i)
+			}
+		}
+		return
+	case q.matchesNameOnly():
+		return l.byName[q.pattern]
+	default:
+		return l.byPath[q.pattern]
+	}
+}
+
+// Returns the given ascending indices as one ascending list, without duplicates
+func mergeIndices(l, r []int) (res []int) {
+	for len(l) > 0 || len(r) > 0 {
+		switch {
+		case len(r) == 0 || len(l) > 0 && l[0] < r[0]:
+			res, l = append(res, l[0]), l[1:]
+		case len(l) == 0 || r[0] < l[0]:
+			res, r = append(res, r[0]), r[1:]
+		default:
+			res, l, r = append(res, l[0]), l[1:], r[1:]
+		}
+	}
+	return
+}
+
+func (c *Catalog) lookupPath() string {
+	return filepath.Join(c.Dir, lookupName)
+}
+
+// Reads the lookup if this wasn't done yet. Catalogs made before there was a lookup get one built from
+// the contents of their seals
+func (c *Catalog) loadLookup() error {
+	if c.files != nil {
+		return nil
+	}
+
+	l := lookup{}
+	fd, err := os.Open(c.lookupPath())
+	if os.IsNotExist(err) {
+		for _, e := range c.Entries() {
+			err = c.Files(e, func(f *api.FileInfo) bool {
+				l.files = append(l.files, newIndexedFile(e.ID, f))
+				return true
+			})
+			if err != nil {
+				return err
+			}
+		}
+		l.index()
+		c.files = &l
+		return c.saveLookup()
+	} else if err != nil {
+		return err
+	}
+	defer fd.Close()
+
+	if err = gob.NewDecoder(fd).Decode(&l.files); err != nil {
+		return err
+	}
+	l.index()
+	c.files = &l
+	return nil
+}
+
+// Writes the lookup atomically, like the index
+func (c *Catalog) saveLookup() error {
+	tmp := c.lookupPath() + ".tmp"
+	fd, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+
+	err = gob.NewEncoder(fd).Encode(c.files.files)
+	if cerr := fd.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, c.lookupPath())
+}
@@ -0,0 +1,80 @@
+package catalog
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/Byron/godi/api"
+	"github.com/Byron/godi/io"
+)
+
+// AddAll adds all given seals to the catalog, and sends a result for each of them to handler.
+// Returns the last error that occurred.
+func (c *Catalog) AddAll(seals []string, volume string, handler func(api.Result)) (err error) {
+	for _, index := range seals {
+		e, aerr := c.Add(index, volume)
+		if aerr != nil {
+			err = aerr
+			handler(&api.BasicResult{Err: err, Prio: api.Error})
+			continue
+		}
+		handler(&api.BasicResult{
+			Msg: fmt.Sprintf("CATALOG: Added %d file(s) with %s of seal '%s' on volume '%s'",
+				e.NumFiles, io.BytesVolume(e.Bytes), e.Seal, e.Volume),
+			Finfo: api.FileInfo{Path: e.Seal, Size: -1},
+			Prio:  api.Valuable,
+		})
+	}
+	return
+}
+
+// Returns a human readable description of the verification state of the entry
+func verifiedString(e *Entry) string {
+	switch {
+	case e.LastVerified.IsZero():
+		return "never verified"
+	case e.VerifiedOK:
+		return "verified " + e.LastVerified.Format(time.RFC1123)
+	default:
+		return "FAILED verification " + e.LastVerified.Format(time.RFC1123)
+	}
+}
+
+// FindAll sends a result for each cataloged file matching one of the given queries to handler, and a summary
+// for each query telling on how many volumes the matches are, and how many of them are in verified seals.
+func (c *Catalog) FindAll(queries []string, handler func(api.Result)) error {
+	for _, qs := range queries {
+		q, err := ParseQuery(qs)
+		if err != nil {
+			return err
+		}
+
+		var numMatches, numVerified uint
+		volumes := make(map[string]bool)
+		seals := make(map[string]bool)
+		err = c.Find(q, func(e *Entry, f *api.FileInfo) {
+			numMatches += 1
+			volumes[e.Volume] = true
+			seals[e.Seal] = true
+			if e.IsVerified() {
+				numVerified += 1
+			}
+			handler(&api.BasicResult{
+				Msg: fmt.Sprintf("FOUND: %s (%s) on volume '%s' in seal '%s', %s",
+					f.RelaPath, io.BytesVolume(f.Size), e.Volume, e.Seal, verifiedString(e)),
+				Finfo: *f,
+				Prio:  api.Info,
+			})
+		})
+		if err != nil {
+			return err
+		}
+
+		handler(&api.BasicResult{
+			Msg: fmt.Sprintf("FIND: %d match(es) for '%s' in %d seal(s) on %d volume(s), %d of which verified",
+				numMatches, qs, len(seals), len(volumes), numVerified),
+			Prio: api.Valuable,
+		})
+	}
+	return nil
+}
@@ -0,0 +1,317 @@
+package catalog
+
+import (
+	"crypto/sha1"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/Byron/godi/api"
+	"github.com/Byron/godi/codec"
+)
+
+const (
+	Name = "catalog"
+
+	// The environment variable overriding the default location of the catalog
+	EnvCatalog = "GODI_CATALOG"
+
+	indexName = "index.json"
+)
+
+// Information about a seal in the catalog
+type Entry struct {
+	ID           string    `json:"id"`           // Identifies the entry, and the file keeping the seal's contents
+	Seal         string    `json:"seal"`         // Absolute path to the seal at the time it was added
+	Root         string    `json:"root"`         // The directory containing the sealed data
+	Volume       string    `json:"volume"`       // A label for the device containing the data
+	Added        time.Time `json:"added"`        // Time at which the seal was added to the catalog
+	NumFiles     uint64    `json:"numFiles"`     // Amount of sealed files
+	Bytes        uint64    `json:"bytes"`        // Amount of sealed bytes
+	LastVerified time.Time `json:"lastVerified"` // Time at which the seal was verified entirely the last time, if ever
+	VerifiedOK   bool      `json:"verifiedOK"`   // True if the last verification didn't find any problem
+}
+
+// Returns true if the data of the seal was verified successfully at least once
+func (e *Entry) IsVerified() bool {
+	return !e.LastVerified.IsZero() && e.VerifiedOK
+}
+
+// A Catalog keeps information about seals in a directory
+type Catalog struct {
+	// The directory containing the catalog
+	Dir string
+
+	entries map[string]*Entry
+
+	// Allows to find files, and is loaded when it is needed first
+	files *lookup
+}
+
+// DefaultDir returns the directory of the catalog to use if none is given explicitly
+func DefaultDir() string {
+	if dir := os.Getenv(EnvCatalog); len(dir) > 0 {
+		return dir
+	}
+	home := os.Getenv("HOME")
+	if len(home) == 0 {
+		home = os.Getenv("USERPROFILE")
+	}
+	return filepath.Join(home, ".godi", Name)
+}
+
+// Open returns the catalog in the given directory, which must have been created before
+func Open(dir string) (*Catalog, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	c := Catalog{Dir: dir, entries: make(map[string]*Entry)}
+	fd, err := os.Open(c.indexPath())
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("There is no catalog at '%s'", dir)
+	} else if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+
+	if err = json.NewDecoder(fd).Decode(&c.entries); err != nil {
+		return nil, fmt.Errorf("Failed to read catalog index at '%s': %s", c.indexPath(), err)
+	}
+	return &c, nil
+}
+
+// Create is like Open, but creates the catalog in the given directory if it doesn't exist yet
+func Create(dir string) (*Catalog, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	if err = os.MkdirAll(dir, 0777); err != nil {
+		return nil, err
+	}
+
+	c := Catalog{Dir: dir, entries: make(map[string]*Entry)}
+	if _, err = os.Stat(c.indexPath()); err == nil {
+		return Open(dir)
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	c.files = &lookup{}
+	c.files.index()
+	if err = c.saveLookup(); err != nil {
+		return nil, err
+	}
+	return &c, c.save()
+}
+
+func (c *Catalog) indexPath() string {
+	return filepath.Join(c.Dir, indexName)
+}
+
+// Returns the path to the file keeping the contents of the given entry
+func (c *Catalog) contentsPath(e *Entry) string {
+	return filepath.Join(c.Dir, e.ID+"."+codec.GobExtension)
+}
+
+// Write the index atomically, to never leave a partial one behind
+func (c *Catalog) save() error {
+	tmp := c.indexPath() + ".tmp"
+	fd, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+
+	err = json.NewEncoder(fd).Encode(c.entries)
+	if cerr := fd.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, c.indexPath())
+}
+
+// Entries returns all entries of the catalog, sorted by volume and seal
+func (c *Catalog) Entries() []*Entry {
+	res := make([]*Entry, 0, len(c.entries))
+	for _, e := range c.entries {
+		res = append(res, e)
+	}
+	sort.Sort(byVolume(res))
+	return res
+}
+
+// Lookup returns the entry of the given seal, or nil if it is not in the catalog
+func (c *Catalog) Lookup(index string) *Entry {
+	if abs, err := filepath.Abs(index); err == nil {
+		index = abs
+	}
+	return c.entries[entryID(index)]
+}
+
+type byVolume []*Entry
+
+func (b byVolume) Len() int      { return len(b) }
+func (b byVolume) Swap(i, j int) { b[i], b[j] = b[j], b[i] }
+func (b byVolume) Less(i, j int) bool {
+	if b[i].Volume != b[j].Volume {
+		return b[i].Volume < b[j].Volume
+	}
+	return b[i].Seal < b[j].Seal
+}
+
+// Returns the id of the entry for the seal at the given absolute path
+func entryID(index string) string {
+	return fmt.Sprintf("%x", sha1.Sum([]byte(index)))[:16]
+}
+
+// Add imports the contents of the given seal into the catalog, replacing a previous import of the same seal.
+// The data is assumed to be stored next to the seal on the given volume. If volume is empty, the name of the
+// directory containing the seal is used.
+func (c *Catalog) Add(index, volume string) (*Entry, error) {
+	index, err := filepath.Abs(index)
+	if err != nil {
+		return nil, err
+	}
+	sc := codec.NewByPath(index)
+	if sc == nil {
+		return nil, fmt.Errorf("Unknown seal file format: '%s'", index)
+	}
+
+	// The lookup is updated along with the contents
+	if err = c.loadLookup(); err != nil {
+		return nil, err
+	}
+
+	root := filepath.Dir(index)
+	if len(volume) == 0 {
+		volume = filepath.Base(root)
+	}
+	e := Entry{
+		ID:     entryID(index),
+		Seal:   index,
+		Root:   root,
+		Volume: volume,
+		Added:  time.Now(),
+	}
+	if prev, ok := c.entries[e.ID]; ok {
+		// The data didn't necessarily change, and we don't know better
+		e.LastVerified, e.VerifiedOK = prev.LastVerified, prev.VerifiedOK
+	}
+
+	fd, err := os.Open(index)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+
+	tmp := c.contentsPath(&e) + ".tmp"
+	out, err := os.Create(tmp)
+	if err != nil {
+		return nil, err
+	}
+
+	// Read and write concurrently, and keep the first error
+	files := make(chan api.FileInfo)
+	written := make(chan error)
+	go func() {
+		err := (&codec.Gob{}).Serialize(files, out)
+		// drain the channel in case of errors, to not block the reader
+		for _ = range files {
+		}
+		written <- err
+	}()
+
+	var indexed []indexedFile
+	err = sc.Deserialize(fd, files, func(f *api.FileInfo) bool {
+		e.NumFiles += 1
+		e.Bytes += uint64(f.Size)
+		indexed = append(indexed, newIndexedFile(e.ID, f))
+		return true
+	})
+	close(files)
+	if werr := <-written; err == nil {
+		err = werr
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return nil, fmt.Errorf("Failed to add seal '%s' to catalog: %s", index, err)
+	}
+	if err = os.Rename(tmp, c.contentsPath(&e)); err != nil {
+		return nil, err
+	}
+	c.files.replace(e.ID, indexed)
+	if err = c.saveLookup(); err != nil {
+		return nil, err
+	}
+
+	c.entries[e.ID] = &e
+	return &e, c.save()
+}
+
+// RecordVerify remembers the outcome of a verification of the entire seal at the given time.
+// Returns the affected entry, which is nil if the seal is not in the catalog.
+func (c *Catalog) RecordVerify(index string, at time.Time, ok bool) (*Entry, error) {
+	e := c.Lookup(index)
+	if e == nil {
+		return nil, nil
+	}
+	e.LastVerified = at
+	e.VerifiedOK = ok
+	return e, c.save()
+}
+
+// Files sends all files of the given entry to fn, with their path pointing into the entry's root.
+// It stops early if fn returns false. The file is only valid during the call.
+func (c *Catalog) Files(e *Entry, fn func(f *api.FileInfo) bool) error {
+	fd, err := os.Open(c.contentsPath(e))
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+
+	files := make(chan api.FileInfo)
+	done := make(chan bool)
+	go func() {
+		for f := range files {
+			if !fn(&f) {
+				break
+			}
+		}
+		close(done)
+		for _ = range files {
+		}
+	}()
+
+	err = (&codec.Gob{}).Deserialize(fd, files, func(f *api.FileInfo) bool {
+		select {
+		case <-done:
+			return false
+		default:
+			f.Path = filepath.Join(e.Root, f.RelaPath)
+			f.Seal = e.Seal
+			return true
+		}
+	})
+	close(files)
+	<-done
+	return err
+}
+
+// Returns an error if the catalog doesn't contain any seal
+func (c *Catalog) checkNotEmpty() error {
+	if len(c.entries) == 0 {
+		return errors.New("The catalog doesn't contain any seal yet")
+	}
+	return nil
+}
@@ -7,8 +7,16 @@ import (
 	"fmt"
 
 	"github.com/Byron/godi/api"
+	bcli "github.com/Byron/godi/bag/cli"
+	catcli "github.com/Byron/godi/catalog/cli"
 	gocli "github.com/Byron/godi/cli"
+	ccli "github.com/Byron/godi/compare/cli"
+	dcli "github.com/Byron/godi/dupes/cli"
+	mcli "github.com/Byron/godi/merge/cli"
+	_ "github.com/Byron/godi/s3"
+	sccli "github.com/Byron/godi/scrub/cli"
 	scli "github.com/Byron/godi/seal/cli"
+	_ "github.com/Byron/godi/sftp"
 	vcli "github.com/Byron/godi/verify/cli"
 
 	"github.com/codegangsta/cli"
@@ -54,6 +62,12 @@ func NewGodiApp() *cli.App {
 	cmds := []cli.Command{}
 	cmds = append(cmds, scli.SubCommands()...)
 	cmds = append(cmds, vcli.SubCommands()...)
+	cmds = append(cmds, sccli.SubCommands()...)
+	cmds = append(cmds, ccli.SubCommands()...)
+	cmds = append(cmds, dcli.SubCommands()...)
+	cmds = append(cmds, catcli.SubCommands()...)
+	cmds = append(cmds, mcli.SubCommands()...)
+	cmds = append(cmds, bcli.SubCommands()...)
 	cmds = append(cmds, optionalSubCommands()...)
 
 	app.Usage = `Verify data integrity and transfer data securely at highest speeds.
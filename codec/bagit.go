@@ -0,0 +1,131 @@
+// Implements the payload and tag manifests of BagIt bags, as defined in RFC 8493
+
+package codec
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/Byron/godi/api"
+)
+
+const (
+	BagItManifestExtension = "txt"
+)
+
+var reIsBagItManifest = regexp.MustCompile(`^(tag)?manifest-(md5|sha1|sha256|sha512)\.txt$`)
+
+// Algorithms as named in BagIt manifests, mapped to the kind of hash they store
+var bagItKinds = map[string]sumKind{
+	"md5":    sumMD5,
+	"sha1":   sumSha1,
+	"sha256": sumSha256,
+	"sha512": sumSha512,
+}
+
+// BagItManifest reads and writes lines like '<hex> <path>', where the path is relative to the bag's base directory,
+// which is the directory containing the manifest.
+// Like checksum lists, manifests don't have a signature and don't store sizes.
+type BagItManifest struct {
+	Sums
+}
+
+// BagItAlgorithms returns the names of the manifest algorithms we support, the strongest one first
+func BagItAlgorithms() []string {
+	return []string{"sha512", "sha256", "sha1", "md5"}
+}
+
+// NewBagItManifest returns a codec for manifests using the given algorithm, or nil if it is not supported
+func NewBagItManifest(algorithm string) *BagItManifest {
+	kind, ok := bagItKinds[algorithm]
+	if !ok {
+		return nil
+	}
+	return &BagItManifest{Sums{kind}}
+}
+
+// Returns a codec if the given file name is the one of a supported manifest or tag manifest
+func newBagItManifestByName(name string) Codec {
+	m := reIsBagItManifest.FindStringSubmatch(name)
+	if m == nil {
+		return nil
+	}
+	if c := NewBagItManifest(m[2]); c != nil {
+		return c
+	}
+	return nil
+}
+
+func (b *BagItManifest) Extension() string {
+	return BagItManifestExtension
+}
+
+// As line breaks separate entries, they are percent-encoded in paths, as well as the percent sign itself
+var (
+	bagItPathEncoder = strings.NewReplacer("%", "%25", "\r", "%0D", "\n", "%0A")
+	bagItPathDecoder = strings.NewReplacer("%25", "%", "%0D", "\r", "%0d", "\r", "%0A", "\n", "%0a", "\n")
+)
+
+func (b *BagItManifest) Serialize(in <-chan api.FileInfo, writer io.Writer) (err error) {
+	w := bufio.NewWriter(writer)
+	for f := range in {
+		digest, size := b.digest(&f)
+		if len(*digest) != size {
+			return fmt.Errorf("Missing %s hash of file '%s'", b.algorithm(), f.RelaPath)
+		}
+		if _, err = fmt.Fprintf(w, "%x %s\n", *digest, bagItPathEncoder.Replace(filepath.ToSlash(f.RelaPath))); err != nil {
+			return
+		}
+	}
+	return w.Flush()
+}
+
+func (b *BagItManifest) Deserialize(reader io.Reader, out chan<- api.FileInfo, predicate func(*api.FileInfo) bool) error {
+	scanner := bufio.NewScanner(reader)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSuffix(scanner.Text(), "\r")
+		if len(line) == 0 {
+			continue
+		}
+
+		f := api.FileInfo{}
+		digest, size := b.digest(&f)
+		sep := strings.IndexAny(line, " \t")
+		var err error
+		if sep != 2*size {
+			err = fmt.Errorf("Expected '<%s> <path>', got '%s'", b.algorithm(), line)
+		} else if err = parseDigest(line[:sep], digest); err == nil {
+			f.RelaPath = bagItPathDecoder.Replace(strings.TrimLeft(line[sep:], " \t"))
+			err = checkRelaPath(f.RelaPath)
+		}
+		if err != nil {
+			return &DecodeError{Msg: fmt.Sprintf("Line %d: %s", lineNum, err.Error())}
+		}
+
+		f.RelaPath = filepath.FromSlash(f.RelaPath)
+		f.Path = f.RelaPath
+		if !predicate(&f) {
+			return nil
+		}
+		out <- f
+	}
+
+	if err := scanner.Err(); err != nil {
+		return &DecodeError{Msg: err.Error()}
+	}
+	return nil
+}
+
+// Returns the name of our algorithm, as used in manifest file names
+func (b *BagItManifest) algorithm() string {
+	for name, kind := range bagItKinds {
+		if kind == b.kind {
+			return name
+		}
+	}
+	panic("unreachable")
+}
@@ -3,5 +3,8 @@ Package codec provides support for serializing and deserializing file-hash infor
 
 Channel-based operation allows to stream file information, which becomes relevant when millions of files are
 supposed to be handled without any delay or noticeable memory overhead.
+
+Codecs are made available by name and seal file extension through Register, which allows to add custom formats
+that will be used by all godi commands.
 */
 package codec
@@ -0,0 +1,543 @@
+// Implements encryption of seals written by any other codec, using a passphrase or an X25519 key pair
+
+package codec
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"code.google.com/p/go.crypto/curve25519"
+	"code.google.com/p/go.crypto/scrypt"
+
+	"github.com/Byron/godi/api"
+)
+
+const (
+	EncryptedExtension = "enc"
+
+	encryptedMagic = "GODIENC\x01"
+
+	// Amount of plaintext bytes per encrypted chunk
+	chunkSize = 64 * 1024
+
+	keyKindPassphrase = 1
+	keyKindX25519     = 2
+
+	// scrypt parameters, allowing to derive a key in about 100ms
+	scryptLogN    = 15
+	scryptMaxLogN = 20
+	scryptR       = 8
+	scryptP       = 1
+	saltLen       = 16
+
+	publicKeyPrefix = "godi-public-key:"
+	secretKeyPrefix = "godi-secret-key:"
+)
+
+// Key is used to encrypt and decrypt seals. It is either a passphrase, or an X25519 key pair.
+// Seals can be encrypted for a key pair of which only the public key is known, but only the secret key
+// can decrypt them.
+type Key struct {
+	passphrase     []byte
+	public, secret *[32]byte
+}
+
+// NewPassphraseKey returns a key deriving the actual encryption key from the given passphrase
+func NewPassphraseKey(passphrase string) *Key {
+	return &Key{passphrase: []byte(passphrase)}
+}
+
+// GenerateKey returns a new X25519 key pair
+func GenerateKey() (*Key, error) {
+	k := Key{secret: new([32]byte)}
+	if _, err := io.ReadFull(rand.Reader, k.secret[:]); err != nil {
+		return nil, err
+	}
+	k.derivePublic()
+	return &k, nil
+}
+
+// ParseKey parses a public or secret key as returned by Key.String() and Key.SecretString() respectively
+func ParseKey(text string) (*Key, error) {
+	text = strings.TrimSpace(text)
+	k := Key{}
+	var dst **[32]byte
+	switch {
+	case strings.HasPrefix(text, publicKeyPrefix):
+		dst = &k.public
+		text = text[len(publicKeyPrefix):]
+	case strings.HasPrefix(text, secretKeyPrefix):
+		dst = &k.secret
+		text = text[len(secretKeyPrefix):]
+	default:
+		return nil, fmt.Errorf("Expected a key starting with '%s' or '%s'", publicKeyPrefix, secretKeyPrefix)
+	}
+
+	b, err := base64.StdEncoding.DecodeString(text)
+	if err != nil || len(b) != 32 {
+		return nil, fmt.Errorf("Invalid key '%s'", text)
+	}
+	*dst = new([32]byte)
+	copy((*dst)[:], b)
+	if k.secret != nil {
+		k.derivePublic()
+	}
+	return &k, nil
+}
+
+// ReadKeyFile reads the first key from the file at the given path, ignoring empty lines and comments starting with '#'
+func ReadKeyFile(path string) (*Key, error) {
+	fd, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+
+	scanner := bufio.NewScanner(fd)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		k, err := ParseKey(line)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read key file '%s': %s", path, err)
+		}
+		return k, nil
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
+	return nil, fmt.Errorf("Key file '%s' doesn't contain a key", path)
+}
+
+// ReadPassphraseFile returns a passphrase key from the first line of the file at the given path
+func ReadPassphraseFile(path string) (*Key, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	passphrase := strings.TrimRight(strings.SplitN(string(data), "\n", 2)[0], "\r")
+	if len(passphrase) == 0 {
+		return nil, fmt.Errorf("Passphrase file '%s' must not be empty", path)
+	}
+	return NewPassphraseKey(passphrase), nil
+}
+
+func (k *Key) derivePublic() {
+	k.public = new([32]byte)
+	curve25519.ScalarBaseMult(k.public, k.secret)
+}
+
+// String returns the public key, which can be shared with anyone sealing data for us
+func (k *Key) String() string {
+	if k.public == nil {
+		return "passphrase"
+	}
+	return publicKeyPrefix + base64.StdEncoding.EncodeToString(k.public[:])
+}
+
+// SecretString returns the secret key, or an empty string if it is unknown
+func (k *Key) SecretString() string {
+	if k.secret == nil {
+		return ""
+	}
+	return secretKeyPrefix + base64.StdEncoding.EncodeToString(k.secret[:])
+}
+
+// CanDecrypt returns true if seals encrypted with this key can also be decrypted with it
+func (k *Key) CanDecrypt() bool {
+	return k.public == nil || k.secret != nil
+}
+
+func (k *Key) kind() byte {
+	if k.public == nil {
+		return keyKindPassphrase
+	}
+	return keyKindX25519
+}
+
+// Returns parameters to store in the header, along with the encryption key to use for a new seal
+func (k *Key) encryptionKey() (params, key []byte, err error) {
+	if k.kind() == keyKindPassphrase {
+		params = make([]byte, saltLen+1)
+		if _, err = io.ReadFull(rand.Reader, params[:saltLen]); err != nil {
+			return
+		}
+		params[saltLen] = scryptLogN
+		key, err = k.decryptionKey(params)
+		return
+	}
+
+	var ephemeralSecret, ephemeralPublic [32]byte
+	if _, err = io.ReadFull(rand.Reader, ephemeralSecret[:]); err != nil {
+		return
+	}
+	curve25519.ScalarBaseMult(&ephemeralPublic, &ephemeralSecret)
+	params = ephemeralPublic[:]
+	key, err = x25519Key(&ephemeralSecret, k.public, &ephemeralPublic, k.public)
+	return
+}
+
+// Returns the key to decrypt a seal with the given header parameters, matching our kind
+func (k *Key) decryptionKey(params []byte) ([]byte, error) {
+	if k.kind() == keyKindPassphrase {
+		if len(params) != saltLen+1 || params[saltLen] > scryptMaxLogN {
+			return nil, errors.New("Invalid passphrase parameters")
+		}
+		return scrypt.Key(k.passphrase, params[:saltLen], 1<<params[saltLen], scryptR, scryptP, 32)
+	}
+
+	if k.secret == nil {
+		return nil, errors.New("Need the secret key to decrypt")
+	}
+	if len(params) != 32 {
+		return nil, errors.New("Invalid ephemeral key")
+	}
+	var ephemeralPublic [32]byte
+	copy(ephemeralPublic[:], params)
+	return x25519Key(k.secret, &ephemeralPublic, &ephemeralPublic, k.public)
+}
+
+// Derives a key from the shared secret of the given secret and public key, bound to both public keys involved
+func x25519Key(secret, public, ephemeralPublic, recipientPublic *[32]byte) ([]byte, error) {
+	var shared [32]byte
+	curve25519.ScalarMult(&shared, secret, public)
+	if shared == [32]byte{} {
+		return nil, errors.New("Invalid public key")
+	}
+	mac := hmac.New(sha256.New, shared[:])
+	mac.Write([]byte("godi seal"))
+	mac.Write(ephemeralPublic[:])
+	mac.Write(recipientPublic[:])
+	return mac.Sum(nil), nil
+}
+
+// Encrypted wraps the seal written by another codec, keeping its contents confidential.
+// The file is structured like so
+// - magic and version
+// - name of the wrapped codec
+// - key kind and its parameters, i.e. the scrypt salt or an ephemeral X25519 public key
+// - chunks of the wrapped seal, encrypted with AES-256-GCM and authenticated together with the header above
+// Use NewByPath() to obtain an instance able to read an existing seal.
+type Encrypted struct {
+	// The name of the wrapped codec. Set from the seal when decoding
+	Format string
+
+	// The first key is used to encrypt. When decrypting, all keys are tried
+	Keys []*Key
+}
+
+// NewEncrypted returns a codec writing seals of the given format, encrypted with the given key
+func NewEncrypted(format string, key *Key) *Encrypted {
+	return &Encrypted{Format: format, Keys: []*Key{key}}
+}
+
+// Returns the codec we wrap, or nil if it is unknown
+func (e *Encrypted) inner() Codec {
+	return NewByName(e.Format)
+}
+
+func (e *Encrypted) Extension() string {
+	if c := e.inner(); c != nil {
+		return c.Extension() + "." + EncryptedExtension
+	}
+	return EncryptedExtension
+}
+
+func (e *Encrypted) Signed() bool {
+	c := e.inner()
+	return c == nil || IsSigned(c)
+}
+
+func (e *Encrypted) HasSizes() bool {
+	c := e.inner()
+	return c == nil || HasSizes(c)
+}
+
+func (e *Encrypted) Digests() api.Digests {
+	if c := e.inner(); c != nil {
+		return DigestsOf(c)
+	}
+	return 0
+}
+
+func (e *Encrypted) KeptDigests() []string {
+	if c := e.inner(); c != nil {
+		if k, ok := c.(DigestKeeper); ok {
+			return k.KeptDigests()
+		}
+		return []string{"sha1", "md5"}
+	}
+	return allDigests
+}
+
+func (e *Encrypted) Serialize(in <-chan api.FileInfo, writer io.Writer) error {
+	c := e.inner()
+	if c == nil || len(e.Keys) == 0 {
+		return fmt.Errorf("Need a known format and a key to write an encrypted seal, got format '%s'", e.Format)
+	}
+	if len(e.Format) > 255 {
+		return fmt.Errorf("Format name '%s' is too long", e.Format)
+	}
+
+	params, key, err := e.Keys[0].encryptionKey()
+	if err != nil {
+		return err
+	}
+	header := bytes.NewBufferString(encryptedMagic)
+	header.WriteByte(byte(len(e.Format)))
+	header.WriteString(e.Format)
+	header.WriteByte(e.Keys[0].kind())
+	header.WriteByte(byte(len(params)))
+	header.Write(params)
+
+	aead, err := newAEAD(key)
+	if err != nil {
+		return err
+	}
+	if _, err = writer.Write(header.Bytes()); err != nil {
+		return err
+	}
+
+	w := chunkWriter{w: writer, aead: aead, ad: header.Bytes(), buf: make([]byte, 0, chunkSize)}
+	if err = c.Serialize(in, &w); err != nil {
+		return err
+	}
+	return w.Close()
+}
+
+func (e *Encrypted) Deserialize(reader io.Reader, out chan<- api.FileInfo, predicate func(*api.FileInfo) bool) error {
+	header, kind, params, err := e.readHeader(reader)
+	if err != nil {
+		return &DecodeError{Msg: err.Error()}
+	}
+	c := e.inner()
+	if c == nil {
+		return &DecodeError{Msg: fmt.Sprintf("Encrypted seal has unknown format '%s'", e.Format)}
+	}
+
+	r := chunkReader{r: reader, ad: header, raw: make([]byte, chunkSize+16)}
+	if err = r.read(); err != nil {
+		return &DecodeError{Msg: err.Error()}
+	}
+
+	numCandidates := 0
+	for _, k := range e.Keys {
+		if k.kind() != kind || !k.CanDecrypt() {
+			continue
+		}
+		numCandidates += 1
+		key, err := k.decryptionKey(params)
+		if err != nil {
+			return &DecodeError{Msg: err.Error()}
+		}
+		if r.aead, err = newAEAD(key); err != nil {
+			return &DecodeError{Msg: err.Error()}
+		}
+		if r.decrypt() == nil {
+			break
+		}
+		r.aead = nil
+	}
+
+	if r.aead == nil {
+		switch {
+		case numCandidates > 0:
+			return &DecodeError{Msg: "Seal cannot be decrypted with any of the given keys"}
+		case kind == keyKindPassphrase:
+			return &DecodeError{Msg: "Seal is encrypted with a passphrase, which is required to decrypt it"}
+		}
+		return &DecodeError{Msg: "Seal is encrypted for a key pair, whose secret key is required to decrypt it"}
+	}
+
+	if err = c.Deserialize(&r, out, predicate); err != nil {
+		return err
+	}
+	// Make sure the entire seal is authentic, even if the codec didn't read all of it
+	if _, err = io.Copy(ioutil.Discard, &r); err != nil {
+		return &DecodeError{Msg: err.Error()}
+	}
+	return nil
+}
+
+// Reads our header and sets our format from it. Returns the header as read, the key kind and its parameters
+func (e *Encrypted) readHeader(reader io.Reader) (header []byte, kind byte, params []byte, err error) {
+	buf := bytes.Buffer{}
+	r := io.TeeReader(reader, &buf)
+	// Reads a byte-prefixed string
+	readString := func() ([]byte, error) {
+		var l [1]byte
+		if _, err := io.ReadFull(r, l[:]); err != nil {
+			return nil, err
+		}
+		s := make([]byte, l[0])
+		_, err := io.ReadFull(r, s)
+		return s, err
+	}
+
+	magic := make([]byte, len(encryptedMagic))
+	if _, err = io.ReadFull(r, magic); err != nil || string(magic) != encryptedMagic {
+		err = errors.New("Not an encrypted seal, or written by an unsupported version")
+		return
+	}
+	format, err := readString()
+	if err != nil {
+		return
+	}
+	e.Format = string(format)
+
+	var k [1]byte
+	if _, err = io.ReadFull(r, k[:]); err != nil {
+		return
+	}
+	kind = k[0]
+	if kind != keyKindPassphrase && kind != keyKindX25519 {
+		err = fmt.Errorf("Unknown key kind %d", kind)
+		return
+	}
+	if params, err = readString(); err != nil {
+		return
+	}
+	return buf.Bytes(), kind, params, nil
+}
+
+// Returns a codec to read the encrypted seal with the given path and beginning, or nil if it isn't one
+func newEncryptedByHead(path string, head []byte) *Encrypted {
+	e := Encrypted{}
+	if _, _, _, err := e.readHeader(bytes.NewReader(head)); err != nil && !strings.HasSuffix(path, "."+EncryptedExtension) {
+		return nil
+	}
+	return &e
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Returns the nonce of the given chunk, which makes sure chunks can't be reordered or dropped
+func chunkNonce(counter uint64, final bool) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce[3:11], counter)
+	if final {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+// Encrypts everything written to it in chunks. The last chunk is written on Close, and is always
+// smaller than the others, which is how it's recognized when reading.
+type chunkWriter struct {
+	w       io.Writer
+	aead    cipher.AEAD
+	ad      []byte
+	buf     []byte
+	counter uint64
+}
+
+func (c *chunkWriter) flush(final bool) error {
+	_, err := c.w.Write(c.aead.Seal(nil, chunkNonce(c.counter, final), c.buf, c.ad))
+	c.counter += 1
+	c.buf = c.buf[:0]
+	return err
+}
+
+func (c *chunkWriter) Write(p []byte) (n int, err error) {
+	for len(p) > 0 {
+		if len(c.buf) == chunkSize {
+			if err = c.flush(false); err != nil {
+				return
+			}
+		}
+		nc := copy(c.buf[len(c.buf):chunkSize], p)
+		c.buf = c.buf[:len(c.buf)+nc]
+		p = p[nc:]
+		n += nc
+	}
+	return
+}
+
+func (c *chunkWriter) Close() error {
+	if len(c.buf) == chunkSize {
+		if err := c.flush(false); err != nil {
+			return err
+		}
+	}
+	return c.flush(true)
+}
+
+// Decrypts chunks as written by chunkWriter
+type chunkReader struct {
+	r       io.Reader
+	aead    cipher.AEAD
+	ad      []byte
+	raw     []byte // the current encrypted chunk
+	n       int    // amount of bytes in raw
+	buf     []byte // the current decrypted chunk
+	plain   []byte // decrypted bytes not yet read
+	final   bool
+	counter uint64
+	err     error
+}
+
+// Reads the next encrypted chunk
+func (c *chunkReader) read() error {
+	var err error
+	c.n, err = io.ReadFull(c.r, c.raw)
+	switch err {
+	case nil:
+		c.final = false
+	case io.ErrUnexpectedEOF:
+		c.final = true
+	case io.EOF:
+		return errors.New("Encrypted seal is truncated")
+	default:
+		return err
+	}
+	return nil
+}
+
+// Decrypts the chunk read last
+func (c *chunkReader) decrypt() (err error) {
+	c.buf, err = c.aead.Open(c.buf[:0], chunkNonce(c.counter, c.final), c.raw[:c.n], c.ad)
+	if err != nil {
+		return errors.New("Encrypted seal was modified or is corrupted")
+	}
+	c.plain = c.buf
+	c.counter += 1
+	return nil
+}
+
+func (c *chunkReader) Read(p []byte) (int, error) {
+	for len(c.plain) == 0 {
+		switch {
+		case c.err != nil:
+			return 0, c.err
+		case c.final:
+			return 0, io.EOF
+		}
+		if c.err = c.read(); c.err == nil {
+			c.err = c.decrypt()
+		}
+	}
+	n := copy(p, c.plain)
+	c.plain = c.plain[n:]
+	return n, nil
+}
@@ -0,0 +1,127 @@
+package codec
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Byron/godi/api"
+)
+
+func TestEncrypted(t *testing.T) {
+	// Enough files to need multiple chunks
+	files := make([]api.FileInfo, 3000)
+	for i := range files {
+		files[i] = api.FileInfo{RelaPath: fmt.Sprintf("confidential/shot_%04d.dpx", i), Size: int64(i),
+			Sha1: bytes.Repeat([]byte{1}, 20), MD5: bytes.Repeat([]byte{2}, 16)}
+	}
+
+	pair, err := GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	public, err := ParseKey(pair.String())
+	if err != nil || public.CanDecrypt() {
+		t.Fatalf("The public key must be parseable and unable to decrypt: %v", err)
+	}
+	secret, err := ParseKey(pair.SecretString())
+	if err != nil || secret.String() != pair.String() {
+		t.Fatalf("The secret key must be parseable and yield the public key: %v", err)
+	}
+	passphrase := NewPassphraseKey("secret")
+
+	for _, tc := range []struct {
+		format       string
+		write, read  *Key
+		otherwise    *Key
+		noKeyMessage string
+	}{
+		{MD5SumName, passphrase, passphrase, NewPassphraseKey("wrong"), "passphrase"},
+		{GobName, public, secret, public, "secret key"},
+	} {
+		c := NewEncrypted(tc.format, tc.write)
+		if c.Extension() != NewByName(tc.format).Extension()+"."+EncryptedExtension {
+			t.Errorf("Unexpected extension '%s'", c.Extension())
+		}
+		data := encodeSums(t, c, files)
+		if bytes.Contains(data, []byte("confidential")) {
+			t.Error("Encrypted seal must not reveal file names")
+		}
+
+		decoded, err := decodeSums(&Encrypted{Keys: []*Key{tc.otherwise, tc.read}}, data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(decoded) != len(files) || decoded[len(files)-1].RelaPath != files[len(files)-1].RelaPath {
+			t.Errorf("Expected %d files to survive the round-trip, got %d", len(files), len(decoded))
+		}
+
+		for _, keys := range [][]*Key{nil, {tc.otherwise}} {
+			_, err = decodeSums(&Encrypted{Keys: keys}, data)
+			if _, ok := err.(*DecodeError); !ok {
+				t.Errorf("Expected a decode error without the right key, got %v", err)
+			} else if len(keys) == 0 && !strings.Contains(err.Error(), tc.noKeyMessage) {
+				t.Errorf("Error should tell which key is required: %s", err)
+			}
+		}
+
+		// Tampering and truncation are detected, even if the last chunk is missing entirely
+		header, _, _, err := (&Encrypted{}).readHeader(bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, broken := range [][]byte{
+			append(append([]byte{}, data[:len(data)-1]...), data[len(data)-1]^1),
+			data[:len(data)-10],
+			data[:len(data)-(len(data)-len(header))%(chunkSize+16)],
+		} {
+			if _, err = decodeSums(&Encrypted{Keys: []*Key{tc.read}}, broken); err == nil {
+				t.Error("Expected modified seal to fail decoding")
+			}
+		}
+
+		// Encrypted seals are found by content, and tell which format they wrap
+		dir, err := ioutil.TempDir("", "godi-encrypted")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		path := filepath.Join(dir, "seal.bin")
+		if err = ioutil.WriteFile(path, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if e, ok := NewByPath(path).(*Encrypted); !ok || e.Format != tc.format || HasSizes(e) != HasSizes(NewByName(tc.format)) {
+			t.Errorf("Expected encrypted codec wrapping %s for '%s', got %#v", tc.format, path, e)
+		}
+	}
+}
+
+func TestChunks(t *testing.T) {
+	aead, err := newAEAD(bytes.Repeat([]byte{1}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The last chunk must be recognizable even if the data fills all chunks
+	for _, size := range []int{0, 1, chunkSize - 1, chunkSize, 2 * chunkSize, 2*chunkSize + 1} {
+		data := bytes.Repeat([]byte{'x'}, size)
+		buf := bytes.Buffer{}
+		w := chunkWriter{w: &buf, aead: aead, buf: make([]byte, 0, chunkSize)}
+		if _, err = w.Write(data); err != nil {
+			t.Fatal(err)
+		}
+		if err = w.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		r := chunkReader{r: &buf, aead: aead, raw: make([]byte, chunkSize+16)}
+		read, err := ioutil.ReadAll(&r)
+		if err != nil || !bytes.Equal(read, data) {
+			t.Errorf("Failed to read back %d bytes, got %d, error %v", size, len(read), err)
+		}
+	}
+}
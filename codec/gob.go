@@ -7,7 +7,9 @@ import (
 	"encoding/gob"
 	"fmt"
 	"io"
+	"os"
 	"strings"
+	"time"
 
 	"github.com/Byron/godi/api"
 )
@@ -15,9 +17,49 @@ import (
 const (
 	GobName      = "gob"
 	GobExtension = "gobz"
-	Version      = 1
+	// Version 1 encoded api.FileInfo as is, and thus whichever fields it happened to have
+	Version = 2
 )
 
+// The record of a single file, which is decoupled from api.FileInfo to keep fields added there
+// for other purposes out of our seals
+type gobRecord struct {
+	Path     string
+	RelaPath string
+	Mode     os.FileMode
+	Size     int64
+
+	// Informational only, and not protected by the signature
+	ModTime time.Time
+	Link    string
+
+	Sha1   []byte
+	MD5    []byte
+	Sha256 []byte
+	Sha512 []byte
+	CRC32  []byte
+}
+
+func newGobRecord(f *api.FileInfo) gobRecord {
+	return gobRecord{f.Path, f.RelaPath, f.Mode, f.Size, f.ModTime, f.Link, f.Sha1, f.MD5, f.Sha256, f.Sha512, f.CRC32}
+}
+
+func (r *gobRecord) fileInfo() api.FileInfo {
+	return api.FileInfo{
+		Path:     r.Path,
+		RelaPath: r.RelaPath,
+		Mode:     r.Mode,
+		Size:     r.Size,
+		ModTime:  r.ModTime,
+		Link:     r.Link,
+		Sha1:     r.Sha1,
+		MD5:      r.MD5,
+		Sha256:   r.Sha256,
+		Sha512:   r.Sha512,
+		CRC32:    r.CRC32,
+	}
+}
+
 // Reads and writes a file structured like so
 // - version
 // - numEntries
@@ -26,10 +68,24 @@ const (
 type Gob struct {
 }
 
+func (g *Gob) KeptDigests() []string {
+	return allDigests
+}
+
 func (g *Gob) Extension() string {
 	return GobExtension
 }
 
+// Sniff returns true if the given data starts with our compressed header
+func (g *Gob) Sniff(head []byte) bool {
+	gzipReader, err := gzip.NewReader(bytes.NewReader(head))
+	if err != nil {
+		return false
+	}
+	fileVersion := 0
+	return gob.NewDecoder(gzipReader).Decode(&fileVersion) == nil && fileVersion >= 1 && fileVersion <= Version
+}
+
 func (g *Gob) Serialize(in <-chan api.FileInfo, writer io.Writer) (err error) {
 	gzipWriter, _ := gzip.NewWriterLevel(writer, 9)
 	defer gzipWriter.Close()
@@ -44,7 +100,7 @@ func (g *Gob) Serialize(in <-chan api.FileInfo, writer io.Writer) (err error) {
 	// NOTE: we re-encode to get rid of the map
 	for finfo := range in {
 		hashInfo(sha1enc, &finfo)
-		if err = encoder.Encode(&finfo); err != nil {
+		if err = encoder.Encode(newGobRecord(&finfo)); err != nil {
 			return
 		}
 	}
@@ -80,17 +136,18 @@ func (g *Gob) Deserialize(reader io.Reader, out chan<- api.FileInfo, predicate f
 	}
 
 	// Of course we would implement reading other formats too
-	if fileVersion != Version {
+	// Records of version 1 decode as well, as gob matches fields by name
+	if fileVersion < 1 || fileVersion > Version {
 		return &DecodeError{Msg: fmt.Sprintf("Cannot handle index file: invalid header version: %d", fileVersion)}
 	}
 
 	var readError error
 	for readError == nil {
 		// Yes - we need a fresh one every loop iteration ! Gob doesn't set fields which have the nil value
-		v := api.FileInfo{}
+		r := gobRecord{}
 
 		// If there is a type-mismatch, we are done reading values and proceed with final signature check
-		if readError = d.Decode(&v); readError != nil {
+		if readError = d.Decode(&r); readError != nil {
 			// Unfortunately, we can't really tell programmatically what happened - need to rely on string scanning :(
 			if strings.Contains(readError.Error(), "type mismatch in decoder") {
 				break
@@ -98,6 +155,7 @@ func (g *Gob) Deserialize(reader io.Reader, out chan<- api.FileInfo, predicate f
 				return fe(readError)
 			}
 		}
+		v := r.fileInfo()
 
 		// Have to hash it before we hand it to the predicate, as it might alter the data
 		hashInfo(sha1enc, &v)
@@ -0,0 +1,73 @@
+package codec
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha1"
+	"encoding/gob"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Byron/godi/api"
+	"github.com/Byron/godi/io"
+)
+
+func TestGob(t *testing.T) {
+	files := []api.FileInfo{
+		{Path: filepath.Join("tree", "file.mov"), RelaPath: "file.mov", Size: 1024, Mode: 0644, ModTime: time.Now(),
+			Sha1: bytes.Repeat([]byte{1}, 20), MD5: bytes.Repeat([]byte{2}, 16),
+			Sha256: bytes.Repeat([]byte{3}, 32), Seal: "other.gobz", Action: io.ActionOverwritten},
+		{Path: filepath.Join("tree", "link.mov"), RelaPath: "link.mov", Size: 1024, Mode: 0644, Link: "file.mov",
+			Sha1: bytes.Repeat([]byte{1}, 20), MD5: bytes.Repeat([]byte{2}, 16)},
+	}
+
+	c := &Gob{}
+	data := encodeSums(t, c, files)
+	decoded, err := decodeSums(c, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(decoded) != len(files) {
+		t.Fatalf("Expected %d files, got %d", len(files), len(decoded))
+	}
+	for i, f := range decoded {
+		want := files[i]
+		if f.Path != want.Path || f.RelaPath != want.RelaPath || f.Size != want.Size || f.Mode != want.Mode ||
+			f.Link != want.Link || !f.ModTime.Equal(want.ModTime) || !bytes.Equal(f.Sha1, want.Sha1) ||
+			!bytes.Equal(f.MD5, want.MD5) || !bytes.Equal(f.Sha256, want.Sha256) {
+			t.Errorf("File %d didn't survive the round-trip: %v", i, f)
+		}
+		// Only what the seal is about is written
+		if f.Seal != "" || f.Action != io.ActionCreated {
+			t.Errorf("File %d must not carry fields unrelated to the seal: %v", i, f)
+		}
+	}
+
+	// Seals of version 1 are still readable
+	old := bytes.Buffer{}
+	gzipWriter := gzip.NewWriter(&old)
+	encoder := gob.NewEncoder(gzipWriter)
+	sha1enc := sha1.New()
+	f := files[1]
+	f.Link = ""
+	hashInfo(sha1enc, &f)
+	encoder.Encode(1)
+	encoder.Encode(struct {
+		Path, RelaPath string
+		Size           int64
+		Sha1, MD5      []byte
+	}{f.Path, f.RelaPath, f.Size, f.Sha1, f.MD5})
+	encoder.Encode(true)
+	encoder.Encode(sha1enc.Sum(nil))
+	gzipWriter.Close()
+
+	if !c.Sniff(old.Bytes()) {
+		t.Error("Seals of version 1 must be recognized")
+	}
+	if decoded, err = decodeSums(c, old.Bytes()); err != nil {
+		t.Fatal(err)
+	} else if len(decoded) != 1 || decoded[0].RelaPath != "link.mov" || decoded[0].Size != 1024 {
+		t.Errorf("Unexpected files of version 1 seal: %v", decoded)
+	}
+}
@@ -0,0 +1,370 @@
+// Implements a compressed JSON Lines format, which can be read by any tool understanding JSON
+
+package codec
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/Byron/godi/api"
+)
+
+const (
+	JSONLName      = "jsonl"
+	JSONLExtension = "jsonl.gz"
+	JSONLVersion   = 1
+
+	jsonlTypeHeader    = "header"
+	jsonlTypeFile      = "file"
+	jsonlTypeSignature = "signature"
+)
+
+// The first record of the file. The algorithms are the digests every file record has
+type jsonlHeader struct {
+	Type       string   `json:"type"`
+	Version    int      `json:"version"`
+	Algorithms []string `json:"algorithms"`
+}
+
+// A record per file, with hashes in hexadecimal, the modification time in RFC3339 format, and the mode like
+// st_mode of POSIX, with the type in the bits of S_IFMT
+type jsonlFile struct {
+	Type   string `json:"type"`
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+	Mode   uint32 `json:"mode"`
+	MTime  string `json:"mtime,omitempty"`
+	Link   string `json:"link,omitempty"`
+	Sha1   string `json:"sha1,omitempty"`
+	MD5    string `json:"md5,omitempty"`
+	Sha256 string `json:"sha256,omitempty"`
+	Sha512 string `json:"sha512,omitempty"`
+	CRC32  string `json:"crc32,omitempty"`
+}
+
+// The bits of S_IFMT of POSIX, by the type of os.FileMode they stand for
+var posixTypes = []struct {
+	mode  os.FileMode
+	posix uint32
+}{
+	{os.ModeDir, 0040000},
+	{os.ModeSymlink, 0120000},
+	{os.ModeNamedPipe, 0010000},
+	{os.ModeSocket, 0140000},
+	{os.ModeDevice | os.ModeCharDevice, 0020000},
+	{os.ModeDevice, 0060000},
+}
+
+// Returns the given mode like st_mode of POSIX
+func posixMode(m os.FileMode) uint32 {
+	mode := uint32(m.Perm())
+	if m&os.ModeSetuid != 0 {
+		mode |= 04000
+	}
+	if m&os.ModeSetgid != 0 {
+		mode |= 02000
+	}
+	if m&os.ModeSticky != 0 {
+		mode |= 01000
+	}
+	for _, t := range posixTypes {
+		if m&t.mode == t.mode {
+			return mode | t.posix
+		}
+	}
+	return mode | 0100000
+}
+
+// The inverse of posixMode()
+func fileModeOf(mode uint32) os.FileMode {
+	m := os.FileMode(mode & 0777)
+	if mode&04000 != 0 {
+		m |= os.ModeSetuid
+	}
+	if mode&02000 != 0 {
+		m |= os.ModeSetgid
+	}
+	if mode&01000 != 0 {
+		m |= os.ModeSticky
+	}
+	for _, t := range posixTypes {
+		if mode&0170000 == t.posix {
+			return m | t.mode
+		}
+	}
+	return m
+}
+
+// Returns the names of the digests the given file has, in the order they are written
+func jsonlAlgorithms(f *api.FileInfo) (names []string) {
+	for _, d := range namedDigests(f) {
+		names = append(names, d.name)
+	}
+	return
+}
+
+// Like hashInfo(), but takes all digests of the file into account, as files may have any of them
+func hashJSONLInfo(sha1enc hash.Hash, f *api.FileInfo) {
+	sha1enc.Write([]byte(f.RelaPath))
+	sha1enc.Write([]byte(f.Path))
+	for _, d := range namedDigests(f) {
+		sha1enc.Write([]byte(d.name))
+		sha1enc.Write(d.digest)
+	}
+	sha1enc.Write([]byte(f.Link))
+}
+
+// The last record of the file, with the sha1 of all prior file records as computed by hashJSONLInfo()
+type jsonlSignature struct {
+	Type string `json:"type"`
+	Sha1 string `json:"sha1"`
+}
+
+// Any record, as read from the file
+type jsonlRecord struct {
+	jsonlFile
+	Version    int      `json:"version"`
+	Algorithms []string `json:"algorithms"`
+}
+
+func (r *jsonlFile) fromFileInfo(f *api.FileInfo) {
+	*r = jsonlFile{
+		Type: jsonlTypeFile,
+		Path: filepath.ToSlash(f.RelaPath),
+		Size: f.Size,
+		Mode: posixMode(f.Mode),
+		Link: filepath.ToSlash(f.Link),
+	}
+	if !f.ModTime.IsZero() {
+		r.MTime = f.ModTime.UTC().Format(time.RFC3339Nano)
+	}
+	if len(f.Sha1) > 0 {
+		r.Sha1 = hex.EncodeToString(f.Sha1)
+	}
+	if len(f.MD5) > 0 {
+		r.MD5 = hex.EncodeToString(f.MD5)
+	}
+	if len(f.Sha256) > 0 {
+		r.Sha256 = hex.EncodeToString(f.Sha256)
+	}
+	if len(f.Sha512) > 0 {
+		r.Sha512 = hex.EncodeToString(f.Sha512)
+	}
+	if len(f.CRC32) > 0 {
+		r.CRC32 = hex.EncodeToString(f.CRC32)
+	}
+}
+
+// Sets f to the file of this record
+func (r *jsonlFile) toFileInfo(f *api.FileInfo) (err error) {
+	if len(r.Path) == 0 {
+		return fmt.Errorf("Empty file path")
+	}
+	if r.Size < 0 {
+		return fmt.Errorf("size of '%s' must not be smaller than 0", r.Path)
+	}
+
+	*f = api.FileInfo{
+		RelaPath: filepath.FromSlash(r.Path),
+		Size:     r.Size,
+		Mode:     fileModeOf(r.Mode),
+		Link:     filepath.FromSlash(r.Link),
+	}
+	f.Path = f.RelaPath
+
+	if len(r.MTime) > 0 {
+		if f.ModTime, err = time.Parse(time.RFC3339Nano, r.MTime); err != nil {
+			return fmt.Errorf("Failed to parse modification time of '%s' with error: %s", r.Path, err)
+		}
+	}
+
+	for _, h := range []struct {
+		hex    string
+		digest *[]byte
+		size   int
+	}{
+		{r.Sha1, &f.Sha1, 20},
+		{r.MD5, &f.MD5, 16},
+		{r.Sha256, &f.Sha256, 32},
+		{r.Sha512, &f.Sha512, 64},
+		{r.CRC32, &f.CRC32, 4},
+	} {
+		if len(h.hex) == 0 {
+			continue
+		}
+		if err = parseDigest(h.hex, h.digest); err != nil {
+			return fmt.Errorf("%s of '%s'", err, r.Path)
+		}
+		if len(*h.digest) != h.size {
+			return fmt.Errorf("Invalid hash length in '%s'. Expected %d, got %d", r.Path, h.size, len(*h.digest))
+		}
+	}
+
+	if len(f.Sha1) == 0 && len(f.MD5) == 0 && len(f.Sha256) == 0 && len(f.Sha512) == 0 && len(f.CRC32) == 0 {
+		return fmt.Errorf("Didn't parse a single hash for file '%s'", r.Path)
+	}
+	return nil
+}
+
+// Reads and writes a gzip compressed file with one JSON record per line
+// - a header with version and the hash algorithms used for all files, which are the ones of the first file
+// - a record per file
+// - a signature, being the sha1 of all file information as computed by hashJSONLInfo()
+type JSONL struct {
+}
+
+func (j *JSONL) KeptDigests() []string {
+	return allDigests
+}
+
+func (j *JSONL) Extension() string {
+	return JSONLExtension
+}
+
+// Sniff returns true if the given data starts with our compressed header record
+func (j *JSONL) Sniff(head []byte) bool {
+	gzipReader, err := gzip.NewReader(bytes.NewReader(head))
+	if err != nil {
+		return false
+	}
+	line, err := bufio.NewReader(gzipReader).ReadBytes('\n')
+	if err != nil {
+		return false
+	}
+	rec := jsonlRecord{}
+	return json.Unmarshal(line, &rec) == nil && rec.Type == jsonlTypeHeader
+}
+
+func (j *JSONL) Serialize(in <-chan api.FileInfo, writer io.Writer) (err error) {
+	gzipWriter, _ := gzip.NewWriterLevel(writer, 9)
+	defer gzipWriter.Close()
+	// The encoder writes a newline after each record
+	enc := json.NewEncoder(gzipWriter)
+	sha1enc := sha1.New()
+
+	// Without files, the header lists the digests we always compute
+	first, ok := <-in
+	algorithms := []string{"sha1", "md5"}
+	if ok {
+		algorithms = jsonlAlgorithms(&first)
+	}
+	if err = enc.Encode(&jsonlHeader{jsonlTypeHeader, JSONLVersion, algorithms}); err != nil {
+		return
+	}
+
+	rec := jsonlFile{}
+	for ; ok; first, ok = <-in {
+		f := first
+		if names := jsonlAlgorithms(&f); strings.Join(names, ",") != strings.Join(algorithms, ",") {
+			return fmt.Errorf("File '%s' has the digests %s, yet all files must have the ones of the first file, %s",
+				f.RelaPath, strings.Join(names, ", "), strings.Join(algorithms, ", "))
+		}
+		// Like in MHL, there is no room for absolute paths
+		f.Path = f.RelaPath
+		hashJSONLInfo(sha1enc, &f)
+		rec.fromFileInfo(&f)
+		if err = enc.Encode(&rec); err != nil {
+			return
+		}
+	}
+
+	return enc.Encode(&jsonlSignature{jsonlTypeSignature, hex.EncodeToString(sha1enc.Sum(nil))})
+}
+
+func (j *JSONL) Deserialize(reader io.Reader, out chan<- api.FileInfo, predicate func(*api.FileInfo) bool) error {
+	gzipReader, err := gzip.NewReader(reader)
+	if err != nil {
+		return &DecodeError{Msg: err.Error()}
+	}
+	// Lines are as long as the paths they contain, which is why we don't use a Scanner
+	lines := bufio.NewReader(gzipReader)
+	sha1enc := sha1.New()
+
+	var signature []byte
+	var header *jsonlRecord
+	for lineNum := 1; ; lineNum++ {
+		line, rerr := lines.ReadBytes('\n')
+		if rerr != nil && rerr != io.EOF {
+			return &DecodeError{Msg: rerr.Error()}
+		}
+		if len(bytes.TrimSpace(line)) == 0 {
+			if rerr == io.EOF {
+				break
+			}
+			continue
+		}
+		fe := func(msg string) error {
+			return &DecodeError{Msg: fmt.Sprintf("Line %d: %s", lineNum, msg)}
+		}
+		if signature != nil {
+			return fe("Unexpected record after signature")
+		}
+
+		rec := jsonlRecord{}
+		if err := json.Unmarshal(line, &rec); err != nil {
+			return fe(err.Error())
+		}
+
+		if header == nil {
+			if rec.Type != jsonlTypeHeader {
+				return fe(fmt.Sprintf("Expected header record, got '%s'", rec.Type))
+			}
+			if rec.Version != JSONLVersion {
+				return fe(fmt.Sprintf("Cannot handle index file: invalid header version: %d", rec.Version))
+			}
+			header = &rec
+			continue
+		}
+
+		switch rec.Type {
+		case jsonlTypeFile:
+			f := api.FileInfo{}
+			if err := rec.toFileInfo(&f); err != nil {
+				return fe(err.Error())
+			}
+			names := strings.Join(jsonlAlgorithms(&f), ",")
+			for _, name := range header.Algorithms {
+				if !strings.Contains(","+names+",", ","+name+",") {
+					return fe(fmt.Sprintf("File '%s' lacks the %s digest listed in the header", rec.Path, name))
+				}
+			}
+			// Have to hash it before we hand it to the predicate, as it might alter the data
+			hashJSONLInfo(sha1enc, &f)
+			if !predicate(&f) {
+				return nil
+			}
+			out <- f
+		case jsonlTypeSignature:
+			if signature, err = hex.DecodeString(rec.Sha1); err != nil || len(signature) == 0 {
+				return fe(fmt.Sprintf("Invalid signature format: %s", rec.Sha1))
+			}
+		case jsonlTypeHeader:
+			return fe("Unexpected second header")
+		default:
+			return fe(fmt.Sprintf("Unknown record type '%s'", rec.Type))
+		}
+
+		if rerr == io.EOF {
+			break
+		}
+	}
+
+	if signature == nil {
+		return &DecodeError{Msg: "Didn't find a signature - the seal is incomplete"}
+	}
+	if !bytes.Equal(signature, sha1enc.Sum(nil)) {
+		return &SignatureMismatchError{}
+	}
+	return nil
+}
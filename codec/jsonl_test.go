@@ -0,0 +1,138 @@
+package codec
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Byron/godi/api"
+)
+
+func TestJSONL(t *testing.T) {
+	files := []api.FileInfo{
+		{RelaPath: "file.mov", Size: 1024, Mode: 0644, ModTime: time.Now(),
+			Sha1: bytes.Repeat([]byte{1}, 20), MD5: bytes.Repeat([]byte{2}, 16)},
+		{RelaPath: filepath.Join("dir", "link"), Size: 5, Mode: os.ModeSymlink | 0777,
+			Sha1: bytes.Repeat([]byte{3}, 20), MD5: bytes.Repeat([]byte{4}, 16)},
+		{RelaPath: filepath.Join("dir", "hardlink.mov"), Size: 1024, Mode: 0644, Link: "file.mov",
+			Sha1: bytes.Repeat([]byte{1}, 20), MD5: bytes.Repeat([]byte{2}, 16)},
+	}
+
+	c := NewByName(JSONLName)
+	if c == nil || NewByPath(filepath.Join("tree", "godi_2014-07-30_102259."+c.Extension())) == nil {
+		t.Fatal("JSONL must be available by name and path")
+	}
+
+	data := encodeSums(t, c, files)
+	decoded, err := decodeSums(c, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(decoded) != len(files) {
+		t.Fatalf("Expected %d files, got %d", len(files), len(decoded))
+	}
+	for i, f := range decoded {
+		want := files[i]
+		if f.RelaPath != want.RelaPath || f.Size != want.Size || f.Mode != want.Mode || f.Link != want.Link ||
+			!f.ModTime.Equal(want.ModTime) || !bytes.Equal(f.Sha1, want.Sha1) || !bytes.Equal(f.MD5, want.MD5) {
+			t.Errorf("File %d didn't survive the round-trip: %v", i, f)
+		}
+	}
+
+	// It's JSON Lines after all
+	gzipReader, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	text, _ := ioutil.ReadAll(gzipReader)
+	lines := strings.Split(strings.TrimSpace(string(text)), "\n")
+	if len(lines) != len(files)+2 || !strings.Contains(lines[0], `"header"`) || !strings.Contains(lines[len(lines)-1], `"signature"`) {
+		t.Errorf("Unexpected records: %s", text)
+	}
+	if !strings.Contains(lines[0], `"algorithms":["sha1","md5"]`) {
+		t.Errorf("The header must list the digests of the files, got %s", lines[0])
+	}
+	// Modes are like st_mode, 0100644 and 0120777
+	if !strings.Contains(lines[1], `"mode":33188`) || !strings.Contains(lines[2], `"mode":41471`) {
+		t.Errorf("Modes must be stored like st_mode, got %s", text)
+	}
+
+	compress := func(text string) []byte {
+		w := bytes.Buffer{}
+		gzipWriter := gzip.NewWriter(&w)
+		gzipWriter.Write([]byte(text))
+		gzipWriter.Close()
+		return w.Bytes()
+	}
+
+	// Modifications are detected
+	tampered := strings.Replace(string(text), `"size":1024`, `"size":1025`, 1)
+	tampered = strings.Replace(tampered, "file.mov", "other.mov", 1)
+	if _, err = decodeSums(c, compress(tampered)); err == nil {
+		t.Error("Modified seal must not be accepted")
+	} else if _, ok := err.(*SignatureMismatchError); !ok {
+		t.Errorf("Expected signature mismatch, got %v", err)
+	}
+
+	// Records are found after blank lines, but there is only one header
+	if _, err = decodeSums(c, compress("\n"+string(text))); err != nil {
+		t.Error(err)
+	}
+	twoHeaders := strings.Join(append([]string{lines[0]}, lines...), "\n")
+	if _, err = decodeSums(c, compress(twoHeaders)); err == nil {
+		t.Error("A second header must not be accepted")
+	}
+
+	original := string(text)
+
+	// Files have the digests listed in the header, which are the ones of the first file
+	sha256Files := make([]api.FileInfo, len(files))
+	copy(sha256Files, files)
+	for i := range sha256Files {
+		sha256Files[i].Sha256 = bytes.Repeat([]byte{5}, 32)
+	}
+	gzipReader, _ = gzip.NewReader(bytes.NewReader(encodeSums(t, c, sha256Files)))
+	if text, _ = ioutil.ReadAll(gzipReader); !strings.Contains(string(text), `"algorithms":["sha1","md5","sha256"]`) {
+		t.Errorf("The header must list the sha256 digest, got %s", text)
+	}
+	sha256Files[1].Sha256 = nil
+	fic := make(chan api.FileInfo, len(sha256Files))
+	for _, f := range sha256Files {
+		fic <- f
+	}
+	close(fic)
+	if err = c.Serialize(fic, ioutil.Discard); err == nil {
+		t.Error("Files with other digests than the first one must not be written")
+	}
+	missing := strings.Replace(original, `"sha1":"`+strings.Repeat("03", 20)+`",`, "", 1)
+	if _, err = decodeSums(c, compress(missing)); err == nil {
+		t.Error("Files lacking a digest listed in the header must not be accepted")
+	}
+
+	// All digests are signed, even if files only have those which aren't always computed
+	sha256Only := []api.FileInfo{{RelaPath: "file.mov", Size: 1024, Mode: 0644, Sha256: bytes.Repeat([]byte{5}, 32)}}
+	gzipReader, _ = gzip.NewReader(bytes.NewReader(encodeSums(t, c, sha256Only)))
+	text, _ = ioutil.ReadAll(gzipReader)
+	if _, err = decodeSums(c, compress(string(text))); err != nil {
+		t.Error(err)
+	}
+	tampered = strings.Replace(string(text), strings.Repeat("05", 32), strings.Repeat("06", 32), 1)
+	if _, err = decodeSums(c, compress(tampered)); err == nil {
+		t.Error("Modified sha256 digest must not be accepted")
+	} else if _, ok := err.(*SignatureMismatchError); !ok {
+		t.Errorf("Expected signature mismatch, got %v", err)
+	}
+
+	// As well as truncated files
+	truncated := strings.Join(lines[:len(lines)-1], "\n")
+	if _, err = decodeSums(c, compress(truncated)); err == nil {
+		t.Error("Seal without signature must not be accepted")
+	} else if _, ok := err.(*DecodeError); !ok {
+		t.Errorf("Expected decode error, got %v", err)
+	}
+}
@@ -10,6 +10,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"time"
 
 	"github.com/Byron/godi/api"
 )
@@ -36,9 +37,10 @@ type mhlHash struct {
 	XMLName xml.Name `xml:"hash"`
 	File    string   `xml:"file"`
 	Size    int64    `xml:"size"`
-	// MTimeString string `xml:"lastmodificationdate"`
-	Sha1 string `xml:"sha1"`
-	Md5  string `xml:"md5"`
+	// Only read, as written by other tools
+	MTimeString string `xml:"lastmodificationdate,omitempty"`
+	Sha1        string `xml:"sha1"`
+	Md5         string `xml:"md5"`
 	// HashDate    string `xml:"hashdate"`
 }
 
@@ -65,6 +67,15 @@ func (h *mhlHash) toFileInfo(f *api.FileInfo) error {
 	}
 	f.Size = h.Size
 
+	f.ModTime = time.Time{}
+	if len(h.MTimeString) > 0 {
+		mtime, err := time.Parse(time.RFC3339, h.MTimeString)
+		if err != nil {
+			return fmt.Errorf("Failed to parse modification time of '%s' with error: %s", h.File, err.Error())
+		}
+		f.ModTime = mtime
+	}
+
 	if len(h.Md5) > 0 {
 		if md5, err := hex.DecodeString(h.Md5); err != nil {
 			return fmt.Errorf("Failed to parse MD5 hash of '%s' with error: %s", h.File, err.Error())
@@ -111,8 +122,11 @@ func (m *MHL) Serialize(in <-chan api.FileInfo, writer io.Writer) (err error) {
 
 	h := mhlHash{}
 	for fi := range in {
-		// Have to flatten the Path - after all, mhl has no support for absolute paths
+		// Have to flatten the Path - after all, mhl has no support for absolute paths, nor for hard links
 		fi.Path = fi.RelaPath
+		fi.Link = ""
+		// Only sign what we keep, as other formats may have needed more digests
+		fi.Sha256, fi.Sha512, fi.CRC32 = nil, nil, nil
 		hashInfo(sha1enc, &fi)
 		h.fromFileInfo(&fi)
 		hl.HashInfo = append(hl.HashInfo, h)
@@ -171,6 +185,11 @@ func (m *MHL) Deserialize(reader io.Reader, out chan<- api.FileInfo, predicate f
 	return nil
 }
 
+// Sniff returns true if the given data contains the root element of a media hash list
+func (m *MHL) Sniff(head []byte) bool {
+	return bytes.Contains(head, []byte("<hashlist"))
+}
+
 func (m *MHL) Extension() string {
 	return MHLExtension
 }
@@ -0,0 +1,180 @@
+package codec
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	gio "github.com/Byron/godi/io"
+)
+
+// The amount of bytes at the beginning of a file we hand to Sniffers
+const sniffLen = 4096
+
+// Sniffer may be implemented by codecs which can recognize their seals by content, which allows to find the
+// right codec even if the extension of a seal is unknown or used by multiple codecs.
+type Sniffer interface {
+	// Sniff returns true if the given beginning of a file looks like one of our seals.
+	// It may be shorter than the file, and cut off anywhere.
+	Sniff(head []byte) bool
+}
+
+type registration struct {
+	name, extension string
+	factory         func() Codec
+}
+
+var (
+	registry     []registration
+	registryLock sync.Mutex
+)
+
+func init() {
+	Register(GobName, GobExtension, func() Codec { return &Gob{} })
+	Register(MHLName, MHLExtension, func() Codec { return &MHL{} })
+	Register(JSONLName, JSONLExtension, func() Codec { return &JSONL{} })
+	Register(MD5SumName, MD5SumExtension, func() Codec { return &Sums{sumMD5} })
+	Register(Sha1SumName, Sha1SumExtension, func() Codec { return &Sums{sumSha1} })
+	Register(Sha256SumName, Sha256SumExtension, func() Codec { return &Sums{sumSha256} })
+	Register(SFVName, SFVExtension, func() Codec { return &Sums{sumCRC32} })
+}
+
+// Register makes a codec available by the given name, and for seal files with the given extension, which
+// is given without leading '.' and may have multiple components, like 'jsonl.gz'.
+// The factory must return a new instance of the codec each time it is called.
+// Multiple codecs may share an extension, which is when content sniffing decides, see Sniffer.
+// It panics if the name is already taken, and is usually called from an init function.
+func Register(name, extension string, factory func() Codec) {
+	if len(name) == 0 || len(extension) == 0 || strings.HasPrefix(extension, ".") || factory == nil {
+		panic(fmt.Sprintf("Invalid registration of codec '%s' with extension '%s'", name, extension))
+	}
+
+	registryLock.Lock()
+	defer registryLock.Unlock()
+	for _, r := range registry {
+		if r.name == name {
+			panic(fmt.Sprintf("Codec '%s' is already registered", name))
+		}
+	}
+	registry = append(registry, registration{name, extension, factory})
+}
+
+// Returns a copy of all registrations, in order
+func registrations() []registration {
+	registryLock.Lock()
+	defer registryLock.Unlock()
+	res := make([]registration, len(registry))
+	copy(res, registry)
+	return res
+}
+
+// Names returns the names of all registered codecs, in order of registration
+func Names() []string {
+	regs := registrations()
+	names := make([]string, len(regs))
+	for i, r := range regs {
+		names[i] = r.name
+	}
+	return names
+}
+
+// Find a codec matching the given name, and return it. Retuns nil otherwise
+func NewByName(name string) Codec {
+	for _, r := range registrations() {
+		if r.name == name {
+			return r.factory()
+		}
+	}
+	return nil
+}
+
+// Returns the registrations with the longest extension matching the given path, in order of registration
+func extensionCandidates(regs []registration, path string) (candidates []registration) {
+	for _, r := range regs {
+		if !strings.HasSuffix(path, "."+r.extension) {
+			continue
+		}
+		if len(candidates) > 0 && len(r.extension) < len(candidates[0].extension) {
+			continue
+		}
+		if len(candidates) > 0 && len(r.extension) > len(candidates[0].extension) {
+			candidates = candidates[:0]
+		}
+		candidates = append(candidates, r)
+	}
+	return
+}
+
+// Finds a codec which can decode the file at the given path.
+// The codec with the longest matching extension is used, without reading the file. Only if the extension is
+// unknown, or used by multiple codecs, the beginning of the file is presented to all codecs implementing Sniffer.
+// Returns nil if there is no suitable codec. Use NewByExtension() to tell seals from other files.
+func NewByPath(path string) Codec {
+	// BagIt manifests are identified by their entire name
+	if c := newBagItManifestByName(filepath.Base(path)); c != nil {
+		return c
+	}
+
+	// Encrypted seals have a header which tells the format they wrap
+	if strings.HasSuffix(path, "."+EncryptedExtension) {
+		return newEncryptedByHead(path, readHead(path))
+	}
+
+	regs := registrations()
+	candidates := extensionCandidates(regs, path)
+	if len(candidates) == 1 {
+		return candidates[0].factory()
+	}
+
+	// Let the content decide
+	head := readHead(path)
+	knownExtension := len(candidates) > 0
+	if !knownExtension {
+		if c := newEncryptedByHead(path, head); c != nil {
+			return c
+		}
+		candidates = regs
+	}
+	if len(head) > 0 {
+		for _, r := range candidates {
+			c := r.factory()
+			if s, ok := c.(Sniffer); ok && s.Sniff(head) {
+				return c
+			}
+		}
+	}
+
+	// The extension matches, so we use the codec registered first
+	if knownExtension {
+		return candidates[0].factory()
+	}
+	return nil
+}
+
+// NewByExtension is like NewByPath(), but returns nil without reading the file if its name isn't the one of
+// a seal, which is when it could also be a file that merely looks like one
+func NewByExtension(path string) Codec {
+	if newBagItManifestByName(filepath.Base(path)) == nil && !strings.HasSuffix(path, "."+EncryptedExtension) &&
+		len(extensionCandidates(registrations(), path)) == 0 {
+		return nil
+	}
+	return NewByPath(path)
+}
+
+// Returns the beginning of the file at path, or nil if it can't be read
+func readHead(path string) []byte {
+	fd, err := gio.Open(path)
+	if err != nil {
+		return nil
+	}
+	defer fd.Close()
+
+	head := make([]byte, sniffLen)
+	n, err := io.ReadFull(fd, head)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return nil
+	}
+	return head[:n]
+}
@@ -0,0 +1,99 @@
+package codec
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/Byron/godi/api"
+)
+
+// A codec which shares its extension with sha1sum, and recognizes its seals by a marker
+type markedSums struct {
+	Sums
+}
+
+const testMarker = "#marked\n"
+
+func (m *markedSums) Sniff(head []byte) bool {
+	return bytes.HasPrefix(head, []byte(testMarker))
+}
+
+func TestRegistry(t *testing.T) {
+	const name = "marked"
+	Register(name, Sha1SumExtension, func() Codec { return &markedSums{Sums{sumSha1}} })
+
+	names := Names()
+	if names[0] != GobName || names[len(names)-1] != name {
+		t.Fatalf("Names must be in order of registration, got %v", names)
+	}
+	if _, ok := NewByName(name).(*markedSums); !ok {
+		t.Fatal("Registered codec must be available by name")
+	}
+
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Error("Registering a name twice must panic")
+			}
+		}()
+		Register(GobName, "other", func() Codec { return &Gob{} })
+	}()
+
+	dir, err := ioutil.TempDir("", "godi-registry")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := []api.FileInfo{{RelaPath: "file", Path: "file", Size: 5,
+		Sha1: bytes.Repeat([]byte{1}, 20), MD5: bytes.Repeat([]byte{2}, 16),
+		Sha256: bytes.Repeat([]byte{3}, 32), CRC32: bytes.Repeat([]byte{4}, 4)}}
+	write := func(c Codec, name string, prefix string) string {
+		path := filepath.Join(dir, name)
+		data := append([]byte(prefix), encodeSums(t, c, files)...)
+		if err := ioutil.WriteFile(path, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	for _, tc := range []struct {
+		path string
+		want Codec
+	}{
+		// The extension is enough
+		{write(&Gob{}, "seal.gobz", ""), &Gob{}},
+		// Shared extensions are resolved by content, falling back to the first registration
+		{write(&Sums{sumSha1}, "marked.sha1", testMarker), &markedSums{Sums{sumSha1}}},
+		{write(&Sums{sumSha1}, "plain.sha1", ""), &Sums{sumSha1}},
+		// Unknown extensions are resolved by content only
+		{write(&Gob{}, "seal.bin", ""), &Gob{}},
+		{write(&MHL{}, "seal.xml", ""), &MHL{}},
+		{write(&JSONL{}, "seal.json.gz", ""), &JSONL{}},
+		{write(&Sums{sumSha256}, "SHA256SUMS", ""), &Sums{sumSha256}},
+		{write(&Sums{sumCRC32}, "seal.txt", ""), &Sums{sumCRC32}},
+		{filepath.Join(dir, "missing.bin"), nil},
+	} {
+		if c := NewByPath(tc.path); !reflect.DeepEqual(c, tc.want) {
+			t.Errorf("Expected codec %#v for '%s', got %#v", tc.want, filepath.Base(tc.path), c)
+		}
+	}
+
+	// Known extensions are trusted without reading the file, while unknown ones never make a seal
+	for _, tc := range []struct {
+		path string
+		want Codec
+	}{
+		{filepath.Join(dir, "missing.gobz"), &Gob{}},
+		{write(&Sums{sumMD5}, "checksums.txt", ""), nil},
+		{write(&Sums{sumMD5}, "seal.md5", ""), &Sums{sumMD5}},
+	} {
+		if c := NewByExtension(tc.path); !reflect.DeepEqual(c, tc.want) {
+			t.Errorf("Expected codec %#v for '%s', got %#v", tc.want, filepath.Base(tc.path), c)
+		}
+	}
+}
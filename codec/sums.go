@@ -0,0 +1,295 @@
+// Implements the plain-text checksum lists as written by GNU coreutils md5sum, sha1sum and sha256sum,
+// as well as simple file verification (SFV) files based on CRC32.
+
+package codec
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+
+	"github.com/Byron/godi/api"
+)
+
+const (
+	MD5SumName         = "md5sum"
+	MD5SumExtension    = "md5"
+	Sha1SumName        = "sha1sum"
+	Sha1SumExtension   = "sha1"
+	Sha256SumName      = "sha256sum"
+	Sha256SumExtension = "sha256"
+	SFVName            = "sfv"
+	SFVExtension       = "sfv"
+
+	// Only used by BagIt manifests, as there is no sha512sum codec
+	sha512SumExtension = "sha512"
+)
+
+// Identifies the hash stored in a checksum list
+type sumKind uint8
+
+const (
+	sumMD5 sumKind = iota
+	sumSha1
+	sumSha256
+	sumCRC32
+	// Only used by BagIt manifests
+	sumSha512
+)
+
+// Sums reads and writes checksum lists which contain one hash per file, but no size, modification time or signature.
+// Use NewByName() or NewByPath() to obtain an instance.
+// - md5sum, sha1sum, sha256sum: lines like '<hex>  <path>', as understood by 'md5sum -c' and friends
+// - sfv: lines like '<path> <CRC32>', and comments starting with ';'
+type Sums struct {
+	kind sumKind
+}
+
+func (s *Sums) Extension() string {
+	switch s.kind {
+	case sumMD5:
+		return MD5SumExtension
+	case sumSha1:
+		return Sha1SumExtension
+	case sumSha256:
+		return Sha256SumExtension
+	case sumSha512:
+		return sha512SumExtension
+	}
+	return SFVExtension
+}
+
+func (s *Sums) Signed() bool {
+	return false
+}
+
+func (s *Sums) HasSizes() bool {
+	return false
+}
+
+func (s *Sums) Digests() api.Digests {
+	switch s.kind {
+	case sumSha256:
+		return api.DigestSha256
+	case sumSha512:
+		return api.DigestSha512
+	case sumCRC32:
+		return api.DigestCRC32
+	}
+	return 0
+}
+
+func (s *Sums) KeptDigests() []string {
+	switch s.kind {
+	case sumMD5:
+		return []string{"md5"}
+	case sumSha1:
+		return []string{"sha1"}
+	case sumSha256:
+		return []string{"sha256"}
+	case sumSha512:
+		return []string{"sha512"}
+	}
+	return []string{"crc32"}
+}
+
+// Sniff returns true if the first entry of the given data looks like one of ours.
+// As lists only differ by the length of their hashes, they can be told apart reliably.
+func (s *Sums) Sniff(head []byte) bool {
+	for _, line := range strings.Split(string(head), "\n") {
+		line = strings.TrimSuffix(line, "\r")
+		if len(line) == 0 || (s.kind == sumCRC32 && strings.HasPrefix(line, ";")) {
+			continue
+		}
+		f := api.FileInfo{}
+		if s.kind == sumCRC32 {
+			return s.parseSFV(line, &f) == nil
+		}
+		return s.parseSum(line, &f) == nil
+	}
+	return false
+}
+
+// Returns the field of the given file keeping the hash we store, and the length of the hash in bytes
+func (s *Sums) digest(f *api.FileInfo) (*[]byte, int) {
+	switch s.kind {
+	case sumMD5:
+		return &f.MD5, 16
+	case sumSha1:
+		return &f.Sha1, 20
+	case sumSha256:
+		return &f.Sha256, 32
+	case sumSha512:
+		return &f.Sha512, 64
+	}
+	return &f.CRC32, 4
+}
+
+func (s *Sums) Serialize(in <-chan api.FileInfo, writer io.Writer) (err error) {
+	w := bufio.NewWriter(writer)
+	if s.kind == sumCRC32 {
+		if _, err = w.WriteString("; Generated by godi\n"); err != nil {
+			return
+		}
+	}
+
+	for f := range in {
+		path := filepath.ToSlash(f.RelaPath)
+		digest, size := s.digest(&f)
+		if len(*digest) != size {
+			return fmt.Errorf("Missing %s hash of file '%s'", s.Extension(), f.RelaPath)
+		}
+
+		if s.kind == sumCRC32 {
+			if strings.ContainsAny(path, "\r\n") {
+				return fmt.Errorf("File '%s' cannot be stored in an SFV file as its name contains a line break", f.RelaPath)
+			}
+			_, err = fmt.Fprintf(w, "%s %X\n", path, *digest)
+		} else {
+			// Like coreutils, we escape problematic paths and mark the line accordingly
+			prefix := ""
+			if strings.ContainsAny(path, "\\\n") {
+				prefix = "\\"
+				path = strings.Replace(path, "\\", "\\\\", -1)
+				path = strings.Replace(path, "\n", "\\n", -1)
+			}
+			_, err = fmt.Fprintf(w, "%s%x  %s\n", prefix, *digest, path)
+		}
+		if err != nil {
+			return
+		}
+	}
+
+	return w.Flush()
+}
+
+func (s *Sums) Deserialize(reader io.Reader, out chan<- api.FileInfo, predicate func(*api.FileInfo) bool) error {
+	scanner := bufio.NewScanner(reader)
+	numFiles := 0
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSuffix(scanner.Text(), "\r")
+		if len(line) == 0 || (s.kind == sumCRC32 && strings.HasPrefix(line, ";")) {
+			continue
+		}
+
+		f := api.FileInfo{}
+		var err error
+		if s.kind == sumCRC32 {
+			err = s.parseSFV(line, &f)
+		} else {
+			err = s.parseSum(line, &f)
+		}
+		if err == nil {
+			err = checkRelaPath(f.RelaPath)
+		}
+		if err != nil {
+			return &DecodeError{Msg: fmt.Sprintf("Line %d: %s", lineNum, err.Error())}
+		}
+
+		f.RelaPath = filepath.FromSlash(f.RelaPath)
+		f.Path = f.RelaPath
+		numFiles += 1
+		if !predicate(&f) {
+			return nil
+		}
+		out <- f
+	}
+
+	if err := scanner.Err(); err != nil {
+		return &DecodeError{Msg: err.Error()}
+	}
+	if numFiles == 0 {
+		return &DecodeError{Msg: "Didn't find a single hash in checksum file"}
+	}
+	return nil
+}
+
+// Parses a line like '<hex> <mode><path>', where mode is ' ' for text or '*' for binary
+func (s *Sums) parseSum(line string, f *api.FileInfo) error {
+	escaped := strings.HasPrefix(line, "\\")
+	if escaped {
+		line = line[1:]
+	}
+
+	digest, size := s.digest(f)
+	if len(line) < 2*size+3 || line[2*size] != ' ' || (line[2*size+1] != ' ' && line[2*size+1] != '*') {
+		return fmt.Errorf("Expected '<%s>  <path>', got '%s'", s.Extension(), line)
+	}
+	if err := parseDigest(line[:2*size], digest); err != nil {
+		return err
+	}
+
+	f.RelaPath = line[2*size+2:]
+	if escaped {
+		var err error
+		if f.RelaPath, err = unescapePath(f.RelaPath); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Parses a line like '<path> <CRC32>'
+func (s *Sums) parseSFV(line string, f *api.FileInfo) error {
+	sep := strings.LastIndex(line, " ")
+	if sep < 1 {
+		return fmt.Errorf("Expected '<path> <CRC32>', got '%s'", line)
+	}
+	f.RelaPath = strings.TrimRight(line[:sep], " ")
+	if len(line)-sep-1 != 8 {
+		return fmt.Errorf("Invalid CRC32 of '%s': '%s'", f.RelaPath, line[sep+1:])
+	}
+	return parseDigest(line[sep+1:], &f.CRC32)
+}
+
+func parseDigest(h string, digest *[]byte) error {
+	b, err := hex.DecodeString(h)
+	if err != nil {
+		return fmt.Errorf("Invalid hash '%s': %s", h, err)
+	}
+	*digest = b
+	return nil
+}
+
+// Resolves the escape sequences written by coreutils for paths containing backslashes or newlines
+func unescapePath(path string) (string, error) {
+	res := make([]byte, 0, len(path))
+	for i := 0; i < len(path); i++ {
+		if path[i] != '\\' {
+			res = append(res, path[i])
+			continue
+		}
+		i += 1
+		if i == len(path) {
+			return "", fmt.Errorf("Unterminated escape sequence in '%s'", path)
+		}
+		switch path[i] {
+		case '\\':
+			res = append(res, '\\')
+		case 'n':
+			res = append(res, '\n')
+		default:
+			return "", fmt.Errorf("Invalid escape sequence '\\%c' in '%s'", path[i], path)
+		}
+	}
+	return string(res), nil
+}
+
+// Makes sure the path doesn't point outside of the directory containing the checksum file
+func checkRelaPath(path string) error {
+	if len(path) == 0 {
+		return fmt.Errorf("Empty file path")
+	}
+	if strings.HasPrefix(path, "/") || filepath.IsAbs(filepath.FromSlash(path)) {
+		return fmt.Errorf("Absolute paths are not supported, got '%s'", path)
+	}
+	for _, c := range strings.Split(path, "/") {
+		if c == ".." {
+			return fmt.Errorf("Paths must not point outside of the sealed directory, got '%s'", path)
+		}
+	}
+	return nil
+}
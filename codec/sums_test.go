@@ -0,0 +1,130 @@
+package codec
+
+import (
+	"bytes"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Byron/godi/api"
+)
+
+// Serializes the given files with c, and returns the result
+func encodeSums(t *testing.T, c Codec, files []api.FileInfo) []byte {
+	fic := make(chan api.FileInfo, len(files))
+	for _, f := range files {
+		fic <- f
+	}
+	close(fic)
+
+	w := bytes.Buffer{}
+	if err := c.Serialize(fic, &w); err != nil {
+		t.Fatal(err)
+	}
+	t.Log(w.String())
+	return w.Bytes()
+}
+
+// Deserializes all files from the given data
+func decodeSums(c Codec, data []byte) ([]api.FileInfo, error) {
+	fic := make(chan api.FileInfo)
+	var err error
+	go func() {
+		err = c.Deserialize(bytes.NewReader(data), fic, func(f *api.FileInfo) bool { return true })
+		close(fic)
+	}()
+
+	var files []api.FileInfo
+	for f := range fic {
+		files = append(files, f)
+	}
+	return files, err
+}
+
+func TestSumsRoundTrip(t *testing.T) {
+	files := []api.FileInfo{
+		{RelaPath: "file.mov", Sha1: bytes.Repeat([]byte{1}, 20), MD5: bytes.Repeat([]byte{2}, 16),
+			Sha256: bytes.Repeat([]byte{3}, 32), CRC32: []byte{0xde, 0xad, 0xbe, 0xef}},
+		{RelaPath: filepath.Join("dir", "with space"), Sha1: bytes.Repeat([]byte{4}, 20), MD5: bytes.Repeat([]byte{5}, 16),
+			Sha256: bytes.Repeat([]byte{6}, 32), CRC32: []byte{0, 1, 2, 3}},
+	}
+
+	for _, name := range []string{MD5SumName, Sha1SumName, Sha256SumName, SFVName} {
+		c := NewByName(name)
+		if c == nil || NewByPath("godi."+c.Extension()) == nil {
+			t.Fatalf("Codec %s must be available by name and path", name)
+		}
+		if IsSigned(c) || HasSizes(c) {
+			t.Errorf("%s can't be signed or store sizes", name)
+		}
+
+		decoded, err := decodeSums(c, encodeSums(t, c, files))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(decoded) != len(files) {
+			t.Fatalf("%s: expected %d files, got %d", name, len(files), len(decoded))
+		}
+		for i := range files {
+			want, _ := c.(*Sums).digest(&files[i])
+			got, _ := c.(*Sums).digest(&decoded[i])
+			if decoded[i].RelaPath != files[i].RelaPath || !bytes.Equal(*want, *got) {
+				t.Errorf("%s: file %d didn't survive the round-trip: %v", name, i, decoded[i])
+			}
+		}
+	}
+
+	// Errors of BagIt manifests name the hash they use
+	if _, err := decodeSums(&Sums{kind: sumSha512}, []byte("nothex  file")); err == nil || !strings.Contains(err.Error(), "sha512") {
+		t.Errorf("Expected an error mentioning sha512, got %v", err)
+	}
+
+	if DigestsOf(NewByName(Sha256SumName)) != api.DigestSha256 || DigestsOf(NewByName(GobName)) != 0 {
+		t.Error("Codecs must request the digests they store")
+	}
+}
+
+func TestSumsDecode(t *testing.T) {
+	c := NewByName(MD5SumName)
+	files, err := decodeSums(c, []byte(
+		"d41d8cd98f00b204e9800998ecf8427e  empty\r\n"+
+			"d41d8cd98f00b204e9800998ecf8427e *binary/file\n"+
+			"\\d41d8cd98f00b204e9800998ecf8427e  back\\\\slash\\nnewline\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 3 || files[1].RelaPath != filepath.FromSlash("binary/file") || files[2].RelaPath != "back\\slash\nnewline" {
+		t.Errorf("Unexpected decoded files: %v", files)
+	}
+
+	// Escaped paths must survive the round-trip
+	if decoded, err := decodeSums(c, encodeSums(t, c, files)); err != nil || decoded[2].RelaPath != files[2].RelaPath {
+		t.Errorf("Escaped path didn't survive the round-trip: %v, %v", decoded, err)
+	}
+
+	for _, invalid := range []string{
+		"",
+		"d41d8cd98f00b204e9800998ecf8427e",
+		"d41d8cd98f00b204e9800998ecf8427  short",
+		"x41d8cd98f00b204e9800998ecf8427e  nothex",
+		"d41d8cd98f00b204e9800998ecf8427e  /absolute",
+		"d41d8cd98f00b204e9800998ecf8427e  ../outside",
+	} {
+		if _, err := decodeSums(c, []byte(invalid)); err == nil {
+			t.Errorf("Should have failed to decode '%s'", invalid)
+		} else if _, ok := err.(*DecodeError); !ok {
+			t.Errorf("Expected DecodeError, got %v", err)
+		}
+	}
+
+	files, err = decodeSums(NewByName(SFVName), []byte("; comment\nsome file.ext DEADBEEF\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || files[0].RelaPath != "some file.ext" || !bytes.Equal(files[0].CRC32, []byte{0xde, 0xad, 0xbe, 0xef}) {
+		t.Errorf("Unexpected decoded SFV: %v", files)
+	}
+	if _, err = decodeSums(NewByName(SFVName), []byte("file.ext 1234\n")); err == nil || !strings.Contains(err.Error(), "Line 1") {
+		t.Errorf("Invalid CRC32 must be reported with its line, got %v", err)
+	}
+}
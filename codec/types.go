@@ -44,3 +44,23 @@ type Codec interface {
 	// Extension returns the file extension of the codec, without the '.' prefix
 	Extension() string
 }
+
+// Properties may be implemented by codecs whose seals can't keep all information about a file.
+// Codecs not implementing it are assumed to protect their seals with a signature, and to store
+// sizes as well as sha1 and md5 hashes.
+type Properties interface {
+	// Signed returns true if modifications of the seal can be detected
+	Signed() bool
+
+	// HasSizes returns true if the size of each file is stored
+	HasSizes() bool
+
+	// Digests returns the hashes that must be computed in addition to sha1 and md5 to serialize a file
+	Digests() api.Digests
+}
+
+// DigestKeeper may be implemented by codecs whose seals keep other digests than sha1 and md5
+type DigestKeeper interface {
+	// KeptDigests returns the names of the digests stored for each file, like "sha256"
+	KeptDigests() []string
+}
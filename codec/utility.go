@@ -2,58 +2,83 @@ package codec
 
 import (
 	"hash"
-	"path/filepath"
-	"unicode/utf8"
 
 	"github.com/Byron/godi/api"
 )
 
 // Take hashes of input arguments in predefined order
 // NOTE: If order changes for some reason, we have to change the file version !
+// Link is empty for all but hard links, which keeps seals written before it was recorded valid
 func hashInfo(sha1enc hash.Hash, finfo *api.FileInfo) {
 	sha1enc.Write([]byte(finfo.RelaPath))
 	sha1enc.Write([]byte(finfo.Path))
 	sha1enc.Write(finfo.Sha1)
 	sha1enc.Write(finfo.MD5)
+	// Most files don't have these, which keeps the signatures of such files as they were
+	sha1enc.Write(finfo.Sha256)
+	sha1enc.Write(finfo.Sha512)
+	sha1enc.Write(finfo.CRC32)
+	sha1enc.Write([]byte(finfo.Link))
 }
 
-func Names() []string {
-	// I believe I have seen this somewhere - maybe it can be optimized to be constant ?
-	names := [...]string{GobName, MHLName}
-	return names[:]
+// IsSigned returns true if seals written by the given codec are protected by a signature
+func IsSigned(c Codec) bool {
+	if p, ok := c.(Properties); ok {
+		return p.Signed()
+	}
+	return true
 }
 
-// Finds a codec which can decode the file at the given path.
-// We work strictly by name.
-func NewByPath(path string) Codec {
-	ext := filepath.Ext(path)
-
-	// '.' as extension or no extension
-	if len(ext) < 2 {
-		return nil
+// HasSizes returns true if seals written by the given codec contain the size of each file
+func HasSizes(c Codec) bool {
+	if p, ok := c.(Properties); ok {
+		return p.HasSizes()
 	}
+	return true
+}
+
+// A digest of a file, by the name it has in our records
+type namedDigest struct {
+	name   string
+	digest []byte
+}
 
-	// I know, we have ascii, even if there are UTF8 characters ... let's just practice sensible string handling
-	_, s := utf8.DecodeRuneInString(ext)
-	ext = ext[s:]
+// The names of all digests a file may have
+var allDigests = []string{"sha1", "md5", "sha256", "sha512", "crc32"}
 
-	switch ext {
-	case GobExtension:
-		return &Gob{}
-	case MHLExtension:
-		return &MHL{}
+// Returns the digests the given file has, in the order of allDigests
+func namedDigests(f *api.FileInfo) (digests []namedDigest) {
+	for i, digest := range [][]byte{f.Sha1, f.MD5, f.Sha256, f.Sha512, f.CRC32} {
+		if len(digest) > 0 {
+			digests = append(digests, namedDigest{allDigests[i], digest})
+		}
 	}
+	return
+}
 
-	return nil
+// MissingDigest returns the name of a digest of the given file which seals written by the given codec
+// can't keep, or an empty string if they keep all of them
+func MissingDigest(c Codec, f *api.FileInfo) string {
+	kept := []string{"sha1", "md5"}
+	if k, ok := c.(DigestKeeper); ok {
+		kept = k.KeptDigests()
+	}
+	for _, d := range namedDigests(f) {
+		found := false
+		for _, name := range kept {
+			found = found || name == d.name
+		}
+		if !found {
+			return d.name
+		}
+	}
+	return ""
 }
 
-// Find a codec matching the given name, and return it. Retuns nil otherwise
-func NewByName(name string) Codec {
-	switch {
-	case name == GobName:
-		return &Gob{}
-	case name == MHLName:
-		return &MHL{}
+// DigestsOf returns the hashes the given codec needs in addition to sha1 and md5
+func DigestsOf(c Codec) api.Digests {
+	if p, ok := c.(Properties); ok {
+		return p.Digests()
 	}
-	return nil
+	return 0
 }
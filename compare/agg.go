@@ -0,0 +1,213 @@
+package compare
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/Byron/godi/api"
+	"github.com/Byron/godi/codec"
+	"github.com/Byron/godi/io"
+	"github.com/Byron/godi/seal"
+)
+
+// Send the given file to the seal writer, unless it already stopped
+func (sl *sealer) send(f api.FileInfo) {
+	if sl.stopped {
+		return
+	}
+
+	select {
+	case lsr, ok := <-sl.result:
+		// The writer only sends a result early if it failed
+		if ok {
+			sl.lsr = lsr
+		}
+		sl.stopped = true
+		sl.hasError = true
+		close(sl.finfos)
+	case sl.finfos <- f:
+	}
+}
+
+// Finish writing the seal for the given tree, and return a result describing the outcome.
+// Seals which would be incomplete are removed
+func (sl *sealer) finish(tree string, cancelled bool) api.Result {
+	if !sl.stopped {
+		close(sl.finfos)
+		sl.lsr = <-sl.result
+		sl.stopped = true
+	}
+
+	if sl.lsr.Err == nil && !sl.hasError && !cancelled {
+		return &api.BasicResult{
+			Msg: fmt.Sprintf("Wrote seal file to '%s'", sl.lsr.Path),
+			// special marker, to allow others to easily retrieve seal files from the result
+			Finfo: api.FileInfo{Path: sl.lsr.Path, Size: -1},
+			Prio:  api.Valuable,
+		}
+	}
+
+	if len(sl.lsr.Path) > 0 {
+		os.Remove(sl.lsr.Path)
+	}
+	msg := ""
+	if sl.lsr.Err != nil {
+		msg = fmt.Sprintln(sl.lsr.Err.Error())
+	}
+	return &api.BasicResult{
+		Msg:  msg + fmt.Sprintf("Did not write seal for '%s' due to preceeding errors", tree),
+		Err:  sl.lsr.Err,
+		Prio: api.Error,
+	}
+}
+
+func (s *Command) Aggregate(results <-chan api.Result) <-chan api.Result {
+	// Files we have seen in one tree only, so far, by their relative path
+	pairs := make(map[string]*filePair)
+	var numCompared, numMissing, numExtra, numSizeChanged, numContentChanged uint
+
+	var sealers [2]*sealer
+	if s.Seal {
+		for side, tree := range s.Items {
+			sl := sealer{}
+			sl.finfos, sl.result = seal.SetupIndexWriter(tree, codec.NewByName(s.Format))
+			sealers[side] = &sl
+		}
+	}
+
+	resultHandler := func(r api.Result, accumResult chan<- api.Result) bool {
+		br := r.(*api.BasicResult)
+
+		// Results without relative path are sent by the generator - just pass them on
+		if len(br.Finfo.RelaPath) == 0 {
+			accumResult <- r
+			return br.Err == nil
+		}
+
+		side := s.side(&br.Finfo)
+		p, ok := pairs[br.Finfo.RelaPath]
+		if !ok {
+			p = &filePair{}
+			pairs[br.Finfo.RelaPath] = p
+		}
+		p.seen[side] = true
+		p.finfos[side] = br.Finfo
+		if p.seen[0] && p.seen[1] {
+			delete(pairs, br.Finfo.RelaPath)
+		}
+
+		if br.Err != nil {
+			p.failed = true
+			if s.Seal {
+				sealers[side].hasError = true
+			}
+			accumResult <- r
+			return false
+		}
+
+		if s.Seal {
+			sealers[side].send(br.Finfo)
+		}
+
+		if !p.seen[0] || !p.seen[1] || p.failed {
+			return true
+		}
+
+		numCompared += 1
+		a, b := &p.finfos[0], &p.finfos[1]
+		res := api.BasicResult{
+			Finfo: *b,
+			Prio:  api.Info,
+		}
+		switch {
+		case a.Size != b.Size:
+			numSizeChanged += 1
+			res.Err = &api.FileSizeMismatch{Path: b.Path, Want: a.Size, Got: b.Size}
+			res.Msg = fmt.Sprintf("SIZE %s: %s has size %dB, but %s has size %dB", SymbolMismatch, a.Path, a.Size, b.Path, b.Size)
+		case !bytes.Equal(a.Sha1, b.Sha1) || !bytes.Equal(a.MD5, b.MD5):
+			numContentChanged += 1
+			res.Err = &api.FileHashMismatch{Path: b.Path}
+			res.Msg = fmt.Sprintf("CONTENT %s: %s differs from %s", SymbolMismatch, b.Path, a.Path)
+		default:
+			res.Msg = fmt.Sprintf("%s: %s", SymbolOK, b.Path)
+		}
+
+		accumResult <- &res
+		return res.Err == nil
+	}
+
+	finalizer := func(accumResult chan<- api.Result) {
+		// Differences were counted as errors, but are reported separately
+		s.Stats.ErrCount -= numSizeChanged + numContentChanged
+
+		// If we were cancelled, we didn't see all files, and can't tell what's missing
+		if !s.Stats.WasCancelled {
+			relaPaths := make([]string, 0, len(pairs))
+			for relaPath := range pairs {
+				relaPaths = append(relaPaths, relaPath)
+			}
+			sort.Strings(relaPaths)
+
+			for _, relaPath := range relaPaths {
+				p := pairs[relaPath]
+				if p.failed {
+					continue
+				}
+
+				res := api.BasicResult{Prio: api.Error}
+				if p.seen[0] {
+					numMissing += 1
+					path := filepath.Join(s.Items[1], relaPath)
+					res.Finfo = p.finfos[0]
+					res.Err = &os.PathError{Op: "compare", Path: path, Err: os.ErrNotExist}
+					res.Msg = fmt.Sprintf("MISSING %s: %s", SymbolMismatch, path)
+				} else {
+					numExtra += 1
+					res.Finfo = p.finfos[1]
+					res.Err = &os.PathError{Op: "compare", Path: p.finfos[1].Path, Err: os.ErrExist}
+					res.Msg = fmt.Sprintf("EXTRA %s: %s", SymbolMismatch, p.finfos[1].Path)
+				}
+				accumResult <- &res
+			}
+		}
+
+		if s.Seal {
+			for side, tree := range s.Items {
+				res := sealers[side].finish(tree, s.Stats.WasCancelled)
+				if res.Error() != nil {
+					s.Stats.ErrCount += 1
+				}
+				accumResult <- res
+			}
+		}
+
+		numDifferent := numMissing + numExtra + numSizeChanged + numContentChanged
+		ss := SymbolSuccess
+		if numDifferent > 0 || s.Stats.ErrCount > 0 || s.Stats.WasCancelled {
+			ss = SymbolFail
+		}
+
+		accumResult <- &api.BasicResult{
+			Msg: fmt.Sprintf(
+				"COMPARE %s: %d of %d file(s) differ between '%s' and '%s' (%d missing, %d extra, %d with changed size, %d with changed content) [%s]%s",
+				ss,
+				numDifferent,
+				numCompared+numMissing+numExtra,
+				s.Items[0],
+				s.Items[1],
+				numMissing,
+				numExtra,
+				numSizeChanged,
+				numContentChanged,
+				s.Stats.DeltaString(&s.Stats, s.Stats.Elapsed(), io.StatsClientSep),
+				s.Stats.String(),
+			),
+			Prio: api.Valuable,
+		}
+	}
+
+	return api.Aggregate(results, s.Done, resultHandler, finalizer, &s.Stats)
+}
@@ -0,0 +1,67 @@
+/*
+Package cli implements the command-line interface for the Command, for use by the cli.App
+*/
+package cli
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/Byron/godi/cli"
+	"github.com/Byron/godi/codec"
+	"github.com/Byron/godi/compare"
+
+	gcli "github.com/codegangsta/cli"
+)
+
+const (
+	sealFlagName       = "seal"
+	formatFlagName     = "format"
+	compareDescription = `
+	Compare two directory trees directly, without the need for a seal.
+
+	Both trees are read in parallel, and files with the same path relative to their tree are
+	compared by size and signature. Compare will clearly indicate files which are missing in the second
+	tree, extra files which only exist in the second tree, as well as changes in size or contents.
+
+	[arguments ...] are exactly two directories, the first one being the reference, for example
+
+	godi compare /Volumes/original /Volumes/received
+
+	Use --seal to write a seal for both trees while they are compared.
+`
+)
+
+// return subcommands for our particular area of algorithms
+func SubCommands() []gcli.Command {
+	out := make([]gcli.Command, 1)
+	cmd := compare.Command{}
+
+	compare := gcli.Command{
+		Name:      compare.Name,
+		ShortName: "",
+		Usage:     compareDescription,
+		Action:    func(c *gcli.Context) { cli.RunAction(&cmd, c) },
+		Before:    func(c *gcli.Context) error { return checkCompare(&cmd, c) },
+		Flags: []gcli.Flag{
+			gcli.BoolFlag{
+				Name:  sealFlagName,
+				Usage: "Write a seal for both trees while they are compared",
+			},
+			gcli.StringFlag{
+				Name:  formatFlagName,
+				Value: codec.GobName,
+				Usage: fmt.Sprintf("The format of the seal files written with --%s, one of %s", sealFlagName, strings.Join(codec.Names(), ", ")),
+			},
+		},
+	}
+
+	out[0] = compare
+	return out
+}
+
+func checkCompare(cmd *compare.Command, c *gcli.Context) error {
+	cmd.Seal = c.Bool(sealFlagName)
+	cmd.Format = c.String(formatFlagName)
+	return cli.CheckCommonFlagsAndInit(cmd, c)
+}
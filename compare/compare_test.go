@@ -0,0 +1,105 @@
+package compare_test
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Byron/godi/api"
+	"github.com/Byron/godi/codec"
+	"github.com/Byron/godi/compare"
+	"github.com/Byron/godi/testlib"
+	"github.com/Byron/godi/verify"
+)
+
+func TestCompare(t *testing.T) {
+	treeA, _, symlinkA := testlib.MakeDatasetOrPanic()
+	defer testlib.RmTree(treeA)
+	treeB, file, symlinkB := testlib.MakeDatasetOrPanic()
+	defer testlib.RmTree(treeB)
+	// Symlinks are compared by their target, which is an absolute path into their own tree
+	for _, symlink := range []string{symlinkA, symlinkB} {
+		if len(symlink) > 0 {
+			os.Remove(symlink)
+		}
+	}
+	resHandler := testlib.ResultHandler(t, false)
+
+	if _, err := compare.NewCommand([]string{treeA}, 1); err == nil {
+		t.Error("Need exactly two trees")
+	}
+	if _, err := compare.NewCommand([]string{treeA, filepath.Join(treeA, "subdir")}, 1); err == nil {
+		t.Error("Nested trees can't be compared")
+	}
+
+	cmd, err := compare.NewCommand([]string{treeA, treeB}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd.Seal = true
+	cmd.Format = codec.MHLName
+
+	// Identical trees compare fine, and both get a seal
+	var indices []string
+	if err = api.StartEngine(cmd, api.IndexTrackingResultHandlerAdapter(&indices, resHandler)); err != nil {
+		t.Fatal(err)
+	}
+	if len(indices) != 2 {
+		t.Fatalf("Expected a seal for each tree, got %d", len(indices))
+	}
+
+	verifycmd, err := verify.NewCommand(indices, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = api.StartEngine(verifycmd, resHandler); err != nil {
+		t.Error(err)
+	}
+
+	// Seals written previously are not considered part of the tree
+	cmd, _ = compare.NewCommand([]string{treeA, treeB}, 1)
+	if err = api.StartEngine(cmd, resHandler); err != nil {
+		t.Error(err)
+	}
+
+	// Change the second tree in all possible ways
+	if err = os.Remove(filepath.Join(treeB, "somebytes_noext")); err != nil {
+		t.Fatal(err)
+	}
+	testlib.MakeFileOrPanic(filepath.Join(treeB, "extra.file"), 10)
+	testlib.MakeFileOrPanic(filepath.Join(treeB, "subdir", "smallie.blah"), 124)
+	fd, err := os.OpenFile(file, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fd.Write([]byte("x"))
+	fd.Close()
+
+	kinds := make(map[string]int)
+	summary := ""
+	cmd, _ = compare.NewCommand([]string{treeA, treeB}, 1)
+	err = api.StartEngine(cmd, func(r api.Result) {
+		msg, _ := r.Info()
+		for _, kind := range []string{"MISSING", "EXTRA", "SIZE", "CONTENT"} {
+			if strings.HasPrefix(msg, kind) {
+				kinds[kind] += 1
+			}
+		}
+		if strings.HasPrefix(msg, "COMPARE") {
+			summary = msg
+		}
+		t.Log(msg)
+	})
+	if err == nil {
+		t.Error("Differences between the trees must be reported as error")
+	}
+	for _, kind := range []string{"MISSING", "EXTRA", "SIZE", "CONTENT"} {
+		if kinds[kind] != 1 {
+			t.Errorf("Expected exactly one %s result, got %d", kind, kinds[kind])
+		}
+	}
+	if !strings.Contains(summary, "4 of") {
+		t.Errorf("Summary should count all differences: %s", summary)
+	}
+}
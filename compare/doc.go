@@ -0,0 +1,5 @@
+/*
+Package compare implements the 'compare' functionality, which compares two trees directly, without a seal.
+
+*/
+package compare
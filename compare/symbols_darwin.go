@@ -0,0 +1,8 @@
+package compare
+
+const (
+	SymbolOK       = "✔︎️ "
+	SymbolSuccess  = "✅ "
+	SymbolFail     = "⛔️ "
+	SymbolMismatch = "🚫 "
+)
@@ -0,0 +1,109 @@
+package compare
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/Byron/godi/api"
+	"github.com/Byron/godi/codec"
+	"github.com/Byron/godi/io"
+	"github.com/Byron/godi/seal"
+)
+
+const (
+	Name = "compare"
+)
+
+// A type representing all arguments required to drive a compare operation
+type Command struct {
+	api.BasicRunner
+
+	// If set, a seal is written for both trees while they are compared
+	Seal bool
+
+	// The name of the seal format to use
+	Format string
+}
+
+// Keeps information about the files sharing the same relative path in both trees
+type filePair struct {
+	finfos [2]api.FileInfo
+	seen   [2]bool // true for each tree we have received a result for
+	failed bool    // true if one of the files couldn't be read
+}
+
+// Keeps information about the seal we write for one of the trees
+type sealer struct {
+	finfos   chan<- api.FileInfo
+	result   <-chan seal.IndexWriterResult
+	lsr      seal.IndexWriterResult // lastSealResult
+	stopped  bool                   // true if the finfos channel was closed
+	hasError bool                   // true if the seal would be incomplete
+}
+
+// NewCommand returns an initialized compare command
+func NewCommand(trees []string, nReaders int) (*Command, error) {
+	c := Command{}
+	return &c, c.Init(nReaders, 0, trees, api.Info, nil)
+}
+
+// Returns the index of the tree the given file belongs to
+func (s *Command) side(f *api.FileInfo) int {
+	if f.Root() == s.Items[0] {
+		return 0
+	}
+	return 1
+}
+
+func (s *Command) Generate() <-chan api.Result {
+	generate := func(trees []string, files chan<- api.FileInfo, results chan<- api.Result) {
+		api.Traverse(trees, files, results, s.Done, s.Filters, &s.Stats, api.MakeGeneratorResult)
+	}
+
+	return api.Generate(s.RootedReaders, s, generate)
+}
+
+func (s *Command) Gather(rctrl *io.ReadChannelController, files <-chan api.FileInfo, results chan<- api.Result) {
+	makeResult := func(f, source *api.FileInfo, err error) api.Result {
+		return &api.BasicResult{
+			Finfo: *f,
+			Prio:  api.Info,
+			Err:   err,
+		}
+	}
+
+	var digests api.Digests
+	if s.Seal {
+		digests = codec.DigestsOf(codec.NewByName(s.Format))
+	}
+	api.Gather(files, results, &s.Stats, makeResult, rctrl, nil, digests)
+}
+
+func (s *Command) Init(numReaders, numWriters int, items []string, maxLogLevel api.Importance, filters []api.FileFilter) error {
+	if len(items) != 2 {
+		return errors.New("Please provide exactly two directories to compare")
+	}
+
+	trees, err := api.ParseSources(items, false)
+	if err != nil {
+		return err
+	}
+	if len(trees) != 2 {
+		return fmt.Errorf("Cannot compare '%s' with itself or one of its subdirectories", trees[0])
+	}
+
+	if len(s.Format) == 0 {
+		s.Format = codec.GobName
+	}
+	if s.Seal && codec.NewByName(s.Format) == nil {
+		return fmt.Errorf("Invalid seal format '%s'", s.Format)
+	}
+
+	// Seals are not part of the data, and we might be writing some ourselves
+	ff := make([]api.FileFilter, len(filters), len(filters)+1)
+	copy(ff, filters)
+	ff = append(ff, api.FilterSeals)
+
+	s.InitBasicRunner(numReaders, trees, maxLogLevel, ff)
+	return nil
+}
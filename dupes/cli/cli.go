@@ -0,0 +1,42 @@
+/*
+Package cli implements the command-line interface for the Command, for use by the cli.App
+*/
+package cli
+
+import (
+	"github.com/Byron/godi/cli"
+	"github.com/Byron/godi/dupes"
+
+	gcli "github.com/codegangsta/cli"
+)
+
+const (
+	dupesDescription = `
+	Find files with the same contents, and show how much space they waste.
+
+	Files are grouped by their size and signature. Seal files are read without touching the data they describe,
+	as they contain the signatures already. Directories are read entirely to compute the signature of each file.
+
+	[arguments ...] are one or more seal files or directories, for example
+
+	godi dupes /Volumes/archive/*/godi_*.gobz
+	godi dupes /Volumes/projects
+`
+)
+
+// return subcommands for our particular area of algorithms
+func SubCommands() []gcli.Command {
+	out := make([]gcli.Command, 1)
+	cmd := dupes.Command{}
+
+	dupes := gcli.Command{
+		Name:      dupes.Name,
+		ShortName: "",
+		Usage:     dupesDescription,
+		Action:    func(c *gcli.Context) { cli.RunAction(&cmd, c) },
+		Before:    func(c *gcli.Context) error { return cli.CheckCommonFlagsAndInit(&cmd, c) },
+	}
+
+	out[0] = dupes
+	return out
+}
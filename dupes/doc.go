@@ -0,0 +1,5 @@
+/*
+Package dupes implements the 'dupes' functionality, which finds files with the same contents in seals or trees.
+
+*/
+package dupes
@@ -0,0 +1,105 @@
+package dupes_test
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Byron/godi/api"
+	"github.com/Byron/godi/codec"
+	"github.com/Byron/godi/dupes"
+	"github.com/Byron/godi/seal"
+	"github.com/Byron/godi/testlib"
+)
+
+func TestDupes(t *testing.T) {
+	datasetTree, _, _ := testlib.MakeDatasetOrPanic()
+	defer testlib.RmTree(datasetTree)
+	resHandler := testlib.ResultHandler(t, false)
+
+	// All files of the dataset are zeroed, which makes files of the same size duplicates
+	testlib.MakeFileOrPanic(filepath.Join(datasetTree, "copy_noext"), 313)
+	testlib.MakeFileOrPanic(filepath.Join(datasetTree, "subdir", "copy.ext"), 313)
+
+	findDupes := func(items []string) (sets []string, summary string) {
+		cmd, err := dupes.NewCommand(items, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = api.StartEngine(cmd, func(r api.Result) {
+			msg, prio := r.Info()
+			if prio == api.Valuable {
+				summary = msg
+			} else if strings.HasPrefix(msg, "DUPES") {
+				sets = append(sets, msg)
+			}
+			resHandler(r)
+		}); err != nil {
+			t.Error(err)
+		}
+		return
+	}
+
+	check := func(sets []string, summary string) {
+		if len(sets) != 1 || strings.Count(sets[0], "\n") != 3 {
+			t.Fatalf("Expected one set of three files, got %v", sets)
+		}
+		if !strings.Contains(summary, "1 set(s) with 3 duplicate file(s)") {
+			t.Errorf("Unexpected summary: %s", summary)
+		}
+	}
+
+	sets, summary := findDupes([]string{datasetTree})
+	check(sets, summary)
+
+	sealcmd, _ := seal.NewCommand([]string{datasetTree}, 1, 0)
+	var indices []string
+	if err := api.StartEngine(sealcmd, api.IndexTrackingResultHandlerAdapter(&indices, resHandler)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Seals yield the same result, and files listed in multiple sources count only once
+	sets, summary = findDupes(indices)
+	check(sets, summary)
+	sets, summary = findDupes([]string{indices[0], datasetTree})
+	check(sets, summary)
+
+	// Seals without sizes and with other digests are compared by the digests they have
+	sumscmd := seal.Command{Mode: seal.ModeSeal, Format: codec.Sha256SumName}
+	if err := sumscmd.Init(1, 0, []string{datasetTree}, api.Info, []api.FileFilter{api.FilterSeals}); err != nil {
+		t.Fatal(err)
+	}
+	var sums []string
+	if err := api.StartEngine(&sumscmd, api.IndexTrackingResultHandlerAdapter(&sums, resHandler)); err != nil {
+		t.Fatal(err)
+	}
+	sets, summary = findDupes(sums)
+	check(sets, summary)
+	if !strings.Contains(sets[0], "of unknown size") {
+		t.Errorf("Sizes of files in sums can't be known, got %s", sets[0])
+	}
+	sets, summary = findDupes([]string{sums[0], datasetTree})
+	check(sets, summary)
+
+	// Files which just look like a seal are hashed like any other
+	dir, err := ioutil.TempDir("", "godi-dupes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer testlib.RmTree(dir)
+	data, err := ioutil.ReadFile(sums[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var copies []string
+	for _, name := range []string{"a.txt", "b.txt"} {
+		copies = append(copies, filepath.Join(dir, name))
+		if err = ioutil.WriteFile(copies[len(copies)-1], data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if sets, _ = findDupes(copies); len(sets) != 1 || strings.Count(sets[0], "\n") != 2 {
+		t.Errorf("Expected the checksum files to be duplicates of each other, got %v", sets)
+	}
+}
@@ -0,0 +1,349 @@
+package dupes
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/Byron/godi/api"
+	"github.com/Byron/godi/codec"
+	"github.com/Byron/godi/io"
+)
+
+const (
+	Name = "dupes"
+)
+
+// A type representing all arguments required to drive a dupes operation
+type Command struct {
+	api.BasicRunner
+
+	// The digests to compute in addition to sha1 and md5, to compare files of trees with those of the given seals
+	digests api.Digests
+}
+
+// A set of files with the same contents
+type dupeSet struct {
+	// The size of each file, which is 0 if all files are from seals without sizes
+	size int64
+
+	// All digests known of the files
+	digests api.FileInfo
+
+	paths []string
+
+	// Set if the set was merged into another one, and is to be ignored
+	merged bool
+}
+
+// Adds the digests of the given file to the ones we know
+func (d *dupeSet) learn(f *api.FileInfo) {
+	known := &d.digests
+	for _, p := range [][2]*[]byte{{&known.Sha512, &f.Sha512}, {&known.Sha256, &f.Sha256}, {&known.Sha1, &f.Sha1},
+		{&known.MD5, &f.MD5}, {&known.CRC32, &f.CRC32}} {
+		if len(*p[0]) == 0 {
+			*p[0] = *p[1]
+		}
+	}
+}
+
+// Adds the given path unless we have it already, and returns true if it was added
+func (d *dupeSet) add(path string) bool {
+	for _, p := range d.paths {
+		if p == path {
+			return false
+		}
+	}
+	d.paths = append(d.paths, path)
+	return true
+}
+
+// Returns the amount of bytes which could be saved if only one of the files was kept
+func (d *dupeSet) wasted() uint64 {
+	return uint64(d.size) * uint64(len(d.paths)-1)
+}
+
+// Sorts sets by the amount of wasted bytes, largest first
+type byWaste []*dupeSet
+
+func (b byWaste) Len() int      { return len(b) }
+func (b byWaste) Swap(i, j int) { b[i], b[j] = b[j], b[i] }
+func (b byWaste) Less(i, j int) bool {
+	if b[i].wasted() != b[j].wasted() {
+		return b[i].wasted() > b[j].wasted()
+	}
+	return b[i].paths[0] < b[j].paths[0]
+}
+
+// NewCommand returns an initialized dupes command
+func NewCommand(items []string, nReaders int) (*Command, error) {
+	c := Command{}
+	return &c, c.Init(nReaders, 0, items, api.Info, nil)
+}
+
+// Returns true if the given item is a seal file, instead of a tree or file to hash.
+// Files which merely look like a seal, like the output of md5sum, are hashed like any other
+func isSeal(item string) bool {
+	if stat, err := os.Stat(item); err != nil || stat.IsDir() {
+		return false
+	}
+	return codec.NewByExtension(item) != nil
+}
+
+// Returns keys which are equal for files with the same contents, one per digest, strongest first.
+// CRC32 is too weak to identify contents on its own, and is combined with the size, if known
+func digestKeys(f *api.FileInfo, hasSize bool) (keys []string) {
+	if len(f.Sha512) > 0 {
+		keys = append(keys, fmt.Sprintf("sha512:%x", f.Sha512))
+	}
+	if len(f.Sha256) > 0 {
+		keys = append(keys, fmt.Sprintf("sha256:%x", f.Sha256))
+	}
+	if len(f.Sha1) > 0 {
+		keys = append(keys, fmt.Sprintf("sha1:%x", f.Sha1))
+	}
+	if len(f.MD5) > 0 {
+		keys = append(keys, fmt.Sprintf("md5:%x", f.MD5))
+	}
+	if len(f.CRC32) > 0 && hasSize {
+		keys = append(keys, fmt.Sprintf("%d:crc32:%x", f.Size, f.CRC32))
+	}
+	return
+}
+
+func (s *Command) Generate() <-chan api.Result {
+	generate := func(items []string, files chan<- api.FileInfo, results chan<- api.Result) {
+		var trees []string
+		for _, item := range items {
+			if !isSeal(item) {
+				trees = append(trees, item)
+				continue
+			}
+
+			// Sealed files already have a digest - there is no need to read them
+			fd, err := os.Open(item)
+			if err != nil {
+				results <- &api.BasicResult{Err: err, Prio: api.Error}
+				continue
+			}
+			sealed := make(chan api.FileInfo)
+			forwarded := make(chan bool)
+			go func() {
+				for f := range sealed {
+					results <- &api.BasicResult{Finfo: f, Prio: api.Info}
+				}
+				close(forwarded)
+			}()
+
+			root := filepath.Dir(item)
+			err = codec.NewByPath(item).Deserialize(fd, sealed, func(f *api.FileInfo) bool {
+				select {
+				case <-s.Done:
+					return false
+				default:
+					f.Path = filepath.Join(root, f.RelaPath)
+					f.Seal = item
+					return true
+				}
+			})
+			fd.Close()
+			close(sealed)
+			<-forwarded
+			if err != nil {
+				results <- &api.BasicResult{
+					Msg:  fmt.Sprintf("Failed to read seal at '%s'", item),
+					Err:  err,
+					Prio: api.Error,
+				}
+			}
+		}
+
+		api.Traverse(trees, files, results, s.Done, s.Filters, &s.Stats,
+			func(root, msg string, err error) api.Result {
+				prio := api.Info
+				if err != nil {
+					prio = api.Error
+				}
+				return &api.BasicResult{Msg: msg, Err: err, Prio: prio}
+			})
+	}
+
+	return api.Generate(s.RootedReaders, s, generate)
+}
+
+func (s *Command) Gather(rctrl *io.ReadChannelController, files <-chan api.FileInfo, results chan<- api.Result) {
+	makeResult := func(f, source *api.FileInfo, err error) api.Result {
+		return &api.BasicResult{
+			Finfo: *f,
+			Prio:  api.Info,
+			Err:   err,
+		}
+	}
+
+	api.Gather(files, results, &s.Stats, makeResult, rctrl, nil, s.digests)
+}
+
+func (s *Command) Aggregate(results <-chan api.Result) <-chan api.Result {
+	sets := make(map[string]*dupeSet)
+	var numFiles uint
+
+	// Seals of some formats don't keep sizes, by seal
+	hasSizes := make(map[string]bool)
+	hasSize := func(f *api.FileInfo) bool {
+		if len(f.Seal) == 0 {
+			return true
+		}
+		has, ok := hasSizes[f.Seal]
+		if !ok {
+			has = codec.HasSizes(codec.NewByPath(f.Seal))
+			hasSizes[f.Seal] = has
+		}
+		return has
+	}
+
+	resultHandler := func(r api.Result, accumResult chan<- api.Result) bool {
+		br := r.(*api.BasicResult)
+		if br.Err != nil || len(br.Finfo.Path) == 0 {
+			accumResult <- r
+			return br.Err == nil
+		}
+
+		f := &br.Finfo
+		sized := hasSize(f)
+		keys := digestKeys(f, sized)
+		// Empty files don't waste space, and files without digest can't be compared
+		if (sized && f.Size == 0) || len(keys) == 0 {
+			return true
+		}
+
+		// Seals of different formats have different digests, which is why a file may belong to
+		// multiple sets we know, which are merged. Sets whose digests differ from ours share a weak one by chance
+		var found []*dupeSet
+		for _, key := range keys {
+			if set, ok := sets[key]; ok && api.SameDigests(&set.digests, f) {
+				isNew := true
+				for _, other := range found {
+					isNew = isNew && other != set
+				}
+				if isNew {
+					found = append(found, set)
+				}
+			}
+		}
+
+		set := &dupeSet{}
+		if len(found) > 0 {
+			set, found = found[0], found[1:]
+		}
+		set.learn(f)
+		if sized {
+			set.size = f.Size
+		}
+		for _, other := range found {
+			if !api.SameDigests(&set.digests, &other.digests) {
+				continue
+			}
+			set.learn(&other.digests)
+			if set.size == 0 {
+				set.size = other.size
+			}
+			for _, path := range other.paths {
+				set.add(path)
+			}
+			other.merged = true
+		}
+		set.digests.Size = set.size
+		for _, key := range digestKeys(&set.digests, set.size > 0) {
+			if prev, ok := sets[key]; !ok || prev.merged {
+				sets[key] = set
+			}
+		}
+
+		// The same file may be listed in multiple seals, or in a seal and a tree
+		if set.add(f.Path) {
+			numFiles += 1
+		}
+		return true
+	}
+
+	finalizer := func(accumResult chan<- api.Result) {
+		var dupes []*dupeSet
+		var numDupes uint
+		var wasted uint64
+		seen := make(map[*dupeSet]bool)
+		for _, set := range sets {
+			if len(set.paths) < 2 || set.merged || seen[set] {
+				continue
+			}
+			seen[set] = true
+			sort.Strings(set.paths)
+			dupes = append(dupes, set)
+			numDupes += uint(len(set.paths))
+			wasted += set.wasted()
+		}
+
+		// Show the sets wasting the most space first
+		sort.Sort(byWaste(dupes))
+
+		for _, set := range dupes {
+			each := fmt.Sprintf("of %s each", io.BytesVolume(set.size))
+			if set.size == 0 {
+				each = "of unknown size"
+			}
+			accumResult <- &api.BasicResult{
+				Msg: fmt.Sprintf("DUPES: %d file(s) %s, wasting %s\n\t%s",
+					len(set.paths),
+					each,
+					io.BytesVolume(set.wasted()),
+					strings.Join(set.paths, "\n\t"),
+				),
+				Finfo: api.FileInfo{Path: set.paths[0], Size: set.size},
+				Prio:  api.Info,
+			}
+		}
+
+		accumResult <- &api.BasicResult{
+			Msg: fmt.Sprintf(
+				"DUPES: Found %d set(s) with %d duplicate file(s) among %d file(s), wasting %s [%s]%s",
+				len(dupes),
+				numDupes,
+				numFiles,
+				io.BytesVolume(wasted),
+				s.Stats.DeltaString(&s.Stats, s.Stats.Elapsed(), io.StatsClientSep),
+				s.Stats.String(),
+			),
+			Prio: api.Valuable,
+		}
+	}
+
+	return api.Aggregate(results, s.Done, resultHandler, finalizer, &s.Stats)
+}
+
+func (s *Command) Init(numReaders, numWriters int, items []string, maxLogLevel api.Importance, filters []api.FileFilter) error {
+	if len(items) == 0 {
+		return errors.New("Please provide at least one seal file or directory")
+	}
+
+	validItems, err := api.ParseSources(items, true)
+	if err != nil {
+		return err
+	}
+
+	// Seals are not part of the data in trees we hash
+	ff := make([]api.FileFilter, len(filters), len(filters)+1)
+	copy(ff, filters)
+	ff = append(ff, api.FilterSeals)
+
+	// Files of trees are compared with sealed ones by the digests of the seals
+	for _, item := range validItems {
+		if isSeal(item) {
+			s.digests |= codec.DigestsOf(codec.NewByPath(item))
+		}
+	}
+
+	s.InitBasicRunner(numReaders, validItems, maxLogLevel, ff)
+	return nil
+}
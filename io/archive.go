@@ -0,0 +1,624 @@
+package io
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/flate"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	TarExtension   = ".tar"
+	TarGzExtension = ".tar.gz"
+	TgzExtension   = ".tgz"
+	ZipExtension   = ".zip"
+)
+
+var archiveExtensions = []string{TarExtension, TarGzExtension, TgzExtension, ZipExtension}
+
+// IsArchivePath returns true if the given path names a tar, compressed tar or zip archive, judging by its extension
+func IsArchivePath(path string) bool {
+	path = strings.ToLower(path)
+	for _, ext := range archiveExtensions {
+		if strings.HasSuffix(path, ext) {
+			return true
+		}
+	}
+	return false
+}
+
+// IsArchive returns true if the given path is an existing archive file, see IsArchivePath().
+// Archives are supported on the local file system only
+func IsArchive(path string) bool {
+	if !IsArchivePath(path) || fileSystemOf(path) != LocalFileSystem {
+		return false
+	}
+	stat, err := os.Stat(path)
+	return err == nil && stat.Mode().IsRegular()
+}
+
+// Returns true if the archive at the given path is a zip archive, tar otherwise
+func isZip(path string) bool {
+	return strings.HasSuffix(strings.ToLower(path), ZipExtension)
+}
+
+// Returns true if the archive at the given path is a compressed tar archive, which can only be read front to back
+func isGzip(path string) bool {
+	path = strings.ToLower(path)
+	return strings.HasSuffix(path, TarGzExtension) || strings.HasSuffix(path, TgzExtension)
+}
+
+// Information about a member, whose size may differ from the one stored in the archive
+type memberInfo struct {
+	os.FileInfo
+	size int64
+}
+
+func (m *memberInfo) Size() int64 {
+	return m.size
+}
+
+// Returns information about the given tar member. Symbolic links have the size of their target, like on disk
+func tarMemberInfo(hdr *tar.Header) os.FileInfo {
+	if hdr.Typeflag == tar.TypeSymlink {
+		return &memberInfo{hdr.FileInfo(), int64(len(hdr.Linkname))}
+	}
+	return hdr.FileInfo()
+}
+
+// Returns the name of a member relative to the archive, or an empty string if it isn't a file
+func memberName(name string, info os.FileInfo) string {
+	if !info.Mode().IsRegular() && info.Mode()&os.ModeSymlink != os.ModeSymlink {
+		return ""
+	}
+	return strings.TrimPrefix(name, "./")
+}
+
+// Information about a member of an archive, sufficient to read it without scanning the archive
+type archiveMember struct {
+	info     os.FileInfo
+	linkname string // the target of symbolic links in tar archives
+	target   string // the name of the member holding the data of hard links in tar archives
+	offset   int64  // offset of the data in the archive, or -1 if the archive has to be read up to the member
+	size     int64  // size of the data in the archive, which may be compressed
+	deflated bool   // true if the data is compressed
+}
+
+// All members of an archive, as they were when the archive had the given size and modification time
+type archiveIndex struct {
+	size    int64
+	modTime time.Time
+	names   []string // in archive order
+	members map[string]*archiveMember
+}
+
+var (
+	archiveIndices     = make(map[string]*archiveIndex)
+	archiveIndicesLock sync.Mutex
+)
+
+// Returns the index of the archive at the given path, which is read only if the archive changed since we last saw it
+func indexArchive(path string) (*archiveIndex, error) {
+	stat, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	archiveIndicesLock.Lock()
+	defer archiveIndicesLock.Unlock()
+	if idx, ok := archiveIndices[path]; ok && idx.size == stat.Size() && idx.modTime.Equal(stat.ModTime()) {
+		return idx, nil
+	}
+
+	fd, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+
+	idx := archiveIndex{size: stat.Size(), modTime: stat.ModTime(), members: make(map[string]*archiveMember)}
+	add := func(name string, m *archiveMember) {
+		if name = memberName(name, m.info); len(name) == 0 {
+			return
+		}
+		idx.names = append(idx.names, name)
+		idx.members[name] = m
+	}
+
+	if isZip(path) {
+		zr, err := zip.NewReader(fd, stat.Size())
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read zip archive '%s': %s", path, err)
+		}
+		for _, f := range zr.File {
+			if f.Method != zip.Store && f.Method != zip.Deflate {
+				return nil, fmt.Errorf("Member '%s' of '%s' uses an unsupported compression method", f.Name, path)
+			}
+			offset, err := f.DataOffset()
+			if err != nil {
+				return nil, err
+			}
+			add(f.Name, &archiveMember{
+				info:     f.FileInfo(),
+				offset:   offset,
+				size:     int64(f.CompressedSize64),
+				deflated: f.Method == zip.Deflate,
+			})
+		}
+	} else {
+		var r io.Reader = fd
+		compressed := isGzip(path)
+		if compressed {
+			if r, err = gzip.NewReader(fd); err != nil {
+				return nil, fmt.Errorf("Failed to read compressed archive '%s': %s", path, err)
+			}
+		}
+		tr := tar.NewReader(r)
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				return nil, fmt.Errorf("Failed to read tar archive '%s': %s", path, err)
+			}
+			// The reader doesn't read ahead, which puts us right at the beginning of the data
+			offset := int64(-1)
+			if !compressed {
+				if offset, err = fd.Seek(0, os.SEEK_CUR); err != nil {
+					return nil, err
+				}
+			}
+			if hdr.Typeflag == tar.TypeLink {
+				// Hard links have no data, but share the one of an earlier member
+				target := strings.TrimPrefix(hdr.Linkname, "./")
+				t, ok := idx.members[target]
+				if !ok {
+					return nil, fmt.Errorf("Hard link '%s' in '%s' points to unknown member '%s'", hdr.Name, path, hdr.Linkname)
+				}
+				add(hdr.Name, &archiveMember{
+					info:   &memberInfo{hdr.FileInfo(), t.info.Size()},
+					offset: t.offset,
+					size:   t.size,
+					target: target,
+				})
+				continue
+			}
+			add(hdr.Name, &archiveMember{info: tarMemberInfo(hdr), linkname: hdr.Linkname, offset: offset, size: hdr.Size})
+		}
+	}
+
+	archiveIndices[path] = &idx
+	return &idx, nil
+}
+
+// Returns the path to the archive containing the given path, and the name of the member within it.
+// The archive is empty if the path is not inside of an archive
+func splitArchivePath(path string) (archive, member string) {
+	lpath := strings.ToLower(filepath.ToSlash(path))
+	isInArchive := false
+	for _, ext := range archiveExtensions {
+		isInArchive = isInArchive || strings.Contains(lpath, ext+"/")
+	}
+	if !isInArchive {
+		return
+	}
+
+	for dir := filepath.Dir(path); dir != filepath.Dir(dir); dir = filepath.Dir(dir) {
+		if IsArchive(dir) {
+			return dir, filepath.ToSlash(path[len(dir)+1:])
+		}
+	}
+	return
+}
+
+// Returns the archive member at the given path, or nil if the path is not inside of an archive
+func archiveMemberAt(path string) (string, *archiveMember, error) {
+	archive, name := splitArchivePath(path)
+	if len(archive) == 0 {
+		return "", nil, nil
+	}
+	idx, err := indexArchive(archive)
+	if err != nil {
+		return archive, nil, err
+	}
+	m, ok := idx.members[name]
+	if !ok {
+		return archive, nil, &os.PathError{Op: "open", Path: path, Err: os.ErrNotExist}
+	}
+	return archive, m, nil
+}
+
+// Reads a member of an archive, and closes the archive when done
+type memberReader struct {
+	io.Reader
+	fd *os.File
+}
+
+func (m *memberReader) Close() error {
+	if c, ok := m.Reader.(io.Closer); ok {
+		c.Close()
+	}
+	return m.fd.Close()
+}
+
+// Open opens the file at the given path for reading, using its file system, see Mount().
+// The path may point into an archive, like 'delivery.tar/reel1/A001.mov', which allows to read its members
+// without extracting them.
+func Open(path string) (io.ReadCloser, error) {
+	archive, m, err := archiveMemberAt(path)
+	if err != nil {
+		return nil, err
+	}
+	if m == nil {
+		return fileSystemOf(path).Open(path)
+	}
+
+	fd, err := os.Open(archive)
+	if err != nil {
+		return nil, err
+	}
+	if m.offset < 0 {
+		name := filepath.ToSlash(path[len(archive)+1:])
+		if len(m.target) > 0 {
+			name = m.target
+		}
+		return openCompressedMember(fd, path, name)
+	}
+	var r io.Reader = io.NewSectionReader(fd, m.offset, m.size)
+	if m.deflated {
+		r = flate.NewReader(r)
+	}
+	return &memberReader{r, fd}, nil
+}
+
+// Reads the compressed archive in fd up to the member with the given name, and returns a reader for it.
+// The path is used in errors only
+func openCompressedMember(fd *os.File, path, name string) (io.ReadCloser, error) {
+	gz, err := gzip.NewReader(fd)
+	if err != nil {
+		fd.Close()
+		return nil, err
+	}
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err != nil {
+			fd.Close()
+			if err == io.EOF {
+				err = &os.PathError{Op: "open", Path: path, Err: os.ErrNotExist}
+			}
+			return nil, err
+		}
+		if memberName(hdr.Name, hdr.FileInfo()) == name {
+			return &memberReader{tr, fd}, nil
+		}
+	}
+}
+
+// Lstat is like os.Lstat, but uses the file system of the given path, and handles paths pointing into
+// archives, see Open()
+func Lstat(path string) (os.FileInfo, error) {
+	_, m, err := archiveMemberAt(path)
+	if err != nil {
+		return nil, err
+	}
+	if m == nil {
+		return fileSystemOf(path).Lstat(path)
+	}
+	return m.info, nil
+}
+
+// Stat is like Lstat(), but follows symbolic links on file systems. Archive members are never followed
+func Stat(path string) (os.FileInfo, error) {
+	_, m, err := archiveMemberAt(path)
+	if err != nil {
+		return nil, err
+	}
+	if m == nil {
+		return fileSystemOf(path).Stat(path)
+	}
+	return m.info, nil
+}
+
+// Readlink is like os.Readlink, but uses the file system of the given path, and handles paths pointing into
+// archives, see Open()
+func Readlink(path string) (string, error) {
+	_, m, err := archiveMemberAt(path)
+	if err != nil {
+		return "", err
+	}
+	if m == nil {
+		return fileSystemOf(path).Readlink(path)
+	}
+	if m.info.Mode()&os.ModeSymlink != os.ModeSymlink {
+		return "", &os.PathError{Op: "readlink", Path: path, Err: errors.New("not a symbolic link")}
+	}
+	if len(m.linkname) > 0 {
+		return m.linkname, nil
+	}
+
+	// zip stores the target as content
+	r, err := Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+	target, err := ioutil.ReadAll(r)
+	return string(target), err
+}
+
+// ArchiveMembers returns the names of all files in the archive at the given path, in archive order.
+// Names are relative to the archive, and use '/' as separator.
+func ArchiveMembers(path string) ([]string, error) {
+	idx, err := indexArchive(path)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, len(idx.names))
+	copy(names, idx.names)
+	return names, nil
+}
+
+// WalkArchive calls fn for each file in the archive at the given path, in archive order, with its name, its
+// information and a reader for its contents, which may only be used during the call. Names are relative to the
+// archive, and use '/' as separator. Symbolic links are read as their target, as it's done for files on disk.
+// Hard links in tar archives are read like the earlier member they point to, which may read the archive once more.
+// As the archive is read front to back, it may also be compressed, like 'vendor.tar.gz'.
+// The walk stops at the first error, which is returned.
+func WalkArchive(path string, fn func(name string, info os.FileInfo, r io.Reader) error) error {
+	fd, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+
+	if isZip(path) {
+		stat, err := fd.Stat()
+		if err != nil {
+			return err
+		}
+		zr, err := zip.NewReader(fd, stat.Size())
+		if err != nil {
+			return fmt.Errorf("Failed to read zip archive '%s': %s", path, err)
+		}
+		for _, f := range zr.File {
+			info := f.FileInfo()
+			name := memberName(f.Name, info)
+			if len(name) == 0 {
+				continue
+			}
+			r, err := f.Open()
+			if err != nil {
+				return err
+			}
+			err = fn(name, info, r)
+			r.Close()
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	var r io.Reader = fd
+	if isGzip(path) {
+		if r, err = gzip.NewReader(fd); err != nil {
+			return fmt.Errorf("Failed to read compressed archive '%s': %s", path, err)
+		}
+	}
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("Failed to read tar archive '%s': %s", path, err)
+		}
+		info := tarMemberInfo(hdr)
+		name := memberName(hdr.Name, info)
+		if len(name) == 0 {
+			continue
+		}
+
+		var r io.Reader = tr
+		switch hdr.Typeflag {
+		case tar.TypeSymlink:
+			r = strings.NewReader(hdr.Linkname)
+		case tar.TypeLink:
+			// The data of the member we point to was read already
+			member := filepath.Join(path, filepath.FromSlash(name))
+			if info, err = Lstat(member); err != nil {
+				return err
+			}
+			lr, err := Open(member)
+			if err != nil {
+				return err
+			}
+			err = fn(name, info, lr)
+			lr.Close()
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		if err = fn(name, info, r); err != nil {
+			return err
+		}
+	}
+}
+
+// ArchiveWriter writes files as members of a tar or zip archive, which is created when the first member is
+// written. Members are written one at a time, see Begin(), which serializes all writers of the archive.
+type ArchiveWriter struct {
+	path string
+
+	// Held while a member is written
+	l sync.Mutex
+
+	fd *os.File
+	gz *gzip.Writer
+	tw *tar.Writer
+	zw *zip.Writer
+
+	// Names of all members written so far
+	names map[string]bool
+
+	// If set, the archive can't be written anymore
+	err    error
+	closed bool
+}
+
+// NewArchiveWriter returns a writer for an archive at the given path, whose type is determined by its extension.
+// Compressed tar archives are written with gzip.
+// The archive must not exist yet.
+func NewArchiveWriter(path string) *ArchiveWriter {
+	return &ArchiveWriter{path: path, names: make(map[string]bool)}
+}
+
+// Path returns the path to our archive
+func (a *ArchiveWriter) Path() string {
+	return a.path
+}
+
+// Begin must be called before a member is created. It blocks until End() was called for the previous member
+func (a *ArchiveWriter) Begin() {
+	a.l.Lock()
+}
+
+// Create adds a member with the given name, which uses '/' as separator, and returns a writer for its
+// contents, which must be exactly size bytes. Symbolic links point to target, and have no writer.
+// Members get the current time if modTime is the zero time.
+// Must be called between Begin() and End().
+func (a *ArchiveWriter) Create(name string, mode os.FileMode, size int64, modTime time.Time, target string) (io.Writer, error) {
+	if a.err != nil {
+		return nil, a.err
+	}
+	if a.closed {
+		return nil, fmt.Errorf("Archive '%s' was closed already", a.path)
+	}
+	if a.names[name] {
+		return nil, &os.PathError{Op: "create", Path: filepath.Join(a.path, name), Err: os.ErrExist}
+	}
+	if a.fd == nil {
+		if a.fd, a.err = os.OpenFile(a.path, os.O_EXCL|os.O_CREATE|os.O_WRONLY, 0666); a.err != nil {
+			return nil, a.err
+		}
+		if isZip(a.path) {
+			a.zw = zip.NewWriter(a.fd)
+		} else if isGzip(a.path) {
+			a.gz = gzip.NewWriter(a.fd)
+			a.tw = tar.NewWriter(a.gz)
+		} else {
+			a.tw = tar.NewWriter(a.fd)
+		}
+	}
+	a.names[name] = true
+	if modTime.IsZero() {
+		modTime = time.Now()
+	}
+
+	var w io.Writer
+	isSymlink := mode&os.ModeSymlink == os.ModeSymlink
+	if a.zw != nil {
+		// Most of the data we see is compressed already
+		h := zip.FileHeader{Name: name, Method: zip.Store}
+		h.SetModTime(modTime)
+		h.SetMode(mode)
+		if w, a.err = a.zw.CreateHeader(&h); a.err == nil && isSymlink {
+			_, a.err = io.WriteString(w, target)
+			w = nil
+		}
+	} else {
+		h := tar.Header{Name: name, Mode: int64(mode.Perm()), Size: size, ModTime: modTime, Typeflag: tar.TypeReg}
+		if isSymlink {
+			h.Typeflag = tar.TypeSymlink
+			h.Linkname = target
+			h.Size = 0
+		}
+		if a.err = a.tw.WriteHeader(&h); a.err == nil && !isSymlink {
+			w = a.tw
+		}
+	}
+
+	if a.err != nil {
+		return nil, a.err
+	}
+	return w, nil
+}
+
+// End finishes the current member, and must be called once for each call to Begin().
+// An error is returned if the member is incomplete, which makes the archive unusable.
+func (a *ArchiveWriter) End() (err error) {
+	if a.tw != nil && a.err == nil {
+		if err = a.tw.Flush(); err != nil {
+			a.err = err
+		}
+	}
+	a.l.Unlock()
+	return
+}
+
+// AddFile adds a member with the given name and the contents of the given reader, which must be exactly size bytes
+func (a *ArchiveWriter) AddFile(name string, r io.Reader, size int64, modTime time.Time) (err error) {
+	a.Begin()
+	defer func() {
+		if eerr := a.End(); err == nil {
+			err = eerr
+		}
+	}()
+
+	w, err := a.Create(name, 0666, size, modTime, "")
+	if err != nil {
+		return
+	}
+	_, err = io.Copy(w, r)
+	return
+}
+
+// Close finishes the archive, after which no member can be added anymore. It is safe to call it multiple times
+func (a *ArchiveWriter) Close() (err error) {
+	a.l.Lock()
+	defer a.l.Unlock()
+	if a.closed || a.fd == nil {
+		a.closed = true
+		return nil
+	}
+	a.closed = true
+
+	if a.tw != nil {
+		err = a.tw.Close()
+	} else {
+		err = a.zw.Close()
+	}
+	if a.gz != nil {
+		if cerr := a.gz.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if cerr := a.fd.Close(); err == nil {
+		err = cerr
+	}
+	return
+}
+
+// Remove closes the archive and removes it, if it was created by us
+func (a *ArchiveWriter) Remove() error {
+	a.l.Lock()
+	created := a.fd != nil
+	a.l.Unlock()
+
+	a.Close()
+	if !created {
+		return nil
+	}
+	return os.Remove(a.path)
+}
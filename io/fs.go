@@ -0,0 +1,299 @@
+package io
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FileSystem is implemented by everything godi reads files from, or writes files to.
+// Paths are absolute and use the separator of the local file system.
+type FileSystem interface {
+	// Open opens the file at path for reading
+	Open(path string) (io.ReadCloser, error)
+
+	// Create creates a new file at path for writing, whose directory must exist.
+	// Fails with an error satisfying os.IsExist() if there is a file at path already
+	Create(path string, perm os.FileMode) (io.WriteCloser, error)
+
+	// Symlink creates a symbolic link at path which points to target. Fails like Create() if path exists
+	Symlink(target, path string) error
+
+	Readlink(path string) (string, error)
+	Stat(path string) (os.FileInfo, error)
+	Lstat(path string) (os.FileInfo, error)
+
+	// ReadDir returns information about all entries of the directory at path, in no particular order
+	ReadDir(path string) ([]os.FileInfo, error)
+
+	MkdirAll(path string, perm os.FileMode) error
+	Remove(path string) error
+	Chtimes(path string, atime, mtime time.Time) error
+
+	// Device returns an identifier for the device hosting path. Paths which share the bandwidth of a device
+	// must have the same identifier
+	Device(path string) (uint64, error)
+}
+
+// MetadataWriter is implemented by writers of file systems which store the modification time and the digests
+// of a file along with its data, instead of changing it once it was written. SetMetadata is called once the
+// writer was created, without digests, and right before the writer is closed, with the digests of all bytes
+// written, keyed by their lower-case name, like "sha1". The modification time is zero if it is not to be set.
+type MetadataWriter interface {
+	SetMetadata(modTime time.Time, digests map[string][]byte)
+}
+
+// Renamer is implemented by file systems which can move a file to another path of the same file system,
+// atomically replacing the file which may exist there already
+type Renamer interface {
+	Rename(oldpath, newpath string) error
+}
+
+// The file system of the machine we run on
+type localFileSystem struct{}
+
+// LocalFileSystem handles all paths which are not underneath a mount point, see Mount()
+var LocalFileSystem FileSystem = localFileSystem{}
+
+func (localFileSystem) Open(path string) (io.ReadCloser, error) {
+	return os.Open(path)
+}
+
+func (localFileSystem) Create(path string, perm os.FileMode) (io.WriteCloser, error) {
+	return os.OpenFile(path, os.O_EXCL|os.O_WRONLY|os.O_CREATE, perm)
+}
+
+func (localFileSystem) Symlink(target, path string) error {
+	return os.Symlink(target, path)
+}
+
+func (localFileSystem) Readlink(path string) (string, error) {
+	return os.Readlink(path)
+}
+
+func (localFileSystem) Stat(path string) (os.FileInfo, error) {
+	return os.Stat(path)
+}
+
+func (localFileSystem) Lstat(path string) (os.FileInfo, error) {
+	return os.Lstat(path)
+}
+
+func (localFileSystem) ReadDir(path string) ([]os.FileInfo, error) {
+	fd, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+	return fd.Readdir(-1)
+}
+
+func (localFileSystem) MkdirAll(path string, perm os.FileMode) error {
+	return os.MkdirAll(path, perm)
+}
+
+func (localFileSystem) Remove(path string) error {
+	return os.Remove(path)
+}
+
+func (localFileSystem) Rename(oldpath, newpath string) error {
+	return os.Rename(oldpath, newpath)
+}
+
+func (localFileSystem) Chtimes(path string, atime, mtime time.Time) error {
+	return os.Chtimes(path, atime, mtime)
+}
+
+func (localFileSystem) Device(path string) (uint64, error) {
+	return deviceOf(path)
+}
+
+var (
+	mounts     = make(map[string]FileSystem)
+	mountsLock sync.RWMutex
+)
+
+// Mount makes the given file system handle root and all paths underneath it, instead of the local file system.
+// Mount points may be nested, the innermost one handles a path. Mounting nil removes the mount point.
+func Mount(root string, fs FileSystem) {
+	root = filepath.Clean(root)
+	mountsLock.Lock()
+	defer mountsLock.Unlock()
+	if fs == nil {
+		delete(mounts, root)
+		return
+	}
+	mounts[root] = fs
+}
+
+// FileSystemOf returns the file system handling the given path, along with its mount point, which is empty
+// for the local file system
+func FileSystemOf(path string) (FileSystem, string) {
+	mountsLock.RLock()
+	defer mountsLock.RUnlock()
+	if len(mounts) == 0 {
+		return LocalFileSystem, ""
+	}
+
+	path = filepath.Clean(path)
+	var root string
+	fs := LocalFileSystem
+	for r, rfs := range mounts {
+		if len(r) > len(root) && (path == r || strings.HasPrefix(path, strings.TrimSuffix(r, string(os.PathSeparator))+string(os.PathSeparator))) {
+			root, fs = r, rfs
+		}
+	}
+	return fs, root
+}
+
+func fileSystemOf(path string) FileSystem {
+	fs, _ := FileSystemOf(path)
+	return fs
+}
+
+// Dialer connects to the file system identified by the given URL, whose path is to be ignored.
+// The returned file system is mounted at root, which prefixes all paths it receives
+type Dialer func(u *url.URL, root string) (FileSystem, error)
+
+var (
+	dialers = make(map[string]Dialer)
+
+	// Mount points of URLs we resolved already, keyed by their root
+	dialed     = make(map[string]bool)
+	dialedLock sync.Mutex
+)
+
+// RegisterScheme makes URLs with the given scheme, like "sftp", usable wherever paths are expected, see ResolveURL().
+// It is meant to be called during initialization of the package implementing the file system
+func RegisterScheme(scheme string, dial Dialer) {
+	dialers[scheme] = dial
+}
+
+// IsURL returns true if the given item is a URL with a registered scheme, see ResolveURL()
+func IsURL(item string) bool {
+	i := strings.Index(item, "://")
+	if i < 0 {
+		return false
+	}
+	_, ok := dialers[item[:i]]
+	return ok
+}
+
+// ResolveURL returns the path at which the item can be accessed, which is the item itself unless it is a URL
+// with a registered scheme. The file system of its host is dialed and mounted once, at a root derived from
+// scheme, user and host. All URLs to the same host share it, and the path of the URL is appended to it.
+func ResolveURL(item string) (string, error) {
+	i := strings.Index(item, "://")
+	if i < 0 {
+		return item, nil
+	}
+	dial, ok := dialers[item[:i]]
+	if !ok {
+		return item, nil
+	}
+	u, err := url.Parse(item)
+	if err != nil {
+		return "", err
+	}
+	if u.Host == "" {
+		return "", fmt.Errorf("URL '%s' needs a host", item)
+	}
+
+	host := u.Host
+	if u.User != nil {
+		host = u.User.Username() + "@" + host
+	}
+	root := filepath.Join(string(os.PathSeparator), u.Scheme+":", host)
+	path := filepath.Join(root, filepath.FromSlash(u.Path))
+
+	dialedLock.Lock()
+	defer dialedLock.Unlock()
+	if dialed[root] {
+		return path, nil
+	}
+	fs, err := dial(u, root)
+	if err != nil {
+		return "", err
+	}
+	Mount(root, fs)
+	dialed[root] = true
+	return path, nil
+}
+
+// Create is like FileSystem.Create(), using the file system of the given path
+func Create(path string, perm os.FileMode) (io.WriteCloser, error) {
+	return fileSystemOf(path).Create(path, perm)
+}
+
+// Symlink is like FileSystem.Symlink(), using the file system of the given path
+func Symlink(target, path string) error {
+	return fileSystemOf(path).Symlink(target, path)
+}
+
+// ReadDir is like FileSystem.ReadDir(), using the file system of the given path
+func ReadDir(path string) ([]os.FileInfo, error) {
+	return fileSystemOf(path).ReadDir(path)
+}
+
+// MkdirAll is like os.MkdirAll(), using the file system of the given path
+func MkdirAll(path string, perm os.FileMode) error {
+	return fileSystemOf(path).MkdirAll(path, perm)
+}
+
+// Remove is like os.Remove(), using the file system of the given path
+func Remove(path string) error {
+	return fileSystemOf(path).Remove(path)
+}
+
+// CanRename returns true if the file system of the given path implements Renamer
+func CanRename(path string) bool {
+	_, ok := fileSystemOf(path).(Renamer)
+	return ok
+}
+
+// Rename is like os.Rename(), using the file system of the given paths, which must be the same one
+func Rename(oldpath, newpath string) error {
+	fs := fileSystemOf(newpath)
+	r, ok := fs.(Renamer)
+	if !ok || fileSystemOf(oldpath) != fs {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: errors.New("not supported by the file system")}
+	}
+	return r.Rename(oldpath, newpath)
+}
+
+// Chtimes is like os.Chtimes(), using the file system of the given path
+func Chtimes(path string, atime, mtime time.Time) error {
+	return fileSystemOf(path).Chtimes(path, atime, mtime)
+}
+
+// DeviceMap maps the given paths to their devices, effectively grouping them by device.
+// We use a simple array for this as actual device IDs are not relevant
+func DeviceMap(paths []string) [][]string {
+	// Devices of different file systems may have the same identifier
+	type device struct {
+		root string
+		id   uint64
+	}
+	m := make(map[device][]string)
+
+	for _, path := range paths {
+		fs, root := FileSystemOf(path)
+		did := device{root: root}
+		if id, err := fs.Device(path); err == nil {
+			did.id = id
+		}
+		m[did] = append(m[did], path)
+	}
+
+	res := make([][]string, 0, len(m))
+	for _, trees := range m {
+		res = append(res, trees)
+	}
+	return res
+}
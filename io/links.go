@@ -0,0 +1,24 @@
+package io
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+)
+
+// Identifies a file on the local file system, no matter how many hard links it has, see FileIDOf()
+type FileID struct {
+	Device, Inode uint64
+}
+
+// Link creates a hard link at path to the existing file at target, along with all directories leading to it.
+// Fails like Create() if path exists. Hard links are supported on the local file system only
+func Link(target, path string) error {
+	if fileSystemOf(path) != LocalFileSystem || fileSystemOf(target) != LocalFileSystem {
+		return errors.New("Hard links can only be created on the local file system")
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+		return err
+	}
+	return os.Link(target, path)
+}
@@ -7,36 +7,32 @@ import (
 	"syscall"
 )
 
-// deviceMap maps the given paths to their device ids, effectively grouping them by device.
-// We use a simple array for this as actual device IDs are not relevant
-func DeviceMap(paths []string) [][]string {
-	const defaultDevice uint64 = 0
-	m := make(map[uint64][]string)
-
-	for _, path := range paths {
-		fi, ferr := os.Stat(path)
-		did := defaultDevice
-		if ferr == nil {
-			st, ok := fi.Sys().(*syscall.Stat_t)
-			if ok {
-				did = uint64(st.Dev)
-			}
-		}
-		if p, ok := m[did]; ok {
-			m[did] = append(p, path)
-		} else {
-			p = make([]string, 1)
-			p[0] = path
-			m[did] = p
-		}
+// Returns the id of the device hosting the given path on the local file system
+func deviceOf(path string) (uint64, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return 0, err
+	}
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		return uint64(st.Dev), nil
 	}
+	return 0, nil
+}
 
-	res := make([][]string, len(m))
-	c := 0
-	for _, trees := range m {
-		res[c] = trees
-		c += 1
+// FileIDOf returns the id of the file described by the given information, as obtained from the local file system.
+// It's only valid if the file has more than one hard link
+func FileIDOf(fi os.FileInfo) (FileID, bool) {
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok && fi.Mode().IsRegular() && st.Nlink > 1 {
+		return FileID{uint64(st.Dev), uint64(st.Ino)}, true
 	}
+	return FileID{}, false
+}
 
-	return res
+// IsSparse returns true if the file described by the given information, as obtained from the local file system,
+// occupies less space than its size, as some of its zeros are holes which were never written
+func IsSparse(fi os.FileInfo) bool {
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok && fi.Mode().IsRegular() {
+		return int64(st.Blocks)*512 < fi.Size()
+	}
+	return false
 }
@@ -1,8 +1,20 @@
 package io
 
-// deviceMap currently only returns one device - how to obtain a device ID on windows ?
-func DeviceMap(paths []string) [][]string {
-	res := make([][]string, 1)
-	res[0] = paths
-	return res
+import (
+	"os"
+)
+
+// deviceOf currently only returns one device - how to obtain a device ID on windows ?
+func deviceOf(path string) (uint64, error) {
+	return 0, nil
+}
+
+// FileIDOf is not implemented on windows, which is why hard links are never detected there
+func FileIDOf(fi os.FileInfo) (FileID, bool) {
+	return FileID{}, false
+}
+
+// IsSparse is not implemented on windows, where files are always written entirely
+func IsSparse(fi os.FileInfo) bool {
+	return false
 }
@@ -5,7 +5,9 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"sync"
 	"sync/atomic"
+	"time"
 )
 
 // Size for allocated buffers
@@ -33,6 +35,35 @@ type readResult struct {
 
 type ReadChannelController struct {
 	c chan *ChannelReader
+
+	// Shared among all copies of this controller, it throttles all of its readers
+	limiter *rateLimiter
+}
+
+// Limits the throughput of all readers of a controller to a certain amount of bytes per second
+type rateLimiter struct {
+	bps  uint64 // bytes per second, 0 means unlimited. Accessed atomically
+	l    sync.Mutex
+	next time.Time // time at which the next read may start
+}
+
+// Wait until the given amount of bytes, which was just read, is within our budget
+func (r *rateLimiter) wait(n int) {
+	bps := atomic.LoadUint64(&r.bps)
+	if bps == 0 || n == 0 {
+		return
+	}
+
+	r.l.Lock()
+	now := time.Now()
+	if r.next.Before(now) {
+		r.next = now
+	}
+	r.next = r.next.Add(time.Duration(float64(n) / float64(bps) * float64(time.Second)))
+	d := r.next.Sub(now)
+	r.l.Unlock()
+
+	time.Sleep(d)
 }
 
 // Contains all information about a file or reader to be read
@@ -62,6 +93,12 @@ func (r *ReadChannelController) Streams() int {
 	return cap(r.c)
 }
 
+// SetRateLimit limits the amount of bytes all our streams may read per second, combined.
+// A limit of 0 disables rate limiting, which is the default
+func (r *ReadChannelController) SetRateLimit(bytesPerSecond uint64) {
+	atomic.StoreUint64(&r.limiter.bps, bytesPerSecond)
+}
+
 // Return a new channel reader
 // You should set either path
 // The buffer must not be shared among multiple channel readers !
@@ -143,7 +180,8 @@ func NewReadChannelController(nprocs int, stats *Stats, done <-chan bool) ReadCh
 	}
 
 	ctrl := ReadChannelController{
-		make(chan *ChannelReader, nprocs),
+		c:       make(chan *ChannelReader, nprocs),
+		limiter: &rateLimiter{},
 	}
 
 	reader := func(info *ChannelReader) {
@@ -162,7 +200,7 @@ func NewReadChannelController(nprocs int, stats *Stats, done <-chan bool) ReadCh
 		ourReader := false
 		if info.reader == nil {
 			if info.mode&os.ModeSymlink == os.ModeSymlink {
-				ldest, err := os.Readlink(info.path)
+				ldest, err := Readlink(info.path)
 				if err != nil {
 					sendError(err)
 					return
@@ -180,7 +218,7 @@ func NewReadChannelController(nprocs int, stats *Stats, done <-chan bool) ReadCh
 				}
 			} else {
 				ourReader = true
-				info.reader, err = os.Open(info.path)
+				info.reader, err = Open(info.path)
 				if err != nil {
 					sendError(err)
 					return
@@ -213,6 +251,7 @@ func NewReadChannelController(nprocs int, stats *Stats, done <-chan bool) ReadCh
 				{
 					nread, err = info.reader.Read(info.buf)
 					atomic.AddUint64(&stats.BytesRead, uint64(nread))
+					ctrl.limiter.wait(nread)
 					info.results <- readResult{info.buf[:nread], nread, err}
 					// we send all results, but abort if the reader is done for whichever reason
 					if err != nil {
@@ -223,7 +262,7 @@ func NewReadChannelController(nprocs int, stats *Stats, done <-chan bool) ReadCh
 		} // readForever
 
 		if ourReader {
-			info.reader.(*os.File).Close()
+			info.reader.(io.Closer).Close()
 			info.reader = nil
 		}
 	}
@@ -0,0 +1,87 @@
+package io
+
+import (
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+const (
+	// Destinations with this prefix are content-addressed stores, which are created if they don't exist
+	StorePrefix = "cas:"
+
+	// The directory of a content-addressed store which contains its objects. It's what makes a directory a store
+	StoreObjectsDir = "godi_objects"
+)
+
+// IsStore returns true if the given directory is a content-addressed store, see Store.
+// Stores are supported on the local file system only
+func IsStore(path string) bool {
+	if fileSystemOf(path) != LocalFileSystem {
+		return false
+	}
+	stat, err := os.Stat(filepath.Join(path, StoreObjectsDir))
+	return err == nil && stat.IsDir()
+}
+
+// CreateStore turns the given directory into a content-addressed store, creating it as needed.
+// It's no error if it is a store already
+func CreateStore(path string) error {
+	if fileSystemOf(path) != LocalFileSystem {
+		return errors.New("Content-addressed stores can only be created on the local file system")
+	}
+	return os.MkdirAll(filepath.Join(path, StoreObjectsDir), 0777)
+}
+
+// StoreObjectPath returns the path of the object with the given sha1 digest in the given store
+func StoreObjectPath(store string, sha1 []byte) string {
+	name := hex.EncodeToString(sha1)
+	if len(name) < 3 {
+		return filepath.Join(store, StoreObjectsDir, name)
+	}
+	return filepath.Join(store, StoreObjectsDir, name[:2], name[2:])
+}
+
+// Store is a content-addressed store, a directory in which files are kept as objects named by their sha1 digest.
+// That way, identical files are stored only once, no matter where they came from. The seals in the directory
+// of the store serve as manifests, and map the relative paths of the files they describe to their digests.
+// Symbolic links are objects containing their target.
+type Store struct {
+	root string
+}
+
+// NewStore returns a store for the given directory, see CreateStore()
+func NewStore(root string) *Store {
+	return &Store{root}
+}
+
+// Path returns the directory of the store
+func (s *Store) Path() string {
+	return s.root
+}
+
+// Returns a new temporary file, which becomes an object once its digest is known, see commit()
+func (s *Store) create() (*os.File, error) {
+	return ioutil.TempFile(filepath.Join(s.root, StoreObjectsDir), "tmp_")
+}
+
+// Moves the given temporary file into place as the object with the given sha1 digest, and returns its path.
+// If the object exists already, the file is removed, and existed is true.
+// Identical files written at the same time may both end up replacing the object, which is as good as keeping it.
+func (s *Store) commit(temp string, sha1 []byte) (path string, existed bool, err error) {
+	path = StoreObjectPath(s.root, sha1)
+	if _, err = os.Lstat(path); err == nil {
+		return path, true, os.Remove(temp)
+	}
+	if err = os.MkdirAll(filepath.Dir(path), 0777); err == nil {
+		// Objects never change
+		os.Chmod(temp, 0444)
+		err = os.Rename(temp, path)
+	}
+	if err != nil {
+		os.Remove(temp)
+	}
+	return path, false, err
+}
@@ -2,6 +2,8 @@ package io
 
 import (
 	"fmt"
+	"strconv"
+	"strings"
 )
 
 type BytesVolume uint64
@@ -31,3 +33,31 @@ func (b BytesVolume) StringPad(pad string) string {
 func (b BytesVolume) String() string {
 	return b.StringPad("6.2")
 }
+
+// ParseBytesVolume parses a human readable amount of bytes, like "500GB" or "1.5TiB".
+// Units with an 'i' are powers of 1024, the others are powers of 1000. A number without unit is
+// interpreted as bytes
+func ParseBytesVolume(s string) (BytesVolume, error) {
+	units := [...]struct {
+		suffix string
+		factor float64
+	}{
+		{"KiB", 1 << 10}, {"MiB", 1 << 20}, {"GiB", 1 << 30}, {"TiB", 1 << 40}, {"PiB", 1 << 50},
+		{"KB", 1e3}, {"MB", 1e6}, {"GB", 1e9}, {"TB", 1e12}, {"PB", 1e15},
+		{"B", 1},
+	}
+
+	num, factor := strings.TrimSpace(s), float64(1)
+	for _, u := range units {
+		if strings.HasSuffix(num, u.suffix) {
+			num, factor = strings.TrimSpace(num[:len(num)-len(u.suffix)]), u.factor
+			break
+		}
+	}
+
+	v, err := strconv.ParseFloat(num, 64)
+	if err != nil || v < 0 {
+		return 0, fmt.Errorf("Invalid amount of bytes: '%s'", s)
+	}
+	return BytesVolume(v * factor), nil
+}
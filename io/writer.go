@@ -1,13 +1,64 @@
 package io
 
 import (
+	"fmt"
 	"io"
 	"os"
 	"path/filepath"
+	"strings"
 	"sync"
 	"sync/atomic"
+	"time"
 )
 
+// Defines what to do if the destination of a copy exists already
+type ExistPolicy uint8
+
+const (
+	// Fail to write the file
+	ExistFail ExistPolicy = iota
+	// Keep the existing file without writing it. The caller must assure it has the same contents
+	ExistSkipIfIdentical
+	// Replace the existing file
+	ExistOverwrite
+	// Write the file next to the existing one, with a number appended to its name
+	ExistRename
+)
+
+var existPolicyNames = [...]string{"fail", "skip-if-identical", "overwrite", "rename"}
+
+func (e ExistPolicy) String() string {
+	return existPolicyNames[e]
+}
+
+// ParseExistPolicy returns the policy with the given name
+func ParseExistPolicy(name string) (ExistPolicy, error) {
+	for i, n := range existPolicyNames {
+		if n == name {
+			return ExistPolicy(i), nil
+		}
+	}
+	return ExistFail, fmt.Errorf("Invalid policy '%s', must be one of %s", name, strings.Join(existPolicyNames[:], ", "))
+}
+
+// The action taken when writing a file, depending on whether it existed and the ExistPolicy
+type WriteAction uint8
+
+const (
+	ActionCreated WriteAction = iota
+	ActionSkipped
+	ActionOverwritten
+	ActionRenamed
+	// The file was written into a Store, which had an object with the same contents already
+	ActionDeduplicated
+	// The file wasn't written, but is a hard link to another one, see Link()
+	ActionLinked
+)
+
+func (w WriteAction) String() string {
+	return [...]string{"created", "skipped", "overwritten", "renamed", "deduplicated", "linked"}[w]
+}
+
 // Similar to MultiWriter, but assumes writes never fail, and provides the same buffer
 // to all writers in parallel. However, it will return only when all writes are finished
 type uncheckedParallelMultiWriter struct {
@@ -122,6 +173,8 @@ type ChannelWriter struct {
 	n int
 	// error of previous write operation
 	e error
+	// if set, the writer on the other end is closed instead of written to
+	close bool
 
 	// will let us know when reomte is done
 	// NOTE: Would a channel be faster ?
@@ -156,15 +209,25 @@ func (c *ChannelWriter) Write(b []byte) (n int, err error) {
 	return c.n, c.e
 }
 
+// Close the writer on the other end of our channel. Closing may write data, like the last part of an upload,
+// which is why it counts as a stream of the controller
 func (c *ChannelWriter) Close() error {
 	atomic.AddUint32(&c.ctrl.stats.TotalFilesWritten, 1)
-	if w, ok := c.writer.(io.Closer); ok {
-		return w.Close()
+	if _, ok := c.writer.(io.Closer); !ok {
+		return nil
 	}
-	return nil
+	c.close = true
+	c.wg.Add(1)
+	c.ctrl.c <- c
+	c.wg.Wait()
+	c.close = false
+	return c.e
 }
 
-// A writer that will create a new file and intermediate directories on first write.
+// The size of the blocks which are checked for zeros when writing sparse files, matching the one of most file systems
+const sparseBlockSize = 4096
+
+// A writer that will create a new file and intermediate directories on first write, using the file system of its path.
 // You must call the close method to finish the writes and release system resources
 type LazyFileWriteCloser struct {
 
@@ -174,8 +237,55 @@ type LazyFileWriteCloser struct {
 	// The mode the destination file should have when done writing
 	mode os.FileMode
 
+	// The modification time the destination file should have when done writing, if set
+	modTime time.Time
+
+	// The size of the file to write, which is only needed when writing into archives
+	size int64
+
+	// If set, blocks of zeros are skipped instead of written to files of the local file system, leaving holes
+	sparse bool
+
+	// True if the last block was skipped, which requires the file to be extended to its size when closing
+	hole bool
+
+	// The digests of the written file, which are passed on to writers implementing MetadataWriter
+	digests map[string][]byte
+
+	// If set, files are written as members of the archive, whose path is the root of all paths we are given.
+	// As members are written one at a time, only one file is read at a time by all readers sharing the archive,
+	// see SetPath()
+	Archive *ArchiveWriter
+
+	// The writer of the current archive member, unset for symbolic links
+	member io.Writer
+
+	// If set, files are written as objects of the store, whose path is the root of all paths we are given
+	Store *Store
+
+	// The path of the object the file was stored as, valid after closing
+	object string
+
+	// What to do if the file at path exists already
+	OnExist ExistPolicy
+
+	// If set, writers implementing MetadataWriter are not given the digests of the file
+	NoDigestMetadata bool
+
+	// If set, existing files are not replaced when closing, but once all of them are committed, see Replacements
+	Replacements *Replacements
+
+	// What happened to the file at path, valid after the first write
+	action WriteAction
+
+	// True if the file at path was created or dealt with after the first write
+	created bool
+
+	// The file written instead of the existing one at path, which replaces it once it is complete
+	temp string
+
 	// A writer we are using to perform the write
-	writer *os.File
+	writer io.WriteCloser
 }
 
 // Path returns the currently set path
@@ -184,19 +294,181 @@ func (l *LazyFileWriteCloser) Path() string {
 }
 
 // SetPath changes the path to the given one.
-// It's an error to set a new path while the previous writer wasn't closed yet
+// It's an error to set a new path while the previous writer wasn't closed yet.
+// If we write into an Archive, this blocks until the member written previously was closed, by us or by another
+// writer of the same archive. As this is called by the reader of the file, copying into an archive reads only one
+// file at a time, no matter how many readers there are. Spooling members to disk would allow reading in parallel,
+// at the cost of writing all data twice, which isn't worth it as the archive is written sequentially anyway
 func (l *LazyFileWriteCloser) SetPath(p string, mode os.FileMode) {
-	if l.writer != nil {
+	if l.writer != nil || l.member != nil || len(l.temp) > 0 {
 		panic("Previous writer wasn't close - can't set new path")
 	}
 	l.path = p
 	l.mode = mode
+	l.modTime = time.Time{}
+	l.size = 0
+	l.sparse = false
+	l.hole = false
+	l.digests = nil
+	l.object = ""
+	l.action = ActionCreated
+	l.created = false
+
+	// Wait until the archive is ready for the next member, which is undone when closing
+	if l.Archive != nil {
+		l.Archive.Begin()
+	}
+}
+
+// SetSize sets the amount of bytes we are going to write. Must be called after SetPath
+func (l *LazyFileWriteCloser) SetSize(size int64) {
+	l.size = size
+}
+
+// SetSparse enables writing the file at our path with holes where it has zeros, like the sparse file it is a copy of.
+// Must be called after SetPath
+func (l *LazyFileWriteCloser) SetSparse(sparse bool) {
+	l.sparse = sparse
+}
+
+// Object returns the path of the object the file was stored as, if it was written into a Store.
+// Valid after closing
+func (l *LazyFileWriteCloser) Object() string {
+	return l.object
+}
+
+// Action returns what happened to the file at our path when it was written, which may have changed the path
+func (l *LazyFileWriteCloser) Action() WriteAction {
+	return l.action
+}
+
+// Creates the file at our path, or a symlink pointing to the given target, dealing with existing files
+// according to our policy
+func (l *LazyFileWriteCloser) create(target []byte) error {
+	create := func(path string) (err error) {
+		if l.mode&os.ModeSymlink == os.ModeSymlink {
+			return Symlink(string(target), path)
+		}
+		// Keep the writer unset on error, an interface holding a nil file isn't nil
+		var w io.WriteCloser
+		if w, err = Create(path, l.mode); err == nil {
+			l.writer = w
+			// The digests are only known once all bytes were written
+			if mw, ok := w.(MetadataWriter); ok {
+				mw.SetMetadata(l.modTime, nil)
+			}
+		}
+		return err
+	}
+
+	err := create(l.path)
+	if !os.IsExist(err) {
+		return err
+	}
+
+	switch l.OnExist {
+	case ExistSkipIfIdentical:
+		l.action = ActionSkipped
+		return nil
+	case ExistOverwrite:
+		// The existing file is kept until its replacement is complete, see replace().
+		// Renaming assures we get the mode and type we want, and that hardlinks are left alone
+		dir, base := filepath.Dir(l.path), filepath.Base(l.path)
+		for i := 0; os.IsExist(err); i++ {
+			l.temp = filepath.Join(dir, fmt.Sprintf(".%s.godi-%d", base, i))
+			err = create(l.temp)
+		}
+		if err != nil {
+			l.temp = ""
+			return err
+		}
+		l.action = ActionOverwritten
+	case ExistRename:
+		ext := filepath.Ext(l.path)
+		if ext == filepath.Base(l.path) {
+			ext = ""
+		}
+		base := l.path[:len(l.path)-len(ext)]
+		for i := 1; os.IsExist(err); i++ {
+			l.path = fmt.Sprintf("%s_%d%s", base, i, ext)
+			err = create(l.path)
+		}
+		l.action = ActionRenamed
+	}
+	return err
+}
+
+// Moves the temporary file over the existing one at our path if it was written entirely, as indicated by digests,
+// or removes it otherwise. Returns the given error, or the one of the replacement
+func (l *LazyFileWriteCloser) replace(err error) error {
+	temp := l.temp
+	l.temp = ""
+	if err != nil || l.digests == nil {
+		Remove(temp)
+		return err
+	}
+	if l.Replacements != nil {
+		l.Replacements.add(temp, l.path)
+		return nil
+	}
+	if err = Rename(temp, l.path); err != nil {
+		Remove(temp)
+	}
+	return err
+}
+
+// SetDigests sets the digests of the file at our path, see MetadataWriter. Must be called after SetPath
+func (l *LazyFileWriteCloser) SetDigests(digests map[string][]byte) {
+	l.digests = digests
+}
+
+// SetModTime sets the modification time to apply to the file at our path when it is closed.
+// Must be called after SetPath
+func (l *LazyFileWriteCloser) SetModTime(t time.Time) {
+	l.modTime = t
+}
+
+// ModTime returns the modification time the file at our path is given, or the zero time if it is the
+// time it was written at
+func (l *LazyFileWriteCloser) ModTime() time.Time {
+	return l.modTime
 }
 
 func (l *LazyFileWriteCloser) Write(b []byte) (n int, err error) {
-	if l.writer == nil {
+	if l.Archive != nil {
+		if !l.created {
+			var target string
+			if l.mode&os.ModeSymlink == os.ModeSymlink {
+				target = string(b)
+			}
+			name := filepath.ToSlash(l.path[len(l.Archive.Path())+1:])
+			if l.member, err = l.Archive.Create(name, l.mode, l.size, l.modTime, target); err != nil {
+				return 0, err
+			}
+			l.created = true
+		}
+		if l.member == nil {
+			return len(b), nil
+		}
+		return l.member.Write(b)
+	}
+
+	// Objects are named by their digest, which is known once all bytes were written
+	if l.Store != nil {
+		if !l.created {
+			fd, err := l.Store.create()
+			if err != nil {
+				return 0, err
+			}
+			l.writer = fd
+			l.created = true
+		}
+		return l.writer.Write(b)
+	}
+
+	if !l.created {
 		// assure directory exists
-		err = os.MkdirAll(filepath.Dir(l.path), 0777)
+		err = MkdirAll(filepath.Dir(l.path), 0777)
 		if err != nil {
 			return 0, err
 		}
@@ -206,31 +478,177 @@ func (l *LazyFileWriteCloser) Write(b []byte) (n int, err error) {
 		// If not, the reader will panic
 
 		// Symlinks are created right away
-		if l.mode&os.ModeSymlink == os.ModeSymlink {
-			err = os.Symlink(string(b), l.path)
-			return len(b), err
-		} else {
-			l.writer, err = os.OpenFile(l.path, os.O_EXCL|os.O_WRONLY|os.O_CREATE, l.mode)
-			if err != nil {
-				return 0, err
-			}
+		if err = l.create(b); err != nil {
+			return 0, err
 		}
+		l.created = true
 	}
 
+	// Symlinks and skipped files have nothing more to write
+	if l.writer == nil {
+		return len(b), nil
+	}
+	if fd, ok := l.writer.(*os.File); ok && l.sparse {
+		return l.writeSparse(fd, b)
+	}
 	return l.writer.Write(b)
 }
 
+// Writes the given bytes to fd, but seeks over all blocks of zeros to leave holes instead
+func (l *LazyFileWriteCloser) writeSparse(fd *os.File, b []byte) (n int, err error) {
+	isZero := func(b []byte) bool {
+		for _, c := range b {
+			if c != 0 {
+				return false
+			}
+		}
+		return true
+	}
+
+	for n < len(b) {
+		// Consecutive blocks of the same kind are handled at once
+		end, zero := n, false
+		for end < len(b) {
+			bend := end + sparseBlockSize
+			if bend > len(b) {
+				bend = len(b)
+			}
+			if bzero := isZero(b[end:bend]); end == n {
+				zero = bzero
+			} else if bzero != zero {
+				break
+			}
+			end = bend
+		}
+
+		if zero {
+			_, err = fd.Seek(int64(end-n), os.SEEK_CUR)
+		} else {
+			_, err = fd.Write(b[n:end])
+		}
+		if err != nil {
+			return n, err
+		}
+		l.hole = zero
+		n = end
+	}
+	return n, nil
+}
+
 // Close our writer if it was initialized already. Therefore it's safe to call this even if Write wasn't called
 // beforehand
 func (l *LazyFileWriteCloser) Close() error {
-	if l.writer != nil {
+	if l.Archive != nil {
+		l.member = nil
+		return l.Archive.End()
+	}
+	if l.Store != nil && l.writer != nil {
+		temp := l.writer.(*os.File).Name()
 		err := l.writer.Close()
 		l.writer = nil
+		// Without digests, the file wasn't read entirely
+		if err != nil || l.digests == nil {
+			os.Remove(temp)
+			return err
+		}
+		var existed bool
+		if l.object, existed, err = l.Store.commit(temp, l.digests["sha1"]); existed {
+			l.action = ActionDeduplicated
+		}
+		return err
+	}
+	if l.writer != nil {
+		mw, hasMetadata := l.writer.(MetadataWriter)
+		if hasMetadata {
+			digests := l.digests
+			if l.NoDigestMetadata {
+				digests = nil
+			}
+			mw.SetMetadata(l.modTime, digests)
+		}
+		var err error
+		if l.hole {
+			// Seeking doesn't change the size, which is why trailing holes are made by truncating
+			fd := l.writer.(*os.File)
+			var size int64
+			if size, err = fd.Seek(0, os.SEEK_CUR); err == nil {
+				err = fd.Truncate(size)
+			}
+		}
+		if cerr := l.writer.Close(); err == nil {
+			err = cerr
+		}
+		l.writer = nil
+		path := l.path
+		if len(l.temp) > 0 {
+			path = l.temp
+		}
+		if err == nil && !hasMetadata && !l.modTime.IsZero() {
+			err = Chtimes(path, l.modTime, l.modTime)
+		}
+		if len(l.temp) > 0 {
+			err = l.replace(err)
+		}
 		return err
 	}
+	// Symbolic links replacing existing ones
+	if len(l.temp) > 0 {
+		return l.replace(nil)
+	}
 	return nil
 }
 
+// Replacements keeps complete copies of existing files, which replace them all at once when committed.
+// This allows to keep existing files unchanged until it is known that all of their copies succeeded.
+// It is safe for concurrent use
+type Replacements struct {
+	l sync.Mutex
+
+	// Temporary files, by the path of the existing file they replace
+	temps map[string]string
+}
+
+func (r *Replacements) add(temp, path string) {
+	r.l.Lock()
+	defer r.l.Unlock()
+	if r.temps == nil {
+		r.temps = make(map[string]string)
+	}
+	r.temps[path] = temp
+}
+
+// Len returns the amount of files waiting to be replaced
+func (r *Replacements) Len() int {
+	r.l.Lock()
+	defer r.l.Unlock()
+	return len(r.temps)
+}
+
+// Commit replaces all existing files with their copies, and returns the errors of those which couldn't be replaced.
+// Their copies are removed
+func (r *Replacements) Commit() (errs []error) {
+	r.l.Lock()
+	defer r.l.Unlock()
+	for path, temp := range r.temps {
+		if err := Rename(temp, path); err != nil {
+			Remove(temp)
+			errs = append(errs, err)
+		}
+	}
+	r.temps = nil
+	return
+}
+
+// Discard removes all copies, keeping the existing files unchanged
+func (r *Replacements) Discard() {
+	r.l.Lock()
+	defer r.l.Unlock()
+	for _, temp := range r.temps {
+		Remove(temp)
+	}
+	r.temps = nil
+}
+
 // A utility to help control how parallel we try to write
 type WriteChannelController struct {
 	// Keeps all write requests, which contain all information we could possibly want to write something.
@@ -249,6 +667,24 @@ type RootedWriteController struct {
 
 	// A possibly shared controller which may write to the given tree
 	Ctrl WriteChannelController
+
+	// What to do with files which exist in one of the trees already
+	OnExist ExistPolicy
+
+	// Writers for the trees which are archives, by tree
+	Archives map[string]*ArchiveWriter
+
+	// The trees which are content-addressed stores
+	Stores map[string]*Store
+
+	// If set, existing files are only replaced once the replacements are committed
+	Replacements *Replacements
+
+	// If set, copies get the modification time of their source. Otherwise it is the time they were written at
+	KeepModTimes bool
+
+	// If set, file systems storing metadata with each file don't store its digests, see MetadataWriter
+	NoDigestMetadata bool
 }
 
 // Create a new controller which deals with writing all incoming requests with nprocs go-routines.
@@ -266,6 +702,11 @@ func NewWriteChannelController(nprocs, channelCap int, stats *Stats) WriteChanne
 	for i := 0; i < nprocs; i++ {
 		go func() {
 			for cw := range ctrl.c {
+				if cw.close {
+					cw.e = cw.writer.(io.Closer).Close()
+					cw.wg.Done()
+					continue
+				}
 				atomic.AddUint32(&stats.FilesBeingWritten, 1)
 				cw.n, cw.e = cw.writer.Write(cw.b)
 				atomic.AddUint64(&stats.BytesWritten, uint64(cw.n))
@@ -305,3 +746,38 @@ func (wm RootedWriteControllers) Trees() (n int) {
 	}
 	return
 }
+
+// Archive returns the writer for the given tree if it is an archive, or nil
+func (wm RootedWriteControllers) Archive(tree string) *ArchiveWriter {
+	for _, rctrl := range wm {
+		if a, ok := rctrl.Archives[tree]; ok {
+			return a
+		}
+	}
+	return nil
+}
+
+// CanLink returns true if hard links can be created in all trees, which are directories of the local file system
+func (wm RootedWriteControllers) CanLink() bool {
+	for _, rctrl := range wm {
+		if len(rctrl.Archives) > 0 || len(rctrl.Stores) > 0 {
+			return false
+		}
+		for _, tree := range rctrl.Trees {
+			if fileSystemOf(tree) != LocalFileSystem {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// Store returns the given tree if it is a content-addressed store, or nil
+func (wm RootedWriteControllers) Store(tree string) *Store {
+	for _, rctrl := range wm {
+		if s, ok := rctrl.Stores[tree]; ok {
+			return s
+		}
+	}
+	return nil
+}
@@ -0,0 +1,153 @@
+/*
+Package cli implements the command-line interface for merge and split, for use by the cli.App
+*/
+package cli
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/Byron/godi/api"
+	"github.com/Byron/godi/cli"
+	"github.com/Byron/godi/codec"
+	"github.com/Byron/godi/merge"
+	"github.com/Byron/godi/seal"
+
+	gcli "github.com/codegangsta/cli"
+)
+
+const (
+	formatFlagName   = "format"
+	subdirFlagName   = "subdir"
+	mergeDescription = `
+	Combine multiple seals into a single one.
+
+	All seals must be located inside of the destination directory, which will contain the merged seal.
+	The paths of all sealed files are made relative to it. Files listed in more than one seal are merged
+	if they are the same, and cause the merge to fail otherwise.
+
+	[arguments ...] are two or more seal files, optionally followed by the destination directory, for example
+
+	godi merge /Volumes/project/card1/godi_2014-07-30_102259.gobz /Volumes/project/card2/godi_2014-07-30_112259.gobz -- /Volumes/project
+
+	If the destination is omitted, the deepest directory containing all seals is used.
+`
+	splitDescription = `
+	Write a seal for a sub-directory of the data described by an existing seal.
+
+	The new seal is placed in the sub-directory, and contains all sealed files inside of it.
+
+	[arguments ...] is a seal file, for example
+
+	godi split --subdir A003 /Volumes/project/godi_2014-07-30_102259.gobz
+`
+)
+
+// return subcommands for our particular area of algorithms
+func SubCommands() []gcli.Command {
+	format := gcli.StringFlag{
+		Name:  formatFlagName,
+		Value: codec.GobName,
+		Usage: fmt.Sprintf("The format of the produced seal file, one of %s", strings.Join(codec.Names(), ", ")),
+	}
+
+	return []gcli.Command{
+		gcli.Command{
+			Name:      merge.MergeName,
+			ShortName: "",
+			Usage:     mergeDescription,
+			Action:    func(c *gcli.Context) { run(c, mergeSeals) },
+			Flags:     []gcli.Flag{format},
+		},
+		gcli.Command{
+			Name:      merge.SplitName,
+			ShortName: "",
+			Usage:     splitDescription,
+			Action:    func(c *gcli.Context) { run(c, splitSeal) },
+			Flags: []gcli.Flag{
+				format,
+				gcli.StringFlag{
+					Name:  subdirFlagName,
+					Value: "",
+					Usage: "The sub-directory to write a seal for, relative to the seal's directory",
+				},
+			},
+		},
+	}
+}
+
+func mergeSeals(c *gcli.Context, sc codec.Codec, handler func(api.Result)) error {
+	seals, root := c.Args(), ""
+	for i, arg := range seals {
+		if arg == seal.Sep {
+			if i != len(seals)-2 {
+				return fmt.Errorf("Expected a single destination directory after '%s'", seal.Sep)
+			}
+			seals, root = seals[:i], seals[i+1]
+			break
+		}
+	}
+
+	index, numFiles, conflicts, err := merge.Merge(seals, root, sc)
+	for _, conflict := range conflicts {
+		handler(&api.BasicResult{Msg: "CONFLICT: " + conflict.Error(), Err: conflict, Prio: api.Error})
+	}
+	if err != nil {
+		return err
+	}
+
+	handler(&api.BasicResult{
+		Msg:   fmt.Sprintf("MERGE: Wrote %d file(s) of %d seal(s) to '%s'", numFiles, len(seals), index),
+		Finfo: api.FileInfo{Path: index, Size: -1},
+		Prio:  api.Valuable,
+	})
+	return nil
+}
+
+func splitSeal(c *gcli.Context, sc codec.Codec, handler func(api.Result)) error {
+	if len(c.Args()) != 1 {
+		return errors.New("Please provide exactly one seal file to split")
+	}
+	subdir := c.String(subdirFlagName)
+	if len(subdir) == 0 {
+		return fmt.Errorf("Please provide the sub-directory to split off with --%s", subdirFlagName)
+	}
+
+	index, numFiles, err := merge.Split(c.Args()[0], subdir, sc)
+	if err != nil {
+		return err
+	}
+
+	handler(&api.BasicResult{
+		Msg:   fmt.Sprintf("SPLIT: Wrote %d file(s) to '%s'", numFiles, index),
+		Finfo: api.FileInfo{Path: index, Size: -1},
+		Prio:  api.Valuable,
+	})
+	return nil
+}
+
+// Parses common flags and runs the given function with the chosen codec, dealing with errors accordingly
+func run(c *gcli.Context, fn func(*gcli.Context, codec.Codec, func(api.Result)) error) {
+	_, level, _, err := cli.CheckCommonFlags(c)
+	handler := cli.MakeLogHandler(level)
+
+	if err == nil {
+		format := c.String(formatFlagName)
+		sc := codec.NewByName(format)
+		if sc == nil {
+			err = fmt.Errorf("Invalid seal format '%s', must be one of %s", format, strings.Join(codec.Names(), ", "))
+		} else {
+			err = fn(c, sc, handler)
+		}
+	}
+	if err != nil {
+		handler(&api.BasicResult{Err: err, Prio: api.Error})
+	}
+
+	nerr := cli.CliFinishApp(c)
+	if err != nil || nerr != nil {
+		os.Exit(1)
+	}
+}
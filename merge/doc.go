@@ -0,0 +1,6 @@
+/*
+Package merge implements the 'merge' and 'split' functionality, which combine multiple seals into one, or
+extract a seal for a sub-directory from an existing one.
+
+*/
+package merge
@@ -0,0 +1,137 @@
+package merge_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Byron/godi/api"
+	"github.com/Byron/godi/codec"
+	"github.com/Byron/godi/merge"
+	"github.com/Byron/godi/seal"
+	"github.com/Byron/godi/testlib"
+	"github.com/Byron/godi/verify"
+)
+
+func sealOrFail(t *testing.T, tree, format string) string {
+	sealcmd, err := seal.NewCommand([]string{tree}, 1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealcmd.Format = format
+	var indices []string
+	if err = api.StartEngine(sealcmd, api.IndexTrackingResultHandlerAdapter(&indices, testlib.ResultHandler(t, false))); err != nil {
+		t.Fatal(err)
+	}
+	return indices[0]
+}
+
+func verifyOrFail(t *testing.T, index string) {
+	verifycmd, err := verify.NewCommand([]string{index}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = api.StartEngine(verifycmd, testlib.ResultHandler(t, false)); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestMergeAndSplit(t *testing.T) {
+	project, _ := ioutil.TempDir("", "project")
+	defer testlib.RmTree(project)
+
+	// Two cards, consolidated into one project
+	var seals []string
+	for _, card := range []string{"card1", "card2"} {
+		dataset, _, symlink := testlib.MakeDatasetOrPanic()
+		// The symlink points into the dataset, and would be broken after moving it
+		if len(symlink) > 0 {
+			os.Remove(symlink)
+		}
+		tree := filepath.Join(project, card)
+		if err := os.Rename(dataset, tree); err != nil {
+			t.Fatal(err)
+		}
+		seals = append(seals, sealOrFail(t, tree, codec.GobName))
+	}
+
+	if _, _, _, err := merge.Merge(seals[:1], project, &codec.Gob{}); err == nil {
+		t.Error("Merging requires at least two seals")
+	}
+	if _, _, _, err := merge.Merge(seals, filepath.Join(project, "card1"), &codec.Gob{}); err == nil {
+		t.Error("Seals must be inside of the destination")
+	}
+
+	// The common directory is used as destination by default
+	merged, numFiles, conflicts, err := merge.Merge(seals, "", &codec.MHL{})
+	if err != nil || len(conflicts) > 0 {
+		t.Fatal(err, conflicts)
+	}
+	if filepath.Dir(merged) != project || numFiles != 12 {
+		t.Errorf("Expected merged seal with 12 files in '%s', got '%s' with %d files", project, merged, numFiles)
+	}
+	verifyOrFail(t, merged)
+
+	// Split off a sub-directory of the merged seal
+	split, numFiles, err := merge.Split(merged, filepath.Join("card2", "subdir"), &codec.Gob{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if filepath.Dir(split) != filepath.Join(project, "card2", "subdir") || numFiles != 3 {
+		t.Errorf("Expected split seal with 3 files in card2/subdir, got '%s' with %d files", split, numFiles)
+	}
+	verifyOrFail(t, split)
+
+	if _, _, err = merge.Split(merged, "nonexisting", &codec.Gob{}); err == nil {
+		t.Error("Sub-directories without sealed files can't be split off")
+	}
+	if _, _, err = merge.Split(merged, "..", &codec.Gob{}); err == nil {
+		t.Error("Sub-directories must be inside of the seal's directory")
+	}
+
+	// Seals which disagree about a file can't be merged
+	testlib.MakeFileOrPanic(filepath.Join(project, "card1", "somebytes_noext"), 100)
+	changed := sealOrFail(t, filepath.Join(project, "card1"), codec.MHLName)
+	_, _, conflicts, err = merge.Merge([]string{seals[0], changed}, "", &codec.Gob{})
+	if err == nil || len(conflicts) != 1 || conflicts[0].RelaPath != "somebytes_noext" {
+		t.Errorf("Expected a single conflict, got %v", conflicts)
+	}
+}
+
+func TestMergeChecksumLists(t *testing.T) {
+	project, _ := ioutil.TempDir("", "project")
+	defer testlib.RmTree(project)
+
+	var seals []string
+	for _, card := range []string{"card1", "card2"} {
+		tree := filepath.Join(project, card)
+		if err := os.MkdirAll(filepath.Join(tree, "subdir"), 0777); err != nil {
+			t.Fatal(err)
+		}
+		testlib.MakeFileOrPanic(filepath.Join(tree, "somebytes"), 100)
+		testlib.MakeFileOrPanic(filepath.Join(tree, "subdir", "morebytes"), 50)
+		seals = append(seals, sealOrFail(t, tree, codec.Sha256SumName))
+	}
+
+	// Checksum lists have neither sizes nor sha1 and md5 hashes, which are filled in or kept respectively
+	merged, numFiles, _, err := merge.Merge(seals, "", &codec.Gob{})
+	if err != nil || numFiles != 4 {
+		t.Fatal(err, numFiles)
+	}
+	verifyOrFail(t, merged)
+
+	split, _, err := merge.Split(merged, "card1", &codec.JSONL{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifyOrFail(t, split)
+
+	// Formats which can't keep the sha256 hashes would lose them
+	if _, _, _, err = merge.Merge(seals, "", codec.NewByName(codec.MD5SumName)); err == nil {
+		t.Error("Merging sha256 hashes into an md5 checksum list must fail")
+	}
+	if _, _, err = merge.Split(merged, "card2", &codec.MHL{}); err == nil {
+		t.Error("Splitting sha256 hashes into an mhl seal must fail")
+	}
+}
@@ -0,0 +1,234 @@
+package merge
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/Byron/godi/api"
+	"github.com/Byron/godi/codec"
+	gio "github.com/Byron/godi/io"
+	"github.com/Byron/godi/seal"
+)
+
+const (
+	MergeName = "merge"
+	SplitName = "split"
+)
+
+// A Conflict describes two sealed files which would end up at the same path after merging, but which differ
+type Conflict struct {
+	RelaPath string    // The path relative to the merged seal
+	Seals    [2]string // The seals listing the file
+}
+
+func (c *Conflict) Error() string {
+	return fmt.Sprintf("'%s' differs between '%s' and '%s'", c.RelaPath, c.Seals[0], c.Seals[1])
+}
+
+// Returns true if both files have the same digests, and the same size if compareSizes is set
+func sameFile(l, r *api.FileInfo, compareSizes bool) bool {
+	return (!compareSizes || l.Size == r.Size) && api.SameDigests(l, r)
+}
+
+// Read all files of the given seal, whose signature is verified on the way.
+// Returns true as well if the seal contains the size of each file
+func readSeal(index string) ([]api.FileInfo, bool, error) {
+	c := codec.NewByPath(index)
+	if c == nil {
+		return nil, false, fmt.Errorf("Unknown seal file format: '%s'", index)
+	}
+	fd, err := os.Open(index)
+	if err != nil {
+		return nil, false, err
+	}
+	defer fd.Close()
+
+	var res []api.FileInfo
+	files := make(chan api.FileInfo)
+	collected := make(chan bool)
+	go func() {
+		for f := range files {
+			res = append(res, f)
+		}
+		close(collected)
+	}()
+
+	err = c.Deserialize(fd, files, func(*api.FileInfo) bool { return true })
+	close(files)
+	<-collected
+	if err != nil {
+		return nil, false, fmt.Errorf("Failed to read seal '%s': %s", index, err)
+	}
+	return res, codec.HasSizes(c), nil
+}
+
+// Makes sure a seal written by c keeps all the given file has, as read from the given seal.
+// If the seal has no sizes but c stores them, the size is taken from the file itself.
+func complete(c codec.Codec, f *api.FileInfo, index string, hasSizes bool) error {
+	if name := codec.MissingDigest(c, f); len(name) > 0 {
+		return fmt.Errorf("Seals of format '%s' can't keep the %s hash of '%s', please choose another format", c.Extension(), name, f.Path)
+	}
+	if hasSizes || !codec.HasSizes(c) {
+		return nil
+	}
+	stat, err := gio.Lstat(f.Path)
+	if err != nil {
+		return fmt.Errorf("Seal '%s' has no size of '%s', which can't be read either, please choose a format without sizes: %s", index, f.Path, err)
+	}
+	f.Size = stat.Size()
+	return nil
+}
+
+// Write a new seal with the given files into tree, and return its path
+func writeSeal(tree string, c codec.Codec, files []api.FileInfo) (string, error) {
+	finfos, result := seal.SetupIndexWriter(tree, c)
+	for _, f := range files {
+		select {
+		case r := <-result:
+			// The writer only sends a result early if it failed
+			return r.Path, r.Err
+		case finfos <- f:
+		}
+	}
+	close(finfos)
+	r := <-result
+	return r.Path, r.Err
+}
+
+// Returns the directory containing all of the given directories
+func commonDir(dirs []string) string {
+	common := dirs[0]
+	for _, dir := range dirs[1:] {
+		for common != dir && !strings.HasPrefix(dir, common+string(os.PathSeparator)) {
+			parent := filepath.Dir(common)
+			if parent == common {
+				break
+			}
+			common = parent
+		}
+	}
+	return common
+}
+
+// Merge combines the given seals into a new seal in root, written with the given codec. The directories of all
+// seals must be inside of root, or equal to it, and their relative paths are rebased onto root accordingly.
+// If root is empty, the deepest directory containing all seals is used.
+// Files listed in multiple seals are merged if they are the same, otherwise they are returned as conflicts,
+// and no seal is written.
+// Returns the path to the new seal and the amount of files in it.
+func Merge(seals []string, root string, c codec.Codec) (index string, numFiles int, conflicts []*Conflict, err error) {
+	if len(seals) < 2 {
+		return "", 0, nil, errors.New("Please provide at least two seal files to merge")
+	}
+
+	dirs := make([]string, len(seals))
+	for i, path := range seals {
+		if seals[i], err = filepath.Abs(path); err != nil {
+			return
+		}
+		dirs[i] = filepath.Dir(seals[i])
+	}
+	if len(root) == 0 {
+		root = commonDir(dirs)
+	}
+	if root, err = filepath.Abs(root); err != nil {
+		return
+	}
+
+	type source struct {
+		f        api.FileInfo
+		seal     string
+		hasSizes bool
+	}
+	merged := make(map[string]*source)
+	var files []api.FileInfo
+
+	for i, path := range seals {
+		var prefix string
+		if dirs[i] != root {
+			if !strings.HasPrefix(dirs[i], root+string(os.PathSeparator)) {
+				return "", 0, nil, fmt.Errorf("Seal '%s' is not located inside of '%s'", path, root)
+			}
+			prefix = dirs[i][len(root)+1:]
+		}
+
+		var sealed []api.FileInfo
+		var hasSizes bool
+		if sealed, hasSizes, err = readSeal(path); err != nil {
+			return
+		}
+		for _, f := range sealed {
+			f.RelaPath = filepath.Join(prefix, f.RelaPath)
+			f.Path = filepath.Join(root, f.RelaPath)
+			if len(f.Link) > 0 {
+				f.Link = filepath.Join(prefix, f.Link)
+			}
+			if err = complete(c, &f, path, hasSizes); err != nil {
+				return
+			}
+			if prev, ok := merged[f.RelaPath]; ok {
+				if !sameFile(&prev.f, &f, prev.hasSizes && hasSizes) {
+					conflicts = append(conflicts, &Conflict{f.RelaPath, [2]string{prev.seal, path}})
+				}
+				continue
+			}
+			merged[f.RelaPath] = &source{f, path, hasSizes}
+			files = append(files, f)
+		}
+	}
+
+	if len(conflicts) > 0 {
+		return "", 0, conflicts, fmt.Errorf("Didn't write merged seal due to %d conflicting file(s)", len(conflicts))
+	}
+	index, err = writeSeal(root, c, files)
+	return index, len(files), nil, err
+}
+
+// Split writes a new seal into the given sub-directory of the directory containing the given seal, using
+// the given codec. It contains all sealed files inside of the sub-directory, with paths relative to it.
+// Returns the path to the new seal and the amount of files in it.
+func Split(index, subdir string, c codec.Codec) (string, int, error) {
+	subdir = filepath.Clean(subdir)
+	if filepath.IsAbs(subdir) || subdir == "." || subdir == ".." || strings.HasPrefix(subdir, ".."+string(os.PathSeparator)) {
+		return "", 0, fmt.Errorf("Sub-directory '%s' must be relative to the seal's directory", subdir)
+	}
+
+	index, err := filepath.Abs(index)
+	if err != nil {
+		return "", 0, err
+	}
+	sealed, hasSizes, err := readSeal(index)
+	if err != nil {
+		return "", 0, err
+	}
+
+	tree := filepath.Join(filepath.Dir(index), subdir)
+	prefix := subdir + string(os.PathSeparator)
+	var files []api.FileInfo
+	for _, f := range sealed {
+		if !strings.HasPrefix(f.RelaPath, prefix) {
+			continue
+		}
+		f.RelaPath = f.RelaPath[len(prefix):]
+		f.Path = filepath.Join(tree, f.RelaPath)
+		// Links to files outside of the sub-directory are verified by their contents instead
+		if strings.HasPrefix(f.Link, prefix) {
+			f.Link = f.Link[len(prefix):]
+		} else {
+			f.Link = ""
+		}
+		if err = complete(c, &f, index, hasSizes); err != nil {
+			return "", 0, err
+		}
+		files = append(files, f)
+	}
+
+	if len(files) == 0 {
+		return "", 0, fmt.Errorf("Seal '%s' doesn't contain any file in '%s'", index, subdir)
+	}
+	out, err := writeSeal(tree, c, files)
+	return out, len(files), err
+}
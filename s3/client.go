@@ -0,0 +1,265 @@
+package s3
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Error is returned if the server rejected a request
+type Error struct {
+	StatusCode int
+	Code       string `xml:"Code"`
+	Message    string `xml:"Message"`
+}
+
+func (e *Error) Error() string {
+	if len(e.Code) == 0 {
+		return fmt.Sprintf("s3: request failed with status %d", e.StatusCode)
+	}
+	return fmt.Sprintf("s3: %s: %s (status %d)", e.Code, e.Message, e.StatusCode)
+}
+
+// Client performs requests on an S3 server. It may be used by multiple go-routines at once.
+type Client struct {
+	endpoint *url.URL
+	config   Config
+}
+
+// NewClient returns a client for the server described by the given configuration
+func NewClient(config *Config) (*Client, error) {
+	endpoint, err := url.Parse(config.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if endpoint.Scheme != "http" && endpoint.Scheme != "https" || len(endpoint.Host) == 0 {
+		return nil, fmt.Errorf("Invalid S3 endpoint '%s', expected a URL like 'https://host:port'", config.Endpoint)
+	}
+	return &Client{endpoint, *config}, nil
+}
+
+// A request to the server
+type request struct {
+	method string
+	bucket string
+	key    string
+	query  url.Values
+	header http.Header
+	body   []byte
+}
+
+// Performs the given request, and returns the response if its status indicates success.
+// The response body must be closed by the caller
+func (c *Client) do(r request) (*http.Response, error) {
+	p := "/" + r.bucket
+	if len(r.key) > 0 {
+		p += "/" + r.key
+	}
+	req, err := http.NewRequest(r.method, c.endpoint.String(), bytes.NewReader(r.body))
+	if err != nil {
+		return nil, err
+	}
+	// Keys may contain anything, which is why we escape the path ourselves
+	req.URL.Opaque = uriEscape(p, true)
+	req.URL.RawQuery = canonicalQuery(r.query)
+	for name, values := range r.header {
+		req.Header[name] = values
+	}
+	req.ContentLength = int64(len(r.body))
+	Sign(req, payloadHash(r.body), c.config.Region, c.config.AccessKey, c.config.SecretKey, time.Now())
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode/100 == 2 {
+		return res, nil
+	}
+
+	defer res.Body.Close()
+	switch res.StatusCode {
+	case http.StatusNotFound:
+		return nil, os.ErrNotExist
+	case http.StatusForbidden:
+		return nil, os.ErrPermission
+	}
+	e := Error{StatusCode: res.StatusCode}
+	if r.method != "HEAD" {
+		xml.NewDecoder(res.Body).Decode(&e)
+	}
+	return nil, &e
+}
+
+// Performs the given request, and decodes the XML document it returns into v
+func (c *Client) decode(r request, v interface{}) error {
+	res, err := c.do(r)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	return xml.NewDecoder(res.Body).Decode(v)
+}
+
+// Performs the given request, ignoring the body of its response
+func (c *Client) discard(r request) (http.Header, error) {
+	res, err := c.do(r)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	io.Copy(ioutil.Discard, res.Body)
+	return res.Header, nil
+}
+
+// HeadBucket returns an error if the bucket doesn't exist or isn't accessible
+func (c *Client) HeadBucket(bucket string) error {
+	_, err := c.discard(request{method: "HEAD", bucket: bucket})
+	return err
+}
+
+// HeadObject returns the headers of the object with the given key, which include its size and metadata
+func (c *Client) HeadObject(bucket, key string) (http.Header, error) {
+	return c.discard(request{method: "HEAD", bucket: bucket, key: key})
+}
+
+// GetObject returns the headers of the object with the given key along with a reader for its contents,
+// which must be closed
+func (c *Client) GetObject(bucket, key string) (http.Header, io.ReadCloser, error) {
+	res, err := c.do(request{method: "GET", bucket: bucket, key: key})
+	if err != nil {
+		return nil, nil, err
+	}
+	return res.Header, res.Body, nil
+}
+
+// PutObject stores the given data as object with the given key. The header may contain its metadata
+func (c *Client) PutObject(bucket, key string, data []byte, header http.Header) error {
+	_, err := c.discard(request{method: "PUT", bucket: bucket, key: key, header: header, body: data})
+	return err
+}
+
+// DeleteObject removes the object with the given key
+func (c *Client) DeleteObject(bucket, key string) error {
+	_, err := c.discard(request{method: "DELETE", bucket: bucket, key: key})
+	return err
+}
+
+// Object describes an object as listed by ListObjects()
+type Object struct {
+	Key          string    `xml:"Key"`
+	Size         int64     `xml:"Size"`
+	LastModified time.Time `xml:"LastModified"`
+}
+
+type listBucketResult struct {
+	Contents              []Object `xml:"Contents"`
+	CommonPrefixes        []string `xml:"CommonPrefixes>Prefix"`
+	IsTruncated           bool     `xml:"IsTruncated"`
+	NextContinuationToken string   `xml:"NextContinuationToken"`
+}
+
+// ListObjects returns the objects whose key starts with prefix, sorted by key. If delimiter is set, the keys
+// containing it after the prefix are not returned, but the prefixes they share up to the delimiter instead.
+// If max is larger than 0, no more than roughly this amount of objects and prefixes is returned.
+func (c *Client) ListObjects(bucket, prefix, delimiter string, max int) (objects []Object, prefixes []string, err error) {
+	query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+	if len(delimiter) > 0 {
+		query.Set("delimiter", delimiter)
+	}
+	if max > 0 {
+		query.Set("max-keys", strconv.Itoa(max))
+	}
+
+	for {
+		var res listBucketResult
+		if err = c.decode(request{method: "GET", bucket: bucket, query: query}, &res); err != nil {
+			return nil, nil, err
+		}
+		objects = append(objects, res.Contents...)
+		prefixes = append(prefixes, res.CommonPrefixes...)
+		if !res.IsTruncated || (max > 0 && len(objects)+len(prefixes) >= max) {
+			return objects, prefixes, nil
+		}
+		query.Set("continuation-token", res.NextContinuationToken)
+	}
+}
+
+// CreateMultipartUpload starts an upload of an object in parts, and returns its id.
+// The header may contain the object's metadata
+func (c *Client) CreateMultipartUpload(bucket, key string, header http.Header) (string, error) {
+	var res struct {
+		UploadId string `xml:"UploadId"`
+	}
+	err := c.decode(request{method: "POST", bucket: bucket, key: key, query: url.Values{"uploads": {""}}, header: header}, &res)
+	return res.UploadId, err
+}
+
+// Part describes a part of a multipart upload, see CompleteMultipartUpload()
+type Part struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+func partQuery(id string, number int) url.Values {
+	return url.Values{"uploadId": {id}, "partNumber": {strconv.Itoa(number)}}
+}
+
+// UploadPart uploads the part with the given number, counting from one
+func (c *Client) UploadPart(bucket, key, id string, number int, data []byte) (Part, error) {
+	header, err := c.discard(request{method: "PUT", bucket: bucket, key: key, query: partQuery(id, number), body: data})
+	if err != nil {
+		return Part{}, err
+	}
+	return Part{number, header.Get("ETag")}, nil
+}
+
+// UploadPartCopy uses the given range of bytes of another object as part with the given number.
+// The last byte is included in the range
+func (c *Client) UploadPartCopy(bucket, key, id string, number int, srcBucket, srcKey string, first, last int64) (Part, error) {
+	header := http.Header{
+		"X-Amz-Copy-Source":       {uriEscape("/"+srcBucket+"/"+srcKey, true)},
+		"X-Amz-Copy-Source-Range": {fmt.Sprintf("bytes=%d-%d", first, last)},
+	}
+	var res struct {
+		ETag string `xml:"ETag"`
+	}
+	err := c.decode(request{method: "PUT", bucket: bucket, key: key, query: partQuery(id, number), header: header}, &res)
+	return Part{number, res.ETag}, err
+}
+
+// CompleteMultipartUpload assembles the object from the given parts, which must be sorted by their number
+func (c *Client) CompleteMultipartUpload(bucket, key, id string, parts []Part) error {
+	body, err := xml.Marshal(struct {
+		XMLName xml.Name `xml:"CompleteMultipartUpload"`
+		Parts   []Part   `xml:"Part"`
+	}{Parts: parts})
+	if err != nil {
+		return err
+	}
+	// Errors may be reported after the status was sent
+	var res struct {
+		XMLName xml.Name
+		Error
+	}
+	if err = c.decode(request{method: "POST", bucket: bucket, key: key, query: url.Values{"uploadId": {id}}, body: body}, &res); err != nil {
+		return err
+	}
+	if res.XMLName.Local == "Error" {
+		res.Error.StatusCode = http.StatusOK
+		return &res.Error
+	}
+	return nil
+}
+
+// AbortMultipartUpload discards the upload with the given id, along with all of its parts
+func (c *Client) AbortMultipartUpload(bucket, key, id string) error {
+	_, err := c.discard(request{method: "DELETE", bucket: bucket, key: key, query: url.Values{"uploadId": {id}}})
+	return err
+}
@@ -0,0 +1,9 @@
+/*
+Package s3 implements a client for S3-compatible object stores, like Amazon S3 or MinIO.
+
+Its FileSystem makes buckets available to all commands, which accept URLs like 's3://bucket/prefix' wherever
+directories are expected, once this package is imported. The server keeps objects in memory, and is meant to
+test against.
+
+*/
+package s3
@@ -0,0 +1,622 @@
+package s3
+
+import (
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	gio "github.com/Byron/godi/io"
+)
+
+const (
+	// The scheme of URLs we handle
+	Scheme = "s3"
+
+	// The environment variable with the URL of the server to use, see NewConfig
+	EnvEndpoint = "GODI_S3_ENDPOINT"
+
+	// Objects are stored with metadata named like this, like 'X-Amz-Meta-Godi-Sha1'
+	MetadataPrefix = "X-Amz-Meta-Godi-"
+
+	metaModTime = MetadataPrefix + "Mtime"
+	metaType    = MetadataPrefix + "Type"
+
+	// Symbolic links are stored as objects containing their target, with this type
+	typeSymlink = "symlink"
+
+	// The smallest part of a multipart upload the server accepts, unless it is the last one
+	minPartSize = 5 * 1024 * 1024
+
+	// The largest part which can be copied, and the largest amount of parts an object may have
+	maxCopyPartSize = 5 * 1024 * 1024 * 1024
+	maxParts        = 10000
+)
+
+// Config describes how to connect to a server
+type Config struct {
+	// The URL of the server, like 'https://s3.amazonaws.com' or 'http://minio.local:9000'.
+	// Buckets are addressed by path, which all servers support
+	Endpoint string
+
+	Region    string
+	AccessKey string
+	SecretKey string
+
+	// The size of the parts of multipart uploads. Files up to this size are uploaded with a single request.
+	// Every thousand parts, it is doubled, which allows huge files to stay below the maximum amount of parts
+	PartSize int
+}
+
+// NewConfig returns the configuration used to connect to the server hosting the bucket of the given URL.
+// The default reads the endpoint from the environment variable named by EnvEndpoint, and the credentials
+// and region from the variables used by the tools of Amazon, like AWS_ACCESS_KEY_ID.
+// It may be replaced to change this, for instance to connect to test servers.
+var NewConfig = func(u *url.URL) (*Config, error) {
+	config := Config{
+		Endpoint:  os.Getenv(EnvEndpoint),
+		Region:    os.Getenv("AWS_REGION"),
+		AccessKey: os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		PartSize:  16 * 1024 * 1024,
+	}
+	if len(config.Endpoint) == 0 {
+		config.Endpoint = "https://s3.amazonaws.com"
+	}
+	if len(config.Region) == 0 {
+		config.Region = "us-east-1"
+	}
+	if len(config.AccessKey) == 0 || len(config.SecretKey) == 0 {
+		return nil, errors.New("Please set AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY to access S3 buckets")
+	}
+	return &config, nil
+}
+
+// FileSystem implements io.FileSystem for a bucket. Local paths underneath its mount point are mapped to keys,
+// using '/' as separator. Directories are the prefixes shared by keys, and exist as long as they contain objects.
+type FileSystem struct {
+	c        *Client
+	bucket   string
+	root     string
+	partSize int
+
+	// Directories known to exist, which don't have to be created
+	dirs     map[string]bool
+	dirsLock sync.Mutex
+}
+
+// NewFileSystem returns a file system which handles all paths below root using the objects in the given bucket
+func NewFileSystem(c *Client, bucket, root string) *FileSystem {
+	partSize := c.config.PartSize
+	if partSize < 1 {
+		partSize = minPartSize
+	}
+	return &FileSystem{c: c, bucket: bucket, root: filepath.Clean(root), partSize: partSize, dirs: make(map[string]bool)}
+}
+
+// Returns the key of the object at the given path, which is empty for the root of the bucket
+func (f *FileSystem) key(p string) string {
+	p = strings.TrimPrefix(filepath.Clean(p), f.root)
+	return strings.Trim(filepath.ToSlash(p), "/")
+}
+
+// Information about an object or directory, which is its own os.FileInfo
+type fileInfo struct {
+	name    string
+	size    int64
+	mode    os.FileMode
+	modTime time.Time
+
+	// If set, the metadata of the object is retrieved when first needed, as listings don't contain it
+	head func() (http.Header, error)
+	once sync.Once
+}
+
+func (f *fileInfo) Name() string     { return f.name }
+func (f *fileInfo) Size() int64      { return f.size }
+func (f *fileInfo) IsDir() bool      { return f.mode.IsDir() }
+func (f *fileInfo) Sys() interface{} { return nil }
+
+func (f *fileInfo) Mode() os.FileMode {
+	f.load()
+	return f.mode
+}
+
+func (f *fileInfo) ModTime() time.Time {
+	f.load()
+	return f.modTime
+}
+
+func (f *fileInfo) load() {
+	f.once.Do(func() {
+		if f.head == nil {
+			return
+		}
+		if header, err := f.head(); err == nil {
+			f.setMetadata(header)
+		}
+	})
+}
+
+// Sets our mode and modification time from the given headers of an object
+func (f *fileInfo) setMetadata(header http.Header) {
+	f.mode = 0644
+	if header.Get(metaType) == typeSymlink {
+		f.mode = os.ModeSymlink | 0777
+	}
+	if t, err := time.Parse(time.RFC3339Nano, header.Get(metaModTime)); err == nil {
+		f.modTime = t
+	} else if t, err := http.ParseTime(header.Get("Last-Modified")); err == nil {
+		f.modTime = t
+	}
+}
+
+// Returns information about the object described by the given headers
+func objectInfo(name string, header http.Header) *fileInfo {
+	size, _ := strconv.ParseInt(header.Get("Content-Length"), 10, 64)
+	fi := fileInfo{name: name, size: size}
+	fi.setMetadata(header)
+	fi.once.Do(func() {})
+	return &fi
+}
+
+func dirInfo(name string) *fileInfo {
+	return &fileInfo{name: name, mode: os.ModeDir | 0755}
+}
+
+func (f *FileSystem) Lstat(p string) (os.FileInfo, error) {
+	key := f.key(p)
+	if len(key) == 0 {
+		if err := f.c.HeadBucket(f.bucket); err != nil {
+			return nil, &os.PathError{Op: "lstat", Path: p, Err: err}
+		}
+		return dirInfo(filepath.Base(p)), nil
+	}
+
+	header, err := f.c.HeadObject(f.bucket, key)
+	if err == nil {
+		return objectInfo(filepath.Base(p), header), nil
+	} else if !os.IsNotExist(err) {
+		return nil, &os.PathError{Op: "lstat", Path: p, Err: err}
+	}
+
+	// Directories exist as long as objects have them as prefix
+	objects, prefixes, err := f.c.ListObjects(f.bucket, key+"/", "/", 1)
+	if err != nil {
+		return nil, &os.PathError{Op: "lstat", Path: p, Err: err}
+	}
+	if len(objects) == 0 && len(prefixes) == 0 {
+		return nil, &os.PathError{Op: "lstat", Path: p, Err: os.ErrNotExist}
+	}
+	return dirInfo(filepath.Base(p)), nil
+}
+
+// Returns the path the symbolic link at the given path points to, which may be handled by another file system
+func (f *FileSystem) follow(p string) (string, error) {
+	for i := 0; i < 8; i++ {
+		fi, err := f.Lstat(p)
+		if err != nil || fi.Mode()&os.ModeSymlink != os.ModeSymlink {
+			return p, err
+		}
+		target, err := f.Readlink(p)
+		if err != nil {
+			return "", err
+		}
+		if !filepath.IsAbs(target) {
+			target = filepath.Join(filepath.Dir(p), target)
+		}
+		if _, root := gio.FileSystemOf(target); root != f.root {
+			return target, nil
+		}
+		p = target
+	}
+	return "", &os.PathError{Op: "stat", Path: p, Err: errors.New("too many levels of symbolic links")}
+}
+
+func (f *FileSystem) Stat(p string) (os.FileInfo, error) {
+	target, err := f.follow(p)
+	if err != nil {
+		return nil, err
+	}
+	if _, root := gio.FileSystemOf(target); root != f.root {
+		return gio.Stat(target)
+	}
+	return f.Lstat(target)
+}
+
+// Open reads the object at the given path right away, and only follows it if it turns out to be a symbolic link
+func (f *FileSystem) Open(p string) (io.ReadCloser, error) {
+	header, body, err := f.c.GetObject(f.bucket, f.key(p))
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: p, Err: err}
+	}
+	if header.Get(metaType) != typeSymlink {
+		return body, nil
+	}
+	body.Close()
+
+	target, err := f.follow(p)
+	if err != nil {
+		return nil, err
+	}
+	if _, root := gio.FileSystemOf(target); root != f.root {
+		return gio.Open(target)
+	}
+	if _, body, err = f.c.GetObject(f.bucket, f.key(target)); err != nil {
+		return nil, &os.PathError{Op: "open", Path: p, Err: err}
+	}
+	return body, nil
+}
+
+func (f *FileSystem) Readlink(p string) (string, error) {
+	header, body, err := f.c.GetObject(f.bucket, f.key(p))
+	if err != nil {
+		return "", &os.PathError{Op: "readlink", Path: p, Err: err}
+	}
+	defer body.Close()
+	if header.Get(metaType) != typeSymlink {
+		return "", &os.PathError{Op: "readlink", Path: p, Err: errors.New("not a symbolic link")}
+	}
+	target, err := ioutil.ReadAll(body)
+	if err != nil {
+		return "", &os.PathError{Op: "readlink", Path: p, Err: err}
+	}
+	return filepath.FromSlash(string(target)), nil
+}
+
+// Returns an error satisfying os.IsExist() if there is an object with the given key.
+// There is no way to create objects exclusively, which is why there is a short time in which another
+// client could create it after we checked
+func (f *FileSystem) checkExists(op, p, key string) error {
+	_, err := f.c.HeadObject(f.bucket, key)
+	if err == nil {
+		err = os.ErrExist
+	} else if os.IsNotExist(err) {
+		return nil
+	}
+	return &os.PathError{Op: op, Path: p, Err: err}
+}
+
+func (f *FileSystem) Create(p string, perm os.FileMode) (io.WriteCloser, error) {
+	key := f.key(p)
+	if err := f.checkExists("create", p, key); err != nil {
+		return nil, err
+	}
+	return &writer{fs: f, path: p, key: key, partSize: f.partSize}, nil
+}
+
+func (f *FileSystem) Symlink(target, p string) error {
+	key := f.key(p)
+	if err := f.checkExists("symlink", p, key); err != nil {
+		return err
+	}
+	header := http.Header{metaType: {typeSymlink}}
+	if err := f.c.PutObject(f.bucket, key, []byte(filepath.ToSlash(target)), header); err != nil {
+		return &os.PathError{Op: "symlink", Path: p, Err: err}
+	}
+	return nil
+}
+
+func (f *FileSystem) ReadDir(p string) ([]os.FileInfo, error) {
+	key := f.key(p)
+	prefix := key + "/"
+	if len(key) == 0 {
+		prefix = ""
+	}
+	objects, prefixes, err := f.c.ListObjects(f.bucket, prefix, "/", 0)
+	if err != nil {
+		return nil, &os.PathError{Op: "readdir", Path: p, Err: err}
+	}
+	if len(objects) == 0 && len(prefixes) == 0 {
+		if fi, err := f.Lstat(p); err != nil {
+			return nil, err
+		} else if !fi.IsDir() {
+			return nil, &os.PathError{Op: "readdir", Path: p, Err: errors.New("not a directory")}
+		}
+	}
+
+	infos := make([]os.FileInfo, 0, len(objects)+len(prefixes))
+	for _, o := range objects {
+		// The marker of an empty directory isn't part of it
+		if strings.HasSuffix(o.Key, "/") {
+			continue
+		}
+		key := o.Key
+		fi := fileInfo{name: key[len(prefix):], size: o.Size, modTime: o.LastModified, mode: 0644}
+		fi.head = func() (http.Header, error) {
+			return f.c.HeadObject(f.bucket, key)
+		}
+		infos = append(infos, &fi)
+	}
+	for _, dir := range prefixes {
+		infos = append(infos, dirInfo(strings.TrimSuffix(dir[len(prefix):], "/")))
+	}
+	return infos, nil
+}
+
+// MkdirAll creates an empty object with a trailing slash as marker of the directory at the given path, which
+// makes it exist until it is removed. There is no need to create any parent directories
+func (f *FileSystem) MkdirAll(p string, perm os.FileMode) error {
+	key := f.key(p)
+	if len(key) == 0 {
+		return nil
+	}
+	f.dirsLock.Lock()
+	known := f.dirs[key]
+	f.dirsLock.Unlock()
+	if known {
+		return nil
+	}
+
+	if fi, err := f.Lstat(p); err == nil && !fi.IsDir() {
+		return &os.PathError{Op: "mkdir", Path: p, Err: errors.New("not a directory")}
+	} else if os.IsNotExist(err) {
+		if err = f.c.PutObject(f.bucket, key+"/", nil, nil); err != nil {
+			return &os.PathError{Op: "mkdir", Path: p, Err: err}
+		}
+	} else if err != nil {
+		return err
+	}
+
+	f.dirsLock.Lock()
+	f.dirs[key] = true
+	f.dirsLock.Unlock()
+	return nil
+}
+
+// Remove removes the object at the given path, or the marker of an empty directory
+func (f *FileSystem) Remove(p string) error {
+	key := f.key(p)
+	if len(key) == 0 {
+		return &os.PathError{Op: "remove", Path: p, Err: errors.New("cannot remove the bucket")}
+	}
+	_, err := f.c.HeadObject(f.bucket, key)
+	if err == nil {
+		err = f.c.DeleteObject(f.bucket, key)
+	} else if os.IsNotExist(err) {
+		var objects []Object
+		var prefixes []string
+		if objects, prefixes, err = f.c.ListObjects(f.bucket, key+"/", "/", 2); err == nil {
+			switch {
+			case len(prefixes) > 0 || len(objects) > 1 || len(objects) == 1 && objects[0].Key != key+"/":
+				err = errors.New("directory not empty")
+			case len(objects) == 1:
+				err = f.c.DeleteObject(f.bucket, key+"/")
+				f.dirsLock.Lock()
+				delete(f.dirs, key)
+				f.dirsLock.Unlock()
+			default:
+				err = os.ErrNotExist
+			}
+		}
+	}
+	if err != nil {
+		return &os.PathError{Op: "remove", Path: p, Err: err}
+	}
+	return nil
+}
+
+// Chtimes changes the modification time stored with the object, which copies it onto itself
+func (f *FileSystem) Chtimes(p string, atime, mtime time.Time) error {
+	key := f.key(p)
+	header, err := f.c.HeadObject(f.bucket, key)
+	if err == nil {
+		size, _ := strconv.ParseInt(header.Get("Content-Length"), 10, 64)
+		meta := http.Header{}
+		for name, values := range header {
+			if strings.HasPrefix(name, "X-Amz-Meta-") {
+				meta[name] = values
+			}
+		}
+		meta.Set(metaModTime, mtime.UTC().Format(time.RFC3339Nano))
+		err = f.replaceMetadata(key, size, meta)
+	}
+	if err != nil {
+		return &os.PathError{Op: "chtimes", Path: p, Err: err}
+	}
+	return nil
+}
+
+// Device returns the same identifier for all paths, making each bucket a device of its own.
+// This way, the amount of streams per device is the amount of concurrent uploads per bucket.
+func (f *FileSystem) Device(p string) (uint64, error) {
+	return 0, nil
+}
+
+// Replaces the metadata of the object with the given key and size, which can only be done by copying it.
+// The copy is made in parts, which is the only way to copy objects of any size. It is made by the server,
+// which reads and writes the entire object once more.
+func (f *FileSystem) replaceMetadata(key string, size int64, meta http.Header) error {
+	if size == 0 {
+		return f.c.PutObject(f.bucket, key, nil, meta)
+	}
+	id, err := f.c.CreateMultipartUpload(f.bucket, key, meta)
+	if err != nil {
+		return err
+	}
+	var parts []Part
+	for first := int64(0); first < size && err == nil; first += maxCopyPartSize {
+		last := first + maxCopyPartSize - 1
+		if last >= size {
+			last = size - 1
+		}
+		var part Part
+		if part, err = f.c.UploadPartCopy(f.bucket, key, id, len(parts)+1, f.bucket, key, first, last); err == nil {
+			parts = append(parts, part)
+		}
+	}
+	if err == nil {
+		err = f.c.CompleteMultipartUpload(f.bucket, key, id, parts)
+	}
+	if err != nil {
+		f.c.AbortMultipartUpload(f.bucket, key, id)
+	}
+	return err
+}
+
+// Uploads an object while it is written. Parts are uploaded as soon as they are full, while the last one is
+// uploaded when closing. Objects of up to one part are uploaded with a single request.
+type writer struct {
+	fs   *FileSystem
+	path string
+	key  string
+
+	buf      []byte
+	partSize int
+
+	// Set once the first part was uploaded
+	uploadID string
+	parts    []Part
+	size     int64
+
+	// The metadata to store with the object, see SetMetadata()
+	modTime time.Time
+	digests map[string][]byte
+
+	// The error which aborted the upload
+	err error
+}
+
+// SetMetadata implements io.MetadataWriter, which stores the modification time and the digests with the object.
+// The digests are only known once all bytes were uploaded, which is why objects larger than one part are copied
+// onto themselves to set them. This makes the server read and write each of them once more
+func (w *writer) SetMetadata(modTime time.Time, digests map[string][]byte) {
+	w.modTime = modTime
+	w.digests = digests
+}
+
+// Returns the metadata to store with the object, with or without its digests, or nil if there is none
+func (w *writer) metadata(withDigests bool) http.Header {
+	if !withDigests && w.modTime.IsZero() || withDigests && w.modTime.IsZero() && len(w.digests) == 0 {
+		return nil
+	}
+	meta := http.Header{}
+	if !w.modTime.IsZero() {
+		meta.Set(metaModTime, w.modTime.UTC().Format(time.RFC3339Nano))
+	}
+	if withDigests {
+		for name, digest := range w.digests {
+			meta.Set(MetadataPrefix+name, hex.EncodeToString(digest))
+		}
+	}
+	return meta
+}
+
+// Discards everything uploaded so far, and remembers the error which caused it
+func (w *writer) abort(err error) error {
+	if len(w.uploadID) > 0 {
+		w.fs.c.AbortMultipartUpload(w.fs.bucket, w.key, w.uploadID)
+	}
+	w.err = &os.PathError{Op: "write", Path: w.path, Err: err}
+	w.buf = nil
+	return w.err
+}
+
+// Uploads the buffer as the next part
+func (w *writer) flush() error {
+	if len(w.parts) == maxParts {
+		return errors.New("too many parts")
+	}
+	if len(w.uploadID) == 0 {
+		// The modification time is known up front, unlike the digests
+		id, err := w.fs.c.CreateMultipartUpload(w.fs.bucket, w.key, w.metadata(false))
+		if err != nil {
+			return err
+		}
+		w.uploadID = id
+	}
+	part, err := w.fs.c.UploadPart(w.fs.bucket, w.key, w.uploadID, len(w.parts)+1, w.buf)
+	if err != nil {
+		return err
+	}
+	w.parts = append(w.parts, part)
+	w.buf = w.buf[:0]
+	if len(w.parts)%1000 == 0 {
+		w.partSize *= 2
+	}
+	return nil
+}
+
+func (w *writer) Write(b []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	n := len(b)
+	for len(b) > 0 {
+		// The buffer is only uploaded once we know it's not the last part
+		if len(w.buf) == w.partSize {
+			if err := w.flush(); err != nil {
+				return 0, w.abort(err)
+			}
+		}
+		c := w.partSize - len(w.buf)
+		if c > len(b) {
+			c = len(b)
+		}
+		w.buf = append(w.buf, b[:c]...)
+		b = b[c:]
+	}
+	w.size += int64(n)
+	return n, nil
+}
+
+func (w *writer) Close() error {
+	if w.err != nil {
+		return w.err
+	}
+	if len(w.uploadID) == 0 {
+		if err := w.fs.c.PutObject(w.fs.bucket, w.key, w.buf, w.metadata(true)); err != nil {
+			return w.abort(err)
+		}
+		w.buf = nil
+		return nil
+	}
+
+	err := w.flush()
+	if err == nil {
+		err = w.fs.c.CompleteMultipartUpload(w.fs.bucket, w.key, w.uploadID, w.parts)
+	}
+	if err != nil {
+		return w.abort(err)
+	}
+	w.uploadID = ""
+	w.buf = nil
+
+	// The digests weren't known when the upload began
+	if len(w.digests) > 0 {
+		if err = w.fs.replaceMetadata(w.key, w.size, w.metadata(true)); err != nil {
+			w.err = &os.PathError{Op: "close", Path: w.path, Err: err}
+			return w.err
+		}
+	}
+	return nil
+}
+
+// Dial connects to the server hosting the bucket named by the host of the given URL, and returns a file system
+// mounted at root
+func Dial(u *url.URL, root string) (gio.FileSystem, error) {
+	config, err := NewConfig(u)
+	if err != nil {
+		return nil, err
+	}
+	c, err := NewClient(config)
+	if err != nil {
+		return nil, err
+	}
+	if err = c.HeadBucket(u.Host); err != nil {
+		return nil, &os.PathError{Op: "dial", Path: u.String(), Err: err}
+	}
+	return NewFileSystem(c, u.Host, root), nil
+}
+
+func init() {
+	gio.RegisterScheme(Scheme, Dial)
+}
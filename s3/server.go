@@ -0,0 +1,490 @@
+package s3
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// An object kept by the server
+type object struct {
+	data    []byte
+	meta    http.Header
+	etag    string
+	modTime time.Time
+}
+
+// A multipart upload in progress
+type upload struct {
+	bucket string
+	key    string
+	meta   http.Header
+	parts  map[int]*object
+}
+
+// Server is an S3 server which keeps all objects in memory, and implements the requests sent by the Client.
+// It checks the signature of each request, and is meant to be tested against, using net/http/httptest.
+type Server struct {
+	Region    string
+	AccessKey string
+	SecretKey string
+
+	// If set, listings return no more than this amount of entries at once
+	MaxKeys int
+
+	// If set, each upload takes at least this long, which allows to observe concurrent uploads
+	Latency time.Duration
+
+	l       sync.Mutex
+	buckets map[string]map[string]*object
+	uploads map[string]*upload
+	nextID  int
+
+	// The amount of uploads in progress, and the largest amount seen at once, per bucket
+	active    map[string]int
+	maxActive map[string]int
+}
+
+// NewServer returns a server with the given, empty buckets, which accepts requests signed with the given
+// credentials
+func NewServer(region, accessKey, secretKey string, buckets ...string) *Server {
+	s := Server{
+		Region:    region,
+		AccessKey: accessKey,
+		SecretKey: secretKey,
+		buckets:   make(map[string]map[string]*object),
+		uploads:   make(map[string]*upload),
+		active:    make(map[string]int),
+		maxActive: make(map[string]int),
+	}
+	for _, bucket := range buckets {
+		s.buckets[bucket] = make(map[string]*object)
+	}
+	return &s
+}
+
+// Object returns the contents and metadata of the object with the given key
+func (s *Server) Object(bucket, key string) ([]byte, http.Header, bool) {
+	s.l.Lock()
+	defer s.l.Unlock()
+	o, ok := s.buckets[bucket][key]
+	if !ok {
+		return nil, nil, false
+	}
+	return o.data, o.meta, true
+}
+
+// MaxConcurrentUploads returns the largest amount of objects and parts which were uploaded to the given
+// bucket at the same time
+func (s *Server) MaxConcurrentUploads(bucket string) int {
+	s.l.Lock()
+	defer s.l.Unlock()
+	return s.maxActive[bucket]
+}
+
+// Uploads returns the amount of multipart uploads which were neither completed nor aborted
+func (s *Server) Uploads() int {
+	s.l.Lock()
+	defer s.l.Unlock()
+	return len(s.uploads)
+}
+
+// The error sent with a status code
+type serverError struct {
+	status  int
+	Code    string
+	Message string
+}
+
+func (e *serverError) Error() string {
+	return e.Message
+}
+
+// Returns the metadata in the given headers
+func metadataOf(header http.Header) http.Header {
+	meta := http.Header{}
+	for name, values := range header {
+		if strings.HasPrefix(name, "X-Amz-Meta-") {
+			meta[name] = values
+		}
+	}
+	return meta
+}
+
+func newObject(data []byte, meta http.Header) *object {
+	sum := md5.Sum(data)
+	return &object{data, meta, `"` + hex.EncodeToString(sum[:]) + `"`, time.Now().UTC()}
+}
+
+// Returns an error unless the request was signed with our credentials
+func (s *Server) authenticate(r *http.Request, body []byte) error {
+	denied := func(msg string) error {
+		return &serverError{http.StatusForbidden, "SignatureDoesNotMatch", msg}
+	}
+
+	var credential, signed, sig string
+	auth := strings.TrimPrefix(r.Header.Get("Authorization"), signatureAlgorithm+" ")
+	for _, field := range strings.Split(auth, ", ") {
+		tokens := strings.SplitN(field, "=", 2)
+		if len(tokens) != 2 {
+			return denied("Malformed authorization header")
+		}
+		switch tokens[0] {
+		case "Credential":
+			credential = tokens[1]
+		case "SignedHeaders":
+			signed = tokens[1]
+		case "Signature":
+			sig = tokens[1]
+		}
+	}
+
+	t, err := time.Parse(amzTimeFormat, r.Header.Get("X-Amz-Date"))
+	if err != nil {
+		return denied("Missing or invalid date")
+	}
+	scope := strings.Join([]string{s.AccessKey, t.Format(amzDateFormat), s.Region, service, "aws4_request"}, "/")
+	if credential != scope {
+		return denied("Unknown credential " + credential)
+	}
+	hash := r.Header.Get("X-Amz-Content-Sha256")
+	if hash != payloadHash(body) {
+		return denied("The payload doesn't match its hash")
+	}
+
+	path := r.RequestURI
+	if i := strings.Index(path, "?"); i >= 0 {
+		path = path[:i]
+	}
+	names := strings.Split(signed, ";")
+	if signature(r.Method, path, r.URL.Query(), names, r.Header, r.Host, hash, s.Region, s.SecretKey, t) != sig {
+		return denied("The signature doesn't match")
+	}
+	return nil
+}
+
+// Counts an upload to the given bucket, and returns a function to call once it is done
+func (s *Server) beginUpload(bucket string) func() {
+	s.l.Lock()
+	s.active[bucket] += 1
+	if s.active[bucket] > s.maxActive[bucket] {
+		s.maxActive[bucket] = s.active[bucket]
+	}
+	s.l.Unlock()
+	time.Sleep(s.Latency)
+
+	return func() {
+		s.l.Lock()
+		s.active[bucket] -= 1
+		s.l.Unlock()
+	}
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err == nil {
+		err = s.authenticate(r, body)
+	}
+	if err == nil {
+		err = s.serve(w, r, body)
+	}
+	if err == nil {
+		return
+	}
+
+	serr, ok := err.(*serverError)
+	if !ok {
+		serr = &serverError{http.StatusInternalServerError, "InternalError", err.Error()}
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(serr.status)
+	if r.Method != "HEAD" {
+		xml.NewEncoder(w).Encode(struct {
+			XMLName xml.Name `xml:"Error"`
+			Code    string
+			Message string
+		}{Code: serr.Code, Message: serr.Message})
+	}
+}
+
+// Writes the given value as XML document with a status of OK
+func writeXML(w http.ResponseWriter, v interface{}) error {
+	w.Header().Set("Content-Type", "application/xml")
+	return xml.NewEncoder(w).Encode(v)
+}
+
+func noSuchKey(key string) error {
+	return &serverError{http.StatusNotFound, "NoSuchKey", "The specified key does not exist: " + key}
+}
+
+func noSuchUpload(id string) error {
+	return &serverError{http.StatusNotFound, "NoSuchUpload", "The specified upload does not exist: " + id}
+}
+
+// Performs the request, and writes its response unless there is an error
+func (s *Server) serve(w http.ResponseWriter, r *http.Request, body []byte) error {
+	tokens := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+	bucket, key := tokens[0], ""
+	if len(tokens) > 1 {
+		key = tokens[1]
+	}
+	query := r.URL.Query()
+
+	s.l.Lock()
+	_, ok := s.buckets[bucket]
+	s.l.Unlock()
+	if !ok {
+		return &serverError{http.StatusNotFound, "NoSuchBucket", "The specified bucket does not exist: " + bucket}
+	}
+
+	switch {
+	case len(key) == 0 && r.Method == "HEAD":
+		return nil
+	case len(key) == 0 && r.Method == "GET":
+		return s.list(w, bucket, query)
+	case len(key) == 0:
+		return &serverError{http.StatusMethodNotAllowed, "MethodNotAllowed", "Bucket operations are not supported"}
+	case r.Method == "HEAD" || r.Method == "GET":
+		s.l.Lock()
+		o, ok := s.buckets[bucket][key]
+		s.l.Unlock()
+		if !ok {
+			return noSuchKey(key)
+		}
+		for name, values := range o.meta {
+			w.Header()[name] = values
+		}
+		w.Header().Set("ETag", o.etag)
+		w.Header().Set("Last-Modified", o.modTime.Format(http.TimeFormat))
+		w.Header().Set("Content-Length", strconv.Itoa(len(o.data)))
+		if r.Method == "GET" {
+			w.Write(o.data)
+		}
+		return nil
+	case r.Method == "PUT" && len(query.Get("uploadId")) > 0:
+		return s.uploadPart(w, r, bucket, key, body)
+	case r.Method == "PUT":
+		defer s.beginUpload(bucket)()
+		o := newObject(body, metadataOf(r.Header))
+		s.l.Lock()
+		s.buckets[bucket][key] = o
+		s.l.Unlock()
+		w.Header().Set("ETag", o.etag)
+		return nil
+	case r.Method == "DELETE" && len(query.Get("uploadId")) > 0:
+		s.l.Lock()
+		defer s.l.Unlock()
+		if _, ok := s.uploads[query.Get("uploadId")]; !ok {
+			return noSuchUpload(query.Get("uploadId"))
+		}
+		delete(s.uploads, query.Get("uploadId"))
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	case r.Method == "DELETE":
+		s.l.Lock()
+		delete(s.buckets[bucket], key)
+		s.l.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	case r.Method == "POST" && len(query["uploads"]) > 0:
+		s.l.Lock()
+		s.nextID += 1
+		id := strconv.Itoa(s.nextID)
+		s.uploads[id] = &upload{bucket, key, metadataOf(r.Header), make(map[int]*object)}
+		s.l.Unlock()
+		return writeXML(w, struct {
+			XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+			Bucket   string
+			Key      string
+			UploadId string
+		}{Bucket: bucket, Key: key, UploadId: id})
+	case r.Method == "POST" && len(query.Get("uploadId")) > 0:
+		return s.completeUpload(w, bucket, key, query.Get("uploadId"), body)
+	}
+	return &serverError{http.StatusNotImplemented, "NotImplemented", "The request is not supported"}
+}
+
+// Returns the upload with the given id, which must be one of the given object
+func (s *Server) upload(bucket, key, id string) (*upload, error) {
+	s.l.Lock()
+	defer s.l.Unlock()
+	u, ok := s.uploads[id]
+	if !ok || u.bucket != bucket || u.key != key {
+		return nil, noSuchUpload(id)
+	}
+	return u, nil
+}
+
+func (s *Server) uploadPart(w http.ResponseWriter, r *http.Request, bucket, key string, body []byte) error {
+	query := r.URL.Query()
+	u, err := s.upload(bucket, key, query.Get("uploadId"))
+	if err != nil {
+		return err
+	}
+	number, err := strconv.Atoi(query.Get("partNumber"))
+	if err != nil || number < 1 || number > maxParts {
+		return &serverError{http.StatusBadRequest, "InvalidArgument", "Invalid part number"}
+	}
+	defer s.beginUpload(bucket)()
+
+	source := r.Header.Get("X-Amz-Copy-Source")
+	if len(source) == 0 {
+		part := newObject(body, nil)
+		s.l.Lock()
+		u.parts[number] = part
+		s.l.Unlock()
+		w.Header().Set("ETag", part.etag)
+		return nil
+	}
+
+	if source, err = url.QueryUnescape(source); err != nil {
+		return err
+	}
+	tokens := strings.SplitN(strings.TrimPrefix(source, "/"), "/", 2)
+	if len(tokens) != 2 {
+		return &serverError{http.StatusBadRequest, "InvalidArgument", "Invalid copy source " + source}
+	}
+	s.l.Lock()
+	o, ok := s.buckets[tokens[0]][tokens[1]]
+	s.l.Unlock()
+	if !ok {
+		return noSuchKey(tokens[1])
+	}
+
+	var first, last int
+	if n, err := fmt.Sscanf(r.Header.Get("X-Amz-Copy-Source-Range"), "bytes=%d-%d", &first, &last); err != nil || n != 2 ||
+		first < 0 || last < first || last >= len(o.data) {
+		return &serverError{http.StatusBadRequest, "InvalidRange", "Invalid copy source range"}
+	}
+	part := newObject(o.data[first:last+1], nil)
+	s.l.Lock()
+	u.parts[number] = part
+	s.l.Unlock()
+	return writeXML(w, struct {
+		XMLName      xml.Name `xml:"CopyPartResult"`
+		ETag         string
+		LastModified time.Time
+	}{ETag: part.etag, LastModified: part.modTime})
+}
+
+func (s *Server) completeUpload(w http.ResponseWriter, bucket, key, id string, body []byte) error {
+	u, err := s.upload(bucket, key, id)
+	if err != nil {
+		return err
+	}
+	var req struct {
+		Parts []Part `xml:"Part"`
+	}
+	if err = xml.Unmarshal(body, &req); err != nil || len(req.Parts) == 0 {
+		return &serverError{http.StatusBadRequest, "MalformedXML", "Invalid list of parts"}
+	}
+
+	s.l.Lock()
+	defer s.l.Unlock()
+	var data bytes.Buffer
+	for i, p := range req.Parts {
+		part, ok := u.parts[p.PartNumber]
+		if !ok || part.etag != p.ETag || i > 0 && p.PartNumber <= req.Parts[i-1].PartNumber {
+			return &serverError{http.StatusBadRequest, "InvalidPart", fmt.Sprintf("Invalid part %d", p.PartNumber)}
+		}
+		data.Write(part.data)
+	}
+	s.buckets[bucket][key] = newObject(data.Bytes(), u.meta)
+	delete(s.uploads, id)
+
+	return writeXML(w, struct {
+		XMLName xml.Name `xml:"CompleteMultipartUploadResult"`
+		Bucket  string
+		Key     string
+		ETag    string
+	}{Bucket: bucket, Key: key, ETag: s.buckets[bucket][key].etag})
+}
+
+// Lists the objects of a bucket, using the key of the last entry as continuation token
+func (s *Server) list(w http.ResponseWriter, bucket string, query url.Values) error {
+	if query.Get("list-type") != "2" {
+		return &serverError{http.StatusNotImplemented, "NotImplemented", "Only version 2 of listings is supported"}
+	}
+	prefix, delimiter, token := query.Get("prefix"), query.Get("delimiter"), query.Get("continuation-token")
+	max := 1000
+	if n, err := strconv.Atoi(query.Get("max-keys")); err == nil && n < max {
+		max = n
+	}
+	if s.MaxKeys > 0 && s.MaxKeys < max {
+		max = s.MaxKeys
+	}
+
+	s.l.Lock()
+	defer s.l.Unlock()
+	var keys []string
+	for key := range s.buckets[bucket] {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	type content struct {
+		Key          string
+		LastModified time.Time
+		ETag         string
+		Size         int
+	}
+	type commonPrefix struct {
+		Prefix string
+	}
+	res := struct {
+		XMLName               xml.Name `xml:"ListBucketResult"`
+		Name                  string
+		Prefix                string
+		KeyCount              int
+		MaxKeys               int
+		IsTruncated           bool
+		NextContinuationToken string         `xml:",omitempty"`
+		Contents              []content      `xml:",omitempty"`
+		CommonPrefixes        []commonPrefix `xml:",omitempty"`
+	}{Name: bucket, Prefix: prefix, MaxKeys: max}
+
+	for _, key := range keys {
+		// Keys sharing a prefix we returned already come right after it. Only the marker of the listed
+		// directory itself ends with the delimiter without being a shared prefix
+		if len(token) > 0 && (key <= token ||
+			len(delimiter) > 0 && len(token) > len(prefix) && strings.HasSuffix(token, delimiter) && strings.HasPrefix(key, token)) {
+			continue
+		}
+		entry := key
+		if i := strings.Index(key[len(prefix):], delimiter); len(delimiter) > 0 && i >= 0 {
+			entry = key[:len(prefix)+i+len(delimiter)]
+			if n := len(res.CommonPrefixes); n > 0 && res.CommonPrefixes[n-1].Prefix == entry {
+				continue
+			}
+		}
+		if res.KeyCount == max {
+			res.IsTruncated = true
+			break
+		}
+
+		if entry == key {
+			o := s.buckets[bucket][key]
+			res.Contents = append(res.Contents, content{key, o.modTime, o.etag, len(o.data)})
+		} else {
+			res.CommonPrefixes = append(res.CommonPrefixes, commonPrefix{entry})
+		}
+		res.KeyCount += 1
+		res.NextContinuationToken = entry
+	}
+	if !res.IsTruncated {
+		res.NextContinuationToken = ""
+	}
+	return writeXML(w, &res)
+}
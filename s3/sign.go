@@ -0,0 +1,128 @@
+package s3
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	signatureAlgorithm = "AWS4-HMAC-SHA256"
+	service            = "s3"
+
+	// The format of the time used in signatures, and of the date which is part of their scope
+	amzTimeFormat = "20060102T150405Z"
+	amzDateFormat = "20060102"
+)
+
+// The hash of an empty payload
+var emptyPayloadHash = payloadHash(nil)
+
+// Returns the hex-encoded sha256 of the given payload, as needed for signing it
+func payloadHash(b []byte) string {
+	h := sha256.Sum256(b)
+	return hex.EncodeToString(h[:])
+}
+
+// Returns s with all bytes escaped which are not unreserved according to RFC 3986.
+// If keepSlash is set, slashes are not escaped
+func uriEscape(s string, keepSlash bool) string {
+	var b []byte
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' ||
+			c == '-' || c == '_' || c == '.' || c == '~' || (keepSlash && c == '/') {
+			b = append(b, c)
+		} else {
+			b = append(b, fmt.Sprintf("%%%02X", c)...)
+		}
+	}
+	return string(b)
+}
+
+// Returns the query in its canonical form, sorted by key, which is also the form we send it in
+func canonicalQuery(query url.Values) string {
+	var pairs []string
+	for key, values := range query {
+		for _, value := range values {
+			pairs = append(pairs, uriEscape(key, false)+"="+uriEscape(value, false))
+		}
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, "&")
+}
+
+// Returns the names of the given headers in their canonical order, along with the canonical form of the headers.
+// The host is passed separately, as it is no header of requests
+func canonicalHeaders(names []string, header http.Header, host string) string {
+	var b []byte
+	for _, name := range names {
+		value := host
+		if name != "host" {
+			value = strings.Join(header[http.CanonicalHeaderKey(name)], ",")
+		}
+		b = append(b, name+":"+strings.TrimSpace(value)+"\n"...)
+	}
+	return string(b)
+}
+
+// Returns the key to sign requests made on the given day with
+func signingKey(secretKey, date, region string) []byte {
+	mac := func(key []byte, data string) []byte {
+		h := hmac.New(sha256.New, key)
+		h.Write([]byte(data))
+		return h.Sum(nil)
+	}
+	return mac(mac(mac(mac([]byte("AWS4"+secretKey), date), region), service), "aws4_request")
+}
+
+// Returns the signature of a request with the given properties. The path must be escaped, and the signed
+// headers must be lower-case and sorted
+func signature(method, path string, query url.Values, signed []string, header http.Header, host, hash string,
+	region, secretKey string, t time.Time) string {
+	request := strings.Join([]string{
+		method,
+		path,
+		canonicalQuery(query),
+		canonicalHeaders(signed, header, host),
+		strings.Join(signed, ";"),
+		hash,
+	}, "\n")
+	date := t.Format(amzDateFormat)
+	toSign := strings.Join([]string{
+		signatureAlgorithm,
+		t.Format(amzTimeFormat),
+		date + "/" + region + "/" + service + "/aws4_request",
+		payloadHash([]byte(request)),
+	}, "\n")
+
+	h := hmac.New(sha256.New, signingKey(secretKey, date, region))
+	h.Write([]byte(toSign))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Sign authenticates the request using AWS signature version 4, with the hex-encoded sha256 of its payload.
+// The path of the request must be escaped, and stored as opaque part of its URL.
+// All headers of the request are signed, and it must not be changed afterwards.
+func Sign(req *http.Request, hash, region, accessKey, secretKey string, t time.Time) {
+	t = t.UTC()
+	req.Header.Set("X-Amz-Date", t.Format(amzTimeFormat))
+	req.Header.Set("X-Amz-Content-Sha256", hash)
+
+	signed := []string{"host"}
+	for name := range req.Header {
+		signed = append(signed, strings.ToLower(name))
+	}
+	sort.Strings(signed)
+
+	sig := signature(req.Method, req.URL.Opaque, req.URL.Query(), signed, req.Header, req.URL.Host, hash,
+		region, secretKey, t)
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s/%s/%s/aws4_request, SignedHeaders=%s, Signature=%s",
+		signatureAlgorithm, accessKey, t.Format(amzDateFormat), region, service, strings.Join(signed, ";"), sig))
+}
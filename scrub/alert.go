@@ -0,0 +1,50 @@
+package scrub
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// An Alert is sent whenever scrubbing a seal yields problems, like changed or missing files
+type Alert struct {
+	Seal     string    `json:"seal"`     // The seal whose slice was verified
+	Messages []string  `json:"messages"` // A message for each problem we encountered
+	Time     time.Time `json:"time"`     // The time at which the pass started
+}
+
+// Send the alert to our hook and webhook, if set. Returns the last error that occurred.
+func (s *Command) alert(a *Alert) (err error) {
+	if len(s.Hook) > 0 {
+		cmd := exec.Command(s.Hook)
+		cmd.Env = append(os.Environ(), "GODI_SEAL="+a.Seal, fmt.Sprintf("GODI_PROBLEMS=%d", len(a.Messages)))
+		cmd.Stdin = strings.NewReader(strings.Join(a.Messages, "\n") + "\n")
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		if e := cmd.Run(); e != nil {
+			err = fmt.Errorf("Alert hook '%s' failed: %s", s.Hook, e)
+		}
+	}
+
+	if len(s.Webhook) > 0 {
+		buf := bytes.Buffer{}
+		if e := json.NewEncoder(&buf).Encode(a); e != nil {
+			return e
+		}
+		res, e := http.Post(s.Webhook, "application/json", &buf)
+		if e != nil {
+			err = fmt.Errorf("Alert webhook '%s' failed: %s", s.Webhook, e)
+		} else {
+			res.Body.Close()
+			if res.StatusCode/100 != 2 {
+				err = fmt.Errorf("Alert webhook '%s' responded with status %s", s.Webhook, res.Status)
+			}
+		}
+	}
+	return
+}
@@ -0,0 +1,183 @@
+/*
+Package cli implements the command-line interface for the Command, for use by the cli.App
+*/
+package cli
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/Byron/godi/api"
+	"github.com/Byron/godi/catalog"
+	"github.com/Byron/godi/cli"
+	"github.com/Byron/godi/io"
+	"github.com/Byron/godi/scrub"
+
+	gcli "github.com/codegangsta/cli"
+)
+
+const (
+	stateFlagName          = "state"
+	sliceFlagName          = "slice"
+	bytesPerSecondFlagName = "bytes-per-second"
+	intervalFlagName       = "interval"
+	atFlagName             = "at"
+	hookFlagName           = "hook"
+	webhookFlagName        = "webhook"
+	onceFlagName           = "once"
+	catalogFlagName        = "catalog"
+	useCatalogFlagName     = "use-catalog"
+	scrubDescription       = `
+	Continuously verify seals, one slice at a time.
+
+	Each pass verifies a limited amount of data, and remembers where to continue in a state file.
+	Passes are repeated in regular intervals, so that your entire archive is verified over time
+	without saturating the devices it resides on. If a pass detects changed or missing files,
+	an alert is sent to a command or a webhook.
+
+	[arguments ...] are one or more seal files, for example
+
+	godi scrub --state ~/.godi-scrub.json --slice 2TB --at 01:00 --hook ./notify.sh /Volumes/archive/*.gobz
+
+	Use --catalog to scrub all cataloged seals on connected volumes as well.
+`
+	sliceDescription = `The amount of data to verify per pass, like '500GB'.
+	If unset, all seals are verified entirely in each pass.`
+	bytesPerSecondDescription = `The maximum amount of bytes to read per second and device, like '50MB'.
+	If unset, reads are not limited.`
+	hookDescription = `A command to run if a pass found problems. It receives all problems on stdin,
+	and the affected seal in the GODI_SEAL environment variable.`
+)
+
+// return subcommands for our particular area of algorithms
+func SubCommands() []gcli.Command {
+	out := make([]gcli.Command, 1)
+	cmd := scrub.Command{}
+	once := false
+
+	scrub := gcli.Command{
+		Name:      scrub.Name,
+		ShortName: "",
+		Usage:     scrubDescription,
+		Action:    func(c *gcli.Context) { runScrub(&cmd, once, c) },
+		Before:    func(c *gcli.Context) error { return checkScrub(&cmd, &once, c) },
+		Flags: []gcli.Flag{
+			gcli.StringFlag{
+				Name:  stateFlagName,
+				Value: "",
+				Usage: "The file keeping track of the progress between passes",
+			},
+			gcli.StringFlag{
+				Name:  sliceFlagName,
+				Value: "",
+				Usage: sliceDescription,
+			},
+			gcli.StringFlag{
+				Name:  bytesPerSecondFlagName,
+				Value: "",
+				Usage: bytesPerSecondDescription,
+			},
+			gcli.StringFlag{
+				Name:  intervalFlagName,
+				Value: scrub.DefaultInterval.String(),
+				Usage: "The time between the start of two passes, like '24h'",
+			},
+			gcli.StringFlag{
+				Name:  atFlagName,
+				Value: "",
+				Usage: "The time of day at which passes start, like '01:30'. Overrides --" + intervalFlagName,
+			},
+			gcli.StringFlag{
+				Name:  hookFlagName,
+				Value: "",
+				Usage: hookDescription,
+			},
+			gcli.StringFlag{
+				Name:  webhookFlagName,
+				Value: "",
+				Usage: "A URL to post a json alert to if a pass found problems",
+			},
+			gcli.BoolFlag{
+				Name:  onceFlagName,
+				Usage: "Perform a single pass and exit, for use with external schedulers",
+			},
+			gcli.BoolFlag{
+				Name:  useCatalogFlagName,
+				Usage: "Scrub all seals of the default catalog which are on connected volumes, see --catalog",
+			},
+			gcli.StringFlag{
+				Name:  catalogFlagName,
+				Value: "",
+				Usage: "Scrub all seals of the catalog in the given directory which are on connected volumes",
+			},
+		},
+	}
+
+	out[0] = scrub
+	return out
+}
+
+func checkScrub(cmd *scrub.Command, once *bool, c *gcli.Context) (err error) {
+	nr, level, _, err := cli.CheckCommonFlags(c)
+	if err != nil {
+		return
+	}
+
+	if slice := c.String(sliceFlagName); len(slice) > 0 {
+		if cmd.SliceBytes, err = io.ParseBytesVolume(slice); err != nil {
+			return
+		}
+	}
+	if bps := c.String(bytesPerSecondFlagName); len(bps) > 0 {
+		if cmd.BytesPerSecond, err = io.ParseBytesVolume(bps); err != nil {
+			return
+		}
+	}
+	if cmd.Interval, err = time.ParseDuration(c.String(intervalFlagName)); err != nil {
+		return
+	}
+
+	cmd.At = -1
+	if at := c.String(atFlagName); len(at) > 0 {
+		t, err := time.Parse("15:04", at)
+		if err != nil {
+			return fmt.Errorf("Invalid time of day '%s', expected HH:MM", at)
+		}
+		cmd.At = time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute
+	}
+
+	cmd.Hook = c.String(hookFlagName)
+	cmd.Webhook = c.String(webhookFlagName)
+	*once = c.Bool(onceFlagName)
+	dir := c.String(catalogFlagName)
+	if len(dir) == 0 && c.Bool(useCatalogFlagName) {
+		dir = catalog.DefaultDir()
+	}
+	if len(dir) > 0 {
+		if cmd.Catalog, err = catalog.Open(dir); err != nil {
+			return
+		}
+	}
+
+	return cmd.Init(c.Args(), c.String(stateFlagName), nr, level)
+}
+
+func runScrub(cmd *scrub.Command, once bool, c *gcli.Context) {
+	handler := cli.MakeLogHandler(cmd.Level)
+
+	var err error
+	if once {
+		_, err = cmd.Pass(handler)
+	} else {
+		err = cmd.Run(handler)
+	}
+	if err != nil {
+		handler(&api.BasicResult{Err: err, Prio: api.Error})
+	}
+
+	nerr := cli.CliFinishApp(c)
+	if err != nil || nerr != nil {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,7 @@
+/*
+Package scrub implements the 'scrub' functionality, which continuously verifies seals in slices.
+
+Each pass verifies a limited amount of data, and remembers where to continue in a state file. That way,
+an entire archive is verified over the course of multiple passes without saturating the devices it resides on.
+*/
+package scrub
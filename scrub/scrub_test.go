@@ -0,0 +1,121 @@
+package scrub_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Byron/godi/api"
+	"github.com/Byron/godi/scrub"
+	"github.com/Byron/godi/seal"
+	"github.com/Byron/godi/testlib"
+)
+
+func TestScrub(t *testing.T) {
+	datasetTree, file, _ := testlib.MakeDatasetOrPanic()
+	defer testlib.RmTree(datasetTree)
+	stateDir, _ := ioutil.TempDir("", "scrub")
+	defer testlib.RmTree(stateDir)
+	statePath := filepath.Join(stateDir, "state.json")
+
+	sealcmd, _ := seal.NewCommand([]string{datasetTree}, 1, 0)
+	resHandler := testlib.ResultHandler(t, false)
+
+	var indices []string
+	if err := api.StartEngine(sealcmd, api.IndexTrackingResultHandlerAdapter(&indices, resHandler)); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := scrub.NewCommand(indices, "", 1); err == nil {
+		t.Error("A state file is required")
+	}
+
+	cmd, err := scrub.NewCommand(indices, statePath, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The smallest possible slice verifies about one file per pass
+	cmd.SliceBytes = 1
+	cmd.BytesPerSecond = 100 * 1024 * 1024
+	const numFiles = 7
+	passes := 0
+	for passes < numFiles {
+		if cancelled, err := cmd.Pass(resHandler); cancelled || err != nil {
+			t.Fatal(cancelled, err)
+		}
+		passes += 1
+		if readState(t, statePath)[indices[0]].Cycles == 1 {
+			break
+		}
+	}
+	if passes < 2 || readState(t, statePath)[indices[0]].Cycles != 1 {
+		t.Errorf("Expected one complete cycle in multiple passes, got one after %d passes", passes)
+	}
+
+	// A problem must trigger an alert
+	var alert scrub.Alert
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&alert)
+	}))
+	defer srv.Close()
+
+	os.Remove(file)
+	cmd.SliceBytes = 0
+	cmd.Webhook = srv.URL
+	if _, err := cmd.Pass(testlib.ResultHandler(t, true)); err == nil {
+		t.Error("Scrubbing should have noticed the missing file")
+	}
+	if alert.Seal != indices[0] || len(alert.Messages) != 1 {
+		t.Errorf("Didn't receive the expected alert: %#v", alert)
+	}
+
+	// Seals which can't be verified at all are alerted, and don't keep the others from being scrubbed
+	otherTree, _, _ := testlib.MakeDatasetOrPanic()
+	defer testlib.RmTree(otherTree)
+	sealcmd, _ = seal.NewCommand([]string{otherTree}, 1, 0)
+	var others []string
+	if err = api.StartEngine(sealcmd, api.IndexTrackingResultHandlerAdapter(&others, resHandler)); err != nil {
+		t.Fatal(err)
+	}
+	otherStatePath := filepath.Join(stateDir, "other.json")
+	if cmd, err = scrub.NewCommand([]string{indices[0], others[0]}, otherStatePath, 1); err != nil {
+		t.Fatal(err)
+	}
+	cmd.Webhook = srv.URL
+	alert = scrub.Alert{}
+	os.Remove(indices[0])
+	if _, err = cmd.Pass(testlib.ResultHandler(t, true)); err == nil {
+		t.Error("Scrubbing should have noticed the missing seal")
+	}
+	if alert.Seal != indices[0] || len(alert.Messages) != 1 {
+		t.Errorf("Didn't receive the expected alert: %#v", alert)
+	}
+	if readState(t, otherStatePath)[others[0]].Cycles != 1 {
+		t.Error("The other seal should have been scrubbed in the same pass")
+	}
+}
+
+type sealState struct {
+	Offset uint64
+	Cycles uint
+}
+
+func readState(t *testing.T, path string) map[string]sealState {
+	var st struct {
+		Seals map[string]sealState
+	}
+	fd, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fd.Close()
+	if err = json.NewDecoder(fd).Decode(&st); err != nil {
+		t.Fatal(err)
+	}
+	return st.Seals
+}
@@ -0,0 +1,336 @@
+package scrub
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/Byron/godi/api"
+	"github.com/Byron/godi/catalog"
+	"github.com/Byron/godi/io"
+	"github.com/Byron/godi/verify"
+)
+
+const (
+	Name = "scrub"
+
+	DefaultInterval = 24 * time.Hour
+)
+
+// Keeps the progress of scrubbing a single seal
+type sealState struct {
+	Offset    uint64    `json:"offset"`    // Index of the next sealed file to verify
+	Cycles    uint      `json:"cycles"`    // Amount of times the seal was verified entirely
+	LastPass  time.Time `json:"lastPass"`  // Time at which a slice of the seal was verified the last time
+	LastCycle time.Time `json:"lastCycle"` // Time at which the last slice of the seal was verified
+	Failures  uint      `json:"failures"`  // Amount of passes in which the seal couldn't be verified at all
+}
+
+// The progress of all seals we scrub, as stored in the state file
+type state struct {
+	Current string                `json:"current"` // The seal to continue with in the next pass
+	Seals   map[string]*sealState `json:"seals"`
+}
+
+// Read the state from the given path. A state file which doesn't exist yet yields an empty state
+func loadState(path string) (*state, error) {
+	st := state{Seals: make(map[string]*sealState)}
+	fd, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return &st, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+
+	if err = json.NewDecoder(fd).Decode(&st); err != nil {
+		return nil, fmt.Errorf("Failed to read scrub state at '%s': %s", path, err)
+	}
+	if st.Seals == nil {
+		st.Seals = make(map[string]*sealState)
+	}
+	return &st, nil
+}
+
+// Write the state to the given path atomically, to never leave a partial state behind
+func (st *state) save(path string) error {
+	tmp := path + ".tmp"
+	fd, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+
+	err = json.NewEncoder(fd).Encode(st)
+	if cerr := fd.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// Returns the state of the given seal, creating it as needed
+func (st *state) seal(index string) *sealState {
+	ss, ok := st.Seals[index]
+	if !ok {
+		ss = &sealState{}
+		st.Seals[index] = ss
+	}
+	return ss
+}
+
+// A type representing all arguments required to drive a scrub operation
+type Command struct {
+	// The seals to verify
+	Seals []string
+
+	// Path to the file keeping our progress between passes
+	StatePath string
+
+	// Amount of data to verify per pass. If 0, all seals are verified entirely in each pass
+	SliceBytes io.BytesVolume
+
+	// Amount of bytes per second we may read from each device. If 0, reads are not limited
+	BytesPerSecond io.BytesVolume
+
+	// Time between the start of two passes
+	Interval time.Duration
+
+	// Time of day at which passes start, as offset to midnight. If negative, Interval is used instead
+	At time.Duration
+
+	// A command to run if a pass found a problem. It receives the messages on stdin
+	Hook string
+
+	// A URL to post an Alert to, as json, if a pass found a problem
+	Webhook string
+
+	// If set, all cataloged seals which are currently accessible are scrubbed as well
+	Catalog *catalog.Catalog
+
+	// Arguments for each verify command
+	NumReaders int
+	Level      api.Importance
+}
+
+// NewCommand returns an initialized scrub command
+func NewCommand(seals []string, statePath string, nReaders int) (*Command, error) {
+	c := Command{
+		Interval: DefaultInterval,
+		At:       -1,
+	}
+	return &c, c.Init(seals, statePath, nReaders, api.Info)
+}
+
+// Init verifies and sets the given arguments
+func (s *Command) Init(seals []string, statePath string, nReaders int, maxLogLevel api.Importance) (err error) {
+	if s.Catalog != nil {
+		for _, e := range s.Catalog.Entries() {
+			// Seals on volumes which are not connected can't be scrubbed
+			if _, err := os.Stat(e.Seal); err == nil {
+				seals = append(seals, e.Seal)
+			}
+		}
+	}
+	if len(seals) == 0 {
+		return errors.New("Please provide at least one seal file to scrub")
+	}
+	if len(statePath) == 0 {
+		return errors.New("Please provide a path to the state file")
+	}
+	if s.Interval <= 0 {
+		return errors.New("The interval between passes must be larger than 0")
+	}
+
+	if s.Seals, err = api.ParseSources(seals, true); err != nil {
+		return
+	}
+	if s.StatePath, err = filepath.Abs(statePath); err != nil {
+		return
+	}
+	if _, err = loadState(s.StatePath); err != nil {
+		return
+	}
+
+	s.NumReaders = nReaders
+	s.Level = maxLogLevel
+	return nil
+}
+
+// Returns the time at which the pass following the one started at the given time should start
+func (s *Command) nextPass(started time.Time) time.Time {
+	if s.At < 0 {
+		return started.Add(s.Interval)
+	}
+
+	y, m, d := started.Date()
+	next := time.Date(y, m, d, 0, 0, 0, 0, started.Location()).Add(s.At)
+	for !next.After(started) {
+		next = next.AddDate(0, 0, 1)
+	}
+	return next
+}
+
+// Run performs passes until it is interrupted by a signal, and returns the last error of a pass
+func (s *Command) Run(handler func(api.Result)) (err error) {
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(signals)
+
+	for {
+		started := time.Now()
+		var cancelled bool
+		if cancelled, err = s.Pass(handler); cancelled {
+			return
+		} else if err != nil {
+			handler(&api.BasicResult{Err: err, Prio: api.Error})
+		}
+
+		next := s.nextPass(started)
+		handler(&api.BasicResult{
+			Msg:  fmt.Sprintf("SCRUB: next pass at %s", next.Format(time.RFC1123)),
+			Prio: api.Valuable,
+		})
+
+		select {
+		case <-signals:
+			return
+		case <-time.After(next.Sub(time.Now())):
+		}
+	}
+}
+
+// Pass verifies the next slice of our seals, and sends an alert if there were problems.
+// Returns true if the pass was cancelled, and the last error we encountered
+func (s *Command) Pass(handler func(api.Result)) (bool, error) {
+	st, err := loadState(s.StatePath)
+	if err != nil {
+		return false, err
+	}
+
+	first := 0
+	for i, index := range s.Seals {
+		if index == st.Current {
+			first = i
+			break
+		}
+	}
+
+	// Each seal is verified at most once per pass
+	var lastErr error
+	remaining := uint64(s.SliceBytes)
+	for i := 0; i < len(s.Seals); i++ {
+		index := s.Seals[(first+i)%len(s.Seals)]
+		ss := st.seal(index)
+
+		completed, cancelled, err := s.scrubSeal(index, ss, &remaining, handler)
+		if cancelled {
+			return true, err
+		} else if err != nil {
+			lastErr = err
+		}
+
+		if completed {
+			st.Current = s.Seals[(first+i+1)%len(s.Seals)]
+		} else {
+			st.Current = index
+		}
+		if err = st.save(s.StatePath); err != nil {
+			return false, err
+		}
+
+		if !completed || (s.SliceBytes > 0 && remaining == 0) {
+			break
+		}
+	}
+
+	return false, lastErr
+}
+
+// Verify the next slice of the given seal, limited by the remaining amount of bytes if we have a slice size.
+// Returns true if we are done with the seal in this cycle, which is when it was verified entirely or couldn't be
+// verified at all, and true if we were cancelled, as well as alerting errors.
+func (s *Command) scrubSeal(index string, ss *sealState, remaining *uint64, handler func(api.Result)) (completed, cancelled bool, err error) {
+	var pos, next uint64
+	selected, exhausted := false, false
+
+	cmd := verify.Command{
+		Filter: func(_ string, f *api.FileInfo) bool {
+			p := pos
+			pos += 1
+			if p < ss.Offset || exhausted {
+				return false
+			}
+			if s.SliceBytes > 0 {
+				// Always pick at least one file per pass, or we would never get past files larger than a slice
+				if (selected || *remaining < uint64(s.SliceBytes)) && uint64(f.Size) > *remaining {
+					exhausted = true
+					next = p
+					return false
+				}
+				if uint64(f.Size) < *remaining {
+					*remaining -= uint64(f.Size)
+				} else {
+					*remaining = 0
+				}
+			}
+			selected = true
+			return true
+		},
+	}
+	if ierr := cmd.Init(s.NumReaders, 0, []string{index}, s.Level, nil); ierr != nil {
+		// It's retried in the next cycle, instead of keeping us from getting to the other seals
+		handler(&api.BasicResult{Err: ierr, Prio: api.Error})
+		alert := Alert{Seal: index, Time: time.Now(), Messages: []string{ierr.Error()}}
+		ss.LastPass = alert.Time
+		ss.Offset = 0
+		ss.Failures += 1
+		if err = s.alert(&alert); err == nil {
+			err = fmt.Errorf("Failed to scrub '%s': %s", index, ierr)
+		}
+		return true, false, err
+	}
+	for _, rctrl := range cmd.RootedReaders {
+		rctrl.Ctrl.SetRateLimit(uint64(s.BytesPerSecond))
+	}
+
+	alert := Alert{Seal: index, Time: time.Now()}
+	api.StartEngine(&cmd, func(r api.Result) {
+		if r.Error() != nil {
+			msg, _ := r.Info()
+			alert.Messages = append(alert.Messages, msg)
+		}
+		handler(r)
+	})
+
+	select {
+	case <-cmd.Done:
+		return false, true, nil
+	default:
+	}
+
+	ss.LastPass = alert.Time
+	if exhausted {
+		ss.Offset = next
+	} else {
+		completed = true
+		ss.Offset = 0
+		ss.Cycles += 1
+		ss.LastCycle = alert.Time
+	}
+
+	if len(alert.Messages) > 0 {
+		err = s.alert(&alert)
+		if err == nil {
+			err = fmt.Errorf("Scrubbing '%s' found %d problem(s)", index, len(alert.Messages))
+		}
+	}
+	return
+}
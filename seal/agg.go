@@ -2,25 +2,29 @@ package seal
 
 import (
 	"fmt"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"sort"
 	"sync/atomic"
+	"time"
 
 	"github.com/Byron/godi/api"
 	"github.com/Byron/godi/codec"
 	"github.com/Byron/godi/io"
 )
 
-// Will setup a go-routine which writes a seal for the given tree, continuously as new files come in
-func setupIndexWriter(commonTree string, encoder codec.Codec) (chan<- api.FileInfo, <-chan indexWriterResult) {
+// SetupIndexWriter starts a go-routine which writes a seal for the given tree, continuously as new files come in.
+// The seal of an archive is written next to it.
+// Close the returned channel to finish the seal. The result is sent exactly once, which may be early in case of errors.
+func SetupIndexWriter(commonTree string, encoder codec.Codec) (chan<- api.FileInfo, <-chan IndexWriterResult) {
 	if encoder == nil {
 		panic("No encoder provided")
 	}
 
 	sealFiles := make(chan api.FileInfo)
 	// we may always put in one item, which allows this go-routine to go down without having to wait
-	results := make(chan indexWriterResult, 1)
+	results := make(chan IndexWriterResult, 1)
 
 	go func() {
 		defer close(results)
@@ -33,19 +37,67 @@ func setupIndexWriter(commonTree string, encoder codec.Codec) (chan<- api.FileIn
 
 		// This will and should fail if the file already exists
 		indexPath := api.IndexPath(commonTree, encoder.Extension())
-		fd, err := os.OpenFile(indexPath, os.O_EXCL|os.O_CREATE|os.O_WRONLY, 0666)
+		if io.IsArchive(commonTree) {
+			// Archives we read from are not changed
+			indexPath = api.ArchiveIndexPath(commonTree, encoder.Extension())
+		}
+		fd, err := io.Create(indexPath, 0666)
 		if err == nil {
 			// We assume the serializer deals with buffering if he needs it.
 			// MHL caches in memory, and gob uses zip, which allocates a big buffer itself
 			err = encoder.Serialize(sealFiles, fd)
-			fd.Close()
+			if cerr := fd.Close(); err == nil {
+				err = cerr
+			}
 			if err != nil {
 				// Remove intermediate results
-				os.Remove(indexPath)
+				io.Remove(indexPath)
+			}
+		}
+
+		results <- IndexWriterResult{Path: indexPath, Err: err}
+	}()
+
+	return sealFiles, results
+}
+
+// SetupArchiveIndexWriter is like SetupIndexWriter, but embeds the seal into the given archive as its last member.
+// The archive is closed once the seal was written.
+func SetupArchiveIndexWriter(archive *io.ArchiveWriter, encoder codec.Codec) (chan<- api.FileInfo, <-chan IndexWriterResult) {
+	if encoder == nil {
+		panic("No encoder provided")
+	}
+
+	sealFiles := make(chan api.FileInfo)
+	results := make(chan IndexWriterResult, 1)
+
+	go func() {
+		defer close(results)
+
+		// Members are written one after another, which is why the seal is kept aside until all files are done
+		name := filepath.Base(api.IndexPath("", encoder.Extension()))
+		indexPath := filepath.Join(archive.Path(), name)
+		fd, err := ioutil.TempFile("", name)
+		if err == nil {
+			err = encoder.Serialize(sealFiles, fd)
+			var size int64
+			if err == nil {
+				size, err = fd.Seek(0, os.SEEK_CUR)
+			}
+			if err == nil {
+				_, err = fd.Seek(0, os.SEEK_SET)
+			}
+			if err == nil {
+				err = archive.AddFile(name, fd, size, time.Now())
 			}
+			if cerr := archive.Close(); err == nil {
+				err = cerr
+			}
+			fd.Close()
+			os.Remove(fd.Name())
 		}
 
-		results <- indexWriterResult{path: indexPath, err: err}
+		results <- IndexWriterResult{Path: indexPath, Err: err}
 	}()
 
 	return sealFiles, results
@@ -55,18 +107,23 @@ func (s *Command) Aggregate(results <-chan api.Result) <-chan api.Result {
 	treeInfoMap := make(map[string]*aggregationTreeInfo)
 	isWriting := len(s.rootedWriters) > 0
 
-	resultHandler := func(r api.Result, accumResult chan<- api.Result) bool {
-		sr := r.(*SealResult)
-
-		// If we have no file information, this one is likely to be sent by the generator.
-		// For now we just pass it on.
-		// NOTE(st): right now we are trying to seal as much as possible, but count errors on the way
-		// We could use the gen info to abort early, by marking entire trees as failed.
-		if sr.FromGenerator() {
-			accumResult <- r
-			return sr.Err == nil
+	// When syncing, the seal is written even if nothing is copied, and contains all unchanged files
+	var syncTreeInfo *aggregationTreeInfo
+	if s.Mode == ModeSync {
+		var tree string
+		if tree, syncTreeInfo = s.seedSyncSeal(); syncTreeInfo != nil {
+			treeInfoMap[tree] = syncTreeInfo
 		}
+	}
 
+	// Hard links of each tree, which are created in destinations once the file they link to was written
+	linkTrackers := make(map[string]*linkTracker)
+	link := func(target, path string) error { return nil }
+	if isWriting {
+		link = io.Link
+	}
+
+	handleFile := func(sr *SealResult, accumResult chan<- api.Result) bool {
 		deleteResultSafely := func(tree, path string) {
 			if !isWriting {
 				panic("Shouldn't ever try to delete a file we have not written ... ")
@@ -75,7 +132,7 @@ func (s *Command) Aggregate(results <-chan api.Result) <-chan api.Result {
 			br := api.BasicResult{Prio: api.Info}
 
 			// If the file doesn't exist anymore, we don't care either
-			err := os.Remove(path)
+			err := io.Remove(path)
 			if err == nil {
 				s.Stats.NumUndoneFiles += 1
 				br.Msg = fmt.Sprintf("Removed '%s'", path)
@@ -86,7 +143,7 @@ func (s *Command) Aggregate(results <-chan api.Result) <-chan api.Result {
 				// Also crawl upwards
 				var derr error
 				for dir := filepath.Dir(path); dir != tree && derr == nil; dir = filepath.Dir(dir) {
-					derr = os.Remove(dir)
+					derr = io.Remove(dir)
 				}
 			}
 		}
@@ -98,28 +155,41 @@ func (s *Command) Aggregate(results <-chan api.Result) <-chan api.Result {
 			// Initialize this root
 			// Create a new go-routine which will take care of streaming file-information straight to file
 			treeInfo = &aggregationTreeInfo{}
-			treeInfo.sealFInfos, treeInfo.sealResult = setupIndexWriter(treeRoot, codec.NewByName(s.Format))
+			if archive := s.rootedWriters.Archive(treeRoot); archive != nil {
+				treeInfo.sealFInfos, treeInfo.sealResult = SetupArchiveIndexWriter(archive, s.encoder())
+			} else {
+				treeInfo.sealFInfos, treeInfo.sealResult = SetupIndexWriter(treeRoot, s.encoder())
+			}
 			treeInfoMap[treeRoot] = treeInfo
 		}
 
 		// We will keep track of the file even if it reported an error.
 		// That way, we can later determine what to cleanup
-		hasError := r.Error() != nil || treeInfo.hasError
+		hasError := sr.Err != nil || treeInfo.hasError
 
 		// In any case, remember the file we have written in some way (may be partial write)
 		// However, don't remember the file if we didn't actually write it in any way
-		// and failed to write because it existed
-		if isWriting && !os.IsExist(sr.Err) {
+		// and failed to write because it existed, or kept the existing one.
+		// Overwritten files are replaced only once complete, and removing them would lose what was there before.
+		// Objects of stores may be shared with files of other seals, and are kept
+		if isWriting && !os.IsExist(sr.Err) && sr.Finfo.Action != io.ActionSkipped &&
+			sr.Finfo.Action != io.ActionOverwritten && s.rootedWriters.Store(treeRoot) == nil {
 			treeInfo.writtenFiles = append(treeInfo.writtenFiles, sr.Finfo.Path)
 		}
 
-		if !hasError && treeInfo.lsr.err == nil {
+		if !hasError && treeInfo.lsr.Err == nil {
 			// Provide some informational logging
 			sr.Prio = api.Info
 			if len(sr.source) == 0 {
 				sr.Msg = fmt.Sprintf("%s %s", io.SymbolHash, sr.Finfo.Path)
 			} else {
 				sr.Msg = fmt.Sprintf("CP %s -> %s", sr.source, sr.Finfo.Path)
+				if sr.Finfo.Action != io.ActionCreated {
+					sr.Msg += fmt.Sprintf(" (%s)", sr.Finfo.Action)
+				}
+				if s.Mode == ModeMove {
+					s.moved[sr.Finfo.Path] = movedFile{sr.source, sr.Finfo.Size, sr.sourceModTime}
+				}
 			}
 
 			// The seal can fail anytime, for instance on permission issues or when there
@@ -133,7 +203,7 @@ func (s *Command) Aggregate(results <-chan api.Result) <-chan api.Result {
 					close(treeInfo.sealFInfos)
 
 					// Mark the tree early - I would always expect the error to be set here ...
-					if treeInfo.lsr.err != nil {
+					if treeInfo.lsr.Err != nil {
 						// error is counted where it is handled
 						treeInfo.hasError = true
 						// Check if all trees have failures, and provide feedback to the generators !
@@ -186,11 +256,54 @@ func (s *Command) Aggregate(results <-chan api.Result) <-chan api.Result {
 		}
 
 		return !hasError
+	} // end handleFile()
+
+	resultHandler := func(r api.Result, accumResult chan<- api.Result) bool {
+		sr := r.(*SealResult)
+
+		// If we have no file information, this one is likely to be sent by the generator.
+		// For now we just pass it on.
+		// NOTE(st): right now we are trying to seal as much as possible, but count errors on the way
+		// We could use the gen info to abort early, by marking entire trees as failed.
+		if sr.FromGenerator() {
+			accumResult <- r
+			return sr.Err == nil
+		}
+
+		tracker, ok := linkTrackers[sr.Finfo.Root()]
+		if !ok {
+			tracker = newLinkTracker()
+			linkTrackers[sr.Finfo.Root()] = tracker
+		}
+		ok = true
+		for _, lr := range tracker.resolve(sr, link) {
+			if !handleFile(lr, accumResult) {
+				// The caller counts one error per result it gave us
+				if !ok {
+					s.Stats.ErrCount += 1
+				}
+				ok = false
+			}
+		}
+		return ok
 	} // end resultHandler()
 
 	finalizer := func(
 		accumResult chan<- api.Result) {
 
+		// Links whose target never arrived can neither be sealed nor created
+		for _, tracker := range linkTrackers {
+			for _, lr := range tracker.unresolved() {
+				if !handleFile(lr, accumResult) {
+					s.Stats.ErrCount += 1
+				}
+			}
+		}
+
+		if s.Mode == ModeSync {
+			s.commitSync(syncTreeInfo, accumResult)
+		}
+
 		// All we have to do is to stop the sealers and gather their result, possibly deleting
 		// incomplete seals (created because there was some error on the way)
 		for tree, treeInfo := range treeInfoMap {
@@ -198,20 +311,20 @@ func (s *Command) Aggregate(results <-chan api.Result) <-chan api.Result {
 			// Of course, the gc will decide when to actually free it.
 			treeInfo.writtenFiles = nil
 
-			if treeInfo.lsr.err == nil {
+			if treeInfo.lsr.Err == nil {
 				close(treeInfo.sealFInfos)
 				treeInfo.lsr = <-treeInfo.sealResult
 			}
 
 			br := api.BasicResult{}
-			if treeInfo.lsr.err == nil {
+			if treeInfo.lsr.Err == nil {
 				// Can we have an error here ? Just be sure we don't, otherwise we say to have
 				// written the file, and remove it in the next step
 				if !treeInfo.hasError {
-					br.Msg = fmt.Sprintf("Wrote seal file to '%s'", treeInfo.lsr.path)
+					br.Msg = fmt.Sprintf("Wrote seal file to '%s'", treeInfo.lsr.Path)
 					// special marker, to allow others to easily retrieve seal files from the result
 					// No normal file has a size of -1
-					br.Finfo = api.FileInfo{Path: treeInfo.lsr.path, Size: -1}
+					br.Finfo = api.FileInfo{Path: treeInfo.lsr.Path, Size: -1}
 					br.Prio = api.Valuable
 				}
 			} else {
@@ -222,11 +335,15 @@ func (s *Command) Aggregate(results <-chan api.Result) <-chan api.Result {
 			}
 
 			if treeInfo.hasError {
-				if len(treeInfo.lsr.path) > 0 {
-					os.Remove(treeInfo.lsr.path)
+				if archive := s.rootedWriters.Archive(tree); archive != nil {
+					// Incomplete archives are useless
+					archive.Remove()
+				} else if len(treeInfo.lsr.Path) > 0 && !os.IsExist(treeInfo.lsr.Err) {
+					// A seal which existed already isn't ours to remove
+					io.Remove(treeInfo.lsr.Path)
 				}
-				if treeInfo.lsr.err != nil {
-					br.Msg = fmt.Sprintln(treeInfo.lsr.err.Error())
+				if treeInfo.lsr.Err != nil {
+					br.Msg = fmt.Sprintln(treeInfo.lsr.Err.Error())
 				}
 				br.Msg += fmt.Sprintf("Did not write seal for '%s' due to preceeding errors", tree)
 				br.Prio = api.Error
@@ -235,9 +352,24 @@ func (s *Command) Aggregate(results <-chan api.Result) <-chan api.Result {
 			accumResult <- &br
 		} // end for each tree/treeInfo tuple
 
-		prefix := fmt.Sprintf("SEAL %s", SymbolSuccess)
+		// Archives which didn't receive a single file were never created
+		for _, wctrl := range s.rootedWriters {
+			for _, archive := range wctrl.Archives {
+				archive.Close()
+			}
+		}
+
+		if s.Mode == ModeSync {
+			s.finishSync(syncTreeInfo, accumResult)
+		}
+
+		name := "SEAL"
+		if s.Mode == ModeSync {
+			name = "SYNC"
+		}
+		prefix := fmt.Sprintf("%s %s", name, SymbolSuccess)
 		if s.Stats.ErrCount > 0 {
-			prefix = fmt.Sprintf("SEAL %s", SymbolFail)
+			prefix = fmt.Sprintf("%s %s", name, SymbolFail)
 		}
 
 		// Final seal result !
@@ -4,6 +4,7 @@ Package cli implements the commandline interface for the Command, ready for dige
 package cli
 
 import (
+	"errors"
 	"fmt"
 	"os"
 	"strings"
@@ -11,6 +12,7 @@ import (
 	"github.com/Byron/godi/api"
 	"github.com/Byron/godi/cli"
 	"github.com/Byron/godi/codec"
+	"github.com/Byron/godi/io"
 	"github.com/Byron/godi/seal"
 	"github.com/Byron/godi/verify"
 
@@ -21,6 +23,14 @@ const (
 	verifyAfterCopy        = "verify"
 	streamsPerOutputDevice = "streams-per-output-device"
 	formatFlag             = "format"
+	encryptToFlag          = "encrypt-to"
+	passphraseFlag         = "passphrase-file"
+	keygenName             = "keygen"
+	onExistFlag            = "on-exist"
+	dryRunFlag             = "dry-run"
+	deleteFlag             = "delete"
+	keepMtimeFlag          = "keep-mtime"
+	noDigestMetadataFlag   = "no-digest-metadata"
 	sealDescription        = `
 	Generate a seal for one ore more directories to allow them to be verified later.
 
@@ -32,7 +42,10 @@ const (
 
 	[arguments ...] can be files or directories, for example
 
-	godi seal my-anniversary.mov /Volumes/backup/`
+	godi seal my-anniversary.mov /Volumes/backup/
+
+	tar, tar.gz and zip archives are sealed like the directory they would extract to,
+	without extracting them. Their seal is written next to them, like vendor.tar.gz_godi_<time>.gob`
 
 	sealedCopyDescription = `
 	Seal one or more directories and copy their contents to one or more destinations.
@@ -43,7 +56,73 @@ const (
 
 	[arguments ...] specify the source file(s) or directories, as well as the destination(s), for example
 	godi sealed-copy s/ /Volumes/a
-	godi sealed-copy s1/ s2/ -- /Volumes/a /Volumes/b`
+	godi sealed-copy s1/ s2/ -- /Volumes/a /Volumes/b
+
+	A destination may be a new tar, tar.gz or zip archive, which receives the seal as its last member
+	godi sealed-copy s/ /Volumes/a/delivery.tar
+
+	Sources and destinations may be on remote hosts, given as sftp:// URLs. Each host is one device
+	godi sealed-copy s/ sftp://user@host/Volumes/a
+
+	Buckets of S3 compatible servers are given as s3:// URLs. Each bucket is one device
+	godi sealed-copy s/ s3://bucket/prefix
+
+	A destination prefixed with cas: is a content-addressed store, which keeps identical files only once.
+	Its seals map the paths of files to their contents, and are restored with 'godi restore'
+	godi sealed-copy s/ cas:/Volumes/archive`
+
+	sealedMoveDescription = `
+	Like sealed-copy, but remove the sources once all of their copies were verified.
+
+	All produced seals are verified after copying, and each source file is only removed if all of its
+	copies were found to match it. Files which changed since they were copied are kept, just like
+	directories which still contain files.
+	A log of removed files is written next to the seal in each destination.
+
+	[arguments ...] specify the source file(s) or directories, as well as the destination(s), for example
+	godi sealed-move /Volumes/card -- /Volumes/a/card /Volumes/b/card
+	godi sealed-move --dry-run /Volumes/card /Volumes/a/card`
+
+	syncDescription = `
+	Make a destination directory match a source directory, copying only what changed.
+
+	New files are copied, as well as files which changed, which is determined by comparing their signatures
+	if both directories have a seal describing them, or by their size and modification time otherwise.
+	The plan is shown before it is executed. Once all files were copied, the seal of the destination is
+	replaced by one describing all of its files, and extraneous files are removed if --delete is set.
+
+	[arguments ...] specify the source and the destination directory, for example
+	godi sync /Volumes/archive -- /Volumes/mirror
+	godi sync --delete --dry-run /Volumes/archive /Volumes/mirror`
+
+	restoreDescription = `
+	Rebuild the directory tree described by a seal in a content-addressed store.
+
+	Each file is copied from the object holding its contents, whose digest is checked on the way, and the
+	destination receives a seal of its own. If a store is given instead of a seal, its newest seal is restored.
+
+	[arguments ...] specify the seal and the destination directory, for example
+	godi restore /Volumes/archive/godi_2015-01-03_132154.gob /Volumes/work/A003
+	godi restore --verify /Volumes/archive /Volumes/work/A003`
+
+	keygenDescription = `
+	Generate a key pair to encrypt seals with, and write it to a new file.
+
+	The public key is printed, and can be given to anyone sealing data for you with --encrypt-to.
+	Keep the key file secret, as it is needed to verify encrypted seals with 'godi verify --key'.
+
+	[arguments ...] is the path to the key file to create, for example
+
+	godi keygen ~/.godi/seal.key`
+
+	onExistDescription = `What to do if a file exists in a destination already, one of
+	fail: the copy fails, and all files copied to the destination are removed
+	skip-if-identical: the existing file is kept if its contents match the source, and the copy fails otherwise
+	overwrite: the existing file is replaced once its copy is complete, and kept if the copy fails
+	rename: the file is copied next to the existing one, with a number appended to its name`
+
+	encryptToDescription = `Encrypt the seal for the given public key, as printed by 'godi keygen',
+	which may also be read from a key file. The seal can only be verified with the secret key.`
 )
 
 var (
@@ -51,20 +130,66 @@ var (
 	%s: is a compressed binary seal format, which is temper-proof and highly efficient, 
 	handling millions of files easily.
 	%s: is a human-readable XML format understood by mediahashlist.org, which will 
-	be inefficient for large amount of files`,
-		strings.Join(codec.Names(), ", "), codec.GobName, codec.MHLName)
+	be inefficient for large amount of files
+	%s: is a compressed, streamable JSON Lines format, which is temper-proof and 
+	easy to read with any tool understanding JSON
+	%s, %s, %s, %s: are unsigned plain-text checksum lists, 
+	as understood by 'md5sum -c' and friends, or by SFV tools`,
+		strings.Join(codec.Names(), ", "), codec.GobName, codec.MHLName, codec.JSONLName,
+		codec.MD5SumName, codec.Sha1SumName, codec.Sha256SumName, codec.SFVName)
 )
 
 // return subcommands for our particular area of algorithms
 func SubCommands() []gcli.Command {
 	cmdseal := seal.Command{Mode: seal.ModeSeal}
 	cmdcopy := seal.Command{Mode: seal.ModeCopy}
+	cmdmove := seal.Command{Mode: seal.ModeMove}
+	cmdsync := seal.Command{Mode: seal.ModeSync}
+	cmdrestore := seal.Command{Mode: seal.ModeRestore}
 
 	fmt := gcli.StringFlag{
 		Name:  formatFlag,
 		Value: codec.GobName,
 		Usage: formatDescription,
 	}
+	encryptTo := gcli.StringFlag{
+		Name:  encryptToFlag,
+		Value: "",
+		Usage: encryptToDescription,
+	}
+	passphrase := gcli.StringFlag{
+		Name:  passphraseFlag,
+		Value: "",
+		Usage: "Encrypt the seal with the passphrase in the first line of the given file",
+	}
+	verify := gcli.BoolFlag{
+		Name:  verifyAfterCopy,
+		Usage: "Run `godi verify` on all produced seals when copy is finished"}
+	spod := gcli.IntFlag{
+		Name:  streamsPerOutputDevice + ", spod",
+		Value: 1,
+		Usage: "Amount of parallel streams per output device"}
+	onExist := gcli.StringFlag{
+		Name:  onExistFlag,
+		Value: io.ExistFail.String(),
+		Usage: onExistDescription,
+	}
+	keepMtime := gcli.BoolFlag{
+		Name:  keepMtimeFlag,
+		Usage: "Give copies the modification time of their source, instead of the time they were written at"}
+	noDigestMetadata := gcli.BoolFlag{
+		Name: noDigestMetadataFlag,
+		Usage: `Don't store digests with each object copied into S3 buckets. This spares copying objects
+	larger than one part onto themselves, which is needed as digests are only known once they were uploaded`}
+	copyFlags := []gcli.Flag{
+		spod,
+		onExist,
+		keepMtime,
+		noDigestMetadata,
+		fmt,
+		encryptTo,
+		passphrase,
+	}
 
 	return []gcli.Command{
 		gcli.Command{
@@ -73,7 +198,7 @@ func SubCommands() []gcli.Command {
 			Usage:     sealDescription,
 			Action:    func(c *gcli.Context) { cli.RunAction(&cmdseal, c) },
 			Before:    func(c *gcli.Context) error { return checkSeal(&cmdseal, c) },
-			Flags:     []gcli.Flag{fmt},
+			Flags:     []gcli.Flag{fmt, encryptTo, passphrase},
 		},
 		gcli.Command{
 			Name:      seal.ModeCopy,
@@ -81,34 +206,129 @@ func SubCommands() []gcli.Command {
 			Usage:     sealedCopyDescription,
 			Action:    func(c *gcli.Context) { startSealedCopy(&cmdcopy, c) },
 			Before:    func(c *gcli.Context) error { return checkSealedCopy(&cmdcopy, c) },
+			Flags:     append([]gcli.Flag{verify}, copyFlags...),
+		},
+		gcli.Command{
+			Name:      seal.ModeMove,
+			ShortName: "",
+			Usage:     sealedMoveDescription,
+			Action:    func(c *gcli.Context) { startSealedCopy(&cmdmove, c) },
+			Before:    func(c *gcli.Context) error { return checkSealedCopy(&cmdmove, c) },
+			Flags: append([]gcli.Flag{
+				gcli.BoolFlag{
+					Name:  dryRunFlag,
+					Usage: "Copy and verify as usual, but only show which sources would be removed"},
+			}, copyFlags...),
+		},
+		gcli.Command{
+			Name:      seal.ModeSync,
+			ShortName: "",
+			Usage:     syncDescription,
+			Action:    func(c *gcli.Context) { startSealedCopy(&cmdsync, c) },
+			Before:    func(c *gcli.Context) error { return checkSealedCopy(&cmdsync, c) },
 			Flags: []gcli.Flag{
+				verify,
 				gcli.BoolFlag{
-					Name:  verifyAfterCopy,
-					Usage: "Run `godi verify` on all produced seals when copy is finished"},
-				gcli.IntFlag{
-					Name:  streamsPerOutputDevice + ", spod",
-					Value: 1,
-					Usage: "Amount of parallel streams per output device"},
+					Name:  deleteFlag,
+					Usage: "Remove files from the destination which don't exist in the source"},
+				gcli.BoolFlag{
+					Name:  dryRunFlag,
+					Usage: "Only show what would be copied and removed"},
+				spod,
 				fmt,
+				encryptTo,
+				passphrase,
 			},
 		},
+		gcli.Command{
+			Name:      seal.ModeRestore,
+			ShortName: "",
+			Usage:     restoreDescription,
+			Action:    func(c *gcli.Context) { startSealedCopy(&cmdrestore, c) },
+			Before:    func(c *gcli.Context) error { return checkSealedCopy(&cmdrestore, c) },
+			Flags: []gcli.Flag{
+				verify,
+				spod,
+				onExist,
+				keepMtime,
+				fmt,
+				gcli.StringFlag{
+					Name:  passphraseFlag,
+					Value: "",
+					Usage: "Decrypt the seal to restore, and encrypt the new one, with the passphrase in the first line of the given file",
+				},
+			},
+		},
+		gcli.Command{
+			Name:      keygenName,
+			ShortName: "",
+			Usage:     keygenDescription,
+			Action:    generateKey,
+		},
+	}
+}
+
+// Sets the key to encrypt seals with, if one was given
+func checkKey(cmd *seal.Command, c *gcli.Context) (err error) {
+	to, passphrase := c.String(encryptToFlag), c.String(passphraseFlag)
+	switch {
+	case len(to) > 0 && len(passphrase) > 0:
+		return fmt.Errorf("Please use either --%s or --%s", encryptToFlag, passphraseFlag)
+	case len(passphrase) > 0:
+		cmd.Key, err = codec.ReadPassphraseFile(passphrase)
+	case len(to) > 0:
+		if cmd.Key, err = codec.ParseKey(to); err != nil {
+			if _, serr := os.Stat(to); serr == nil {
+				cmd.Key, err = codec.ReadKeyFile(to)
+			}
+		}
+	}
+	return
+}
+
+func generateKey(c *gcli.Context) {
+	err := func() error {
+		if len(c.Args()) != 1 {
+			return fmt.Errorf("Please provide the path to the key file to create")
+		}
+		key, err := codec.GenerateKey()
+		if err != nil {
+			return err
+		}
+
+		fd, err := os.OpenFile(c.Args()[0], os.O_EXCL|os.O_CREATE|os.O_WRONLY, 0600)
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(fd, "# godi seal key - keep it secret\n# public key: %s\n%s\n", key, key.SecretString())
+		if cerr := fd.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			os.Remove(c.Args()[0])
+			return err
+		}
+
+		fmt.Println(key)
+		return nil
+	}()
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
 	}
 }
 
 func checkSeal(cmd *seal.Command, c *gcli.Context) error {
 	cmd.Format = c.String(formatFlag)
 	if len(cmd.Format) > 0 {
-		valid := false
-		for _, name := range codec.Names() {
-			if name == cmd.Format {
-				valid = true
-				break
-			}
-		}
-		if !valid {
+		if codec.NewByName(cmd.Format) == nil {
 			return fmt.Errorf("Invalid seal format '%s', must be one of %s", cmd.Format, strings.Join(codec.Names(), ", "))
 		}
 	}
+	if err := checkKey(cmd, c); err != nil {
+		return err
+	}
 
 	if err := cli.CheckCommonFlagsAndInit(cmd, c); err != nil {
 		return err
@@ -118,7 +338,28 @@ func checkSeal(cmd *seal.Command, c *gcli.Context) error {
 }
 
 func checkSealedCopy(cmd *seal.Command, c *gcli.Context) error {
-	cmd.Verify = c.Bool(verifyAfterCopy)
+	// Moves are always verified, as it's what tells us which sources may be removed
+	cmd.Verify = c.Bool(verifyAfterCopy) || cmd.Mode == seal.ModeMove
+	cmd.DryRun = c.Bool(dryRunFlag)
+	cmd.Delete = c.Bool(deleteFlag)
+	cmd.KeepModTimes = c.Bool(keepMtimeFlag)
+	cmd.NoDigestMetadata = c.Bool(noDigestMetadataFlag)
+	// A sync in dry-run mode doesn't write a seal we could verify
+	if cmd.Mode == seal.ModeSync && cmd.DryRun {
+		cmd.Verify = false
+	}
+	var err error
+	if cmd.Mode != seal.ModeSync {
+		if cmd.OnExist, err = io.ParseExistPolicy(c.String(onExistFlag)); err != nil {
+			return fmt.Errorf("--%s: %s", onExistFlag, err)
+		}
+	}
+	if err = checkKey(cmd, c); err != nil {
+		return err
+	}
+	if cmd.Verify && cmd.Key != nil && !cmd.Key.CanDecrypt() {
+		return fmt.Errorf("Verifying the seals needs the secret key to decrypt them, not just the public one")
+	}
 	// have to do init ourselves as we set amount of writers
 	nr, level, filters, err := cli.CheckCommonFlags(c)
 	if err != nil {
@@ -140,6 +381,7 @@ func startSealedCopy(cmd *seal.Command, c *gcli.Context) {
 	if cmd.Verify {
 		// Setup a aggregation result handler which tracks produced indices
 		var indices []string
+		var moveErr error
 		cmdDone := make(chan bool)
 
 		handler := cli.MakeLogHandler(cmd.LogLevel())
@@ -164,14 +406,43 @@ func startSealedCopy(cmd *seal.Command, c *gcli.Context) {
 					// prepare and run a verify command
 					verifycmd, err := verify.NewCommand(indices, c.GlobalInt(cli.StreamsPerInputDeviceFlagName))
 					if err == nil {
-						err = api.StartEngine(verifycmd, handler)
+						if cmd.Key != nil {
+							verifycmd.Keys = []*codec.Key{cmd.Key}
+						}
+
+						// When moving, keep track of all copies which are known to be good
+						var verified []string
+						verifyFailed := false
+						verifyHandler := handler
+						if cmd.Mode == seal.ModeMove {
+							verifyHandler = func(r api.Result) {
+								if r.Error() == nil {
+									verified = append(verified, r.FileInformation().Path)
+								} else {
+									verifyFailed = true
+								}
+								handler(r)
+							}
+						}
+						err = api.StartEngine(verifycmd, verifyHandler)
+
+						if cmd.Mode == seal.ModeMove {
+							// Errors of a seal itself, like a bad signature, may only be known after its files
+							// were verified, which is why no source is removed if anything failed
+							if err != nil || verifyFailed {
+								moveErr = errors.New("Kept all sources as not all of their copies could be verified")
+								handler(&api.BasicResult{Err: moveErr, Prio: api.Error})
+							} else {
+								moveErr = cmd.RemoveSources(verified, handler)
+							}
+						}
 					}
 				}
 			}
 		}
 
 		// Finally, exit with appropriate error code
-		if err != nil {
+		if err != nil || moveErr != nil {
 			os.Exit(1)
 		}
 	} else {
@@ -1,5 +1,5 @@
 /*
-Package seal implements the 'seal' and 'sealed-copy' functionality.
+Package seal implements the 'seal', 'sealed-copy', 'sealed-move' and 'sync' functionality.
 
 */
 package seal
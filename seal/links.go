@@ -0,0 +1,85 @@
+package seal
+
+import (
+	"fmt"
+	"path/filepath"
+
+	"github.com/Byron/godi/api"
+)
+
+// The outcome of a file which others are hard links to
+type linkTarget struct {
+	finfo api.FileInfo
+	err   error
+}
+
+// Keeps track of the hard links of a tree, which are sealed with the digests of the file they link to.
+// As files are read in parallel, the latter may be done after its links
+type linkTracker struct {
+	// Files with hard links, by RelaPath, once they are done
+	targets map[string]linkTarget
+
+	// Links waiting for the file they link to, by its RelaPath
+	pending map[string][]*SealResult
+}
+
+func newLinkTracker() *linkTracker {
+	return &linkTracker{
+		targets: make(map[string]linkTarget),
+		pending: make(map[string][]*SealResult),
+	}
+}
+
+// Returns the given result along with all links which are ready to be handled now, in that order.
+// Links are completed by link(), which must return an error if the link can't be made in the destination.
+func (l *linkTracker) resolve(sr *SealResult, link func(target, path string) error) []*SealResult {
+	complete := func(lr *SealResult, target *linkTarget) {
+		if lr.Err != nil {
+			return
+		}
+		if target.err != nil {
+			lr.Err = fmt.Errorf("Hard link '%s' failed as its target failed: %s", lr.Finfo.Path, target.err)
+			return
+		}
+		f, t := &lr.Finfo, &target.finfo
+		f.Sha1, f.MD5, f.Sha256, f.Sha512, f.CRC32 = t.Sha1, t.MD5, t.Sha256, t.Sha512, t.CRC32
+		lr.Err = link(t.Path, f.Path)
+	}
+
+	if len(sr.Finfo.Link) > 0 {
+		target, ok := l.targets[sr.Finfo.Link]
+		if !ok {
+			l.pending[sr.Finfo.Link] = append(l.pending[sr.Finfo.Link], sr)
+			return nil
+		}
+		complete(sr, &target)
+		return []*SealResult{sr}
+	}
+
+	ready := []*SealResult{sr}
+	if sr.Finfo.HasLinks() {
+		target := linkTarget{sr.Finfo, sr.Err}
+		l.targets[sr.Finfo.RelaPath] = target
+		for _, lr := range l.pending[sr.Finfo.RelaPath] {
+			complete(lr, &target)
+			ready = append(ready, lr)
+		}
+		delete(l.pending, sr.Finfo.RelaPath)
+	}
+	return ready
+}
+
+// Returns all links whose target was never done, with an error
+func (l *linkTracker) unresolved() (res []*SealResult) {
+	for rela, links := range l.pending {
+		for _, lr := range links {
+			if lr.Err == nil {
+				lr.Err = fmt.Errorf("Hard link '%s' failed as its target '%s' wasn't sealed",
+					lr.Finfo.Path, filepath.Join(lr.Finfo.Root(), rela))
+			}
+			res = append(res, lr)
+		}
+	}
+	l.pending = make(map[string][]*SealResult)
+	return
+}
@@ -0,0 +1,182 @@
+package seal
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Byron/godi/api"
+	"github.com/Byron/godi/io"
+)
+
+const removalLogPrefix = "godi-removed"
+
+// A source file copied in move mode, as it was when it was read
+type movedFile struct {
+	source  string
+	size    int64
+	modTime time.Time
+}
+
+// RemoveSources removes the source of each file copied in move mode, if all of its copies were verified.
+// verified contains the paths of all copies which were found to be unchanged after copying them, and must only
+// be given if their seals verified without any error.
+// Sources which changed since they were copied are kept, and directories which become empty are removed,
+// except for the source trees themselves. A log of removed sources is written into each destination.
+// In dry-run mode, sources are only reported. Results are sent to the given handler, and the first error
+// is returned.
+func (s *Command) RemoveSources(verified []string, handler func(api.Result)) (err error) {
+	if s.Mode != ModeMove {
+		panic("Can only remove sources in move mode")
+	}
+
+	// Copies by source
+	copies := make(map[string][]string)
+	for dst, m := range s.moved {
+		copies[m.source] = append(copies[m.source], dst)
+	}
+	numVerified := make(map[string]int)
+	for _, dst := range verified {
+		if m, ok := s.moved[dst]; ok {
+			numVerified[m.source] += 1
+		}
+	}
+
+	sources := make([]string, 0, len(copies))
+	for source := range copies {
+		sources = append(sources, source)
+	}
+	sort.Strings(sources)
+
+	fail := func(e error) {
+		if err == nil {
+			err = e
+		}
+		handler(&api.BasicResult{Err: e, Prio: api.Error})
+	}
+
+	numDestinations := s.rootedWriters.Trees()
+	var removed []string
+	for _, source := range sources {
+		dsts := copies[source]
+		m := s.moved[dsts[0]]
+		if numVerified[source] != numDestinations {
+			fail(fmt.Errorf("Kept '%s' as only %d of %d copies were verified", source, numVerified[source], numDestinations))
+			continue
+		}
+
+		// Don't remove what we didn't copy
+		stat, serr := io.Lstat(source)
+		if serr != nil {
+			fail(serr)
+			continue
+		}
+		if stat.Size() != m.size || (!m.modTime.IsZero() && !stat.ModTime().Equal(m.modTime)) {
+			fail(fmt.Errorf("Kept '%s' as it changed since it was copied", source))
+			continue
+		}
+
+		msg := "WOULD REMOVE"
+		if !s.DryRun {
+			if rerr := io.Remove(source); rerr != nil {
+				fail(rerr)
+				continue
+			}
+			s.removeEmptyDirs(filepath.Dir(source))
+			msg = "RM"
+		}
+		removed = append(removed, source)
+		handler(&api.BasicResult{
+			Finfo: api.FileInfo{Path: source, Size: m.size},
+			Msg:   fmt.Sprintf("%s %s", msg, source),
+			Prio:  api.Info,
+		})
+	}
+
+	var logs []string
+	if !s.DryRun && len(removed) > 0 {
+		var lerr error
+		if logs, lerr = s.writeRemovalLogs(removed, copies); lerr != nil {
+			fail(lerr)
+		}
+	}
+
+	prefix := fmt.Sprintf("MOVE %s", SymbolSuccess)
+	if err != nil {
+		prefix = fmt.Sprintf("MOVE %s", SymbolFail)
+	}
+	msg := fmt.Sprintf("%s: Removed %d of %d source file(s)", prefix, len(removed), len(sources))
+	if s.DryRun {
+		msg = fmt.Sprintf("%s: Would remove %d of %d source file(s) - DRY RUN: nothing was removed", prefix, len(removed), len(sources))
+	}
+	if len(logs) > 0 {
+		msg += fmt.Sprintf(", see %s", strings.Join(logs, ", "))
+	}
+	handler(&api.BasicResult{Msg: msg, Prio: api.Valuable})
+	return
+}
+
+// Removes the given directory and its parents while they are empty, stopping at the source tree
+func (s *Command) removeEmptyDirs(dir string) {
+	isInSource := func(dir string) bool {
+		for _, tree := range s.Items {
+			if strings.HasPrefix(dir, tree+string(os.PathSeparator)) {
+				return true
+			}
+		}
+		return false
+	}
+
+	for ; isInSource(dir); dir = filepath.Dir(dir) {
+		if io.Remove(dir) != nil {
+			return
+		}
+	}
+}
+
+// Writes a log of the given removed sources into each destination tree, listing the copies in the respective tree.
+// Returns the paths of all logs
+func (s *Command) writeRemovalLogs(removed []string, copies map[string][]string) (logs []string, err error) {
+	now := time.Now()
+	name := fmt.Sprintf("%s_%04d-%02d-%02d_%02d%02d%02d.log", removalLogPrefix,
+		now.Year(), now.Month(), now.Day(), now.Hour(), now.Minute(), now.Second())
+
+	for _, wctrl := range s.rootedWriters {
+		for _, tree := range wctrl.Trees {
+			path := filepath.Join(tree, name)
+			fd, ferr := io.Create(path, 0666)
+			if ferr != nil {
+				if err == nil {
+					err = ferr
+				}
+				continue
+			}
+
+			w := bufio.NewWriter(fd)
+			fmt.Fprintf(w, "# Sources removed by godi %s on %s after their copies were verified\n", ModeMove, now.Format(time.RFC1123))
+			for _, source := range removed {
+				for _, dst := range copies[source] {
+					if strings.HasPrefix(dst, tree+string(os.PathSeparator)) {
+						fmt.Fprintf(w, "%s -> %s\n", source, dst)
+					}
+				}
+			}
+			ferr = w.Flush()
+			if cerr := fd.Close(); ferr == nil {
+				ferr = cerr
+			}
+			if ferr != nil {
+				if err == nil {
+					err = ferr
+				}
+				continue
+			}
+			logs = append(logs, path)
+		}
+	}
+	return
+}
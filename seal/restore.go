@@ -0,0 +1,130 @@
+package seal
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/Byron/godi/api"
+	"github.com/Byron/godi/codec"
+	"github.com/Byron/godi/io"
+)
+
+// Parses arguments like 'seal destination' in restore mode, and returns the store containing the seal along with
+// the destination. If a store is given instead of a seal, its newest seal is restored.
+func (s *Command) parseRestoreArguments(items []string) (store string, dtrees []string, err error) {
+	if len(items) != 2 {
+		return "", nil, errors.New("Please specify the seal to restore, or the store containing it, and the destination directory")
+	}
+	sources, err := api.ParseSources(items[:1], true)
+	if err != nil {
+		return
+	}
+
+	index := sources[0]
+	if io.IsStore(index) {
+		seals, err := api.FindSeals(index)
+		if err != nil {
+			return "", nil, err
+		}
+		if len(seals) == 0 {
+			return "", nil, fmt.Errorf("Could not find a seal file in '%s'", index)
+		}
+		index = seals[len(seals)-1]
+	}
+	store = filepath.Dir(index)
+	if !io.IsStore(store) || codec.NewByPath(index) == nil {
+		return "", nil, fmt.Errorf("'%s' is no seal of a content-addressed store", index)
+	}
+
+	if dtrees, err = parseDestinations(items[1:]); err != nil {
+		return
+	}
+	if strings.HasPrefix(dtrees[0]+string(os.PathSeparator), store+string(os.PathSeparator)) {
+		return "", nil, fmt.Errorf("Cannot restore '%s' into its own store", index)
+	}
+
+	s.restored = index
+	return store, dtrees, nil
+}
+
+// Sends all files described by the restored seal, which are read from their objects.
+// Symbolic links are sent along with their target, as their objects are files
+func (s *Command) generateRestore(files chan<- api.FileInfo, results chan<- api.Result) {
+	store := filepath.Dir(s.restored)
+
+	send := func(f api.FileInfo) bool {
+		if f.Mode&os.ModeSymlink != os.ModeSymlink {
+			select {
+			case <-s.Done:
+				return false
+			case files <- f:
+				return true
+			}
+		}
+
+		fd, err := io.Open(f.Path)
+		if err == nil {
+			var target []byte
+			target, err = ioutil.ReadAll(fd)
+			fd.Close()
+			if err == nil {
+				return api.SendStream(f, bytes.NewReader(target), files, s.Done)
+			}
+		}
+		results <- makeGeneratorResult(f.Path, fmt.Sprintf("Failed to read object of '%s': %s", f.RelaPath, err), err)
+		return true
+	}
+
+	err := func() error {
+		c := codec.NewByPath(s.restored)
+		if e, ok := c.(*codec.Encrypted); ok && s.Key != nil {
+			e.Keys = []*codec.Key{s.Key}
+		}
+		fd, err := io.Open(s.restored)
+		if err != nil {
+			return err
+		}
+		defer fd.Close()
+		hasSizes := codec.HasSizes(c)
+
+		// The seal must be read entirely, even if we can't send its files anymore
+		entries := make(chan api.FileInfo)
+		sent := make(chan bool)
+		go func() {
+			ok := true
+			for f := range entries {
+				ok = ok && send(f)
+			}
+			close(sent)
+		}()
+
+		err = c.Deserialize(fd, entries, func(f *api.FileInfo) bool {
+			select {
+			case <-s.Done:
+				return false
+			default:
+			}
+			f.Path = io.StoreObjectPath(store, f.Sha1)
+			// Without a sealed size and mode, we take the ones of the object
+			if !hasSizes {
+				if stat, err := io.Lstat(f.Path); err == nil {
+					f.Size = stat.Size()
+				}
+				f.Mode = 0644
+			}
+			return true
+		})
+		close(entries)
+		<-sent
+		return err
+	}()
+
+	if err != nil {
+		results <- makeGeneratorResult(store, fmt.Sprintf("Failed to read seal '%s': %s", s.restored, err), err)
+	}
+}
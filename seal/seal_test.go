@@ -1,13 +1,20 @@
 package seal_test
 
 import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
 	"runtime"
+	"strings"
 	"testing"
 
 	"github.com/Byron/godi/api"
+	"github.com/Byron/godi/io"
 	"github.com/Byron/godi/seal"
 	"github.com/Byron/godi/testlib"
 	"github.com/Byron/godi/verify"
@@ -84,8 +91,8 @@ func TestSeal(t *testing.T) {
 	copyDestination2, _ := ioutil.TempDir("", "sealed-copy")
 	defer testlib.RmTree(copyDestination2)
 
-	cmd, err = seal.NewCommand([]string{datasetTree, seal.Sep, copyDestination1, copyDestination2}, maxProcs, 1)
-	if err != nil {
+	cmd = &seal.Command{Mode: seal.ModeCopy, KeepModTimes: true}
+	if err = cmd.Init(maxProcs, 1, []string{datasetTree, seal.Sep, copyDestination1, copyDestination2}, api.Info, []api.FileFilter{api.FilterSeals}); err != nil {
 		t.Fatal(err)
 	}
 
@@ -107,4 +114,863 @@ func TestSeal(t *testing.T) {
 	if err := api.StartEngine(verifycmd, resHandler); err != nil {
 		t.Fatal("Couldn't verify files that were just written")
 	}
+
+	// Copies must keep the modification time of their source
+	verifycmd = &verify.Command{Quick: true}
+	if err := verifycmd.Init(maxProcs, 0, indices, api.Info, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := api.StartEngine(verifycmd, resHandler); err != nil {
+		t.Fatal("Copies didn't retain the modification time of their source")
+	}
+}
+
+func TestSealedCopyOnExist(t *testing.T) {
+	datasetTree, _, _ := testlib.MakeDatasetOrPanic()
+	defer testlib.RmTree(datasetTree)
+	copyDestination, _ := ioutil.TempDir("", "sealed-copy")
+	defer testlib.RmTree(copyDestination)
+	resHandler := testlib.ResultHandler(t, true)
+
+	// Runs a copy with the given policy, and returns the amount of files per action.
+	// Seals are removed to not clash with the ones of the next copy
+	runCopy := func(policy io.ExistPolicy) (map[io.WriteAction]int, error) {
+		cmd := seal.Command{Mode: seal.ModeCopy, OnExist: policy}
+		if err := cmd.Init(1, 1, []string{datasetTree, seal.Sep, copyDestination}, api.Info, []api.FileFilter{api.FilterSeals}); err != nil {
+			t.Fatal(err)
+		}
+		actions := make(map[io.WriteAction]int)
+		var indices []string
+		err := api.StartEngine(&cmd, api.IndexTrackingResultHandlerAdapter(&indices, func(r api.Result) {
+			if f := r.FileInformation(); len(f.RelaPath) > 0 && r.Error() == nil {
+				actions[f.Action] += 1
+			}
+			resHandler(r)
+		}))
+		for _, index := range indices {
+			os.Remove(index)
+		}
+		return actions, err
+	}
+
+	actions, err := runCopy(io.ExistFail)
+	if err != nil {
+		t.Fatal(err)
+	}
+	numFiles := actions[io.ActionCreated]
+
+	// Existing files are never removed, no matter what
+	if _, err = runCopy(io.ExistFail); err == nil {
+		t.Error("Copying onto existing files must fail by default")
+	}
+	if actions, err = runCopy(io.ExistSkipIfIdentical); err != nil || actions[io.ActionSkipped] != numFiles {
+		t.Errorf("Expected all %d files to be skipped, got %v, error %v", numFiles, actions, err)
+	}
+
+	changed := filepath.Join(copyDestination, "subdir", "smallie.blah")
+	if err = ioutil.WriteFile(changed, bytes.Repeat([]byte{1}, 123), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = runCopy(io.ExistSkipIfIdentical); err == nil {
+		t.Error("Existing files with different contents must not be skipped")
+	}
+	if _, err = os.Stat(changed); err != nil {
+		t.Error("Existing files must be kept even if the copy fails")
+	}
+
+	if actions, err = runCopy(io.ExistRename); err != nil || actions[io.ActionRenamed] != numFiles {
+		t.Errorf("Expected all %d files to be renamed, got %v, error %v", numFiles, actions, err)
+	}
+	if _, err = os.Stat(filepath.Join(copyDestination, "subdir", "smallie_1.blah")); err != nil {
+		t.Error("Renamed file must be next to the existing one")
+	}
+
+	if actions, err = runCopy(io.ExistOverwrite); err != nil || actions[io.ActionOverwritten] != numFiles {
+		t.Errorf("Expected all %d files to be overwritten, got %v, error %v", numFiles, actions, err)
+	}
+	if data, _ := ioutil.ReadFile(changed); !bytes.Equal(data, make([]byte, 123)) {
+		t.Error("Changed file should have been overwritten")
+	}
+}
+
+func TestSealedMove(t *testing.T) {
+	datasetTree, _, _ := testlib.MakeDatasetOrPanic()
+	defer testlib.RmTree(datasetTree)
+	copyDestination1, _ := ioutil.TempDir("", "sealed-move")
+	defer testlib.RmTree(copyDestination1)
+	copyDestination2, _ := ioutil.TempDir("", "sealed-move")
+	defer testlib.RmTree(copyDestination2)
+	resHandler := testlib.ResultHandler(t, true)
+
+	cmd := seal.Command{Mode: seal.ModeMove, DryRun: true}
+	if err := cmd.Init(1, 1, []string{datasetTree, seal.Sep, copyDestination1, copyDestination2}, api.Info, []api.FileFilter{api.FilterSeals}); err != nil {
+		t.Fatal(err)
+	}
+	var indices []string
+	if err := api.StartEngine(&cmd, api.IndexTrackingResultHandlerAdapter(&indices, resHandler)); err != nil {
+		t.Fatal(err)
+	}
+
+	verifycmd, err := verify.NewCommand(indices, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var verified []string
+	if err = api.StartEngine(verifycmd, func(r api.Result) {
+		if r.Error() == nil {
+			verified = append(verified, r.FileInformation().Path)
+		}
+		resHandler(r)
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Sources are only removed if all of their copies were verified
+	var partial []string
+	for _, path := range verified {
+		if path != filepath.Join(copyDestination2, "subdir", "smallie.blah") {
+			partial = append(partial, path)
+		}
+	}
+	if err = cmd.RemoveSources(partial, resHandler); err == nil {
+		t.Error("Sources with unverified copies must be kept")
+	}
+	if _, err = os.Stat(filepath.Join(datasetTree, "subdir", "smallie.blah")); err != nil {
+		t.Fatal("Dry runs must not remove anything")
+	}
+
+	cmd.DryRun = false
+	if err = cmd.RemoveSources(verified, resHandler); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(filepath.Join(datasetTree, "subdir")); !os.IsNotExist(err) {
+		t.Error("Directories should be removed once they are empty")
+	}
+	if _, err = os.Stat(datasetTree); err != nil {
+		t.Error("The source tree itself must be kept")
+	}
+	if _, err = os.Stat(filepath.Join(copyDestination1, "subdir", "smallie.blah")); err != nil {
+		t.Error("Copies must remain")
+	}
+	for _, tree := range []string{copyDestination1, copyDestination2} {
+		if logs, _ := filepath.Glob(filepath.Join(tree, "godi-removed_*.log")); len(logs) != 1 {
+			t.Errorf("Expected a removal log in '%s'", tree)
+		}
+	}
+}
+
+func TestSync(t *testing.T) {
+	datasetTree, _, _ := testlib.MakeDatasetOrPanic()
+	defer testlib.RmTree(datasetTree)
+	mirror, _ := ioutil.TempDir("", "sync")
+	defer testlib.RmTree(mirror)
+	resHandler := testlib.ResultHandler(t, false)
+
+	// Runs a sync and returns the amount of copied and removed files, as well as the seals in the mirror.
+	// The seal is renamed to look older, which keeps it from clashing with the one of the next sync
+	nsync := 0
+	runSync := func(delete, dryRun bool) (numCopied, numRemoved int, seals []string) {
+		cmd := seal.Command{Mode: seal.ModeSync, Delete: delete, DryRun: dryRun}
+		if err := cmd.Init(1, 1, []string{datasetTree, seal.Sep, mirror}, api.Info, nil); err != nil {
+			t.Fatal(err)
+		}
+		var indices []string
+		err := api.StartEngine(&cmd, api.IndexTrackingResultHandlerAdapter(&indices, func(r api.Result) {
+			msg, _ := r.Info()
+			if strings.HasPrefix(msg, "CP ") {
+				numCopied += 1
+			} else if strings.HasPrefix(msg, "RM ") {
+				numRemoved += 1
+			}
+			resHandler(r)
+		}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, index := range indices {
+			nsync += 1
+			os.Rename(index, filepath.Join(mirror, fmt.Sprintf("godi_2000-01-01_0000%02d.gobz", nsync)))
+		}
+		seals, _ = api.FindSeals(mirror)
+		return
+	}
+
+	numFiles, _, seals := runSync(false, false)
+	if numFiles == 0 || len(seals) != 1 {
+		t.Fatalf("Expected all files to be copied, and a seal to be written, got %d and %v", numFiles, seals)
+	}
+	if numCopied, _, _ := runSync(false, false); numCopied != 0 {
+		t.Errorf("Unchanged files must not be copied again, got %d", numCopied)
+	}
+
+	changed := filepath.Join(datasetTree, "subdir", "smallie.blah")
+	testlib.MakeFileOrPanic(changed, 124)
+	testlib.MakeFileOrPanic(filepath.Join(datasetTree, "new.file"), 10)
+	os.Mkdir(filepath.Join(mirror, "extra"), 0777)
+	extra := testlib.MakeFileOrPanic(filepath.Join(mirror, "extra", "file"), 10)
+
+	if numCopied, numRemoved, _ := runSync(true, true); numCopied != 0 || numRemoved != 0 {
+		t.Errorf("A dry run must not change anything, yet %d files were copied and %d removed", numCopied, numRemoved)
+	}
+	numCopied, numRemoved, seals := runSync(true, false)
+	if numCopied != 2 || numRemoved != 2 {
+		t.Errorf("Expected the new and changed file to be copied, and the extraneous file and the old seal to be removed, got %d and %d", numCopied, numRemoved)
+	}
+	if _, err := os.Stat(filepath.Dir(extra)); !os.IsNotExist(err) {
+		t.Error("Directories should be removed once they are empty")
+	}
+
+	// The updated seal describes the mirror entirely
+	if len(seals) != 1 {
+		t.Fatalf("Expected the previous seal to be replaced, got %v", seals)
+	}
+	verifycmd, err := verify.NewCommand(seals, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	numVerified := 0
+	if err = api.StartEngine(verifycmd, func(r api.Result) {
+		if len(r.FileInformation().RelaPath) > 0 && r.FileInformation().Size >= 0 {
+			numVerified += 1
+		}
+		resHandler(r)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if numVerified != numFiles+1 {
+		t.Errorf("Expected %d files to be verified, got %d", numFiles+1, numVerified)
+	}
+}
+
+func TestSyncReadError(t *testing.T) {
+	mirror, _ := ioutil.TempDir("", "sync")
+	defer testlib.RmTree(mirror)
+	resHandler := testlib.ResultHandler(t, false)
+
+	// The source can fail to be read, which is simulated in memory
+	root := filepath.Join(os.TempDir(), "godi-memory-fs")
+	mem := testlib.NewMemoryFileSystem()
+	io.Mount(root, mem)
+	defer io.Mount(root, nil)
+	source := filepath.Join(root, "source")
+	if err := mem.MkdirAll(source, 0777); err != nil {
+		t.Fatal(err)
+	}
+	writeSource := func(name, data string) {
+		path := filepath.Join(source, name)
+		mem.Remove(path)
+		w, err := mem.Create(path, 0666)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte(data))
+		w.Close()
+	}
+	for _, name := range []string{"a", "b", "c"} {
+		writeSource(name, name)
+	}
+
+	var indices []string
+	runSync := func(handler func(api.Result)) error {
+		cmd := seal.Command{Mode: seal.ModeSync}
+		if err := cmd.Init(1, 1, []string{source, seal.Sep, mirror}, api.Info, nil); err != nil {
+			t.Fatal(err)
+		}
+		return api.StartEngine(&cmd, api.IndexTrackingResultHandlerAdapter(&indices, handler))
+	}
+	if err := runSync(resHandler); err != nil {
+		t.Fatal(err)
+	}
+	if len(indices) != 1 {
+		t.Fatalf("Expected one seal, got %v", indices)
+	}
+	index := filepath.Join(mirror, "godi_2000-01-01_000001.gobz")
+	if err := os.Rename(indices[0], index); err != nil {
+		t.Fatal(err)
+	}
+
+	// All files changed, but the last one can't be read after the others were copied
+	for _, name := range []string{"a", "b", "c"} {
+		writeSource(name, name+" changed")
+	}
+	writeSource("d", "d")
+	mem.Fail = func(op, path string) error {
+		if op == "open" && filepath.Base(path) == "c" {
+			return errors.New("input/output error")
+		}
+		return nil
+	}
+	if err := runSync(testlib.ResultHandler(t, true)); err == nil {
+		t.Fatal("Expected the read error to fail the sync")
+	}
+
+	// The mirror is as it was before
+	for _, name := range []string{"a", "b", "c"} {
+		if data, _ := ioutil.ReadFile(filepath.Join(mirror, name)); string(data) != name {
+			t.Errorf("Expected '%s' to be unchanged, got '%s'", name, data)
+		}
+	}
+	if infos, _ := ioutil.ReadDir(mirror); len(infos) != 4 {
+		t.Errorf("Expected nothing but the previous files and seal in the mirror, got %d files", len(infos))
+	}
+	verifycmd, err := verify.NewCommand([]string{index}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = api.StartEngine(verifycmd, resHandler); err != nil {
+		t.Errorf("The previous seal must still describe the mirror: %s", err)
+	}
+}
+
+func TestSealedCopyArchive(t *testing.T) {
+	datasetTree, _, _ := testlib.MakeDatasetOrPanic()
+	defer testlib.RmTree(datasetTree)
+	dir, _ := ioutil.TempDir("", "sealed-copy-archive")
+	defer testlib.RmTree(dir)
+	resHandler := testlib.ResultHandler(t, false)
+
+	for _, name := range []string{"delivery.tar", "delivery.zip"} {
+		archive := filepath.Join(dir, name)
+		// Multiple readers make sure members are written one at a time
+		cmd, err := seal.NewCommand([]string{datasetTree, seal.Sep, archive}, runtime.GOMAXPROCS(0)+1, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var indices []string
+		if err = api.StartEngine(cmd, api.IndexTrackingResultHandlerAdapter(&indices, resHandler)); err != nil {
+			t.Fatal(err)
+		}
+		if len(indices) != 1 || filepath.Dir(indices[0]) != archive {
+			t.Fatalf("Expected the seal to be embedded into the archive, got %v", indices)
+		}
+		if _, err = seal.NewCommand([]string{datasetTree, seal.Sep, archive}, 1, 1); err == nil {
+			t.Error("Existing archives must not be written")
+		}
+
+		// Archives are verified without extracting them, by seal or by archive
+		for _, item := range []string{indices[0], archive} {
+			verifycmd, err := verify.NewCommand([]string{item}, 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			numVerified := 0
+			if err = api.StartEngine(verifycmd, func(r api.Result) {
+				if f := r.FileInformation(); r.Error() == nil && len(f.RelaPath) > 0 && f.Size >= 0 {
+					numVerified += 1
+				}
+				resHandler(r)
+			}); err != nil {
+				t.Fatal(err)
+			}
+			if numVerified != 7 {
+				t.Errorf("Expected all 7 files in '%s' to be verified, got %d", item, numVerified)
+			}
+		}
+
+		// Changes are detected
+		data, err := ioutil.ReadFile(archive)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data[len(data)/2] ^= 1
+		if err = ioutil.WriteFile(archive, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		verifycmd, err := verify.NewCommand([]string{archive}, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = api.StartEngine(verifycmd, testlib.ResultHandler(t, true)); err == nil {
+			t.Errorf("Modification of '%s' went undetected", archive)
+		}
+	}
+}
+
+func TestSealArchiveSource(t *testing.T) {
+	datasetTree, _, _ := testlib.MakeDatasetOrPanic()
+	defer testlib.RmTree(datasetTree)
+	dir, _ := ioutil.TempDir("", "seal-archive-source")
+	defer testlib.RmTree(dir)
+	resHandler := testlib.ResultHandler(t, false)
+
+	// A seal of the tree works for archives made of it
+	var treeIndices []string
+	cmd, err := seal.NewCommand([]string{datasetTree}, 1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = api.StartEngine(cmd, api.IndexTrackingResultHandlerAdapter(&treeIndices, resHandler)); err != nil {
+		t.Fatal(err)
+	}
+	if len(treeIndices) != 1 {
+		t.Fatalf("Expected one seal, got %v", treeIndices)
+	}
+
+	verifyArchive := func(cmd *verify.Command, archive string) {
+		numVerified := 0
+		if err := api.StartEngine(cmd, func(r api.Result) {
+			if f := r.FileInformation(); r.Error() == nil && len(f.RelaPath) > 0 && f.Size >= 0 {
+				numVerified += 1
+				if !strings.HasPrefix(f.Path, archive+string(os.PathSeparator)) {
+					t.Errorf("Expected '%s' to be read from '%s'", f.Path, archive)
+				}
+			}
+			resHandler(r)
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if numVerified != 7 {
+			t.Errorf("Expected all 7 files in '%s' to be verified, got %d", archive, numVerified)
+		}
+	}
+
+	for _, name := range []string{"vendor.tar", "vendor.tar.gz", "vendor.zip"} {
+		archive := filepath.Join(dir, name)
+		cmd, err := seal.NewCommand([]string{datasetTree, seal.Sep, archive}, 1, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = api.StartEngine(cmd, resHandler); err != nil {
+			t.Fatal(err)
+		}
+
+		// The seal of an archive is written next to it, and the embedded seal is no data
+		var indices []string
+		if cmd, err = seal.NewCommand([]string{archive}, 2, 0); err != nil {
+			t.Fatal(err)
+		}
+		numSealed := 0
+		if err = api.StartEngine(cmd, api.IndexTrackingResultHandlerAdapter(&indices, func(r api.Result) {
+			if f := r.FileInformation(); r.Error() == nil && len(f.RelaPath) > 0 && f.Size >= 0 {
+				numSealed += 1
+			}
+			resHandler(r)
+		})); err != nil {
+			t.Fatal(err)
+		}
+		if len(indices) != 1 || api.IndexedArchive(indices[0]) != archive {
+			t.Fatalf("Expected a seal next to '%s', got %v", archive, indices)
+		}
+		if numSealed != 7 {
+			t.Errorf("Expected 7 files to be sealed in '%s', got %d", archive, numSealed)
+		}
+		if seals, err := api.FindSeals(archive); err != nil || len(seals) != 2 {
+			t.Errorf("Expected to find the embedded seal and the one next to '%s', got %v, %v", archive, seals, err)
+		}
+		if seals, err := api.FindSeals(dir); err != nil || len(seals) != 0 {
+			t.Errorf("Seals of archives are not seals of their directory, got %v, %v", seals, err)
+		}
+
+		verifycmd, err := verify.NewCommand(indices, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		verifyArchive(verifycmd, archive)
+
+		verifycmd = &verify.Command{Roots: map[string]string{treeIndices[0]: archive}}
+		if err = verifycmd.Init(1, 0, treeIndices, api.Info, nil); err != nil {
+			t.Fatal(err)
+		}
+		verifyArchive(verifycmd, archive)
+
+		verifycmd = &verify.Command{Quick: true}
+		if err = verifycmd.Init(1, 0, indices, api.Info, nil); err != nil {
+			t.Fatal(err)
+		}
+		verifyArchive(verifycmd, archive)
+	}
+}
+
+func TestSealArchiveHardLinks(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "seal-archive-links")
+	defer testlib.RmTree(dir)
+	resHandler := testlib.ResultHandler(t, false)
+	data := []byte("shared data")
+
+	for _, name := range []string{"links.tar", "links.tar.gz"} {
+		archive := filepath.Join(dir, name)
+		fd, err := os.Create(archive)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var gz *gzip.Writer
+		tw := tar.NewWriter(fd)
+		if strings.HasSuffix(name, ".gz") {
+			gz = gzip.NewWriter(fd)
+			tw = tar.NewWriter(gz)
+		}
+		tw.WriteHeader(&tar.Header{Name: "./file", Mode: 0644, Size: int64(len(data)), Typeflag: tar.TypeReg})
+		tw.Write(data)
+		tw.WriteHeader(&tar.Header{Name: "./dir/link", Mode: 0644, Linkname: "./file", Typeflag: tar.TypeLink})
+		tw.Close()
+		if gz != nil {
+			gz.Close()
+		}
+		fd.Close()
+
+		// Hard links are read like the member they point to
+		var indices []string
+		cmd, err := seal.NewCommand([]string{archive}, 1, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var sealed []api.FileInfo
+		if err = api.StartEngine(cmd, api.IndexTrackingResultHandlerAdapter(&indices, func(r api.Result) {
+			if f := r.FileInformation(); r.Error() == nil && len(f.RelaPath) > 0 && f.Size >= 0 {
+				sealed = append(sealed, *f)
+			}
+			resHandler(r)
+		})); err != nil {
+			t.Fatal(err)
+		}
+		if len(sealed) != 2 {
+			t.Fatalf("Expected both members of '%s' to be sealed, got %v", archive, sealed)
+		}
+		for _, f := range sealed {
+			if f.Size != int64(len(data)) || !bytes.Equal(f.Sha1, sealed[0].Sha1) {
+				t.Errorf("Expected '%s' to have the data of the member it links to, got %v", f.Path, f)
+			}
+		}
+
+		verifycmd, err := verify.NewCommand(indices, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = api.StartEngine(verifycmd, resHandler); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestSealedCopyFileSystem(t *testing.T) {
+	datasetTree, _, _ := testlib.MakeDatasetOrPanic()
+	defer testlib.RmTree(datasetTree)
+	resHandler := testlib.ResultHandler(t, false)
+
+	// Nothing underneath the mount point touches the disk
+	root := filepath.Join(os.TempDir(), "godi-memory-fs")
+	mem := testlib.NewMemoryFileSystem()
+	io.Mount(root, mem)
+	defer io.Mount(root, nil)
+
+	copy, broken := filepath.Join(root, "copy"), filepath.Join(root, "broken")
+	for _, dir := range []string{copy, broken} {
+		if err := mem.MkdirAll(dir, 0777); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var indices []string
+	cmd, err := seal.NewCommand([]string{datasetTree, seal.Sep, copy}, 1, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = api.StartEngine(cmd, api.IndexTrackingResultHandlerAdapter(&indices, resHandler)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(root); !os.IsNotExist(err) {
+		t.Fatalf("Files were written to disk at '%s'", root)
+	}
+	if len(indices) != 1 {
+		t.Fatalf("Expected one seal, got %v", indices)
+	}
+
+	verifycmd, err := verify.NewCommand(indices, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = api.StartEngine(verifycmd, resHandler); err != nil {
+		t.Fatal(err)
+	}
+
+	// Failures are handled like they are on disk, and leave nothing behind
+	mem.Fail = func(op, path string) error {
+		if op == "write" && filepath.Base(path) == "biggie.foo" {
+			return errors.New("device is full")
+		}
+		return nil
+	}
+	if cmd, err = seal.NewCommand([]string{datasetTree, seal.Sep, broken}, 1, 1); err != nil {
+		t.Fatal(err)
+	}
+	if err = api.StartEngine(cmd, testlib.ResultHandler(t, true)); err == nil {
+		t.Error("Expected the failing write to be reported")
+	}
+	if infos, err := mem.ReadDir(broken); err != nil || len(infos) != 0 {
+		t.Errorf("Expected the failed copy to be removed, got %d files, %v", len(infos), err)
+	}
+
+	// Existing files are only replaced by complete copies, and kept if overwriting fails
+	mem.Fail = func(op, path string) error {
+		if op == "write" && strings.HasPrefix(filepath.Base(path), ".biggie.foo.") {
+			return errors.New("device is full")
+		}
+		return nil
+	}
+	index := filepath.Join(copy, "godi_2000-01-01_000001.gobz")
+	if err = mem.Rename(indices[0], index); err != nil {
+		t.Fatal(err)
+	}
+	cmd = &seal.Command{Mode: seal.ModeCopy, OnExist: io.ExistOverwrite}
+	if err = cmd.Init(1, 1, []string{datasetTree, seal.Sep, copy}, api.Info, []api.FileFilter{api.FilterSeals}); err != nil {
+		t.Fatal(err)
+	}
+	if err = api.StartEngine(cmd, testlib.ResultHandler(t, true)); err == nil {
+		t.Error("Expected the failing overwrite to be reported")
+	}
+	mem.Fail = nil
+	if verifycmd, err = verify.NewCommand([]string{index}, 1); err != nil {
+		t.Fatal(err)
+	}
+	if err = api.StartEngine(verifycmd, resHandler); err != nil {
+		t.Errorf("Existing files must be intact after a failed overwrite: %s", err)
+	}
+	if infos, _ := mem.ReadDir(filepath.Join(copy, "subdir")); len(infos) != 3 {
+		t.Errorf("Expected no temporary files to be left, got %d files", len(infos))
+	}
+}
+
+func TestSealedCopyStore(t *testing.T) {
+	datasetTree, _, symlink := testlib.MakeDatasetOrPanic()
+	defer testlib.RmTree(datasetTree)
+	otherTree, _, _ := testlib.MakeDatasetOrPanic()
+	defer testlib.RmTree(otherTree)
+	dir, _ := ioutil.TempDir("", "sealed-copy-store")
+	defer testlib.RmTree(dir)
+	resHandler := testlib.ResultHandler(t, false)
+
+	store := filepath.Join(dir, "store")
+	countObjects := func() (n int) {
+		filepath.Walk(filepath.Join(store, io.StoreObjectsDir), func(path string, info os.FileInfo, err error) error {
+			if err == nil && !info.IsDir() {
+				n += 1
+			}
+			return nil
+		})
+		return
+	}
+
+	// Both trees have the same files, except for their symlinks
+	var indices []string
+	numDeduplicated := 0
+	for i, tree := range []string{datasetTree, otherTree} {
+		cmd, err := seal.NewCommand([]string{tree, io.StorePrefix + store}, 1, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var treeIndices []string
+		if err = api.StartEngine(cmd, api.IndexTrackingResultHandlerAdapter(&treeIndices, func(r api.Result) {
+			if r.FileInformation().Action == io.ActionDeduplicated {
+				numDeduplicated += 1
+			}
+			resHandler(r)
+		})); err != nil {
+			t.Fatal(err)
+		}
+		if len(treeIndices) != 1 || filepath.Dir(treeIndices[0]) != store {
+			t.Fatalf("Expected the seal to be written into the store, got %v", treeIndices)
+		}
+		// Seals are named by the time they were written, which is the same for both copies
+		index := filepath.Join(store, fmt.Sprintf("godi_2000-01-01_00000%d.gobz", i))
+		if err = os.Rename(treeIndices[0], index); err != nil {
+			t.Fatal(err)
+		}
+		indices = append(indices, index)
+	}
+	if numDeduplicated != 6 {
+		t.Errorf("Expected all files but the symlink of the second copy to be deduplicated, got %d", numDeduplicated)
+	}
+	if n := countObjects(); n != 8 {
+		t.Errorf("Expected 8 distinct objects, got %d", n)
+	}
+
+	// Seals of stores are verified by reading the objects they refer to
+	verifycmd, err := verify.NewCommand(indices, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = api.StartEngine(verifycmd, resHandler); err != nil {
+		t.Fatal(err)
+	}
+
+	// Stores can't be moved or synced into
+	movecmd := seal.Command{Mode: seal.ModeMove}
+	if err = movecmd.Init(1, 1, []string{otherTree, store}, api.Info, nil); err == nil {
+		t.Error("Files must not be moved into a store")
+	}
+
+	// The tree is restored from the store, and sealed on the way
+	restored, broken := filepath.Join(dir, "restored"), filepath.Join(dir, "broken")
+	for _, tree := range []string{restored, broken} {
+		if err = os.Mkdir(tree, 0777); err != nil {
+			t.Fatal(err)
+		}
+	}
+	restorecmd := seal.Command{Mode: seal.ModeRestore}
+	if err = restorecmd.Init(1, 1, []string{indices[0], restored}, api.Info, nil); err != nil {
+		t.Fatal(err)
+	}
+	var restoredIndices []string
+	if err = api.StartEngine(&restorecmd, api.IndexTrackingResultHandlerAdapter(&restoredIndices, resHandler)); err != nil {
+		t.Fatal(err)
+	}
+	if len(restoredIndices) != 1 || filepath.Dir(restoredIndices[0]) != restored {
+		t.Fatalf("Expected the restored tree to be sealed, got %v", restoredIndices)
+	}
+	if verifycmd, err = verify.NewCommand(restoredIndices, 1); err != nil {
+		t.Fatal(err)
+	}
+	if err = api.StartEngine(verifycmd, resHandler); err != nil {
+		t.Fatal(err)
+	}
+	if len(symlink) > 0 {
+		target, _ := os.Readlink(symlink)
+		if rtarget, err := os.Readlink(filepath.Join(restored, filepath.Base(symlink))); err != nil || rtarget != target {
+			t.Errorf("Expected the symlink to point to '%s', got '%s', %v", target, rtarget, err)
+		}
+	}
+	if err = filepath.Walk(datasetTree, func(path string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() {
+			return err
+		}
+		rinfo, err := os.Stat(filepath.Join(restored, path[len(datasetTree):]))
+		if err == nil && rinfo.Size() != info.Size() {
+			err = fmt.Errorf("Expected '%s' to have %d bytes, got %d", path, info.Size(), rinfo.Size())
+		}
+		return err
+	}); err != nil {
+		t.Error(err)
+	}
+	inside := filepath.Join(store, "inside")
+	if err = os.Mkdir(inside, 0777); err != nil {
+		t.Fatal(err)
+	}
+	if err = restorecmd.Init(1, 1, []string{store, inside}, api.Info, nil); err == nil || !strings.Contains(err.Error(), "own store") {
+		t.Errorf("A store must not be restored into itself, got %v", err)
+	}
+
+	// Changed objects are detected by all seals sharing them
+	object := io.StoreObjectPath(store, nil)
+	filepath.Walk(filepath.Join(store, io.StoreObjectsDir), func(path string, info os.FileInfo, err error) error {
+		if err == nil && info.Size() == 123 {
+			object = path
+		}
+		return nil
+	})
+	if err = os.Chmod(object, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(object, bytes.Repeat([]byte{1}, 123), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, index := range indices {
+		if verifycmd, err = verify.NewCommand([]string{index}, 1); err != nil {
+			t.Fatal(err)
+		}
+		if err = api.StartEngine(verifycmd, testlib.ResultHandler(t, true)); err == nil {
+			t.Errorf("Modification of '%s' went undetected by '%s'", object, index)
+		}
+	}
+	restorecmd = seal.Command{Mode: seal.ModeRestore}
+	if err = restorecmd.Init(1, 1, []string{indices[1], broken}, api.Info, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err = api.StartEngine(&restorecmd, testlib.ResultHandler(t, true)); err == nil {
+		t.Error("Restoring a changed object must fail")
+	}
+}
+
+func TestSealedCopyLinks(t *testing.T) {
+	datasetTree, file, _ := testlib.MakeDatasetOrPanic()
+	defer testlib.RmTree(datasetTree)
+	dir, _ := ioutil.TempDir("", "sealed-copy-links")
+	defer testlib.RmTree(dir)
+	resHandler := testlib.ResultHandler(t, false)
+
+	// The file is read once, no matter how many paths it has
+	links := []string{filepath.Join("subdir", "hardlink.ext"), "hardlink.ext"}
+	for _, link := range links {
+		if err := os.Link(file, filepath.Join(datasetTree, link)); err != nil {
+			t.Skipf("Hard links are not supported: %s", err)
+		}
+	}
+	// Files made by the testlib consist of holes, if the file system supports them
+	sparse := filepath.Join(datasetTree, "1mb.ext")
+	stat, err := os.Stat(sparse)
+	if err != nil {
+		t.Fatal(err)
+	}
+	isSparse := io.IsSparse(stat)
+
+	copyTree := filepath.Join(dir, "copy")
+	if err = os.Mkdir(copyTree, 0777); err != nil {
+		t.Fatal(err)
+	}
+	cmd, err := seal.NewCommand([]string{datasetTree, seal.Sep, copyTree}, 2, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var indices []string
+	numLinked := 0
+	if err = api.StartEngine(cmd, api.IndexTrackingResultHandlerAdapter(&indices, func(r api.Result) {
+		if f := r.FileInformation(); f.Action == io.ActionLinked {
+			numLinked += 1
+			if len(f.Sha1) == 0 {
+				t.Errorf("Hard link '%s' must have the digests of its target", f.Path)
+			}
+		}
+		resHandler(r)
+	})); err != nil {
+		t.Fatal(err)
+	}
+	if numLinked != len(links) || len(indices) != 1 {
+		t.Fatalf("Expected %d linked files and one seal, got %d and %v", len(links), numLinked, indices)
+	}
+
+	tstat, err := os.Stat(filepath.Join(copyTree, file[len(datasetTree)+1:]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, link := range links {
+		if lstat, err := os.Stat(filepath.Join(copyTree, link)); err != nil || !os.SameFile(tstat, lstat) {
+			t.Errorf("Expected '%s' to be a hard link in the copy, got %v", link, err)
+		}
+	}
+	if stat, err = os.Stat(filepath.Join(copyTree, filepath.Base(sparse))); err != nil || io.IsSparse(stat) != isSparse {
+		t.Errorf("Expected the copy of '%s' to be as sparse as the original, got %v", sparse, err)
+	}
+
+	verifycmd, err := verify.NewCommand(indices, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = api.StartEngine(verifycmd, resHandler); err != nil {
+		t.Fatal(err)
+	}
+
+	// A link replaced by a copy of its target is detected
+	link := filepath.Join(copyTree, links[0])
+	data, err := ioutil.ReadFile(link)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Remove(link); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(link, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if verifycmd, err = verify.NewCommand(indices, 1); err != nil {
+		t.Fatal(err)
+	}
+	numMismatches := 0
+	errHandler := testlib.ResultHandler(t, true)
+	if err = api.StartEngine(verifycmd, func(r api.Result) {
+		if _, ok := r.Error().(*api.FileLinkMismatch); ok {
+			numMismatches += 1
+		}
+		errHandler(r)
+	}); err == nil || numMismatches != 1 {
+		t.Errorf("Expected the broken hard link to be detected, got %d mismatches and error %v", numMismatches, err)
+	}
 }
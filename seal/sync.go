@@ -0,0 +1,369 @@
+package seal
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+
+	"github.com/Byron/godi/api"
+	"github.com/Byron/godi/codec"
+	"github.com/Byron/godi/io"
+)
+
+// What a sync has to do to make the destination match the source
+type syncPlan struct {
+	// Source files to copy, as they are new, changed, or not described by any seal
+	copies []api.FileInfo
+
+	// Seal entries of unchanged destination files, to be written into the new seal along with the copies
+	kept []api.FileInfo
+
+	// Destination files which don't exist in the source
+	extra []api.FileInfo
+
+	// Results describing the plan
+	results []api.Result
+
+	// The destination seal the plan is based on, which is replaced by the new seal. May be empty
+	baseSeal string
+
+	// Set if the plan could not be made
+	err error
+}
+
+// Returns the seal entries of the newest seal in the given tree by relative path, along with its path.
+// Returns an empty map if there is no seal.
+func (s *Command) readNewestSeal(tree string) (map[string]api.FileInfo, string, error) {
+	entries := make(map[string]api.FileInfo)
+	seals, err := api.FindSeals(tree)
+	if err != nil || len(seals) == 0 {
+		return entries, "", err
+	}
+	index := seals[len(seals)-1]
+
+	c := codec.NewByPath(index)
+	if c == nil {
+		return nil, index, fmt.Errorf("Unknown seal file format: '%s'", index)
+	}
+	if e, ok := c.(*codec.Encrypted); ok && s.Key != nil {
+		e.Keys = []*codec.Key{s.Key}
+	}
+	fd, err := io.Open(index)
+	if err != nil {
+		return nil, index, err
+	}
+	defer fd.Close()
+
+	files := make(chan api.FileInfo)
+	collected := make(chan bool)
+	go func() {
+		for f := range files {
+			entries[f.RelaPath] = f
+		}
+		close(collected)
+	}()
+
+	err = c.Deserialize(fd, files, func(*api.FileInfo) bool { return true })
+	close(files)
+	<-collected
+	if err != nil {
+		return nil, index, fmt.Errorf("Failed to read seal '%s': %s", index, err)
+	}
+	return entries, index, nil
+}
+
+// Returns all files in the given tree by relative path, or the first error encountered while traversing it
+func (s *Command) listTree(tree string, stats *api.Stats) (map[string]api.FileInfo, error) {
+	// Seals are not part of the data, and are handled separately
+	filters := make([]api.FileFilter, len(s.Filters), len(s.Filters)+1)
+	copy(filters, s.Filters)
+	filters = append(filters, api.FilterSeals)
+
+	files := make(chan api.FileInfo)
+	results := make(chan api.Result)
+	go func() {
+		api.Traverse([]string{tree}, files, results, s.Done, filters, stats, makeGeneratorResult)
+		close(files)
+	}()
+
+	res := make(map[string]api.FileInfo)
+	var err error
+	for {
+		select {
+		case f, ok := <-files:
+			if !ok {
+				return res, err
+			}
+			res[f.RelaPath] = f
+		case r := <-results:
+			if err == nil {
+				err = r.Error()
+			}
+		}
+	}
+}
+
+// Returns true if the seal entry e describes the file f as it is on disk
+func describes(e, f *api.FileInfo) bool {
+	if e.Size != f.Size {
+		return false
+	}
+	// The modification time of symbolic links isn't kept when copying them
+	return f.Mode&os.ModeSymlink == os.ModeSymlink || (!e.ModTime.IsZero() && e.ModTime.Equal(f.ModTime))
+}
+
+// Returns true if the source file src is the same as the destination file dst, by size and modification time,
+// or by the target of symbolic links
+func sameOnDisk(src, dst *api.FileInfo) bool {
+	if src.Mode&os.ModeType != dst.Mode&os.ModeType || src.Size != dst.Size {
+		return false
+	}
+	if src.Mode&os.ModeSymlink == os.ModeSymlink {
+		starget, serr := io.Readlink(src.Path)
+		dtarget, derr := io.Readlink(dst.Path)
+		return serr == nil && derr == nil && starget == dtarget
+	}
+	return src.ModTime.Equal(dst.ModTime)
+}
+
+// Compares the source tree with the destination tree, and determines what has to be done to make them match.
+// Files are compared by their signatures if both trees have a seal describing them, and by size and modification
+// time otherwise.
+func (s *Command) planSync() (p syncPlan) {
+	stree, dtree := s.Items[0], s.rootedWriters[0].Trees[0]
+	addResult := func(path, msg string) {
+		p.results = append(p.results, makeGeneratorResult(path, msg, nil))
+	}
+
+	var dsealed, sfiles, dfiles map[string]api.FileInfo
+	// The source seal is merely an optimization
+	ssealed, index, err := s.readNewestSeal(stree)
+	if err != nil {
+		addResult(index, fmt.Sprintf("Ignoring seal '%s' as it could not be read: %s", index, err))
+	}
+	if dsealed, p.baseSeal, p.err = s.readNewestSeal(dtree); p.err != nil {
+		return
+	}
+	if sfiles, p.err = s.listTree(stree, &s.Stats); p.err != nil {
+		return
+	}
+	if dfiles, p.err = s.listTree(dtree, &api.Stats{}); p.err != nil {
+		return
+	}
+
+	// Handle files in a deterministic order, which makes the plan easier to read
+	paths := make([]string, 0, len(sfiles))
+	for relaPath := range sfiles {
+		paths = append(paths, relaPath)
+	}
+	sort.Strings(paths)
+
+	var numNew, numChanged, numUnsealed int
+	for _, relaPath := range paths {
+		sf := sfiles[relaPath]
+		df, exists := dfiles[relaPath]
+		if !exists {
+			numNew += 1
+			p.copies = append(p.copies, sf)
+			addResult(sf.Path, fmt.Sprintf("NEW %s", sf.Path))
+			continue
+		}
+
+		se, hasSourceEntry := ssealed[relaPath]
+		hasSourceEntry = hasSourceEntry && describes(&se, &sf)
+		de, hasDestinationEntry := dsealed[relaPath]
+		hasDestinationEntry = hasDestinationEntry && describes(&de, &df)
+
+		var same bool
+		if hasSourceEntry && hasDestinationEntry {
+			same = bytes.Equal(se.Sha1, de.Sha1) && bytes.Equal(se.MD5, de.MD5)
+		} else {
+			same = sameOnDisk(&sf, &df)
+		}
+
+		switch {
+		case !same:
+			numChanged += 1
+			p.copies = append(p.copies, sf)
+			addResult(sf.Path, fmt.Sprintf("CHANGED %s", sf.Path))
+		case hasDestinationEntry:
+			p.kept = append(p.kept, de)
+		case hasSourceEntry:
+			se.Path = df.Path
+			// Hard links of the source are copied like any other file by sync
+			se.Link = ""
+			p.kept = append(p.kept, se)
+		default:
+			// We need its signature for the new seal, and reading it means copying it
+			numUnsealed += 1
+			p.copies = append(p.copies, sf)
+			addResult(sf.Path, fmt.Sprintf("UNSEALED %s", sf.Path))
+		}
+	}
+
+	paths = paths[:0]
+	for relaPath := range dfiles {
+		if _, exists := sfiles[relaPath]; !exists {
+			paths = append(paths, relaPath)
+		}
+	}
+	sort.Strings(paths)
+
+	for _, relaPath := range paths {
+		df := dfiles[relaPath]
+		p.extra = append(p.extra, df)
+		if s.Delete {
+			addResult(df.Path, fmt.Sprintf("DELETE %s", df.Path))
+			continue
+		}
+		addResult(df.Path, fmt.Sprintf("EXTRA %s", df.Path))
+		// Files we keep remain sealed if they were before
+		if de, ok := dsealed[relaPath]; ok && describes(&de, &df) {
+			p.kept = append(p.kept, de)
+		}
+	}
+
+	// The new seal lives where the old one did. Hard links remain sealed as such only along with their target,
+	// which is replaced otherwise
+	kept := make(map[string]bool, len(p.kept))
+	for _, f := range p.kept {
+		kept[f.RelaPath] = true
+	}
+	for i := range p.kept {
+		p.kept[i].Path = filepath.Join(dtree, p.kept[i].RelaPath)
+		if !kept[p.kept[i].Link] {
+			p.kept[i].Link = ""
+		}
+	}
+
+	msg := fmt.Sprintf("SYNC PLAN: Copy %d new, %d changed and %d unsealed file(s) from '%s' to '%s', keep %d unchanged file(s)",
+		numNew, numChanged, numUnsealed, stree, dtree, len(sfiles)-len(p.copies))
+	if len(p.extra) > 0 {
+		if s.Delete {
+			msg += fmt.Sprintf(", delete %d extraneous file(s)", len(p.extra))
+		} else {
+			msg += fmt.Sprintf(", keep %d extraneous file(s)", len(p.extra))
+		}
+	}
+	if s.DryRun {
+		msg += " - DRY RUN: nothing will be changed"
+	}
+	p.results = append(p.results, &SealResult{
+		BasicResult: api.BasicResult{
+			Msg:   msg,
+			Prio:  api.Valuable,
+			Finfo: api.FileInfo{Path: stree},
+		},
+	})
+	return
+}
+
+// Sends the plan's results, followed by all files to copy unless we are in dry-run mode
+func (s *Command) generateSync(files chan<- api.FileInfo, results chan<- api.Result) {
+	if s.plan.err != nil {
+		results <- makeGeneratorResult(s.Items[0], "", s.plan.err)
+		return
+	}
+	for _, r := range s.plan.results {
+		results <- r
+	}
+	if s.DryRun {
+		return
+	}
+
+	for _, f := range s.plan.copies {
+		if atomic.LoadUint32(&s.Stats.StopTheEngines) > 0 {
+			return
+		}
+		select {
+		case <-s.Done:
+			return
+		case files <- f:
+		}
+	}
+}
+
+// Sets up the seal writer for the destination tree, and sends it the entries of all unchanged files.
+// Returns nil if there is nothing to write.
+func (s *Command) seedSyncSeal() (string, *aggregationTreeInfo) {
+	if s.plan.err != nil || s.DryRun {
+		return "", nil
+	}
+
+	tree := s.rootedWriters[0].Trees[0]
+	treeInfo := &aggregationTreeInfo{}
+	treeInfo.sealFInfos, treeInfo.sealResult = SetupIndexWriter(tree, s.encoder())
+	for _, f := range s.plan.kept {
+		select {
+		case treeInfo.lsr = <-treeInfo.sealResult:
+			// Results are only sent early on error
+			close(treeInfo.sealFInfos)
+			treeInfo.hasError = true
+			return tree, treeInfo
+		case treeInfo.sealFInfos <- f:
+		}
+	}
+	return tree, treeInfo
+}
+
+// Replaces changed files with their copies if nothing failed, and discards the copies otherwise.
+// This way, a failed sync leaves the destination as described by its previous seal
+func (s *Command) commitSync(treeInfo *aggregationTreeInfo, accumResult chan<- api.Result) {
+	replacements := s.rootedWriters[0].Replacements
+	if treeInfo == nil || treeInfo.hasError || s.Stats.ErrCount > 0 {
+		replacements.Discard()
+		return
+	}
+	for _, err := range replacements.Commit() {
+		s.Stats.ErrCount += 1
+		treeInfo.hasError = true
+		accumResult <- &api.BasicResult{Err: err, Prio: api.Error}
+	}
+}
+
+// Removes extraneous files if requested, as well as the seal which was replaced by the new one.
+// Nothing is removed if there was any error.
+func (s *Command) finishSync(treeInfo *aggregationTreeInfo, accumResult chan<- api.Result) {
+	if treeInfo == nil {
+		return
+	}
+	if treeInfo.hasError || s.Stats.ErrCount > 0 {
+		if s.Delete && len(s.plan.extra) > 0 {
+			accumResult <- &api.BasicResult{
+				Msg:  fmt.Sprintf("Did not delete %d extraneous file(s) due to preceeding errors", len(s.plan.extra)),
+				Prio: api.Error,
+			}
+		}
+		return
+	}
+
+	tree := s.rootedWriters[0].Trees[0]
+	remove := func(path string) {
+		br := api.BasicResult{Prio: api.Info, Msg: fmt.Sprintf("RM %s", path)}
+		if err := io.Remove(path); err != nil {
+			s.Stats.ErrCount += 1
+			br = api.BasicResult{Err: err, Prio: api.Error}
+		}
+		accumResult <- &br
+	}
+
+	if s.Delete {
+		for _, f := range s.plan.extra {
+			remove(f.Path)
+			// Remove directories which became empty, but keep the tree
+			for dir := filepath.Dir(f.Path); strings.HasPrefix(dir, tree+string(os.PathSeparator)); dir = filepath.Dir(dir) {
+				if io.Remove(dir) != nil {
+					break
+				}
+			}
+		}
+	}
+
+	if len(s.plan.baseSeal) > 0 && s.plan.baseSeal != treeInfo.lsr.Path {
+		remove(s.plan.baseSeal)
+	}
+}
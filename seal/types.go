@@ -4,7 +4,9 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/Byron/godi/api"
 	"github.com/Byron/godi/codec"
@@ -17,6 +19,10 @@ const (
 
 	ModeSeal = Name
 	ModeCopy = "sealed-copy"
+	ModeMove = "sealed-move"
+	ModeSync = "sync"
+
+	ModeRestore = "restore"
 )
 
 var (
@@ -24,9 +30,10 @@ var (
 	%s can be omitted if there is only one source and one destination.`, Sep, Sep)
 )
 
-type indexWriterResult struct {
-	path string // path to the seal file
-	err  error  // possible error during the seal operation
+// The result of an index writer, see SetupIndexWriter()
+type IndexWriterResult struct {
+	Path string // path to the seal file
+	Err  error  // possible error during the seal operation
 }
 
 // Some information we store per root of files we seal
@@ -42,10 +49,10 @@ type aggregationTreeInfo struct {
 
 	// Contains the error code of the seal operation for the tree we are associated with, and the produced seal file
 	// Will only yield a result one, and be closed afterwards
-	sealResult <-chan indexWriterResult
+	sealResult <-chan IndexWriterResult
 
 	// A possible result we might have gotten due to an early seal error
-	lsr indexWriterResult // lastSealResult
+	lsr IndexWriterResult // lastSealResult
 
 	// if true, the entire tree is considered faulty, and further results won't be recorded or accepted
 	hasError bool
@@ -71,6 +78,36 @@ type Command struct {
 	// The name of the seal format to use
 	Format string
 
+	// If set, seals are encrypted with the given key, hiding the names of sealed files
+	Key *codec.Key
+
+	// What to do with files which exist in a destination already
+	OnExist io.ExistPolicy
+
+	// If set, copies get the modification time of their source. Always set in sync mode, which compares
+	// files by it
+	KeepModTimes bool
+
+	// If set, copies in S3 buckets don't store their digests as metadata, which spares copying objects
+	// larger than one part onto themselves. The seal keeps the digests either way
+	NoDigestMetadata bool
+
+	// If set in move mode, sources which would be removed are only reported.
+	// In sync mode, only the plan is reported
+	DryRun bool
+
+	// If set in sync mode, destination files which don't exist in the source are removed
+	Delete bool
+
+	// What to do in sync mode, determined when generating
+	plan syncPlan
+
+	// The source of each copy made in move mode, by path of the copy
+	moved map[string]movedFile
+
+	// The seal of a content-addressed store whose files are copied in restore mode
+	restored string
+
 	// A map of writers - there may just be one writer per device.
 	// Map may be unset if we are not in write mode
 	rootedWriters io.RootedWriteControllers
@@ -81,6 +118,8 @@ type SealResult struct {
 	api.BasicResult
 	// source of a copy operation, may be unset
 	source string
+	// modification time of the source, which the copy may not have
+	sourceModTime time.Time
 }
 
 // Returns true if this result was sent from a generator. The latter sends the root as Path, but doesn't set a RelaPath
@@ -102,9 +141,14 @@ func NewCommand(trees []string, nReaders, nWriters int) (*Command, error) {
 
 func (s *Command) Gather(rctrl *io.ReadChannelController, files <-chan api.FileInfo, results chan<- api.Result) {
 	makeResult := func(f, source *api.FileInfo, err error) api.Result {
-		s := ""
+		src, srcModTime := "", time.Time{}
 		if source != nil && source.Path != f.Path {
-			s = source.Path
+			src, srcModTime = source.Path, source.ModTime
+		}
+		// Objects are named by their digest, which is what the copy must have
+		if err == nil && s.Mode == ModeRestore && source != nil &&
+			source.Path != io.StoreObjectPath(filepath.Dir(s.restored), f.Sha1) {
+			err = fmt.Errorf("Object '%s' doesn't match its digest", source.Path)
 		}
 		res := SealResult{
 			BasicResult: api.BasicResult{
@@ -112,12 +156,21 @@ func (s *Command) Gather(rctrl *io.ReadChannelController, files <-chan api.FileI
 				Prio:  api.Info,
 				Err:   err,
 			},
-			source: s,
+			source:        src,
+			sourceModTime: srcModTime,
 		}
 		return &res
 	}
 
-	api.Gather(files, results, s.Statistics(), makeResult, rctrl, s.rootedWriters)
+	api.Gather(files, results, s.Statistics(), makeResult, rctrl, s.rootedWriters, codec.DigestsOf(codec.NewByName(s.Format)))
+}
+
+// Returns the codec to write our seals with
+func (s *Command) encoder() codec.Codec {
+	if s.Key != nil {
+		return codec.NewEncrypted(s.Format, s.Key)
+	}
+	return codec.NewByName(s.Format)
 }
 
 func (s *Command) Init(numReaders, numWriters int, items []string, maxLogLevel api.Importance, filters []api.FileFilter) (err error) {
@@ -135,71 +188,208 @@ func (s *Command) Init(numReaders, numWriters int, items []string, maxLogLevel a
 			return
 		}
 		s.InitBasicRunner(numReaders, items, maxLogLevel, filters)
-	} else if s.Mode == ModeCopy {
-		finishSetup := func(sources, dtrees []string) error {
-			// Make sure we don't copy onto ourselves
-			for _, stree := range sources {
-				for _, dtree := range dtrees {
-					if strings.HasPrefix(dtree+string(os.PathSeparator), stree) {
-						return fmt.Errorf("Cannot copy '%s' into it's own subdirectory or itself at '%s'", stree, dtree)
-					}
-				}
+	} else if s.Mode == ModeCopy || s.Mode == ModeMove || s.Mode == ModeSync {
+		sources, dtrees, err := ParseCopyArguments(items)
+		if err != nil {
+			return err
+		}
+		if s.Mode == ModeSync {
+			if len(sources) != 1 || len(dtrees) != 1 {
+				return errors.New("Please provide exactly one source and one destination directory to sync")
 			}
-			s.InitBasicRunner(numReaders, sources, maxLogLevel, filters)
-
-			// build the device map with all writer destinations
-			dm := io.DeviceMap(dtrees)
-
-			// Finally, put all actual values into our list to have a deterministic iteration order.
-			// After all, we don't really care about the device from this point on
-			s.rootedWriters = make(io.RootedWriteControllers, len(dm))
-			for did, trees := range dm {
-				// each device as so and so many destinations. Each destination uses the same write controller
-				s.rootedWriters[did] = io.RootedWriteController{
-					Trees: trees,
-					Ctrl:  io.NewWriteChannelController(numWriters, numWriters*len(trees), &s.Stats.Stats),
+			for _, tree := range []string{sources[0], dtrees[0]} {
+				if stat, err := io.Stat(tree); err != nil || !stat.IsDir() {
+					return fmt.Errorf("Can only sync directories, got '%s'", tree)
 				}
-			} // for each tree set in deviceMap
-			return nil
-		} // end helper
-
-		// Parses [src, ...] -- [dst, ...]
-		err = errors.New(usage)
-		if len(items) < 2 {
-			return
+			}
+			// Changed files are replaced once all copies succeeded, see commitSync()
+			s.OnExist = io.ExistOverwrite
+			s.KeepModTimes = true
 		}
-
-		for i, item := range items {
-			if item == Sep {
-				if i == 0 {
-					return
+		if s.Mode == ModeMove {
+			for _, tree := range sources {
+				if io.IsArchive(tree) {
+					return fmt.Errorf("Cannot move files out of archive '%s'", tree)
 				}
-				if i == len(items)-1 {
-					return
+			}
+		}
+		// Existing files are replaced by renaming their complete copy over them, which not all file systems can do
+		if s.OnExist == io.ExistOverwrite {
+			for _, tree := range dtrees {
+				if !io.IsArchivePath(tree) && !io.IsStore(tree) && !io.CanRename(tree) {
+					return fmt.Errorf("Cannot overwrite files in '%s' as its file system can't replace them atomically", tree)
 				}
-				sources, e := api.ParseSources(items[:i], true)
-				if e != nil {
-					return e
+			}
+		}
+		// Files in stores are found by their digest, not by the path we would sync or verify them at
+		if s.Mode != ModeCopy {
+			for _, tree := range dtrees {
+				if io.IsStore(tree) {
+					return fmt.Errorf("Content-addressed store '%s' can only be written by %s", tree, ModeCopy)
 				}
+			}
+		}
+		s.InitBasicRunner(numReaders, sources, maxLogLevel, filters)
+		s.moved = make(map[string]movedFile)
+		s.initWriters(dtrees, numWriters)
+		if s.Mode == ModeSync {
+			s.rootedWriters[0].Replacements = &io.Replacements{}
+		}
+	} else if s.Mode == ModeRestore {
+		store, dtrees, err := s.parseRestoreArguments(items)
+		if err != nil {
+			return err
+		}
+		s.InitBasicRunner(numReaders, []string{store}, maxLogLevel, filters)
+		s.initWriters(dtrees, numWriters)
+	} else {
+		panic(fmt.Sprintf("Unsupported mode: %s", s.Mode))
+	}
+	return
+}
 
-				dtrees, e := api.ParseSources(items[i+1:], false)
-				if e != nil {
-					return e
-				}
+// Sets up a write controller for each device of the given destinations
+func (s *Command) initWriters(dtrees []string, numWriters int) {
+	// build the device map with all writer destinations
+	dm := io.DeviceMap(dtrees)
+
+	// Finally, put all actual values into our list to have a deterministic iteration order.
+	// After all, we don't really care about the device from this point on
+	s.rootedWriters = make(io.RootedWriteControllers, len(dm))
+	for did, trees := range dm {
+		// each device as so and so many destinations. Each destination uses the same write controller
+		archives := make(map[string]*io.ArchiveWriter)
+		stores := make(map[string]*io.Store)
+		for _, tree := range trees {
+			if io.IsArchivePath(tree) {
+				archives[tree] = io.NewArchiveWriter(tree)
+			} else if io.IsStore(tree) {
+				stores[tree] = io.NewStore(tree)
+			}
+		}
+		s.rootedWriters[did] = io.RootedWriteController{
+			Trees:            trees,
+			Ctrl:             io.NewWriteChannelController(numWriters, numWriters*len(trees), &s.Stats.Stats),
+			OnExist:          s.OnExist,
+			Archives:         archives,
+			Stores:           stores,
+			KeepModTimes:     s.KeepModTimes,
+			NoDigestMetadata: s.NoDigestMetadata,
+		}
+	} // for each tree set in deviceMap
+}
 
-				return finishSetup(sources, dtrees)
+// Parses the given destinations, which are directories, content-addressed stores, or tar and zip archives
+// which don't exist yet. Stores are created if they are given with io.StorePrefix
+func parseDestinations(items []string) (dtrees []string, err error) {
+	var dirs []string
+	for _, item := range items {
+		if strings.HasPrefix(item, io.StorePrefix) {
+			if item, err = io.ResolveURL(strings.TrimPrefix(item, io.StorePrefix)); err != nil {
+				return
+			}
+			if err = io.CreateStore(item); err != nil {
+				return nil, fmt.Errorf("Failed to create store '%s': %s", item, err)
+			}
+			dirs = append(dirs, item)
+			continue
+		}
+		if !io.IsArchivePath(item) {
+			// Remote destinations have no mount point to mistype, and object stores have no directories
+			// to create up front, which is why we create them as needed
+			if path, err := io.ResolveURL(item); err != nil {
+				return nil, err
+			} else if path != item {
+				if err = io.MkdirAll(path, 0777); err != nil {
+					return nil, err
+				}
+				item = path
 			}
-		} // for each item
+			dirs = append(dirs, item)
+			continue
+		}
+		if item, err = io.ResolveURL(item); err != nil {
+			return
+		}
+		if _, root := io.FileSystemOf(item); len(root) > 0 {
+			return nil, fmt.Errorf("Archive '%s' can only be written to a local directory", item)
+		}
 
-		// So there is no separator, maybe it's source and destination ?
-		if len(items) == 2 {
-			return finishSetup(items[:1], items[1:])
+		if _, err = os.Lstat(item); err == nil {
+			return nil, fmt.Errorf("Archive '%s' exists already", item)
+		}
+		if item, err = filepath.Abs(item); err != nil {
+			return
 		}
+		if stat, err := os.Stat(filepath.Dir(item)); err != nil || !stat.IsDir() {
+			return nil, fmt.Errorf("The directory to contain archive '%s' doesn't exist", item)
+		}
+		dtrees = api.AppendUniqueString(dtrees, item)
+	}
+
+	if len(dirs) > 0 {
+		if dirs, err = api.ParseSources(dirs, false); err != nil {
+			return nil, err
+		}
+		dtrees = append(dtrees, dirs...)
+	}
+	return dtrees, nil
+}
 
-		// source-destination separator not found - prints usage
+// ParseCopyArguments parses arguments like 'source [...] -- destination [...]' into source and destination trees.
+// Destinations may also be tar or zip archives, which are created, or content-addressed stores, see io.Store.
+// The separator can be omitted if there is only one source and one destination.
+func ParseCopyArguments(items []string) (sources, dtrees []string, err error) {
+	// Make sure we don't copy onto ourselves
+	check := func(sources, dtrees []string) ([]string, []string, error) {
+		for _, stree := range sources {
+			for _, dtree := range dtrees {
+				if strings.HasPrefix(dtree+string(os.PathSeparator), stree) {
+					return nil, nil, fmt.Errorf("Cannot copy '%s' into it's own subdirectory or itself at '%s'", stree, dtree)
+				}
+			}
+		}
+		return sources, dtrees, nil
+	}
+
+	// Parses [src, ...] -- [dst, ...]
+	err = errors.New(usage)
+	if len(items) < 2 {
 		return
-	} else {
-		panic(fmt.Sprintf("Unsupported mode: %s", s.Mode))
 	}
+
+	for i, item := range items {
+		if item == Sep {
+			if i == 0 || i == len(items)-1 {
+				return
+			}
+			if sources, err = api.ParseSources(items[:i], true); err != nil {
+				return
+			}
+			if dtrees, err = parseDestinations(items[i+1:]); err != nil {
+				return
+			}
+			return check(sources, dtrees)
+		}
+	} // for each item
+
+	// So there is no separator, maybe it's source and destination ?
+	if len(items) == 2 {
+		sources = items[:1]
+		if io.IsURL(items[0]) {
+			if sources, err = api.ParseSources(sources, true); err != nil {
+				return
+			}
+		}
+		if io.IsArchivePath(items[1]) || strings.HasPrefix(items[1], io.StorePrefix) || io.IsURL(items[1]) {
+			if dtrees, err = parseDestinations(items[1:]); err != nil {
+				return
+			}
+			return check(sources, dtrees)
+		}
+		return check(sources, items[1:])
+	}
+
+	// source-destination separator not found - prints usage
 	return
 }
@@ -0,0 +1,443 @@
+package sftp
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sync"
+)
+
+// A response to a request, as received by the client
+type response struct {
+	typ  byte
+	data []byte
+}
+
+// Client performs requests on an SFTP server. It may be used by multiple go-routines at once, whose requests are
+// sent over the same connection. Paths are the ones of the server, using '/' as separator.
+type Client struct {
+	rw io.ReadWriteCloser
+
+	// Held while a request is sent
+	wl sync.Mutex
+
+	// Protects all fields below
+	l       sync.Mutex
+	nextID  uint32
+	pending map[uint32]chan response
+
+	// Set once the connection broke, which fails all further requests
+	err error
+}
+
+// NewClient initializes an SFTP session over the given connection, which usually is the stdin and stdout of the
+// 'sftp' subsystem of an ssh session. The connection is closed when the client is closed.
+func NewClient(rw io.ReadWriteCloser) (*Client, error) {
+	if err := writePacket(rw, fxpInit, appendUint32(nil, protocolVersion)); err != nil {
+		return nil, err
+	}
+	typ, data, err := readPacket(rw)
+	if err != nil {
+		return nil, err
+	}
+	if typ != fxpVersion {
+		return nil, fmt.Errorf("sftp: expected version packet, got type %d", typ)
+	}
+	p := packetReader{b: data}
+	if v := p.uint32(); p.err != nil || v < protocolVersion {
+		return nil, fmt.Errorf("sftp: server speaks unsupported protocol version %d", v)
+	}
+
+	c := Client{rw: rw, pending: make(map[uint32]chan response)}
+	go c.receive()
+	return &c, nil
+}
+
+// Dispatches responses to the requests waiting for them, until the connection breaks
+func (c *Client) receive() {
+	var err error
+	for {
+		var typ byte
+		var data []byte
+		if typ, data, err = readPacket(c.rw); err != nil {
+			break
+		}
+		p := packetReader{b: data}
+		id := p.uint32()
+		if p.err != nil {
+			err = p.err
+			break
+		}
+
+		c.l.Lock()
+		ch, ok := c.pending[id]
+		delete(c.pending, id)
+		c.l.Unlock()
+		if !ok {
+			err = fmt.Errorf("sftp: received response to unknown request %d", id)
+			break
+		}
+		ch <- response{typ, p.b}
+	}
+
+	if err == io.EOF {
+		err = errors.New("sftp: connection closed")
+	}
+	c.l.Lock()
+	c.err = err
+	for id, ch := range c.pending {
+		close(ch)
+		delete(c.pending, id)
+	}
+	c.l.Unlock()
+}
+
+// Sends a request of the given type with the given payload, which follows the id, and returns the response
+func (c *Client) request(typ byte, payload []byte) (response, error) {
+	ch := make(chan response, 1)
+	c.l.Lock()
+	if c.err != nil {
+		c.l.Unlock()
+		return response{}, c.err
+	}
+	id := c.nextID
+	c.nextID += 1
+	c.pending[id] = ch
+	c.l.Unlock()
+
+	c.wl.Lock()
+	err := writePacket(c.rw, typ, append(appendUint32(nil, id), payload...))
+	c.wl.Unlock()
+	if err != nil {
+		c.l.Lock()
+		delete(c.pending, id)
+		c.l.Unlock()
+		return response{}, err
+	}
+
+	r, ok := <-ch
+	if !ok {
+		c.l.Lock()
+		defer c.l.Unlock()
+		return response{}, c.err
+	}
+	return r, nil
+}
+
+// Returns the error described by a status response, which is nil for OK
+func statusError(r response) error {
+	p := packetReader{b: r.data}
+	code, msg := p.uint32(), p.string()
+	if p.err != nil {
+		return p.err
+	}
+	if code == fxOK {
+		return nil
+	}
+	if code == fxEOF {
+		return io.EOF
+	}
+	return &StatusError{Code: code, Msg: msg}
+}
+
+// Returns an error unless the response is of the expected type. Status responses are turned into errors
+func expect(r response, typ byte) error {
+	if r.typ == typ {
+		return nil
+	}
+	if r.typ == fxpStatus {
+		if err := statusError(r); err != nil {
+			return err
+		}
+	}
+	return fmt.Errorf("sftp: unexpected response of type %d", r.typ)
+}
+
+// Performs a request whose only response is a status
+func (c *Client) statusRequest(typ byte, payload []byte) error {
+	r, err := c.request(typ, payload)
+	if err != nil {
+		return err
+	}
+	if r.typ != fxpStatus {
+		return fmt.Errorf("sftp: unexpected response of type %d", r.typ)
+	}
+	return statusError(r)
+}
+
+// Turns protocol errors into the ones of the os package, where possible
+func pathError(op, path string, err error) error {
+	if serr, ok := err.(*StatusError); ok {
+		switch serr.Code {
+		case fxNoSuchFile:
+			err = os.ErrNotExist
+		case fxPermissionDenied:
+			err = os.ErrPermission
+		}
+	}
+	return &os.PathError{Op: op, Path: path, Err: err}
+}
+
+// Close closes the connection, failing all pending and future requests
+func (c *Client) Close() error {
+	return c.rw.Close()
+}
+
+// Requests the attributes of the file at the given path
+func (c *Client) stat(typ byte, op, p string) (os.FileInfo, error) {
+	r, err := c.request(typ, appendString(nil, p))
+	if err == nil {
+		err = expect(r, fxpAttrs)
+	}
+	if err != nil {
+		return nil, pathError(op, p, err)
+	}
+	pr := packetReader{b: r.data}
+	fi := pr.attributes()
+	if pr.err != nil {
+		return nil, pathError(op, p, pr.err)
+	}
+	fi.name = path.Base(p)
+	return fi, nil
+}
+
+// Stat returns information about the file at the given path, following symbolic links
+func (c *Client) Stat(p string) (os.FileInfo, error) {
+	return c.stat(fxpStat, "stat", p)
+}
+
+// Lstat returns information about the file at the given path
+func (c *Client) Lstat(p string) (os.FileInfo, error) {
+	return c.stat(fxpLstat, "lstat", p)
+}
+
+// Opens the file at the given path with the given flags and permissions, returning its handle
+func (c *Client) open(p string, flags uint32, perm os.FileMode) (*File, error) {
+	b := appendUint32(appendString(nil, p), flags)
+	if flags&fxfCreat != 0 {
+		b = appendAttributes(b, &fileInfo{flags: attrPermissions, perm: uint32(perm.Perm())})
+	} else {
+		b = appendUint32(b, 0)
+	}
+	r, err := c.request(fxpOpen, b)
+	if err == nil {
+		err = expect(r, fxpHandle)
+	}
+	if err != nil {
+		return nil, err
+	}
+	pr := packetReader{b: r.data}
+	handle := pr.string()
+	if pr.err != nil {
+		return nil, pr.err
+	}
+	return &File{c: c, path: p, handle: handle}, nil
+}
+
+// Open opens the file at the given path for reading
+func (c *Client) Open(p string) (*File, error) {
+	f, err := c.open(p, fxfRead, 0)
+	if err != nil {
+		return nil, pathError("open", p, err)
+	}
+	return f, nil
+}
+
+// Create creates a new file at the given path for writing. It fails with an error satisfying os.IsExist()
+// if the file exists already.
+func (c *Client) Create(p string, perm os.FileMode) (*File, error) {
+	f, err := c.open(p, fxfWrite|fxfCreat|fxfTrunc|fxfExcl, perm)
+	if err != nil {
+		// The protocol has no status for existing files
+		if serr, ok := err.(*StatusError); ok && serr.Code == fxFailure {
+			if _, lerr := c.Lstat(p); lerr == nil {
+				err = os.ErrExist
+			}
+		}
+		return nil, pathError("create", p, err)
+	}
+	return f, nil
+}
+
+// ReadDir returns information about all entries of the directory at the given path, in no particular order
+func (c *Client) ReadDir(p string) ([]os.FileInfo, error) {
+	r, err := c.request(fxpOpendir, appendString(nil, p))
+	if err == nil {
+		err = expect(r, fxpHandle)
+	}
+	if err != nil {
+		return nil, pathError("readdir", p, err)
+	}
+	pr := packetReader{b: r.data}
+	handle := pr.string()
+	defer c.statusRequest(fxpClose, appendString(nil, handle))
+
+	var infos []os.FileInfo
+	for {
+		r, err := c.request(fxpReaddir, appendString(nil, handle))
+		if err == nil {
+			err = expect(r, fxpName)
+		}
+		if err == io.EOF {
+			return infos, nil
+		} else if err != nil {
+			return nil, pathError("readdir", p, err)
+		}
+
+		pr := packetReader{b: r.data}
+		for n := pr.uint32(); n > 0 && pr.err == nil; n-- {
+			name := pr.string()
+			pr.string() // long name
+			fi := pr.attributes()
+			fi.name = name
+			if name != "." && name != ".." {
+				infos = append(infos, fi)
+			}
+		}
+		if pr.err != nil {
+			return nil, pathError("readdir", p, pr.err)
+		}
+	}
+}
+
+// Readlink returns the target of the symbolic link at the given path
+func (c *Client) Readlink(p string) (string, error) {
+	r, err := c.request(fxpReadlink, appendString(nil, p))
+	if err == nil {
+		err = expect(r, fxpName)
+	}
+	if err != nil {
+		return "", pathError("readlink", p, err)
+	}
+	pr := packetReader{b: r.data}
+	if n := pr.uint32(); n != 1 && pr.err == nil {
+		return "", pathError("readlink", p, fmt.Errorf("sftp: expected one name, got %d", n))
+	}
+	target := pr.string()
+	if pr.err != nil {
+		return "", pathError("readlink", p, pr.err)
+	}
+	return target, nil
+}
+
+// Symlink creates a symbolic link at the given path which points to target. Fails like Create() if the
+// path exists already
+func (c *Client) Symlink(target, p string) error {
+	// OpenSSH expects the arguments in reverse order, which made it the de-facto standard
+	if err := c.statusRequest(fxpSymlink, appendString(appendString(nil, target), p)); err != nil {
+		if serr, ok := err.(*StatusError); ok && serr.Code == fxFailure {
+			if _, lerr := c.Lstat(p); lerr == nil {
+				err = os.ErrExist
+			}
+		}
+		return pathError("symlink", p, err)
+	}
+	return nil
+}
+
+// Rename moves the file at oldpath to newpath, replacing the file which may exist there already.
+// The server must support the posix-rename extension of OpenSSH
+func (c *Client) Rename(oldpath, newpath string) error {
+	b := appendString(appendString(appendString(nil, extPosixRename), oldpath), newpath)
+	if err := c.statusRequest(fxpExtended, b); err != nil {
+		return pathError("rename", newpath, err)
+	}
+	return nil
+}
+
+// Mkdir creates the directory at the given path
+func (c *Client) Mkdir(p string, perm os.FileMode) error {
+	b := appendAttributes(appendString(nil, p), &fileInfo{flags: attrPermissions, perm: uint32(perm.Perm())})
+	if err := c.statusRequest(fxpMkdir, b); err != nil {
+		return pathError("mkdir", p, err)
+	}
+	return nil
+}
+
+// Remove removes the file at the given path, which must not be a directory
+func (c *Client) Remove(p string) error {
+	if err := c.statusRequest(fxpRemove, appendString(nil, p)); err != nil {
+		return pathError("remove", p, err)
+	}
+	return nil
+}
+
+// Rmdir removes the empty directory at the given path
+func (c *Client) Rmdir(p string) error {
+	if err := c.statusRequest(fxpRmdir, appendString(nil, p)); err != nil {
+		return pathError("rmdir", p, err)
+	}
+	return nil
+}
+
+// Chtimes changes the access and modification time of the file at the given path, with a resolution of seconds
+func (c *Client) Chtimes(p string, atime, mtime uint32) error {
+	b := appendUint32(appendString(nil, p), attrACModTime)
+	b = appendUint32(appendUint32(b, atime), mtime)
+	if err := c.statusRequest(fxpSetstat, b); err != nil {
+		return pathError("chtimes", p, err)
+	}
+	return nil
+}
+
+// File is a file opened on the server, which is read or written sequentially
+type File struct {
+	c      *Client
+	path   string
+	handle string
+	offset uint64
+}
+
+// Read reads up to len(b) bytes from the current offset
+func (f *File) Read(b []byte) (int, error) {
+	if len(b) > maxDataLength {
+		b = b[:maxDataLength]
+	}
+	req := appendUint64(appendString(nil, f.handle), f.offset)
+	r, err := f.c.request(fxpRead, appendUint32(req, uint32(len(b))))
+	if err == nil {
+		err = expect(r, fxpData)
+	}
+	if err == io.EOF {
+		return 0, io.EOF
+	} else if err != nil {
+		return 0, pathError("read", f.path, err)
+	}
+
+	pr := packetReader{b: r.data}
+	data := pr.bytes()
+	if pr.err != nil || len(data) > len(b) {
+		return 0, pathError("read", f.path, errShortPacket)
+	}
+	n := copy(b, data)
+	f.offset += uint64(n)
+	return n, nil
+}
+
+// Write writes all of the given bytes at the current offset
+func (f *File) Write(b []byte) (n int, err error) {
+	for len(b) > 0 {
+		chunk := b
+		if len(chunk) > maxDataLength {
+			chunk = chunk[:maxDataLength]
+		}
+		req := appendUint64(appendString(nil, f.handle), f.offset)
+		if err = f.c.statusRequest(fxpWrite, appendBytes(req, chunk)); err != nil {
+			return n, pathError("write", f.path, err)
+		}
+		f.offset += uint64(len(chunk))
+		n += len(chunk)
+		b = b[len(chunk):]
+	}
+	return n, nil
+}
+
+// Close closes the file, after which it can't be used anymore
+func (f *File) Close() error {
+	if err := f.c.statusRequest(fxpClose, appendString(nil, f.handle)); err != nil {
+		return pathError("close", f.path, err)
+	}
+	return nil
+}
@@ -0,0 +1,9 @@
+/*
+Package sftp implements a client and a server for version 3 of the SSH file transfer protocol, as spoken by OpenSSH.
+
+Its FileSystem makes remote hosts available to all commands, which accept URLs like
+'sftp://user@host:port/path' wherever directories are expected, once this package is imported.
+The server is small, and meant to test against.
+
+*/
+package sftp
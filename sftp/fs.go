@@ -0,0 +1,316 @@
+package sftp
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"code.google.com/p/go.crypto/ssh"
+	"code.google.com/p/go.crypto/ssh/agent"
+
+	gio "github.com/Byron/godi/io"
+)
+
+// The scheme of URLs we handle
+const Scheme = "sftp"
+
+// FileSystem implements io.FileSystem for a remote host. Local paths underneath its mount point are mapped to
+// absolute paths on the host.
+type FileSystem struct {
+	c    *Client
+	root string
+}
+
+// NewFileSystem returns a file system which handles all paths below root using the given client
+func NewFileSystem(c *Client, root string) *FileSystem {
+	return &FileSystem{c, filepath.Clean(root)}
+}
+
+// Returns the path on the remote host
+func (f *FileSystem) remote(p string) string {
+	p = strings.TrimPrefix(filepath.Clean(p), f.root)
+	return path.Join("/", filepath.ToSlash(p))
+}
+
+// Turns errors about remote paths into errors about the local path
+func localError(err error, p string) error {
+	if perr, ok := err.(*os.PathError); ok {
+		perr.Path = p
+	}
+	return err
+}
+
+func (f *FileSystem) Open(p string) (io.ReadCloser, error) {
+	fd, err := f.c.Open(f.remote(p))
+	if err != nil {
+		return nil, localError(err, p)
+	}
+	return fd, nil
+}
+
+func (f *FileSystem) Create(p string, perm os.FileMode) (io.WriteCloser, error) {
+	fd, err := f.c.Create(f.remote(p), perm)
+	if err != nil {
+		return nil, localError(err, p)
+	}
+	return fd, nil
+}
+
+func (f *FileSystem) Symlink(target, p string) error {
+	return localError(f.c.Symlink(filepath.ToSlash(target), f.remote(p)), p)
+}
+
+func (f *FileSystem) Readlink(p string) (string, error) {
+	target, err := f.c.Readlink(f.remote(p))
+	if err != nil {
+		return "", localError(err, p)
+	}
+	return filepath.FromSlash(target), nil
+}
+
+func (f *FileSystem) Stat(p string) (os.FileInfo, error) {
+	fi, err := f.c.Stat(f.remote(p))
+	return fi, localError(err, p)
+}
+
+func (f *FileSystem) Lstat(p string) (os.FileInfo, error) {
+	fi, err := f.c.Lstat(f.remote(p))
+	return fi, localError(err, p)
+}
+
+func (f *FileSystem) ReadDir(p string) ([]os.FileInfo, error) {
+	infos, err := f.c.ReadDir(f.remote(p))
+	return infos, localError(err, p)
+}
+
+func (f *FileSystem) MkdirAll(p string, perm os.FileMode) error {
+	if fi, err := f.Stat(p); err == nil {
+		if !fi.IsDir() {
+			return &os.PathError{Op: "mkdir", Path: p, Err: errors.New("not a directory")}
+		}
+		return nil
+	}
+	if parent := filepath.Dir(p); parent != p && parent != f.root {
+		if err := f.MkdirAll(parent, perm); err != nil {
+			return err
+		}
+	}
+	if err := f.c.Mkdir(f.remote(p), perm); err != nil {
+		// Someone else may have created it in the meanwhile
+		if fi, serr := f.Stat(p); serr == nil && fi.IsDir() {
+			return nil
+		}
+		return localError(err, p)
+	}
+	return nil
+}
+
+func (f *FileSystem) Remove(p string) error {
+	fi, err := f.Lstat(p)
+	if err != nil {
+		return err
+	}
+	if fi.IsDir() {
+		return localError(f.c.Rmdir(f.remote(p)), p)
+	}
+	return localError(f.c.Remove(f.remote(p)), p)
+}
+
+func (f *FileSystem) Rename(oldpath, newpath string) error {
+	return localError(f.c.Rename(f.remote(oldpath), f.remote(newpath)), newpath)
+}
+
+func (f *FileSystem) Chtimes(p string, atime, mtime time.Time) error {
+	return localError(f.c.Chtimes(f.remote(p), uint32(atime.Unix()), uint32(mtime.Unix())), p)
+}
+
+// Device returns the same identifier for all paths, making each host a device of its own.
+// This way, the amount of streams per device applies to each host.
+func (f *FileSystem) Device(p string) (uint64, error) {
+	return 0, nil
+}
+
+// Close closes the connection to the host
+func (f *FileSystem) Close() error {
+	return f.c.Close()
+}
+
+// NewClientConfig returns the configuration used to connect to the host of the given URL.
+// The default authenticates with the password in the URL, the keys of a running ssh-agent and the
+// keys in ~/.ssh, and only accepts hosts listed in ~/.ssh/known_hosts.
+// It may be replaced to change this, for instance to connect to test servers.
+var NewClientConfig = func(u *url.URL) (*ssh.ClientConfig, error) {
+	config := ssh.ClientConfig{
+		HostKeyCallback: checkKnownHost,
+	}
+	if u.User != nil {
+		config.User = u.User.Username()
+		if password, ok := u.User.Password(); ok {
+			config.Auth = append(config.Auth, ssh.Password(password))
+		}
+	}
+	if len(config.User) == 0 {
+		config.User = os.Getenv("USER")
+	}
+
+	if sock := os.Getenv("SSH_AUTH_SOCK"); len(sock) > 0 {
+		if conn, err := net.Dial("unix", sock); err == nil {
+			config.Auth = append(config.Auth, ssh.PublicKeysCallback(agent.NewClient(conn).Signers))
+		}
+	}
+
+	var signers []ssh.Signer
+	for _, name := range []string{"id_rsa", "id_ecdsa", "id_ed25519"} {
+		pem, err := ioutil.ReadFile(filepath.Join(homeDir(), ".ssh", name))
+		if err != nil {
+			continue
+		}
+		// Keys protected by a passphrase are left to the agent
+		if signer, err := ssh.ParsePrivateKey(pem); err == nil {
+			signers = append(signers, signer)
+		}
+	}
+	if len(signers) > 0 {
+		config.Auth = append(config.Auth, ssh.PublicKeys(signers...))
+	}
+	return &config, nil
+}
+
+func homeDir() string {
+	if home := os.Getenv("HOME"); len(home) > 0 {
+		return home
+	}
+	return os.Getenv("USERPROFILE")
+}
+
+// Returns nil if the host is listed with the given key in the known_hosts file
+func checkKnownHost(hostname string, remote net.Addr, key ssh.PublicKey) error {
+	host, port, err := net.SplitHostPort(hostname)
+	if err != nil {
+		host, port = hostname, "22"
+	}
+	pattern := host
+	if port != "22" {
+		pattern = "[" + host + "]:" + port
+	}
+
+	path := filepath.Join(homeDir(), ".ssh", "known_hosts")
+	in, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("Cannot verify key of host '%s' without '%s': %s", hostname, path, err)
+	}
+	for len(in) > 0 {
+		marker, hosts, pubKey, _, rest, err := ssh.ParseKnownHosts(in)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return fmt.Errorf("Could not parse '%s': %s", path, err)
+		}
+		in = rest
+		if len(marker) > 0 {
+			continue
+		}
+		for _, h := range hosts {
+			if matchesHost(h, pattern) {
+				if bytes.Equal(pubKey.Marshal(), key.Marshal()) {
+					return nil
+				}
+				return fmt.Errorf("The key of host '%s' doesn't match the one in '%s'", hostname, path)
+			}
+		}
+	}
+	return fmt.Errorf("Host '%s' is not listed in '%s'", hostname, path)
+}
+
+// Returns true if the given entry of a known_hosts file, which may be hashed, names the host pattern
+func matchesHost(entry, pattern string) bool {
+	if !strings.HasPrefix(entry, "|1|") {
+		return entry == pattern
+	}
+	tokens := strings.Split(entry[3:], "|")
+	if len(tokens) != 2 {
+		return false
+	}
+	salt, err := base64.StdEncoding.DecodeString(tokens[0])
+	if err != nil {
+		return false
+	}
+	hash, err := base64.StdEncoding.DecodeString(tokens[1])
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha1.New, salt)
+	mac.Write([]byte(pattern))
+	return hmac.Equal(mac.Sum(nil), hash)
+}
+
+// The sftp subsystem of an ssh session, closing the connection when done
+type session struct {
+	io.Reader
+	io.WriteCloser
+	conn *ssh.Client
+}
+
+func (s *session) Close() error {
+	s.WriteCloser.Close()
+	return s.conn.Close()
+}
+
+// Dial connects to the host of the given URL, and returns a file system mounted at root
+func Dial(u *url.URL, root string) (gio.FileSystem, error) {
+	config, err := NewClientConfig(u)
+	if err != nil {
+		return nil, err
+	}
+	addr := u.Host
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, "22")
+	}
+	conn, err := ssh.Dial("tcp", addr, config)
+	if err != nil {
+		return nil, fmt.Errorf("Could not connect to '%s': %s", addr, err)
+	}
+
+	s, err := conn.NewSession()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	w, err := s.StdinPipe()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	r, err := s.StdoutPipe()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if err = s.RequestSubsystem(Scheme); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("Host '%s' doesn't support sftp: %s", addr, err)
+	}
+
+	c, err := NewClient(&session{r, w, conn})
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return NewFileSystem(c, root), nil
+}
+
+func init() {
+	gio.RegisterScheme(Scheme, Dial)
+}
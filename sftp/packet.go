@@ -0,0 +1,301 @@
+package sftp
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// We speak version 3 of the protocol, which is what OpenSSH implements
+const protocolVersion = 3
+
+// Packet types
+const (
+	fxpInit     = 1
+	fxpVersion  = 2
+	fxpOpen     = 3
+	fxpClose    = 4
+	fxpRead     = 5
+	fxpWrite    = 6
+	fxpLstat    = 7
+	fxpFstat    = 8
+	fxpSetstat  = 9
+	fxpOpendir  = 11
+	fxpReaddir  = 12
+	fxpRemove   = 13
+	fxpMkdir    = 14
+	fxpRmdir    = 15
+	fxpRealpath = 16
+	fxpStat     = 17
+	fxpReadlink = 19
+	fxpSymlink  = 20
+	fxpStatus   = 101
+	fxpHandle   = 102
+	fxpData     = 103
+	fxpName     = 104
+	fxpAttrs    = 105
+	fxpExtended = 200
+)
+
+// The extension replacing existing files when renaming, which plain renames of version 3 refuse to do
+const extPosixRename = "posix-rename@openssh.com"
+
+// Flags to open files with
+const (
+	fxfRead  = 0x01
+	fxfWrite = 0x02
+	fxfCreat = 0x08
+	fxfTrunc = 0x10
+	fxfExcl  = 0x20
+)
+
+// Flags of attributes which are present
+const (
+	attrSize        = 0x01
+	attrUIDGID      = 0x02
+	attrPermissions = 0x04
+	attrACModTime   = 0x08
+	attrExtended    = 0x80000000
+)
+
+// Status codes
+const (
+	fxOK               = 0
+	fxEOF              = 1
+	fxNoSuchFile       = 2
+	fxPermissionDenied = 3
+	fxFailure          = 4
+	fxBadMessage       = 5
+	fxOpUnsupported    = 8
+)
+
+// The largest amount of data we read or write with a single request, which all servers support
+const maxDataLength = 32 * 1024
+
+// Packets larger than this are considered broken
+const maxPacketLength = 256 * 1024
+
+// Unix file type bits, as used in the permissions attribute
+const (
+	sIFMT   = 0170000
+	sIFIFO  = 0010000
+	sIFCHR  = 0020000
+	sIFDIR  = 0040000
+	sIFBLK  = 0060000
+	sIFREG  = 0100000
+	sIFLNK  = 0120000
+	sIFSOCK = 0140000
+)
+
+// StatusError is returned if the server answered a request with a status other than OK
+type StatusError struct {
+	Code uint32
+	Msg  string
+}
+
+func (s *StatusError) Error() string {
+	return fmt.Sprintf("sftp: %s (status %d)", s.Msg, s.Code)
+}
+
+var errShortPacket = errors.New("sftp: packet too short")
+
+func appendUint32(b []byte, v uint32) []byte {
+	return append(b, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+func appendUint64(b []byte, v uint64) []byte {
+	return appendUint32(appendUint32(b, uint32(v>>32)), uint32(v))
+}
+
+func appendString(b []byte, s string) []byte {
+	return append(appendUint32(b, uint32(len(s))), s...)
+}
+
+func appendBytes(b []byte, s []byte) []byte {
+	return append(appendUint32(b, uint32(len(s))), s...)
+}
+
+// Reads values from a packet, remembering the first error
+type packetReader struct {
+	b   []byte
+	err error
+}
+
+func (p *packetReader) uint32() uint32 {
+	if len(p.b) < 4 {
+		p.err = errShortPacket
+		return 0
+	}
+	v := binary.BigEndian.Uint32(p.b)
+	p.b = p.b[4:]
+	return v
+}
+
+func (p *packetReader) uint64() uint64 {
+	return uint64(p.uint32())<<32 | uint64(p.uint32())
+}
+
+func (p *packetReader) bytes() []byte {
+	n := p.uint32()
+	if p.err != nil || uint32(len(p.b)) < n {
+		p.err = errShortPacket
+		return nil
+	}
+	v := p.b[:n]
+	p.b = p.b[n:]
+	return v
+}
+
+func (p *packetReader) string() string {
+	return string(p.bytes())
+}
+
+// Writes a packet of the given type with the given payload
+func writePacket(w io.Writer, typ byte, payload []byte) error {
+	b := make([]byte, 0, 5+len(payload))
+	b = appendUint32(b, uint32(1+len(payload)))
+	b = append(b, typ)
+	b = append(b, payload...)
+	_, err := w.Write(b)
+	return err
+}
+
+// Reads the next packet and returns its type and payload
+func readPacket(r io.Reader) (byte, []byte, error) {
+	var hdr [4]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return 0, nil, err
+	}
+	n := binary.BigEndian.Uint32(hdr[:])
+	if n < 1 || n > maxPacketLength {
+		return 0, nil, fmt.Errorf("sftp: invalid packet length %d", n)
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return 0, nil, err
+	}
+	return b[0], b[1:], nil
+}
+
+// The attributes of a file, which implement os.FileInfo once they have a name
+type fileInfo struct {
+	name    string
+	flags   uint32
+	size    uint64
+	perm    uint32
+	modTime uint32
+}
+
+func (f *fileInfo) Name() string       { return f.name }
+func (f *fileInfo) Size() int64        { return int64(f.size) }
+func (f *fileInfo) ModTime() time.Time { return time.Unix(int64(f.modTime), 0) }
+func (f *fileInfo) IsDir() bool        { return f.Mode().IsDir() }
+func (f *fileInfo) Sys() interface{}   { return nil }
+
+func (f *fileInfo) Mode() os.FileMode {
+	m := os.FileMode(f.perm & 0777)
+	switch f.perm & sIFMT {
+	case sIFDIR:
+		m |= os.ModeDir
+	case sIFLNK:
+		m |= os.ModeSymlink
+	case sIFIFO:
+		m |= os.ModeNamedPipe
+	case sIFCHR:
+		m |= os.ModeDevice | os.ModeCharDevice
+	case sIFBLK:
+		m |= os.ModeDevice
+	case sIFSOCK:
+		m |= os.ModeSocket
+	}
+	if f.perm&04000 != 0 {
+		m |= os.ModeSetuid
+	}
+	if f.perm&02000 != 0 {
+		m |= os.ModeSetgid
+	}
+	if f.perm&01000 != 0 {
+		m |= os.ModeSticky
+	}
+	return m
+}
+
+// Returns the attributes of the given file information
+func attributesOf(fi os.FileInfo) *fileInfo {
+	m := fi.Mode()
+	perm := uint32(m.Perm())
+	switch {
+	case m.IsDir():
+		perm |= sIFDIR
+	case m&os.ModeSymlink != 0:
+		perm |= sIFLNK
+	case m&os.ModeNamedPipe != 0:
+		perm |= sIFIFO
+	case m&os.ModeCharDevice != 0:
+		perm |= sIFCHR
+	case m&os.ModeDevice != 0:
+		perm |= sIFBLK
+	case m&os.ModeSocket != 0:
+		perm |= sIFSOCK
+	default:
+		perm |= sIFREG
+	}
+	if m&os.ModeSetuid != 0 {
+		perm |= 04000
+	}
+	if m&os.ModeSetgid != 0 {
+		perm |= 02000
+	}
+	if m&os.ModeSticky != 0 {
+		perm |= 01000
+	}
+	return &fileInfo{
+		name:    fi.Name(),
+		flags:   attrSize | attrPermissions | attrACModTime,
+		size:    uint64(fi.Size()),
+		perm:    perm,
+		modTime: uint32(fi.ModTime().Unix()),
+	}
+}
+
+func appendAttributes(b []byte, f *fileInfo) []byte {
+	b = appendUint32(b, f.flags)
+	if f.flags&attrSize != 0 {
+		b = appendUint64(b, f.size)
+	}
+	if f.flags&attrPermissions != 0 {
+		b = appendUint32(b, f.perm)
+	}
+	if f.flags&attrACModTime != 0 {
+		b = appendUint32(appendUint32(b, f.modTime), f.modTime)
+	}
+	return b
+}
+
+func (p *packetReader) attributes() *fileInfo {
+	f := fileInfo{flags: p.uint32()}
+	if f.flags&attrSize != 0 {
+		f.size = p.uint64()
+	}
+	if f.flags&attrUIDGID != 0 {
+		p.uint32()
+		p.uint32()
+	}
+	if f.flags&attrPermissions != 0 {
+		f.perm = p.uint32()
+	}
+	if f.flags&attrACModTime != 0 {
+		p.uint32()
+		f.modTime = p.uint32()
+	}
+	if f.flags&attrExtended != 0 {
+		for n := p.uint32(); n > 0 && p.err == nil; n-- {
+			p.string()
+			p.string()
+		}
+	}
+	return &f
+}
@@ -0,0 +1,284 @@
+package sftp
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// An open file or directory of the server
+type handle struct {
+	fd *os.File
+
+	// Entries of a directory which were not yet sent
+	entries []os.FileInfo
+	listed  bool
+}
+
+// The state of a session served by Serve()
+type server struct {
+	root    string
+	handles map[string]*handle
+	nextID  int
+}
+
+// Serve answers the requests of a client on the given connection until it is closed, exposing the local
+// directory root as '/'. Requests are handled one at a time.
+func Serve(rw io.ReadWriter, root string) error {
+	s := server{root: filepath.Clean(root), handles: make(map[string]*handle)}
+	defer func() {
+		for _, h := range s.handles {
+			h.fd.Close()
+		}
+	}()
+
+	typ, _, err := readPacket(rw)
+	if err != nil {
+		return err
+	}
+	if typ != fxpInit {
+		return fmt.Errorf("sftp: expected init packet, got type %d", typ)
+	}
+	if err = writePacket(rw, fxpVersion, appendUint32(nil, protocolVersion)); err != nil {
+		return err
+	}
+
+	for {
+		typ, data, err := readPacket(rw)
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		p := packetReader{b: data}
+		id := p.uint32()
+		if p.err != nil {
+			return p.err
+		}
+
+		rtyp, payload := s.handle(typ, &p)
+		if p.err != nil {
+			rtyp, payload = statusOf(p.err)
+		}
+		if err = writePacket(rw, rtyp, append(appendUint32(nil, id), payload...)); err != nil {
+			return err
+		}
+	}
+}
+
+// Returns the local path of the given remote one, which can't be outside of our root
+func (s *server) local(p string) string {
+	return filepath.Join(s.root, filepath.FromSlash(path.Clean("/"+p)))
+}
+
+// Returns the status packet describing the given error, which is OK for nil
+func statusOf(err error) (byte, []byte) {
+	code := uint32(fxOK)
+	msg := "OK"
+	if err != nil {
+		msg = err.Error()
+		switch {
+		case err == io.EOF:
+			code = fxEOF
+		case os.IsNotExist(err):
+			code = fxNoSuchFile
+		case os.IsPermission(err):
+			code = fxPermissionDenied
+		default:
+			code = fxFailure
+		}
+	}
+	return fxpStatus, appendString(appendString(appendUint32(nil, code), msg), "")
+}
+
+// Returns the packet describing the given file
+func attrsOf(fi os.FileInfo, err error) (byte, []byte) {
+	if err != nil {
+		return statusOf(err)
+	}
+	return fxpAttrs, appendAttributes(nil, attributesOf(fi))
+}
+
+// Returns the open file or directory identified by the handle in the packet, along with its identifier
+func (s *server) lookup(p *packetReader) (*handle, string, error) {
+	id := p.string()
+	h, ok := s.handles[id]
+	if !ok {
+		return nil, id, os.ErrInvalid
+	}
+	return h, id, nil
+}
+
+// Remembers the given file and returns a packet with its handle
+func (s *server) open(fd *os.File, err error) (byte, []byte) {
+	if err != nil {
+		return statusOf(err)
+	}
+	s.nextID += 1
+	id := strconv.Itoa(s.nextID)
+	s.handles[id] = &handle{fd: fd}
+	return fxpHandle, appendString(nil, id)
+}
+
+// Performs the request of the given type and returns the response
+func (s *server) handle(typ byte, p *packetReader) (byte, []byte) {
+	switch typ {
+	case fxpOpen:
+		name, pflags := s.local(p.string()), p.uint32()
+		attrs := p.attributes()
+		flags := 0
+		switch {
+		case pflags&fxfRead != 0 && pflags&fxfWrite != 0:
+			flags = os.O_RDWR
+		case pflags&fxfWrite != 0:
+			flags = os.O_WRONLY
+		}
+		if pflags&fxfCreat != 0 {
+			flags |= os.O_CREATE
+		}
+		if pflags&fxfTrunc != 0 {
+			flags |= os.O_TRUNC
+		}
+		if pflags&fxfExcl != 0 {
+			flags |= os.O_EXCL
+		}
+		perm := os.FileMode(0666)
+		if attrs.flags&attrPermissions != 0 {
+			perm = os.FileMode(attrs.perm & 0777)
+		}
+		return s.open(os.OpenFile(name, flags, perm))
+	case fxpOpendir:
+		return s.open(os.Open(s.local(p.string())))
+	case fxpClose:
+		h, id, err := s.lookup(p)
+		if err != nil {
+			return statusOf(err)
+		}
+		delete(s.handles, id)
+		return statusOf(h.fd.Close())
+	case fxpRead:
+		h, _, err := s.lookup(p)
+		offset, length := p.uint64(), p.uint32()
+		if err != nil {
+			return statusOf(err)
+		}
+		if length > maxDataLength {
+			length = maxDataLength
+		}
+		b := make([]byte, length)
+		n, err := h.fd.ReadAt(b, int64(offset))
+		if n > 0 {
+			return fxpData, appendBytes(nil, b[:n])
+		}
+		return statusOf(err)
+	case fxpWrite:
+		h, _, err := s.lookup(p)
+		offset, data := p.uint64(), p.bytes()
+		if err != nil {
+			return statusOf(err)
+		}
+		_, err = h.fd.WriteAt(data, int64(offset))
+		return statusOf(err)
+	case fxpFstat:
+		h, _, err := s.lookup(p)
+		if err != nil {
+			return statusOf(err)
+		}
+		return attrsOf(h.fd.Stat())
+	case fxpStat:
+		return attrsOf(os.Stat(s.local(p.string())))
+	case fxpLstat:
+		return attrsOf(os.Lstat(s.local(p.string())))
+	case fxpSetstat:
+		name := s.local(p.string())
+		attrs := p.attributes()
+		var err error
+		if attrs.flags&attrPermissions != 0 {
+			err = os.Chmod(name, os.FileMode(attrs.perm&0777))
+		}
+		if err == nil && attrs.flags&attrACModTime != 0 {
+			mtime := time.Unix(int64(attrs.modTime), 0)
+			err = os.Chtimes(name, mtime, mtime)
+		}
+		return statusOf(err)
+	case fxpReaddir:
+		h, _, err := s.lookup(p)
+		if err != nil {
+			return statusOf(err)
+		}
+		if !h.listed {
+			if h.entries, err = h.fd.Readdir(-1); err != nil {
+				return statusOf(err)
+			}
+			h.listed = true
+		}
+		if len(h.entries) == 0 {
+			return statusOf(io.EOF)
+		}
+		// Keep the packet small, names are sent in batches
+		n := len(h.entries)
+		if n > 100 {
+			n = 100
+		}
+		b := appendUint32(nil, uint32(n))
+		for _, fi := range h.entries[:n] {
+			b = appendString(appendString(b, fi.Name()), fi.Name())
+			b = appendAttributes(b, attributesOf(fi))
+		}
+		h.entries = h.entries[n:]
+		return fxpName, b
+	case fxpRemove:
+		return statusOf(remove(s.local(p.string()), false))
+	case fxpRmdir:
+		return statusOf(remove(s.local(p.string()), true))
+	case fxpMkdir:
+		name := s.local(p.string())
+		attrs := p.attributes()
+		perm := os.FileMode(0777)
+		if attrs.flags&attrPermissions != 0 {
+			perm = os.FileMode(attrs.perm & 0777)
+		}
+		return statusOf(os.Mkdir(name, perm))
+	case fxpRealpath:
+		name := path.Clean("/" + p.string())
+		b := appendString(appendString(appendUint32(nil, 1), name), name)
+		return fxpName, appendUint32(b, 0)
+	case fxpReadlink:
+		target, err := os.Readlink(s.local(p.string()))
+		if err != nil {
+			return statusOf(err)
+		}
+		target = filepath.ToSlash(target)
+		b := appendString(appendString(appendUint32(nil, 1), target), target)
+		return fxpName, appendUint32(b, 0)
+	case fxpSymlink:
+		// Like OpenSSH, we expect the target first
+		target, name := p.string(), s.local(p.string())
+		return statusOf(os.Symlink(filepath.FromSlash(target), name))
+	case fxpExtended:
+		if p.string() == extPosixRename {
+			oldpath, newpath := s.local(p.string()), s.local(p.string())
+			return statusOf(os.Rename(oldpath, newpath))
+		}
+	}
+	return fxpStatus, appendString(appendString(appendUint32(nil, fxOpUnsupported), "unsupported operation"), "")
+}
+
+// Removes the file at the given path, which must be a directory if dir is true, and must not be one otherwise
+func remove(name string, dir bool) error {
+	fi, err := os.Lstat(name)
+	if err != nil {
+		return err
+	}
+	if fi.IsDir() && !dir {
+		return &os.PathError{Op: "remove", Path: name, Err: errors.New("is a directory")}
+	} else if !fi.IsDir() && dir {
+		return &os.PathError{Op: "rmdir", Path: name, Err: errors.New("not a directory")}
+	}
+	return os.Remove(name)
+}
@@ -0,0 +1,213 @@
+package sftp_test
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"code.google.com/p/go.crypto/ssh"
+
+	"github.com/Byron/godi/api"
+	"github.com/Byron/godi/io"
+	"github.com/Byron/godi/seal"
+	"github.com/Byron/godi/sftp"
+	"github.com/Byron/godi/testlib"
+	"github.com/Byron/godi/verify"
+)
+
+const password = "secret"
+
+// Serves the given directory on a local port, returning the server's address and key
+func serve(t *testing.T, root string) (string, ssh.PublicKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := ssh.ServerConfig{
+		PasswordCallback: func(c ssh.ConnMetadata, pass []byte) (*ssh.Permissions, error) {
+			if string(pass) != password {
+				return nil, errors.New("wrong password")
+			}
+			return nil, nil
+		},
+	}
+	config.AddHostKey(signer)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go serveConn(conn, &config, root)
+		}
+	}()
+	return l.Addr().String(), signer.PublicKey()
+}
+
+// Handles all sessions of a single connection, which may only request the sftp subsystem
+func serveConn(conn net.Conn, config *ssh.ServerConfig, root string) {
+	_, chans, reqs, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+
+	for nc := range chans {
+		if nc.ChannelType() != "session" {
+			nc.Reject(ssh.UnknownChannelType, "only sessions are supported")
+			continue
+		}
+		ch, reqs, err := nc.Accept()
+		if err != nil {
+			continue
+		}
+		go func() {
+			for req := range reqs {
+				ok := req.Type == "subsystem" && len(req.Payload) > 4 && string(req.Payload[4:]) == sftp.Scheme
+				req.Reply(ok, nil)
+				if ok {
+					go func() {
+						sftp.Serve(ch, root)
+						ch.SendRequest("exit-status", false, []byte{0, 0, 0, 0})
+						ch.Close()
+					}()
+				}
+			}
+		}()
+	}
+}
+
+func TestSFTP(t *testing.T) {
+	datasetTree, _, _ := testlib.MakeDatasetOrPanic()
+	defer testlib.RmTree(datasetTree)
+	resHandler := testlib.ResultHandler(t, false)
+
+	remoteDir, err := ioutil.TempDir("", "godi-sftp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer testlib.RmTree(remoteDir)
+	if err = os.Mkdir(filepath.Join(remoteDir, "dst"), 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	addr, hostKey := serve(t, remoteDir)
+	sftp.NewClientConfig = func(u *url.URL) (*ssh.ClientConfig, error) {
+		return &ssh.ClientConfig{
+			User: u.User.Username(),
+			Auth: []ssh.AuthMethod{ssh.Password(password)},
+			HostKeyCallback: func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+				if !bytes.Equal(key.Marshal(), hostKey.Marshal()) {
+					return errors.New("unexpected host key")
+				}
+				return nil
+			},
+		}, nil
+	}
+	dst := fmt.Sprintf("sftp://godi@%s/dst", addr)
+
+	// Local to remote
+	var indices []string
+	cmd, err := seal.NewCommand([]string{datasetTree, seal.Sep, dst}, 1, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = api.StartEngine(cmd, api.IndexTrackingResultHandlerAdapter(&indices, resHandler)); err != nil {
+		t.Fatal(err)
+	}
+	if len(indices) != 1 {
+		t.Fatalf("Expected one seal, got %v", indices)
+	}
+	copied := filepath.Join(remoteDir, "dst")
+	for _, name := range []string{"1mb.ext", filepath.Join("subdir", "biggie.foo"), filepath.Base(indices[0])} {
+		if _, err = os.Stat(filepath.Join(copied, name)); err != nil {
+			t.Errorf("Expected '%s' to be copied to the server: %s", name, err)
+		}
+	}
+	expected, _ := ioutil.ReadFile(filepath.Join(datasetTree, "subdir", "biggie.foo"))
+	if actual, _ := ioutil.ReadFile(filepath.Join(copied, "subdir", "biggie.foo")); !bytes.Equal(expected, actual) {
+		t.Error("The copy on the server doesn't match its source")
+	}
+
+	// Existing files are replaced by renaming their copy over them. URLs work without separator, too
+	if err = os.Rename(filepath.Join(copied, filepath.Base(indices[0])), filepath.Join(copied, "godi_2000-01-01_000001.gobz")); err != nil {
+		t.Fatal(err)
+	}
+	cmd = &seal.Command{Mode: seal.ModeCopy, OnExist: io.ExistOverwrite}
+	if err = cmd.Init(1, 1, []string{datasetTree, dst}, api.Info, []api.FileFilter{api.FilterSeals}); err != nil {
+		t.Fatal(err)
+	}
+	indices = nil
+	if err = api.StartEngine(cmd, api.IndexTrackingResultHandlerAdapter(&indices, resHandler)); err != nil {
+		t.Fatal(err)
+	}
+	if len(indices) != 1 {
+		t.Fatalf("Expected one seal, got %v", indices)
+	} else if _, err = os.Stat(filepath.Join(copied, filepath.Base(indices[0]))); err != nil {
+		t.Errorf("Expected the seal to be written to the server: %s", err)
+	}
+	if actual, _ := ioutil.ReadFile(filepath.Join(copied, "subdir", "biggie.foo")); !bytes.Equal(expected, actual) {
+		t.Error("The overwritten copy on the server doesn't match its source")
+	}
+
+	// The seal on the server verifies by URL
+	verifycmd, err := verify.NewCommand([]string{dst}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = api.StartEngine(verifycmd, resHandler); err != nil {
+		t.Fatal(err)
+	}
+
+	// Remote to local
+	localDir, err := ioutil.TempDir("", "godi-sftp-copy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer testlib.RmTree(localDir)
+
+	indices = nil
+	if cmd, err = seal.NewCommand([]string{dst, seal.Sep, localDir}, 1, 1); err != nil {
+		t.Fatal(err)
+	}
+	if err = api.StartEngine(cmd, api.IndexTrackingResultHandlerAdapter(&indices, resHandler)); err != nil {
+		t.Fatal(err)
+	}
+	if verifycmd, err = verify.NewCommand(indices, 1); err != nil {
+		t.Fatal(err)
+	}
+	if err = api.StartEngine(verifycmd, resHandler); err != nil {
+		t.Fatal(err)
+	}
+
+	// Each host is a device of its own, sharing its streams
+	var paths []string
+	for _, u := range []string{dst, fmt.Sprintf("sftp://godi@%s/other", addr), datasetTree} {
+		p, err := io.ResolveURL(u)
+		if err != nil {
+			t.Fatal(err)
+		}
+		paths = append(paths, p)
+	}
+	if devices := io.DeviceMap(paths); len(devices) != 2 {
+		t.Errorf("Expected the host and the local disk as devices, got %v", devices)
+	}
+}
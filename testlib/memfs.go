@@ -0,0 +1,315 @@
+package testlib
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// A file or directory kept in memory, which is its own os.FileInfo
+type memoryFile struct {
+	name    string
+	mode    os.FileMode
+	modTime time.Time
+	data    []byte
+	target  string // of symbolic links
+}
+
+func (m *memoryFile) Name() string       { return m.name }
+func (m *memoryFile) Mode() os.FileMode  { return m.mode }
+func (m *memoryFile) ModTime() time.Time { return m.modTime }
+func (m *memoryFile) IsDir() bool        { return m.mode.IsDir() }
+func (m *memoryFile) Sys() interface{}   { return nil }
+func (m *memoryFile) Size() int64 {
+	if m.mode&os.ModeSymlink == os.ModeSymlink {
+		return int64(len(m.target))
+	}
+	return int64(len(m.data))
+}
+
+// MemoryFileSystem is an io.FileSystem keeping all files in memory, to be used with io.Mount()
+type MemoryFileSystem struct {
+	l     sync.Mutex
+	files map[string]*memoryFile
+
+	// If set, it is called with the name of the operation, like "create", and the path it is performed on.
+	// If it returns an error, the operation fails with it. This allows to simulate failures
+	Fail func(op, path string) error
+}
+
+// NewMemoryFileSystem returns a file system with nothing but the root directory
+func NewMemoryFileSystem() *MemoryFileSystem {
+	root := string(os.PathSeparator)
+	return &MemoryFileSystem{
+		files: map[string]*memoryFile{root: &memoryFile{name: root, mode: os.ModeDir | 0777, modTime: time.Now()}},
+	}
+}
+
+// Returns an error if the operation should fail, and locks the file system otherwise
+func (m *MemoryFileSystem) begin(op, path string) error {
+	if m.Fail != nil {
+		if err := m.Fail(op, path); err != nil {
+			return &os.PathError{Op: op, Path: path, Err: err}
+		}
+	}
+	m.l.Lock()
+	return nil
+}
+
+// Returns the file at the given path, following symbolic links if requested. Must be called with the lock held
+func (m *MemoryFileSystem) lookup(op, path string, follow bool) (*memoryFile, error) {
+	path = filepath.Clean(path)
+	for i := 0; i < 8; i++ {
+		f, ok := m.files[path]
+		if !ok {
+			return nil, &os.PathError{Op: op, Path: path, Err: os.ErrNotExist}
+		}
+		if !follow || f.mode&os.ModeSymlink != os.ModeSymlink {
+			return f, nil
+		}
+		if filepath.IsAbs(f.target) {
+			path = filepath.Clean(f.target)
+		} else {
+			path = filepath.Join(filepath.Dir(path), f.target)
+		}
+	}
+	return nil, &os.PathError{Op: op, Path: path, Err: errors.New("too many levels of symbolic links")}
+}
+
+// Adds the given file at path, whose directory must exist. Must be called with the lock held
+func (m *MemoryFileSystem) add(op, path string, f *memoryFile) error {
+	path = filepath.Clean(path)
+	if _, ok := m.files[path]; ok {
+		return &os.PathError{Op: op, Path: path, Err: os.ErrExist}
+	}
+	if dir, err := m.lookup(op, filepath.Dir(path), true); err != nil {
+		return err
+	} else if !dir.IsDir() {
+		return &os.PathError{Op: op, Path: path, Err: errors.New("not a directory")}
+	}
+	f.name = filepath.Base(path)
+	f.modTime = time.Now()
+	m.files[path] = f
+	return nil
+}
+
+// Returns a copy of the file's information, which doesn't change with the file
+func snapshot(f *memoryFile) os.FileInfo {
+	c := *f
+	return &c
+}
+
+func (m *MemoryFileSystem) Open(path string) (io.ReadCloser, error) {
+	if err := m.begin("open", path); err != nil {
+		return nil, err
+	}
+	defer m.l.Unlock()
+	f, err := m.lookup("open", path, true)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.NopCloser(bytes.NewReader(f.data)), nil
+}
+
+// Writes into a file of a memory file system
+type memoryWriter struct {
+	fs   *MemoryFileSystem
+	f    *memoryFile
+	path string
+}
+
+func (w *memoryWriter) Write(b []byte) (int, error) {
+	if w.fs.Fail != nil {
+		if err := w.fs.Fail("write", w.path); err != nil {
+			return 0, &os.PathError{Op: "write", Path: w.path, Err: err}
+		}
+	}
+	w.fs.l.Lock()
+	w.f.data = append(w.f.data, b...)
+	w.f.modTime = time.Now()
+	w.fs.l.Unlock()
+	return len(b), nil
+}
+
+func (w *memoryWriter) Close() error {
+	return nil
+}
+
+func (m *MemoryFileSystem) Create(path string, perm os.FileMode) (io.WriteCloser, error) {
+	if err := m.begin("create", path); err != nil {
+		return nil, err
+	}
+	defer m.l.Unlock()
+	f := &memoryFile{mode: perm.Perm()}
+	if err := m.add("create", path, f); err != nil {
+		return nil, err
+	}
+	return &memoryWriter{m, f, filepath.Clean(path)}, nil
+}
+
+func (m *MemoryFileSystem) Symlink(target, path string) error {
+	if err := m.begin("symlink", path); err != nil {
+		return err
+	}
+	defer m.l.Unlock()
+	return m.add("symlink", path, &memoryFile{mode: os.ModeSymlink | 0777, target: target})
+}
+
+func (m *MemoryFileSystem) Readlink(path string) (string, error) {
+	if err := m.begin("readlink", path); err != nil {
+		return "", err
+	}
+	defer m.l.Unlock()
+	f, err := m.lookup("readlink", path, false)
+	if err != nil {
+		return "", err
+	}
+	if f.mode&os.ModeSymlink != os.ModeSymlink {
+		return "", &os.PathError{Op: "readlink", Path: path, Err: errors.New("not a symbolic link")}
+	}
+	return f.target, nil
+}
+
+func (m *MemoryFileSystem) Stat(path string) (os.FileInfo, error) {
+	if err := m.begin("stat", path); err != nil {
+		return nil, err
+	}
+	defer m.l.Unlock()
+	f, err := m.lookup("stat", path, true)
+	if err != nil {
+		return nil, err
+	}
+	return snapshot(f), nil
+}
+
+func (m *MemoryFileSystem) Lstat(path string) (os.FileInfo, error) {
+	if err := m.begin("lstat", path); err != nil {
+		return nil, err
+	}
+	defer m.l.Unlock()
+	f, err := m.lookup("lstat", path, false)
+	if err != nil {
+		return nil, err
+	}
+	return snapshot(f), nil
+}
+
+func (m *MemoryFileSystem) ReadDir(path string) ([]os.FileInfo, error) {
+	if err := m.begin("readdir", path); err != nil {
+		return nil, err
+	}
+	defer m.l.Unlock()
+	dir, err := m.lookup("readdir", path, true)
+	if err != nil {
+		return nil, err
+	}
+	if !dir.IsDir() {
+		return nil, &os.PathError{Op: "readdir", Path: path, Err: errors.New("not a directory")}
+	}
+
+	path = filepath.Clean(path)
+	var infos []os.FileInfo
+	for p, f := range m.files {
+		if p != path && filepath.Dir(p) == path {
+			infos = append(infos, snapshot(f))
+		}
+	}
+	return infos, nil
+}
+
+func (m *MemoryFileSystem) MkdirAll(path string, perm os.FileMode) error {
+	if err := m.begin("mkdir", path); err != nil {
+		return err
+	}
+	defer m.l.Unlock()
+
+	var missing []string
+	for p := filepath.Clean(path); ; p = filepath.Dir(p) {
+		if f, err := m.lookup("mkdir", p, true); err == nil {
+			if !f.IsDir() {
+				return &os.PathError{Op: "mkdir", Path: p, Err: errors.New("not a directory")}
+			}
+			break
+		}
+		missing = append(missing, p)
+	}
+	for i := len(missing) - 1; i >= 0; i-- {
+		if err := m.add("mkdir", missing[i], &memoryFile{mode: os.ModeDir | perm.Perm()}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *MemoryFileSystem) Remove(path string) error {
+	if err := m.begin("remove", path); err != nil {
+		return err
+	}
+	defer m.l.Unlock()
+	f, err := m.lookup("remove", path, false)
+	if err != nil {
+		return err
+	}
+	path = filepath.Clean(path)
+	if f.IsDir() {
+		for p := range m.files {
+			if p != path && filepath.Dir(p) == path {
+				return &os.PathError{Op: "remove", Path: path, Err: errors.New("directory not empty")}
+			}
+		}
+	}
+	delete(m.files, path)
+	return nil
+}
+
+// Rename moves the file at oldpath to newpath, replacing the file there. Directories can't be renamed
+func (m *MemoryFileSystem) Rename(oldpath, newpath string) error {
+	if err := m.begin("rename", newpath); err != nil {
+		return err
+	}
+	defer m.l.Unlock()
+	f, err := m.lookup("rename", oldpath, false)
+	if err != nil {
+		return err
+	}
+	if f.IsDir() {
+		return &os.PathError{Op: "rename", Path: oldpath, Err: errors.New("is a directory")}
+	}
+	newpath = filepath.Clean(newpath)
+	if existing, ok := m.files[newpath]; ok {
+		if existing.IsDir() {
+			return &os.PathError{Op: "rename", Path: newpath, Err: errors.New("is a directory")}
+		}
+		delete(m.files, newpath)
+	}
+	modTime := f.modTime
+	if err = m.add("rename", newpath, f); err != nil {
+		return err
+	}
+	f.modTime = modTime
+	delete(m.files, filepath.Clean(oldpath))
+	return nil
+}
+
+func (m *MemoryFileSystem) Chtimes(path string, atime, mtime time.Time) error {
+	if err := m.begin("chtimes", path); err != nil {
+		return err
+	}
+	defer m.l.Unlock()
+	f, err := m.lookup("chtimes", path, true)
+	if err != nil {
+		return err
+	}
+	f.modTime = mtime
+	return nil
+}
+
+// Device returns the same identifier for all paths, as all files share our memory
+func (m *MemoryFileSystem) Device(path string) (uint64, error) {
+	return 0, nil
+}
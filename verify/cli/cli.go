@@ -4,13 +4,33 @@ Package cli implements the command-line interface for the Command, for use by th
 package cli
 
 import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/Byron/godi/catalog"
 	"github.com/Byron/godi/cli"
+	"github.com/Byron/godi/codec"
+	"github.com/Byron/godi/io"
 	"github.com/Byron/godi/verify"
 
 	gcli "github.com/codegangsta/cli"
 )
 
-const verifyDescription = `
+const (
+	rootFlagName        = "root"
+	onlyFlagName        = "only"
+	sampleFlagName      = "sample"
+	sampleBytesFlagName = "sample-bytes"
+	seedFlagName        = "seed"
+	quickFlagName       = "quick"
+	allFlagName         = "all"
+	detectMovesFlagName = "detect-moves"
+	catalogFlagName     = "catalog"
+	useCatalogFlagName  = "use-catalog"
+	keyFlagName         = "key"
+	passphraseFlagName  = "passphrase-file"
+	verifyDescription   = `
 	Compare stored disk-data with seal to detect changes.
 
 	This command will read all files contained in the seal from disk and retake their signature.
@@ -22,7 +42,45 @@ const verifyDescription = `
 	[arguments ...] are one or more seal files, for example
 
 	godi verify /Volumes/backup/godi_2014-07-30_102259.gobz path/to/godi_2012-07-10_102224.mhl
+
+	A directory may be given instead, in which case the newest seal in it is verified, or all of them with --all
+
+	godi verify --all /Volumes/backup
+
+	BagIt bags are validated when their directory is given, which includes their manifests,
+	Payload-Oxum and completeness
+
+	godi verify /Volumes/a/delivery
+
+	Seals kept apart from their data, for instance in a central catalog, can be verified using --root
+
+	godi verify --root /Volumes/backup catalog/godi_2014-07-30_102259.gobz
+
+	For quick spot checks, verify only a part of the sealed files
+
+	godi verify --only 'A003/**' --sample 2% /Volumes/backup/godi_2014-07-30_102259.gobz
+
+	To quickly check whether a delivery is complete, use --quick to only compare file sizes
+	and modification times, without reading any file
+
+	Encrypted seals are decrypted with the secret key they were encrypted for, or their passphrase
+
+	godi verify --key ~/.godi/seal.key /Volumes/backup/godi_2014-07-30_102259.gobz.enc
 `
+	rootDescription = `The directory or archive containing the sealed data, if it is not the one containing the seal.
+	Use a seal=directory pair to specify the root of a single seal, which must be given as it is
+	on the commandline. Can be given multiple times.`
+	onlyDescription = `A comma separated list of glob patterns. Only sealed files whose path relative
+	to the seal matches one of them are verified. '**' matches any amount of directories.`
+	sampleDescription = `Verify only a pseudo-randomly picked fraction of the sealed files,
+	like '2%' or '0.02'.`
+	sampleBytesDescription = `Verify pseudo-randomly picked files until the given amount of bytes
+	per seal is reached, like '500GB' or '1.5TiB'.`
+	seedDescription = `The seed used to pick samples. The same seed picks the same files, which allows
+	to reproduce a previous spot check. If unset, a new one is chosen and shown in the summary.`
+	keyDescription = `A comma separated list of files with secret keys as written by 'godi keygen'.
+	They are tried to decrypt encrypted seals.`
+)
 
 // return subcommands for our particular area of algorithms
 func SubCommands() []gcli.Command {
@@ -34,9 +92,125 @@ func SubCommands() []gcli.Command {
 		ShortName: "",
 		Usage:     verifyDescription,
 		Action:    func(c *gcli.Context) { cli.RunAction(&cmd, c) },
-		Before:    func(c *gcli.Context) error { return cli.CheckCommonFlagsAndInit(&cmd, c) },
+		Before:    func(c *gcli.Context) error { return checkVerify(&cmd, c) },
+		Flags: []gcli.Flag{
+			gcli.StringSliceFlag{
+				Name:  rootFlagName,
+				Value: &gcli.StringSlice{},
+				Usage: rootDescription,
+			},
+			gcli.StringFlag{
+				Name:  onlyFlagName,
+				Value: "",
+				Usage: onlyDescription,
+			},
+			gcli.StringFlag{
+				Name:  sampleFlagName,
+				Value: "",
+				Usage: sampleDescription,
+			},
+			gcli.StringFlag{
+				Name:  sampleBytesFlagName,
+				Value: "",
+				Usage: sampleBytesDescription,
+			},
+			gcli.StringFlag{
+				Name:  seedFlagName,
+				Value: "",
+				Usage: seedDescription,
+			},
+			gcli.BoolFlag{
+				Name:  quickFlagName,
+				Usage: "Only check existence, size and modification time of files, without reading them",
+			},
+			gcli.BoolFlag{
+				Name:  allFlagName,
+				Usage: "Verify all seals found in a given directory, instead of only the newest one",
+			},
+			gcli.BoolFlag{
+				Name:  detectMovesFlagName,
+				Usage: "Report missing files as moved if a file with the same contents exists elsewhere in the tree",
+			},
+			gcli.BoolFlag{
+				Name:  useCatalogFlagName,
+				Usage: "Record the outcome of verifying cataloged seals entirely in the default catalog, see --catalog",
+			},
+			gcli.StringFlag{
+				Name:  catalogFlagName,
+				Value: "",
+				Usage: "Record the outcome of verifying cataloged seals entirely in the catalog in the given directory",
+			},
+			gcli.StringFlag{
+				Name:  keyFlagName,
+				Value: "",
+				Usage: keyDescription,
+			},
+			gcli.StringFlag{
+				Name:  passphraseFlagName,
+				Value: "",
+				Usage: "A file whose first line is the passphrase to decrypt encrypted seals with",
+			},
+		},
 	}
 
 	out[0] = verify
 	return out
 }
+
+func checkVerify(cmd *verify.Command, c *gcli.Context) (err error) {
+	cmd.Roots, err = verify.ParseRoots(c.StringSlice(rootFlagName), c.Args())
+	if err != nil {
+		return
+	}
+
+	if only := c.String(onlyFlagName); len(only) > 0 {
+		cmd.Only = strings.Split(only, ",")
+	}
+	if sample := c.String(sampleFlagName); len(sample) > 0 {
+		if cmd.Sample, err = verify.ParseSample(sample); err != nil {
+			return
+		}
+	}
+	if sampleBytes := c.String(sampleBytesFlagName); len(sampleBytes) > 0 {
+		if cmd.SampleBytes, err = io.ParseBytesVolume(sampleBytes); err != nil {
+			return
+		}
+	}
+	// Seeds are shown as 64 bit integers in the summary, which wouldn't survive the round-trip through an int
+	if seed := c.String(seedFlagName); len(seed) > 0 {
+		if cmd.Seed, err = strconv.ParseInt(seed, 10, 64); err != nil {
+			return fmt.Errorf("Invalid seed '%s', must be an integer as shown in the summary", seed)
+		}
+	}
+	cmd.Quick = c.Bool(quickFlagName)
+	cmd.All = c.Bool(allFlagName)
+	cmd.DetectMoves = c.Bool(detectMovesFlagName)
+	dir := c.String(catalogFlagName)
+	if len(dir) == 0 && c.Bool(useCatalogFlagName) {
+		dir = catalog.DefaultDir()
+	}
+	if len(dir) > 0 {
+		if cmd.Catalog, err = catalog.Open(dir); err != nil {
+			return
+		}
+	}
+
+	if keys := c.String(keyFlagName); len(keys) > 0 {
+		for _, path := range strings.Split(keys, ",") {
+			key, err := codec.ReadKeyFile(path)
+			if err != nil {
+				return err
+			}
+			cmd.Keys = append(cmd.Keys, key)
+		}
+	}
+	if path := c.String(passphraseFlagName); len(path) > 0 {
+		key, err := codec.ReadPassphraseFile(path)
+		if err != nil {
+			return err
+		}
+		cmd.Keys = append(cmd.Keys, key)
+	}
+
+	return cli.CheckCommonFlagsAndInit(cmd, c)
+}
@@ -0,0 +1,137 @@
+package verify
+
+import (
+	"bytes"
+
+	"github.com/Byron/godi/api"
+	"github.com/Byron/godi/codec"
+	"github.com/Byron/godi/io"
+)
+
+// Remember that the given file is part of the given seal
+func (s *Command) recordSealed(index string, f *api.FileInfo) {
+	s.sealedLock.Lock()
+	paths, ok := s.sealed[index]
+	if !ok {
+		paths = make(map[string]bool)
+		s.sealed[index] = paths
+	}
+	paths[f.RelaPath] = true
+	s.sealedLock.Unlock()
+}
+
+// Returns true if the file has the same digest as the sealed one. Sealed files without any digest never match
+func sameDigest(sealed, f *api.FileInfo) bool {
+	numDigests := 0
+	for _, d := range [...][2][]byte{
+		{sealed.Sha1, f.Sha1},
+		{sealed.MD5, f.MD5},
+		{sealed.Sha256, f.Sha256},
+		{sealed.Sha512, f.Sha512},
+		{sealed.CRC32, f.CRC32},
+	} {
+		if len(d[0]) == 0 {
+			continue
+		}
+		if !bytes.Equal(d[0], d[1]) {
+			return false
+		}
+		numDigests += 1
+	}
+	return numDigests > 0
+}
+
+// Hashes all files in the tree of the given seal which are not part of it, and returns the ones matching
+// the content of a missing file, keyed by the result which reported it missing.
+// Only files with the size of a missing file are read, unless the seal doesn't know the sizes of its files.
+func (s *Command) detectMoves(index string, missing []*VerifyResult) map[*VerifyResult]*api.FileInfo {
+	hasSizes := codec.HasSizes(codec.NewByPath(index))
+	sizeKey := func(size int64) int64 {
+		if !hasSizes {
+			return 0
+		}
+		return size
+	}
+
+	bySize := make(map[int64][]*VerifyResult)
+	for _, vr := range missing {
+		key := sizeKey(vr.ifinfo.Size)
+		bySize[key] = append(bySize[key], vr)
+	}
+
+	s.sealedLock.Lock()
+	sealed := s.sealed[index]
+	s.sealedLock.Unlock()
+
+	// Archives are written at once, nothing in them can have moved
+	treeRoot := s.treeRoot(index)
+	if io.IsArchivePath(treeRoot) {
+		return nil
+	}
+
+	// Use the controller of the device the tree is on, to not compete with ourselves
+	var rctrl *io.ReadChannelController
+	for i := range s.RootedReaders {
+		for _, tree := range s.RootedReaders[i].Trees {
+			if tree == treeRoot {
+				rctrl = &s.RootedReaders[i].Ctrl
+			}
+		}
+	}
+	if rctrl == nil {
+		ctrl := io.NewReadChannelController(1, &s.Stats.Stats, s.Done)
+		rctrl = &ctrl
+	}
+
+	traversed := make(chan api.FileInfo)
+	traverseResults := make(chan api.Result)
+	candidates := make(chan api.FileInfo)
+	hashed := make(chan api.Result)
+
+	filters := make([]api.FileFilter, len(s.Filters), len(s.Filters)+1)
+	copy(filters, s.Filters)
+	filters = append(filters, api.FilterSeals)
+
+	go func() {
+		api.Traverse([]string{treeRoot}, traversed, traverseResults, s.Done, filters, &s.Stats,
+			func(root, msg string, err error) api.Result {
+				return &api.BasicResult{Msg: msg, Err: err}
+			})
+		close(traversed)
+		close(traverseResults)
+	}()
+	go func() {
+		// Trees we can't traverse entirely just yield less moves - the files are reported missing anyway
+		for _ = range traverseResults {
+		}
+	}()
+	go func() {
+		for f := range traversed {
+			if !sealed[f.RelaPath] && len(bySize[sizeKey(f.Size)]) > 0 {
+				candidates <- f
+			}
+		}
+		close(candidates)
+	}()
+	go func() {
+		api.Gather(candidates, hashed, &s.Stats, func(f, source *api.FileInfo, err error) api.Result {
+			return &api.BasicResult{Finfo: *f, Err: err}
+		}, rctrl, nil, s.digests)
+		close(hashed)
+	}()
+
+	moved := make(map[*VerifyResult]*api.FileInfo)
+	for r := range hashed {
+		if r.Error() != nil {
+			continue
+		}
+		f := r.FileInformation()
+		for _, vr := range bySize[sizeKey(f.Size)] {
+			if _, isMoved := moved[vr]; !isMoved && sameDigest(&vr.ifinfo, f) {
+				moved[vr] = f
+				break
+			}
+		}
+	}
+	return moved
+}
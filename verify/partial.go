@@ -0,0 +1,165 @@
+package verify
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/Byron/godi/api"
+	"github.com/Byron/godi/codec"
+	"github.com/Byron/godi/io"
+)
+
+// ParseSample parses a fraction of files to verify, like "2%" or "0.02"
+func ParseSample(s string) (float64, error) {
+	num, div := s, 1.0
+	if strings.HasSuffix(s, "%") {
+		num, div = s[:len(s)-1], 100.0
+	}
+
+	v, err := strconv.ParseFloat(num, 64)
+	if err != nil || v <= 0 || v/div > 1 {
+		return 0, fmt.Errorf("Invalid sample '%s', must be a percentage like '2%%' or a fraction in the range (0, 1]", s)
+	}
+	return v / div, nil
+}
+
+// Returns true if we are not verifying all sealed files
+func (s *Command) isPartial() bool {
+	return len(s.Only) > 0 || s.Sample > 0 || s.SampleBytes > 0 || s.Filter != nil
+}
+
+// Returns true if the given file's relative path matches one of our Only patterns, or if there are none
+func (s *Command) matchesOnly(f *api.FileInfo) bool {
+	if len(s.Only) == 0 {
+		return true
+	}
+
+	path := filepath.ToSlash(f.RelaPath)
+	for _, pattern := range s.Only {
+		if api.MatchGlob(filepath.ToSlash(pattern), path) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the position of the given file in the order of our sample, in the range [0, 1<<53). It only depends
+// on the seed and the relative path of the file, which makes the choice reproducible
+func (s *Command) sampleKey(f *api.FileInfo) uint64 {
+	h := fnv.New64a()
+	binary.Write(h, binary.LittleEndian, s.Seed)
+	h.Write([]byte(f.RelaPath))
+	return h.Sum64() >> 11
+}
+
+// Returns true if the given file is part of our sample, which is the given fraction of all files
+func (s *Command) isSampled(f *api.FileInfo, fraction float64) bool {
+	if fraction >= 1 {
+		return true
+	}
+	return float64(s.sampleKey(f))/(1<<53) < fraction
+}
+
+// Returns true if the given file matches our path filters and our sample fraction, if any
+func (s *Command) isSelected(f *api.FileInfo) bool {
+	fraction := 1.0
+	if s.Sample > 0 {
+		fraction = s.Sample
+	}
+	return s.matchesOnly(f) && s.isSampled(f, fraction)
+}
+
+// A file which may be sampled by bytes
+type sampleCandidate struct {
+	key  uint64
+	size int64
+}
+
+type bySampleKey []sampleCandidate
+
+func (b bySampleKey) Len() int           { return len(b) }
+func (b bySampleKey) Less(i, j int) bool { return b[i].key < b[j].key }
+func (b bySampleKey) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+
+// Returns the sample keys of the files in the given seal which fit into SampleBytes, or an error if it can't
+// be read. Selected files are taken in the order of their sample key, which makes the choice independent of
+// the order of files in the seal. Files which don't fit anymore are skipped in favor of smaller ones
+func (s *Command) sampleBytes(c codec.Codec, index string) (sampled map[uint64]bool, err error) {
+	fd, err := io.Open(index)
+	if err != nil {
+		return
+	}
+	defer fd.Close()
+
+	var candidates []sampleCandidate
+	files := make(chan api.FileInfo)
+	collected := make(chan bool)
+	go func() {
+		for f := range files {
+			if s.isSelected(&f) {
+				candidates = append(candidates, sampleCandidate{s.sampleKey(&f), f.Size})
+			}
+		}
+		close(collected)
+	}()
+
+	err = c.Deserialize(fd, files, func(*api.FileInfo) bool { return true })
+	close(files)
+	<-collected
+
+	sort.Sort(bySampleKey(candidates))
+	sampled = make(map[uint64]bool)
+	var selectedBytes uint64
+	for _, cand := range candidates {
+		if selectedBytes+uint64(cand.size) <= uint64(s.SampleBytes) {
+			selectedBytes += uint64(cand.size)
+			sampled[cand.key] = true
+		}
+	}
+	return
+}
+
+// Forwards all sealed files we should verify from sealed to files, and returns the amount of skipped files.
+// If we sample by bytes, only files whose sample key is in sampled are verified, see sampleBytes()
+func (s *Command) selectFiles(sealed <-chan api.FileInfo, files chan<- api.FileInfo, index string, sampled map[uint64]bool) (skipped uint) {
+	for f := range sealed {
+		if !s.isSelected(&f) || (s.SampleBytes > 0 && !sampled[s.sampleKey(&f)]) ||
+			(s.Filter != nil && !s.Filter(index, &f)) {
+			skipped += 1
+			continue
+		}
+		files <- f
+	}
+	return
+}
+
+// Returns a note to append to a tree's summary if the given amount of sealed files wasn't verified
+func (s *Command) partialSummary(skipped uint) string {
+	if skipped == 0 {
+		return ""
+	}
+
+	var how []string
+	if len(s.Only) > 0 {
+		how = append(how, "only "+strings.Join(s.Only, ", "))
+	}
+	if s.Sample > 0 {
+		how = append(how, fmt.Sprintf("sample %g%%", s.Sample*100))
+	}
+	if s.SampleBytes > 0 {
+		how = append(how, fmt.Sprintf("sample %s", s.SampleBytes))
+	}
+	if s.Sample > 0 || s.SampleBytes > 0 {
+		how = append(how, fmt.Sprintf("seed %d", s.Seed))
+	}
+	if s.Filter != nil {
+		how = append(how, "custom filter")
+	}
+
+	return fmt.Sprintf(" - PARTIAL: checked only a subset, %d sealed file(s) were skipped (%s)", skipped, strings.Join(how, ", "))
+}
@@ -7,8 +7,13 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"sort"
+	"sync"
+	"time"
 
 	"github.com/Byron/godi/api"
+	"github.com/Byron/godi/bag"
+	"github.com/Byron/godi/catalog"
 	"github.com/Byron/godi/codec"
 	"github.com/Byron/godi/io"
 )
@@ -20,6 +25,54 @@ const (
 // A type representing all arguments required to drive a Seal operation
 type Command struct {
 	api.BasicRunner
+
+	// Maps a seal file to the directory containing the data it describes.
+	// Seals without an entry are verified against the directory they reside in.
+	Roots map[string]string
+
+	// If set, only sealed files whose relative path matches one of the given globs are verified.
+	// A '**' component matches any amount of directories.
+	Only []string
+
+	// If not 0, only the given fraction of sealed files is verified, picked pseudo-randomly
+	Sample float64
+
+	// If not 0, pseudo-randomly picked files are verified until the given amount of bytes per seal is reached
+	SampleBytes io.BytesVolume
+
+	// Picking samples with the same seed will pick the same files. If 0, a seed is chosen during Init
+	Seed int64
+
+	// If set, it is called with the seal and each sealed file which passed all other selections, in seal order.
+	// The file is only verified if it returns true. It may be called concurrently for seals on different devices.
+	Filter func(index string, f *api.FileInfo) bool
+
+	// If set, files are not read, but only checked for existence, size and modification time
+	Quick bool
+
+	// If set, all seals found in a given directory are verified, instead of only the newest one
+	All bool
+
+	// If set, files in the tree which are not part of the seal are compared to missing files by content,
+	// and reported as moved if they match
+	DetectMoves bool
+
+	// If set, the outcome of verifying a cataloged seal entirely is recorded in the catalog
+	Catalog *catalog.Catalog
+
+	// Keys to try when decrypting encrypted seals
+	Keys []*codec.Key
+
+	// Amount of sealed files per seal which were not verified in partial mode
+	skipped     map[string]uint
+	skippedLock sync.Mutex
+
+	// The relative paths of all sealed files per seal, used to detect moves
+	sealed     map[string]map[string]bool
+	sealedLock sync.Mutex
+
+	// The hashes to compute in addition to sha1 and md5, as required by the formats of our seals
+	digests api.Digests
 }
 
 // Implements information about a verify operation
@@ -28,10 +81,19 @@ type VerifyResult struct {
 	ifinfo          api.FileInfo // the file information we have seen in the index
 }
 
-// Keeps some information on a per-tree level
+// Keeps some information on a per-seal level
 type treeInfo struct {
-	signatureMismatches, missingFiles, numFiles uint
-	sealBroken                                  bool
+	signatureMismatches, missingFiles, movedFiles, numFiles uint
+	sealBroken                                              bool
+
+	// Amount of problems with the structure of the bag the seal belongs to, if it is a bag manifest
+	bagProblems uint
+
+	// Amount of other errors, like files which failed to be read
+	otherErrors uint
+
+	// Results of missing files we didn't report yet, as they might have been moved
+	missing []*VerifyResult
 }
 
 // NewCommand returns an initialized verify command
@@ -47,7 +109,7 @@ func (s *Command) Generate() <-chan api.Result {
 				// Only work in indices that are assigned to us
 				found := false
 				for _, tree := range trees {
-					if filepath.Dir(index) == tree {
+					if s.treeRoot(index) == tree {
 						found = true
 						break
 					}
@@ -60,8 +122,11 @@ func (s *Command) Generate() <-chan api.Result {
 				if c == nil {
 					panic("Should have a codec here - this was checked before")
 				}
+				if e, ok := c.(*codec.Encrypted); ok {
+					e.Keys = s.Keys
+				}
 
-				fd, err := os.Open(index)
+				fd, err := io.Open(index)
 				if err != nil {
 					results <- &VerifyResult{
 						BasicResult: api.BasicResult{
@@ -69,6 +134,7 @@ func (s *Command) Generate() <-chan api.Result {
 							Finfo: api.FileInfo{
 								Path:     index,
 								RelaPath: filepath.Base(index),
+								Seal:     index,
 							},
 						},
 					}
@@ -80,19 +146,87 @@ func (s *Command) Generate() <-chan api.Result {
 				// If it was the absolute file path we use here, it could possibly point to a file far away,
 				// in any case our read controller map will not yield the expected result unless we set it
 				// up here, which is dangerous as it is async ! So let's not use the absolute path, ever !
-				indexDir := filepath.Dir(index)
-				err = c.Deserialize(fd, files, func(v *api.FileInfo) bool {
+				treeRoot := s.treeRoot(index)
+
+				// Without a sealed size, we take the one on disk to be able to read the file
+				hasSizes := codec.HasSizes(c)
+
+				// Files of content-addressed stores are read from their objects
+				isStore := io.IsStore(treeRoot)
+
+				// Archives are read front to back, which requires to know all files to read beforehand
+				sink := files
+				var streamed sync.WaitGroup
+				if !s.Quick && io.IsArchive(treeRoot) {
+					members := make(chan api.FileInfo)
+					sink = members
+					streamed.Add(1)
+					go func(archive string) {
+						api.StreamArchive(archive, members, files, s.Done)
+						streamed.Done()
+					}(treeRoot)
+				}
+
+				// In partial mode, sealed files pass our selection before they are verified
+				out := sink
+				var selected sync.WaitGroup
+				if s.isPartial() {
+					var sampled map[uint64]bool
+					if s.SampleBytes > 0 {
+						// Errors will be reported when we read the seal again
+						sampled, _ = s.sampleBytes(c, index)
+					}
+
+					sealed := make(chan api.FileInfo)
+					out = sealed
+					selected.Add(1)
+					go func() {
+						skipped := s.selectFiles(sealed, sink, index, sampled)
+						s.skippedLock.Lock()
+						s.skipped[index] += skipped
+						s.skippedLock.Unlock()
+						selected.Done()
+					}()
+				}
+
+				err = c.Deserialize(fd, out, func(v *api.FileInfo) bool {
 					select {
 					case <-s.Done:
 						return false
 					default:
 						{
-							v.Path = filepath.Join(indexDir, v.RelaPath)
+							v.Path = filepath.Join(treeRoot, v.RelaPath)
+							if isStore {
+								v.Path = io.StoreObjectPath(treeRoot, v.Sha1)
+							}
+							v.Seal = index
+							if !hasSizes {
+								if stat, err := io.Lstat(v.Path); err == nil {
+									v.Size = stat.Size()
+									v.Mode = stat.Mode()
+								}
+							}
+							if isStore {
+								// Objects are files, and shared by all files with the same contents
+								v.Mode &^= os.ModeSymlink
+								v.ModTime = time.Time{}
+							}
+							if s.DetectMoves {
+								s.recordSealed(index, v)
+							}
 							return true
 						}
 					}
 				})
 				fd.Close()
+				if s.isPartial() {
+					close(out)
+					selected.Wait()
+				}
+				if sink != files {
+					close(sink)
+					streamed.Wait()
+				}
 
 				if err != nil {
 					results <- &VerifyResult{
@@ -101,6 +235,7 @@ func (s *Command) Generate() <-chan api.Result {
 							Finfo: api.FileInfo{
 								Path:     index,
 								RelaPath: filepath.Base(index),
+								Seal:     index,
 							},
 						},
 					}
@@ -128,27 +263,68 @@ func (s *Command) Gather(rctrl *io.ReadChannelController, files <-chan api.FileI
 		return &res
 	}
 
-	api.Gather(files, results, &s.Stats, makeResult, rctrl, nil)
+	if s.Quick {
+		gatherMetadata(files, results, makeResult)
+		return
+	}
+	api.Gather(files, results, &s.Stats, makeResult, rctrl, nil, s.digests)
+}
+
+// The coarsest resolution of modification times we have to expect, which is the one of FAT file systems.
+// Seals may also store them in seconds only
+const modTimeResolution = 2 * time.Second
+
+// Returns true if the given modification times are the same within modTimeResolution
+func sameModTime(l, r time.Time) bool {
+	d := l.Sub(r)
+	if d < 0 {
+		d = -d
+	}
+	return d < modTimeResolution
+}
+
+// Like api.Gather, but only compares the sealed metadata of files with the one on disk, without reading them.
+// Hashes are assumed to be unchanged.
+func gatherMetadata(files <-chan api.FileInfo, results chan<- api.Result, makeResult func(*api.FileInfo, *api.FileInfo, error) api.Result) {
+	for f := range files {
+		umf := f
+		stat, err := io.Lstat(f.Path)
+		if err == nil {
+			f.Size = stat.Size()
+			f.ModTime = stat.ModTime()
+			if f.Size != umf.Size {
+				err = &api.FileSizeMismatch{Path: f.Path, Want: umf.Size, Got: f.Size}
+			} else if !umf.ModTime.IsZero() && umf.Mode&os.ModeSymlink != os.ModeSymlink &&
+				!sameModTime(f.ModTime, umf.ModTime) {
+				err = &api.FileModTimeMismatch{Path: f.Path, Want: umf.ModTime, Got: f.ModTime}
+			}
+		}
+		results <- makeResult(&f, &umf, err)
+	}
 }
 
 func (s *Command) Aggregate(results <-chan api.Result) <-chan api.Result {
-	// Associates a root with with the respective tree information
-	// This comes at the disadvantage that we can't differentiate if there are multiple seals underneath the same root.
+	// Associates a seal with the respective tree information
 	treeInfoMap := make(map[string]*treeInfo)
 
 	resultHandler := func(r api.Result, accumResult chan<- api.Result) bool {
 		vr := r.(*VerifyResult)
 
-		ti, hasTi := treeInfoMap[vr.Finfo.Root()]
+		ti, hasTi := treeInfoMap[vr.Finfo.Seal]
 		if !hasTi {
 			ti = &treeInfo{}
-			treeInfoMap[vr.Finfo.Root()] = ti
+			treeInfoMap[vr.Finfo.Seal] = ti
 		}
 
 		if vr.Err != nil {
 			if os.IsNotExist(vr.Err) || os.IsPermission(vr.Err) {
 				ti.missingFiles += 1
 				vr.Msg = fmt.Sprintf("MISSING %s: %s", SymbolMismatch, vr.Finfo.Path)
+				if s.DetectMoves && os.IsNotExist(vr.Err) {
+					// It's reported once we know it wasn't moved
+					ti.missing = append(ti.missing, vr)
+					return false
+				}
 				accumResult <- vr
 				return false
 			} else if serr, isFileSizeType := vr.Err.(*api.FileSizeMismatch); isFileSizeType {
@@ -158,6 +334,18 @@ func (s *Command) Aggregate(results <-chan api.Result) <-chan api.Result {
 				vr.Msg = fmt.Sprintf("SIZE %s: %s sealed with size %dB, got size %dB", SymbolMismatch, serr.Path, serr.Want, serr.Got)
 				accumResult <- vr
 				return false
+			} else if merr, isModTimeType := vr.Err.(*api.FileModTimeMismatch); isModTimeType {
+				ti.signatureMismatches += 1
+				ti.numFiles += 1
+				vr.Msg = fmt.Sprintf("MTIME %s: %s sealed with modification time %s, got %s", SymbolMismatch, merr.Path, merr.Want, merr.Got)
+				accumResult <- vr
+				return false
+			} else if lerr, isLinkType := vr.Err.(*api.FileLinkMismatch); isLinkType {
+				ti.signatureMismatches += 1
+				ti.numFiles += 1
+				vr.Msg = fmt.Sprintf("LINK %s: %s sealed as hard link to %s, which it isn't anymore", SymbolMismatch, lerr.Path, lerr.Target)
+				accumResult <- vr
+				return false
 			} else if _, isSealSigMismatch := vr.Err.(*codec.SignatureMismatchError); isSealSigMismatch {
 				ti.sealBroken = true
 				vr.Msg = fmt.Sprintf("SEAL %s: '%s' was modified after sealing or is corrupted - don't trust the verify results", SymbolMismatch, vr.Finfo.Path)
@@ -170,6 +358,7 @@ func (s *Command) Aggregate(results <-chan api.Result) <-chan api.Result {
 				return false
 			} else {
 				// It's some other error - just push it forward
+				ti.otherErrors += 1
 				accumResult <- vr
 				return false
 			}
@@ -180,7 +369,10 @@ func (s *Command) Aggregate(results <-chan api.Result) <-chan api.Result {
 		// From here on, it must be a file with no obvious error
 		ti.numFiles += 1
 		if (len(vr.ifinfo.Sha1) > 0 && bytes.Compare(vr.ifinfo.Sha1, vr.Finfo.Sha1) != 0) ||
-			(len(vr.ifinfo.MD5) > 0 && bytes.Compare(vr.ifinfo.MD5, vr.Finfo.MD5) != 0) {
+			(len(vr.ifinfo.MD5) > 0 && bytes.Compare(vr.ifinfo.MD5, vr.Finfo.MD5) != 0) ||
+			(len(vr.ifinfo.Sha256) > 0 && bytes.Compare(vr.ifinfo.Sha256, vr.Finfo.Sha256) != 0) ||
+			(len(vr.ifinfo.Sha512) > 0 && bytes.Compare(vr.ifinfo.Sha512, vr.Finfo.Sha512) != 0) ||
+			(len(vr.ifinfo.CRC32) > 0 && bytes.Compare(vr.ifinfo.CRC32, vr.Finfo.CRC32) != 0) {
 			vr.Msg = fmt.Sprintf("HASH %s: %s flipped at least one bit", SymbolMismatch, vr.Finfo.Path)
 			vr.Err = &api.FileHashMismatch{Path: vr.Finfo.Path}
 			ti.signatureMismatches += 1
@@ -196,23 +388,111 @@ func (s *Command) Aggregate(results <-chan api.Result) <-chan api.Result {
 	finalizer := func(
 		accumResult chan<- api.Result) {
 
-		count := 0
+		// Seals whose files were all skipped didn't produce a result, but still deserve a summary
+		for index := range s.skipped {
+			if _, hasTi := treeInfoMap[index]; !hasTi {
+				treeInfoMap[index] = &treeInfo{}
+			}
+		}
+
+		indices := make([]string, 0, len(treeInfoMap))
+		for index := range treeInfoMap {
+			indices = append(indices, index)
+		}
+		sort.Strings(indices)
+
+		for _, index := range indices {
+			ti := treeInfoMap[index]
+			if len(ti.missing) == 0 {
+				continue
+			}
+
+			var moved map[*VerifyResult]*api.FileInfo
+			if !s.Stats.WasCancelled {
+				moved = s.detectMoves(index, ti.missing)
+			}
+			for _, vr := range ti.missing {
+				f, isMoved := moved[vr]
+				if !isMoved {
+					accumResult <- vr
+					continue
+				}
+
+				ti.missingFiles -= 1
+				ti.movedFiles += 1
+				ti.numFiles += 1
+				accumResult <- &VerifyResult{
+					BasicResult: api.BasicResult{
+						Finfo: *f,
+						Msg:   fmt.Sprintf("MOVED: %s -> %s", vr.Finfo.Path, f.Path),
+						Prio:  api.Warn,
+					},
+					ifinfo: vr.ifinfo,
+				}
+			}
+		}
+
+		// Bags must be complete, which can't be told from their manifests alone
+		for _, index := range indices {
+			if s.isPartial() || s.Stats.WasCancelled || !bag.IsPayloadManifest(index) {
+				continue
+			}
+			ti := treeInfoMap[index]
+			for _, err := range bag.Validate(filepath.Dir(index)) {
+				ti.bagProblems += 1
+				accumResult <- &VerifyResult{
+					BasicResult: api.BasicResult{
+						Msg:  fmt.Sprintf("BAG %s: %s", SymbolMismatch, err),
+						Err:  err,
+						Prio: api.Error,
+					},
+				}
+			}
+		}
+
 		stats := ""
-		for treeRoot, ti := range treeInfoMap {
-			count += 1
+		for count, index := range indices {
+			ti := treeInfoMap[index]
 
 			s.Stats.ErrCount -= ti.signatureMismatches
 			s.Stats.ErrCount -= ti.missingFiles
+			s.Stats.ErrCount -= ti.movedFiles
 
 			// the last result we produce has the final statistics
-			if count == len(treeInfoMap) {
+			partial := s.partialSummary(s.skipped[index])
+			if s.Quick {
+				partial += " - QUICK: file contents were not checked"
+			}
+			if ti.movedFiles > 0 {
+				partial += fmt.Sprintf(" - MOVED: %d file(s) were found at a different path", ti.movedFiles)
+			}
+			if ti.bagProblems > 0 {
+				partial += fmt.Sprintf(" - BAG: %d problem(s) with the structure of the bag", ti.bagProblems)
+			}
+			if !codec.IsSigned(codec.NewByPath(index)) {
+				partial += " - UNSIGNED: the seal format can't tell if the seal itself was modified"
+			}
+			if count == len(indices)-1 {
 				stats = fmt.Sprintf(" [%s]%s",
 					s.Stats.DeltaString(&s.Stats, s.Stats.Elapsed(), io.StatsClientSep),
 					s.Stats.String(),
 				)
 			}
 
-			if ti.signatureMismatches == 0 && ti.missingFiles == 0 && !ti.sealBroken {
+			if s.Catalog != nil && !s.isPartial() && !s.Quick && !s.Stats.WasCancelled {
+				ok := ti.signatureMismatches == 0 && ti.missingFiles == 0 && !ti.sealBroken && ti.bagProblems == 0 && ti.otherErrors == 0
+				if _, err := s.Catalog.RecordVerify(index, s.Stats.StartedAt, ok); err != nil {
+					accumResult <- &VerifyResult{
+						BasicResult: api.BasicResult{
+							Msg:  fmt.Sprintf("Failed to record verification of '%s' in catalog: %s", index, err),
+							Err:  err,
+							Prio: api.Error,
+						},
+					}
+				}
+			}
+
+			if ti.signatureMismatches == 0 && ti.missingFiles == 0 && !ti.sealBroken && ti.bagProblems == 0 {
 				// Make sure we don't pretend it's fine, just because none of the read files SO FAR had an issue
 				ss := SymbolSuccess
 				suffix := ""
@@ -223,11 +503,12 @@ func (s *Command) Aggregate(results <-chan api.Result) <-chan api.Result {
 				accumResult <- &VerifyResult{
 					BasicResult: api.BasicResult{
 						Msg: fmt.Sprintf(
-							"VERIFY %s: None of %d file(s) changed based on seal in '%s'%s%s",
+							"VERIFY %s: None of %d file(s) changed based on seal '%s'%s%s%s",
 							ss,
 							ti.numFiles,
-							treeRoot,
+							index,
 							suffix,
+							partial,
 							stats,
 						),
 						Prio: api.Valuable,
@@ -241,19 +522,20 @@ func (s *Command) Aggregate(results <-chan api.Result) <-chan api.Result {
 				accumResult <- &VerifyResult{
 					BasicResult: api.BasicResult{
 						Msg: fmt.Sprintf(
-							"VERIFY %s: %d of %d file(s) have changed%s based on seal in '%s'%s",
+							"VERIFY %s: %d of %d file(s) have changed%s based on seal '%s'%s%s",
 							SymbolFail,
 							ti.signatureMismatches,
 							ti.numFiles,
 							suffix,
-							treeRoot,
+							index,
+							partial,
 							stats,
 						),
 						Prio: api.Valuable,
 					},
 				}
 			}
-		} // end for each treeInfo
+		} // end for each seal
 	} // end finalizer
 
 	return api.Aggregate(results, s.Done, resultHandler, finalizer, &s.Stats)
@@ -261,26 +543,183 @@ func (s *Command) Aggregate(results <-chan api.Result) <-chan api.Result {
 
 func (s *Command) Init(numReaders, numWriters int, items []string, maxLogLevel api.Importance, filters []api.FileFilter) (err error) {
 	if len(items) == 0 {
-		return errors.New("Please provide at least one seal file")
+		return errors.New("Please provide at least one seal file or a directory containing one")
 	}
 
-	validItems, err := api.ParseSources(items, true)
+	sources, err := api.ParseSources(items, true)
 	if err != nil {
 		return
 	}
 
-	indexDirs := make([]string, len(validItems))
+	// Directories are replaced by the seals we find in them
+	var validItems []string
+	sealsIn := make(map[string][]string)
+	for _, item := range sources {
+		stat, err := io.Stat(item)
+		if err != nil {
+			return err
+		}
+		// Archives are like directories, with their seals embedded
+		if !stat.IsDir() && !io.IsArchive(item) {
+			validItems = api.AppendUniqueString(validItems, item)
+			continue
+		}
+
+		// Bags are verified using their manifests
+		var seals []string
+		if bag.IsBag(item) {
+			if seals, err = bag.Manifests(item); err != nil {
+				return err
+			}
+		} else {
+			if seals, err = api.FindSeals(item); err != nil {
+				return err
+			}
+			if len(seals) == 0 {
+				return fmt.Errorf("Could not find a seal file in '%s'", item)
+			}
+			if !s.All {
+				seals = seals[len(seals)-1:]
+			}
+		}
+		sealsIn[item] = seals
+		for _, index := range seals {
+			validItems = api.AppendUniqueString(validItems, index)
+		}
+	}
+
+	roots := make(map[string]string, len(s.Roots))
+	for item, root := range s.Roots {
+		if item, err = io.ResolveURL(item); err != nil {
+			return
+		}
+		if item, err = filepath.Abs(item); err != nil {
+			return
+		}
+		indices, isDir := sealsIn[item]
+		if !isDir {
+			indices = []string{item}
+			found := false
+			for _, index := range validItems {
+				if index == item {
+					found = true
+					break
+				}
+			}
+			if !found {
+				return fmt.Errorf("Root '%s' was given for seal '%s', which is not verified", root, item)
+			}
+		}
+
+		dirs, err := api.ParseSources([]string{root}, false)
+		if err != nil {
+			return err
+		}
+		for _, index := range indices {
+			roots[index] = dirs[0]
+		}
+	}
+	s.Roots = roots
+
+	for _, pattern := range s.Only {
+		if _, err := filepath.Match(pattern, "empty"); err != nil {
+			return fmt.Errorf("Invalid path filter '%s': %s", pattern, err)
+		}
+	}
+	if s.Sample < 0 || s.Sample > 1 {
+		return fmt.Errorf("Sample must be a fraction in the range (0, 1], got %g", s.Sample)
+	}
+	if (s.Sample > 0 || s.SampleBytes > 0) && s.Seed == 0 {
+		s.Seed = time.Now().UnixNano()
+	}
+	s.skipped = make(map[string]uint)
+	s.sealed = make(map[string]map[string]bool)
+
+	// The data roots define the devices we read from - they are not necessarily the ones containing the seals
+	treeRoots := make([]string, len(validItems))
+	s.digests = 0
 	for i, index := range validItems {
-		if codec := codec.NewByPath(index); codec == nil {
+		c := codec.NewByPath(index)
+		if c == nil {
 			return fmt.Errorf("Unknown seal file format: '%s'", index)
 		}
-		if _, err := os.Stat(index); err != nil {
+		s.digests |= codec.DigestsOf(c)
+		if _, err := io.Stat(index); err != nil {
 			return fmt.Errorf("Cannot access seal file at '%s'", index)
 		}
-		indexDirs[i] = filepath.Dir(index)
+		treeRoots[i] = s.treeRoot(index)
 	}
 
-	s.InitBasicRunner(numReaders, indexDirs, maxLogLevel, filters)
+	s.InitBasicRunner(numReaders, treeRoots, maxLogLevel, filters)
 	s.Items = validItems
 	return nil
 }
+
+// Returns the directory containing the data sealed in the given index
+func (s *Command) treeRoot(index string) string {
+	if root, ok := s.Roots[index]; ok {
+		return root
+	}
+	if archive := api.IndexedArchive(index); len(archive) > 0 {
+		return archive
+	}
+	return filepath.Dir(index)
+}
+
+// ParseRoots parses root specifications as given on the commandline and returns a mapping suitable for
+// Command.Roots. Each specification is either a seal=directory pair, or a single directory which is used for
+// all given seals without a pair. A specification is only taken as pair if the part before a '=' names one
+// of the given seals or directories with seals, which allows directories to contain any character.
+func ParseRoots(specs []string, indices []string) (map[string]string, error) {
+	roots := make(map[string]string)
+	dir := ""
+	for _, spec := range specs {
+		if index, root := splitRoot(spec, indices); len(index) > 0 {
+			if len(root) == 0 {
+				return nil, fmt.Errorf("Invalid root mapping '%s', expected seal=directory", spec)
+			}
+			roots[index] = root
+			continue
+		}
+
+		if len(dir) > 0 {
+			return nil, fmt.Errorf("Only one root may be used for all seals, got '%s' and '%s'", dir, spec)
+		}
+		dir = spec
+	}
+
+	if len(dir) > 0 {
+		for _, index := range indices {
+			if _, ok := roots[index]; !ok {
+				roots[index] = dir
+			}
+		}
+	}
+	return roots, nil
+}
+
+// Returns the given seal=directory pair split into its seal and directory, or an empty seal if no part of spec
+// in front of a '=' is one of the given indices
+func splitRoot(spec string, indices []string) (index, root string) {
+	for i := range spec {
+		if spec[i] != '=' {
+			continue
+		}
+		for _, index := range indices {
+			if sameItem(spec[:i], index) {
+				return index, spec[i+1:]
+			}
+		}
+	}
+	return "", ""
+}
+
+// Returns true if both paths name the same file, which allows to compare relative and absolute paths
+func sameItem(l, r string) bool {
+	if l == r {
+		return true
+	}
+	al, lerr := filepath.Abs(l)
+	ar, rerr := filepath.Abs(r)
+	return lerr == nil && rerr == nil && al == ar
+}
@@ -1,10 +1,16 @@
 package verify_test
 
 import (
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/Byron/godi/api"
+	"github.com/Byron/godi/codec"
+	"github.com/Byron/godi/io"
 	"github.com/Byron/godi/seal"
 	"github.com/Byron/godi/testlib"
 	"github.com/Byron/godi/verify"
@@ -59,3 +65,459 @@ func TestVerify(t *testing.T) {
 		t.Error("Failed to detect a file was removed")
 	}
 }
+
+func TestVerifyRelocatedSeal(t *testing.T) {
+	datasetTree, _, _ := testlib.MakeDatasetOrPanic()
+	defer testlib.RmTree(datasetTree)
+	catalog, _ := ioutil.TempDir("", "catalog")
+	defer testlib.RmTree(catalog)
+
+	sealcmd, _ := seal.NewCommand([]string{datasetTree}, 1, 0)
+	resHandler := testlib.ResultHandler(t, false)
+
+	var indices []string
+	if err := api.StartEngine(sealcmd, api.IndexTrackingResultHandlerAdapter(&indices, resHandler)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Move the seal away from its data
+	index := filepath.Join(catalog, filepath.Base(indices[0]))
+	if err := os.Rename(indices[0], index); err != nil {
+		t.Fatal(err)
+	}
+
+	verifycmd := verify.Command{}
+	if err := verifycmd.Init(1, 0, []string{index}, api.Info, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := api.StartEngine(&verifycmd, testlib.ResultHandler(t, true)); err == nil {
+		t.Error("Shouldn't find any data next to the relocated seal")
+	}
+
+	roots, err := verify.ParseRoots([]string{index + "=" + datasetTree}, []string{index})
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifycmd = verify.Command{Roots: roots}
+	if err := verifycmd.Init(1, 0, []string{index}, api.Info, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := api.StartEngine(&verifycmd, resHandler); err != nil {
+		t.Error(err)
+	}
+
+	// Directories may contain the characters separating the pairs
+	roots, err = verify.ParseRoots([]string{"a.gobz=/Volumes/a,b=c", "/Volumes/all"}, []string{"a.gobz", "b.gobz"})
+	if err != nil || len(roots) != 2 || roots["a.gobz"] != "/Volumes/a,b=c" || roots["b.gobz"] != "/Volumes/all" {
+		t.Errorf("Unexpected roots %v, %v", roots, err)
+	}
+	// Directories may contain '=' if it doesn't follow a seal
+	roots, err = verify.ParseRoots([]string{"/Volumes/a=b"}, []string{"a.gobz"})
+	if err != nil || len(roots) != 1 || roots["a.gobz"] != "/Volumes/a=b" {
+		t.Errorf("Unexpected roots %v, %v", roots, err)
+	}
+	if _, err = verify.ParseRoots([]string{"/Volumes/a", "/Volumes/b"}, nil); err == nil {
+		t.Error("Only one root may apply to all seals")
+	}
+
+	verifycmd = verify.Command{Roots: map[string]string{"not-a-seal.gobz": datasetTree}}
+	if err := verifycmd.Init(1, 0, []string{index}, api.Info, nil); err == nil {
+		t.Error("Roots of seals which are not verified must be rejected")
+	} else {
+		t.Log(err)
+	}
+}
+
+func TestVerifyPartial(t *testing.T) {
+	datasetTree, file, _ := testlib.MakeDatasetOrPanic()
+	defer testlib.RmTree(datasetTree)
+
+	sealcmd, _ := seal.NewCommand([]string{datasetTree}, 1, 0)
+	resHandler := testlib.ResultHandler(t, false)
+
+	var indices []string
+	if err := api.StartEngine(sealcmd, api.IndexTrackingResultHandlerAdapter(&indices, resHandler)); err != nil {
+		t.Fatal(err)
+	}
+
+	// The removed file is not within the subset we verify
+	os.Remove(file)
+
+	verifycmd := verify.Command{Only: []string{"subdir/**", "*.ext"}}
+	if err := verifycmd.Init(1, 0, indices, api.Info, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	sawPartial := false
+	err := api.StartEngine(&verifycmd, func(r api.Result) {
+		resHandler(r)
+		if msg, prio := r.Info(); prio == api.Valuable && strings.Contains(msg, "PARTIAL") {
+			sawPartial = true
+		}
+	})
+	if err != nil {
+		t.Error(err)
+	}
+	if !sawPartial {
+		t.Error("Summary should indicate that only a subset was checked")
+	}
+
+	verifycmd = verify.Command{Sample: 0.01, Seed: 42}
+	if err := verifycmd.Init(1, 0, indices, api.Info, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := api.StartEngine(&verifycmd, resHandler); err != nil {
+		t.Error("A small sample with this seed shouldn't pick the removed file", err)
+	}
+
+	// Sampling by bytes doesn't depend on the order of files in the seal
+	c := codec.NewByPath(indices[0])
+	fd, err := os.Open(indices[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := make(chan api.FileInfo, 100)
+	err = c.Deserialize(fd, files, func(*api.FileInfo) bool { return true })
+	fd.Close()
+	close(files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sealed []api.FileInfo
+	var total int64
+	for f := range files {
+		sealed = append([]api.FileInfo{f}, sealed...)
+		total += f.Size
+	}
+	reversed := filepath.Join(datasetTree, "godi_2001-01-01_000000."+c.Extension())
+	if fd, err = os.Create(reversed); err != nil {
+		t.Fatal(err)
+	}
+	files = make(chan api.FileInfo, len(sealed))
+	for _, f := range sealed {
+		files <- f
+	}
+	close(files)
+	err = c.Serialize(files, fd)
+	fd.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sampled := func(index string) map[string]bool {
+		verified := make(map[string]bool)
+		verifycmd := verify.Command{SampleBytes: io.BytesVolume(total / 2), Seed: 7}
+		if err := verifycmd.Init(1, 0, []string{index}, api.Info, nil); err != nil {
+			t.Fatal(err)
+		}
+		api.StartEngine(&verifycmd, func(r api.Result) {
+			if f := r.FileInformation(); len(f.RelaPath) > 0 {
+				verified[f.RelaPath] = true
+			}
+		})
+		return verified
+	}
+	first, second := sampled(indices[0]), sampled(reversed)
+	if len(first) == 0 || len(first) == len(sealed) || len(first) != len(second) {
+		t.Errorf("Expected the same part of the files to be sampled, got %v and %v", first, second)
+	}
+	for path := range first {
+		if !second[path] {
+			t.Errorf("'%s' was sampled in seal order only", path)
+		}
+	}
+
+	if _, err := verify.ParseSample("200%"); err == nil {
+		t.Error("Samples larger than 100% must be rejected")
+	}
+}
+
+func TestVerifyQuick(t *testing.T) {
+	datasetTree, file, _ := testlib.MakeDatasetOrPanic()
+	defer testlib.RmTree(datasetTree)
+
+	sealcmd, _ := seal.NewCommand([]string{datasetTree}, 1, 0)
+	resHandler := testlib.ResultHandler(t, false)
+
+	var indices []string
+	if err := api.StartEngine(sealcmd, api.IndexTrackingResultHandlerAdapter(&indices, resHandler)); err != nil {
+		t.Fatal(err)
+	}
+
+	quickVerify := func() error {
+		verifycmd := verify.Command{Quick: true}
+		if err := verifycmd.Init(1, 0, indices, api.Info, nil); err != nil {
+			t.Fatal(err)
+		}
+		return api.StartEngine(&verifycmd, testlib.ResultHandler(t, true))
+	}
+
+	if err := quickVerify(); err != nil {
+		t.Error(err)
+	}
+
+	// Copies on FAT file systems have their modification time rounded to 2 seconds
+	stat, err := os.Stat(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rounded := stat.ModTime().Add(time.Second)
+	if err := os.Chtimes(file, rounded, rounded); err != nil {
+		t.Fatal(err)
+	}
+	if err := quickVerify(); err != nil {
+		t.Error("Modification times must be compared within the resolution of FAT file systems")
+	}
+
+	// Changing the contents in place isn't detected, but touching the file is
+	later := time.Now().Add(time.Hour)
+	if err := os.Chtimes(file, later, later); err != nil {
+		t.Fatal(err)
+	}
+	if err := quickVerify(); err == nil {
+		t.Error("Failed to detect a changed modification time")
+	}
+
+	if err := os.Truncate(file, 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := quickVerify(); err == nil {
+		t.Error("Failed to detect a changed size")
+	}
+}
+
+func TestVerifyDiscoveredSeals(t *testing.T) {
+	datasetTree, _, _ := testlib.MakeDatasetOrPanic()
+	defer testlib.RmTree(datasetTree)
+	resHandler := testlib.ResultHandler(t, false)
+
+	// Two seals underneath the same root, with well-known names to define which one is the newest
+	var indices []string
+	for _, name := range []string{"godi_2014-07-30_102259", "godi_2015-01-02_030405"} {
+		sealcmd, _ := seal.NewCommand([]string{datasetTree}, 1, 0)
+		var written []string
+		if err := api.StartEngine(sealcmd, api.IndexTrackingResultHandlerAdapter(&written, resHandler)); err != nil {
+			t.Fatal(err)
+		}
+		index := filepath.Join(datasetTree, name+filepath.Ext(written[0]))
+		if err := os.Rename(written[0], index); err != nil {
+			t.Fatal(err)
+		}
+		indices = append(indices, index)
+	}
+
+	summaries := func(cmd *verify.Command) (out []string) {
+		if err := api.StartEngine(cmd, func(r api.Result) {
+			if msg, _ := r.Info(); strings.HasPrefix(msg, "VERIFY") {
+				out = append(out, msg)
+			}
+			resHandler(r)
+		}); err != nil {
+			t.Error(err)
+		}
+		return
+	}
+
+	verifycmd, err := verify.NewCommand([]string{datasetTree}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := summaries(verifycmd); len(s) != 1 || !strings.Contains(s[0], indices[1]) {
+		t.Errorf("Expected a single summary for the newest seal, got %v", s)
+	}
+
+	verifycmd = &verify.Command{All: true}
+	if err = verifycmd.Init(1, 0, []string{datasetTree}, api.Info, nil); err != nil {
+		t.Fatal(err)
+	}
+	if s := summaries(verifycmd); len(s) != 2 || !strings.Contains(s[0], indices[0]) || !strings.Contains(s[1], indices[1]) {
+		t.Errorf("Expected one summary per seal, got %v", s)
+	}
+
+	if _, err = verify.NewCommand([]string{filepath.Join(datasetTree, "subdir")}, 1); err == nil {
+		t.Error("Directories without seal must be rejected")
+	}
+}
+
+func TestVerifyDetectMoves(t *testing.T) {
+	datasetTree, _, _ := testlib.MakeDatasetOrPanic()
+	defer testlib.RmTree(datasetTree)
+	resHandler := testlib.ResultHandler(t, false)
+
+	sealcmd, _ := seal.NewCommand([]string{datasetTree}, 1, 0)
+	var indices []string
+	if err := api.StartEngine(sealcmd, api.IndexTrackingResultHandlerAdapter(&indices, resHandler)); err != nil {
+		t.Fatal(err)
+	}
+
+	moves := [][2]string{
+		{"1mb.ext", "renamed.ext"},
+		{filepath.Join("subdir", "smallie.blah"), filepath.Join(testlib.FirstSubDir, "smallie.blah")},
+	}
+	for _, move := range moves {
+		if err := os.Rename(filepath.Join(datasetTree, move[0]), filepath.Join(datasetTree, move[1])); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	verifyMoves := func(handler func(api.Result)) (kinds map[string]int, summary string, err error) {
+		verifycmd := verify.Command{DetectMoves: true}
+		if err = verifycmd.Init(1, 0, indices, api.Info, nil); err != nil {
+			t.Fatal(err)
+		}
+		kinds = make(map[string]int)
+		err = api.StartEngine(&verifycmd, func(r api.Result) {
+			msg, _ := r.Info()
+			if strings.HasPrefix(msg, "VERIFY") {
+				summary = msg
+			} else if i := strings.Index(msg, ":"); i > 0 {
+				kinds[strings.Fields(msg[:i])[0]] += 1
+			}
+			handler(r)
+		})
+		return
+	}
+
+	kinds, summary, err := verifyMoves(resHandler)
+	if err != nil {
+		t.Error(err)
+	}
+	if kinds["MOVED"] != len(moves) || kinds["MISSING"] != 0 {
+		t.Errorf("Expected %d moved files, and none missing, got %v", len(moves), kinds)
+	}
+	if !strings.Contains(summary, "MOVED: 2 file(s)") {
+		t.Errorf("Summary should count moved files: %s", summary)
+	}
+
+	// Files which really are gone are still missing
+	os.Remove(filepath.Join(datasetTree, "somebytes_noext"))
+	kinds, _, err = verifyMoves(testlib.ResultHandler(t, true))
+	if err == nil {
+		t.Error("Missing files must be reported as error")
+	}
+	if kinds["MOVED"] != len(moves) || kinds["MISSING"] != 1 {
+		t.Errorf("Expected %d moved files, and one missing, got %v", len(moves), kinds)
+	}
+}
+
+func TestVerifyChecksumFormats(t *testing.T) {
+	for _, format := range []string{codec.MD5SumName, codec.Sha1SumName, codec.Sha256SumName, codec.SFVName} {
+		datasetTree, file, _ := testlib.MakeDatasetOrPanic()
+		defer testlib.RmTree(datasetTree)
+		resHandler := testlib.ResultHandler(t, false)
+
+		sealcmd, _ := seal.NewCommand([]string{datasetTree}, 1, 0)
+		sealcmd.Format = format
+		var indices []string
+		if err := api.StartEngine(sealcmd, api.IndexTrackingResultHandlerAdapter(&indices, resHandler)); err != nil {
+			t.Fatal(err)
+		}
+		if len(indices) != 1 || codec.NewByPath(indices[0]) == nil {
+			t.Fatalf("Expected a single %s seal, got %v", format, indices)
+		}
+
+		summary := ""
+		verifycmd, _ := verify.NewCommand(indices, 1)
+		err := api.StartEngine(verifycmd, func(r api.Result) {
+			if msg, _ := r.Info(); strings.HasPrefix(msg, "VERIFY") {
+				summary = msg
+			}
+			resHandler(r)
+		})
+		if err != nil {
+			t.Errorf("%s: %s", format, err)
+		}
+		if !strings.Contains(summary, "UNSIGNED") {
+			t.Errorf("%s: The summary must indicate that the seal isn't signed: %s", format, summary)
+		}
+
+		// Without sizes, only the hash tells
+		fd, err := os.OpenFile(file, os.O_WRONLY, 0777)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fd.Write([]byte("a"))
+		fd.Close()
+
+		verifycmd, _ = verify.NewCommand(indices, 1)
+		if err = api.StartEngine(verifycmd, testlib.ResultHandler(t, true)); err == nil {
+			t.Errorf("%s: Failed to detect file with changed byte", format)
+		}
+	}
+}
+
+func TestVerifyJSONL(t *testing.T) {
+	datasetTree, _, _ := testlib.MakeDatasetOrPanic()
+	defer testlib.RmTree(datasetTree)
+	resHandler := testlib.ResultHandler(t, false)
+
+	sealcmd, _ := seal.NewCommand([]string{datasetTree}, 1, 0)
+	sealcmd.Format = codec.JSONLName
+	var indices []string
+	if err := api.StartEngine(sealcmd, api.IndexTrackingResultHandlerAdapter(&indices, resHandler)); err != nil {
+		t.Fatal(err)
+	}
+	if len(indices) != 1 || !strings.HasSuffix(indices[0], "."+codec.JSONLExtension) {
+		t.Fatalf("Expected a single jsonl seal, got %v", indices)
+	}
+
+	// The seal is discovered in its directory
+	summary := ""
+	verifycmd, err := verify.NewCommand([]string{datasetTree}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = api.StartEngine(verifycmd, func(r api.Result) {
+		if msg, _ := r.Info(); strings.HasPrefix(msg, "VERIFY") {
+			summary = msg
+		}
+		resHandler(r)
+	})
+	if err != nil {
+		t.Error(err)
+	}
+	if !strings.Contains(summary, indices[0]) || strings.Contains(summary, "UNSIGNED") {
+		t.Errorf("Expected a signed seal to be verified: %s", summary)
+	}
+}
+
+func TestVerifyEncrypted(t *testing.T) {
+	datasetTree, _, _ := testlib.MakeDatasetOrPanic()
+	defer testlib.RmTree(datasetTree)
+	resHandler := testlib.ResultHandler(t, false)
+
+	key, err := codec.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	public, _ := codec.ParseKey(key.String())
+
+	sealcmd, _ := seal.NewCommand([]string{datasetTree}, 1, 0)
+	sealcmd.Key = public
+	var indices []string
+	if err = api.StartEngine(sealcmd, api.IndexTrackingResultHandlerAdapter(&indices, resHandler)); err != nil {
+		t.Fatal(err)
+	}
+	if len(indices) != 1 || !strings.HasSuffix(indices[0], "."+codec.GobExtension+"."+codec.EncryptedExtension) {
+		t.Fatalf("Expected a single encrypted seal, got %v", indices)
+	}
+
+	// Without the secret key, it can't be read
+	for _, keys := range [][]*codec.Key{nil, {public}, {codec.NewPassphraseKey("secret")}} {
+		verifycmd, err := verify.NewCommand(indices, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		verifycmd.Keys = keys
+		err = api.StartEngine(verifycmd, func(api.Result) {})
+		if _, ok := err.(*codec.DecodeError); !ok {
+			t.Errorf("Expected a decode error without the secret key, got %v", err)
+		}
+	}
+
+	verifycmd, _ := verify.NewCommand(indices, 1)
+	verifycmd.Keys = []*codec.Key{codec.NewPassphraseKey("secret"), key}
+	if err = api.StartEngine(verifycmd, resHandler); err != nil {
+		t.Error(err)
+	}
+}
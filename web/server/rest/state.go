@@ -526,7 +526,10 @@ func (r *restHandler) ServeHTTP(w http.ResponseWriter, rq *http.Request) {
 		}
 	case "DEFAULTS":
 		{
-			if err := json.NewEncoder(w).Encode(&valueDefaults); err != nil {
+			// Codecs may be registered by packages initialized after us
+			d := valueDefaults
+			d.Formats = codec.Names()
+			if err := json.NewEncoder(w).Encode(&d); err != nil {
 				http.Error(w, err.Error(), http.StatusInternalServerError)
 			}
 		}